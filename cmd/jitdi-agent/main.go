@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/wzshiming/jitdi/pkg/agent"
+	"github.com/wzshiming/jitdi/pkg/client/clientset/versioned"
+	"github.com/wzshiming/jitdi/pkg/logging"
+	"github.com/wzshiming/jitdi/pkg/transport"
+)
+
+var (
+	server     string
+	adminToken string
+	caFiles    []string
+
+	registry string
+	images   []string
+	username string
+	password string
+
+	runtimeEndpoint string
+
+	nodeName   string
+	kubeconfig string
+	master     string
+
+	logLevel  string
+	logFormat string
+)
+
+func init() {
+	pflag.StringVar(&server, "server", "", "URL of jitdi whose builds are followed, e.g. http://jitdi.jitdi-system:8888, none if empty")
+	pflag.StringVar(&adminToken, "admin-token", os.Getenv("JITDI_ADMIN_TOKEN"), "bearer token of the admin API of jitdi, defaults to $JITDI_ADMIN_TOKEN")
+	pflag.StringSliceVar(&caFiles, "ca-file", nil, "PEM bundle of additional CA certificates trusted for jitdi")
+
+	pflag.StringVar(&registry, "registry", "", "host that the nodes pull jitdi as, defaults to the host of --server, required without it")
+	pflag.StringSliceVar(&images, "image", nil, "glob of the refs pre-pulled, e.g. models/*, can be repeated, all the built refs if empty")
+	pflag.StringVar(&username, "username", "", "user that the images are pulled as, if jitdi requires basic auth")
+	pflag.StringVar(&password, "password", os.Getenv("JITDI_PASSWORD"), "password of the user, defaults to $JITDI_PASSWORD")
+
+	pflag.StringVar(&runtimeEndpoint, "runtime-endpoint", "unix:///run/containerd/containerd.sock", "CRI endpoint of the container runtime of the node")
+
+	pflag.StringVar(&nodeName, "node-name", os.Getenv("NODE_NAME"), "node that the agent runs on, the images of the ImagePrewarms selecting it are pulled, defaults to $NODE_NAME")
+	pflag.StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig file, the in-cluster config is used if empty")
+	pflag.StringVar(&master, "master", "", "master url")
+
+	pflag.StringVar(&logLevel, "log-level", "info", "minimum level logged, one of debug, info, warn or error")
+	pflag.StringVar(&logFormat, "log-format", "text", "format of the logs, text or json")
+	pflag.Parse()
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	logger, err := logging.New(os.Stderr, logging.Options{
+		Level:  logLevel,
+		Format: logFormat,
+	})
+	if err != nil {
+		slog.Error("failed to configure logging", "err", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	tr, err := transport.New(transport.Options{
+		CAFiles: caFiles,
+	})
+	if err != nil {
+		logger.Error("failed to create transport", "err", err)
+		os.Exit(1)
+	}
+
+	puller, err := agent.NewCRIPuller(runtimeEndpoint)
+	if err != nil {
+		logger.Error("failed to connect to the container runtime", "err", err)
+		os.Exit(1)
+	}
+	defer puller.Close()
+
+	a, err := agent.New(puller, agent.Options{
+		Server:     server,
+		AdminToken: adminToken,
+		Registry:   registry,
+		Images:     images,
+		Username:   username,
+		Password:   password,
+		Transport:  tr,
+	})
+	if err != nil {
+		logger.Error("failed to create agent", "err", err)
+		os.Exit(1)
+	}
+
+	if nodeName != "" {
+		clientConfig, err := clientcmd.BuildConfigFromFlags(master, kubeconfig)
+		if err != nil {
+			logger.Error("failed to BuildConfigFromFlags", "err", err)
+			os.Exit(1)
+		}
+		kubeClientset, err := kubernetes.NewForConfig(clientConfig)
+		if err != nil {
+			logger.Error("failed to NewForConfig", "err", err)
+			os.Exit(1)
+		}
+		node, err := kubeClientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			logger.Error("failed to get node", "node", nodeName, "err", err)
+			os.Exit(1)
+		}
+		clientset, err := versioned.NewForConfig(clientConfig)
+		if err != nil {
+			logger.Error("failed to NewForConfig", "err", err)
+			os.Exit(1)
+		}
+		go a.WatchPrewarms(ctx, clientset, node.Labels)
+	}
+
+	err = a.Run(ctx)
+	if err != nil {
+		logger.Error("failed to run agent", "err", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener accepts the connections while the slots are not all taken, the slots can be shared by several listeners.
+func limitListener(l net.Listener, slots chan struct{}) net.Listener {
+	return &limitedListener{Listener: l, slots: slots}
+}
+
+type limitedListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, slots: l.slots}, nil
+}
+
+// limitedConn frees its slot once closed.
+type limitedConn struct {
+	net.Conn
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.slots })
+	return err
+}
@@ -2,40 +2,276 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/spf13/pflag"
-	"k8s.io/apimachinery/pkg/util/yaml"
+	"google.golang.org/grpc"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
 	"github.com/wzshiming/jitdi/pkg/client/clientset/versioned"
+	"github.com/wzshiming/jitdi/pkg/cloudauth"
+	"github.com/wzshiming/jitdi/pkg/forwarded"
 	"github.com/wzshiming/jitdi/pkg/handler"
+	"github.com/wzshiming/jitdi/pkg/logging"
+	"github.com/wzshiming/jitdi/pkg/transport"
 )
 
 var (
-	address string
-	cache   string
+	settings string
 
-	config     string
-	kubeconfig string
-	master     string
+	addresses   []string
+	grpcAddress string
+	cache       string
+	concurrency int
+
+	proxyProtocol  bool
+	trustedProxies []string
+
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+	maxHeaderBytes    int
+	maxConnections    int
+
+	httpProxy  string
+	httpsProxy string
+	noProxy    string
+	caFiles    []string
+
+	insecureRegistries []string
+	upstreamPrefixes   []string
+	dockerConfig       string
+	cloudCredentials   map[string]string
+	credentialHelpers  map[string]string
+
+	circuitBreakerThreshold   float64
+	circuitBreakerMinRequests int
+	circuitBreakerWindow      time.Duration
+	circuitBreakerCooldown    time.Duration
+	registryMirrors           map[string]string
+
+	retryAttempts    int
+	retryBackoff     time.Duration
+	retryStatusCodes []int
+
+	remoteUserAgent     string
+	remoteJobs          int
+	remotePlatform      string
+	remoteRetryAttempts int
+	remoteHeaders       map[string]string
+
+	faultUpstreamLatency     time.Duration
+	faultUpstreamErrorRate   float64
+	faultUpstreamErrorStatus int
+	faultDiskWriteBandwidth  int64
+
+	upstreamMaxBandwidth    int64
+	serveMaxBandwidth       int64
+	serveMaxClientBandwidth int64
+
+	adminToken       string
+	progressInterval time.Duration
+
+	printGrafanaDashboard bool
+	printPrometheusRules  bool
+	metricsJob            string
+
+	enableDelete bool
+	enableUpload bool
+	gcInterval   time.Duration
+	gcMaxSize    int64
+	tagHistory   int
+
+	canarySoak    time.Duration
+	canaryPercent int
+	canaryClients []string
+
+	readOnly bool
+
+	buildWorker       string
+	buildWorkerToken  string
+	buildWorkerTLS    bool
+	workerConcurrency int
+	buildLock         bool
+	peers             []string
+	peerToken         string
+	warmTop           int
+	warmPeer          string
+	warmPeerToken     string
+
+	inlineDataThreshold int64
+	memoryCacheSize     int64
+	readyMinFreeBytes   int64
+
+	fsck              string
+	fsckVerifyDigests bool
+
+	sendfileHeader string
+	sendfilePrefix string
+
+	tagCacheControl    string
+	digestCacheControl string
+
+	redirectUpstream bool
+	redirectHosts    []string
+
+	rebuildMissingBlobs bool
+	reuseMutationLayers bool
+	dedupStagedFiles    bool
+
+	buildTmpDir   string
+	buildMaxFiles int64
+	buildMaxBytes int64
+
+	auditLog     string
+	auditWebhook string
+
+	dragonflyPreheat     string
+	dragonflyToken       string
+	dragonflyRegistryURL string
+
+	htpasswd string
+	tenants  string
+
+	logLevel           string
+	logFormat          string
+	logComponentLevels []string
+
+	config           []string
+	rulesDir         string
+	adminRuleSources []string
+	secretsDir       string
+	kubernetes       bool
+	kubeconfig       string
+	master           string
 )
 
 func init() {
-	pflag.StringVar(&address, "address", ":8888", "listen on the address")
+	pflag.StringVar(&settings, "settings", "", "YAML file of the values of the flags by their names, the flags and their "+envPrefix+"<FLAG> environment variables take precedence over it")
+
+	pflag.StringSliceVar(&addresses, "address", []string{":8888"}, "listen on the address, can be repeated, e.g. 0.0.0.0:8888 and [::]:8888 for separate IPv4 and IPv6 sockets")
+	pflag.StringVar(&grpcAddress, "grpc-address", "", "listen on the address for the gRPC build API, protected by --admin-token, disabled if empty")
+	pflag.BoolVar(&proxyProtocol, "proxy-protocol", false, "read the PROXY protocol headers of the connections from the trusted proxies, or from any peer if none is trusted")
+	pflag.StringSliceVar(&trustedProxies, "trusted-proxy", nil, "CIDR or address of a load balancer or a reverse proxy whose PROXY protocol headers and X-Forwarded-For are trusted, can be repeated")
+	pflag.DurationVar(&readTimeout, "read-timeout", 0, "how long the requests are read for at most, with their bodies, 0 is unlimited")
+	pflag.DurationVar(&readHeaderTimeout, "read-header-timeout", 30*time.Second, "how long the headers of the requests are read for at most, 0 is unlimited")
+	pflag.DurationVar(&writeTimeout, "write-timeout", 0, "how long the responses are written for at most, 0 is unlimited, which the pulls of large blobs need")
+	pflag.DurationVar(&idleTimeout, "idle-timeout", 5*time.Minute, "how long the idle connections are kept open, 0 is unlimited")
+	pflag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long the requests running are waited for on SIGINT or SIGTERM before exiting")
+	pflag.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size in bytes of the headers of the requests")
+	pflag.IntVar(&maxConnections, "max-connections", 0, "maximum number of the connections open at the same time on all the addresses, 0 is unlimited")
 	pflag.StringVar(&cache, "cache", "./cache", "cache directory")
+	pflag.IntVar(&concurrency, "concurrency", 4, "maximum number of mutation sources fetched concurrently per build")
+
+	pflag.StringVar(&httpProxy, "http-proxy", "", "proxy for http upstreams, defaults to $HTTP_PROXY")
+	pflag.StringVar(&httpsProxy, "https-proxy", "", "proxy for https upstreams, defaults to $HTTPS_PROXY")
+	pflag.StringVar(&noProxy, "no-proxy", "", "comma-separated hosts that bypass the proxy, defaults to $NO_PROXY")
+	pflag.StringSliceVar(&caFiles, "ca-file", nil, "PEM bundle of additional CA certificates trusted for upstreams")
+	pflag.StringSliceVar(&insecureRegistries, "insecure-registry", nil, "upstream registry allowed over plain HTTP or without verifying TLS")
+	pflag.StringSliceVar(&upstreamPrefixes, "upstream-prefix", nil, "registry whose images are served under its host as the path prefix, e.g. docker.io for /v2/docker.io/library/nginx, or <prefix>=<registry> to serve a registry under another prefix, e.g. registry.local=127.0.0.1:5000, the rules matching them more specifically apply their mutations")
+	pflag.Float64Var(&circuitBreakerThreshold, "circuit-breaker-threshold", 0, "ratio of the requests to an upstream host failed in the window above which they fail fast, 0 disables it")
+	pflag.IntVar(&circuitBreakerMinRequests, "circuit-breaker-min-requests", 10, "number of the requests to an upstream host in the window below which they never fail fast")
+	pflag.DurationVar(&circuitBreakerWindow, "circuit-breaker-window", time.Minute, "how long the requests to an upstream host are counted for")
+	pflag.DurationVar(&circuitBreakerCooldown, "circuit-breaker-cooldown", 30*time.Second, "how long the requests to a failing upstream host fail fast before it is probed again")
+	pflag.StringToStringVar(&registryMirrors, "registry-mirror", nil, "mirror that the requests to a failing registry are sent to instead, in the form of <registry>=<mirror>, e.g. docker.io=mirror.gcr.io")
+	pflag.IntVar(&retryAttempts, "retry-attempts", 3, "number of the attempts of the requests to the upstreams failed transiently, 1 disables the retries")
+	pflag.DurationVar(&retryBackoff, "retry-backoff", time.Second, "wait before the first retry of a request to the upstreams, doubled before every next one")
+	pflag.IntSliceVar(&retryStatusCodes, "retry-status-code", handler.DefaultRetryStatusCodes, "status code of the responses of the upstreams retried, can be repeated")
+	pflag.StringVar(&remoteUserAgent, "remote-user-agent", "", "added to the User-Agent of the requests to the upstream registries and the User-Agent of the requests to the urls of the mutates, the rules can override it")
+	pflag.StringToStringVar(&remoteHeaders, "remote-header", nil, "header set on the requests to the upstream registries and to the urls of the mutates, in the form of <name>=<value>, e.g. X-Cdn-Token=secret, can be repeated, a User-Agent replaces the whole one, the rules can override them")
+	pflag.IntVar(&remoteJobs, "remote-jobs", 0, "number of the requests sent at once by the operations of go-containerregistry on several blobs, 0 keeps its default of 4, the rules can override it")
+	pflag.StringVar(&remotePlatform, "remote-platform", "", "platform as os/arch[/variant] of the images pulled from the indexes without a platform to pick, e.g. the models of ollama, linux/amd64 if empty, the rules can override it")
+	pflag.IntVar(&remoteRetryAttempts, "remote-retry-attempts", 0, "number of the attempts of go-containerregistry on the temporary errors, 0 keeps its default of 3, 1 disables its retries, the rules can override it")
+	pflag.DurationVar(&faultUpstreamLatency, "fault-upstream-latency", 0, "delay injected before every request to the upstreams, to test the pull timeouts of the clients, not for production")
+	pflag.Float64Var(&faultUpstreamErrorRate, "fault-upstream-error-rate", 0, "ratio from 0 to 1 of the requests to the upstreams failed on purpose, to test the retries, not for production")
+	pflag.IntVar(&faultUpstreamErrorStatus, "fault-upstream-error-status", http.StatusServiceUnavailable, "status code of the requests to the upstreams failed on purpose, 0 resets their connections instead")
+	pflag.Int64Var(&faultDiskWriteBandwidth, "fault-disk-write-bandwidth", 0, "bytes per second written to the blobs of the cache at most, to emulate a slow disk, not for production, 0 is unlimited")
+	pflag.Int64Var(&upstreamMaxBandwidth, "upstream-max-bandwidth", 0, "bytes per second pulled from the upstreams at most, 0 is unlimited")
+	pflag.Int64Var(&serveMaxBandwidth, "serve-max-bandwidth", 0, "bytes per second served to all the clients at most, 0 is unlimited")
+	pflag.Int64Var(&serveMaxClientBandwidth, "serve-max-client-bandwidth", 0, "bytes per second served to each client at most, by its user or its address, 0 is unlimited")
+	pflag.StringVar(&dockerConfig, "docker-config", "", "directory of the config.json with the credentials of the upstream registries, defaults to $DOCKER_CONFIG or ~/.docker")
+	pflag.StringToStringVar(&cloudCredentials, "cloud-credentials", nil, "registries whose credentials are resolved from the ambient identity of jitdi in their cloud, in the form of <registry glob>=<ecr|gcr|acr>, e.g. *.dkr.ecr.*.amazonaws.com=ecr, can be repeated")
+	pflag.StringToStringVar(&credentialHelpers, "credential-helper", nil, "registries whose credentials are resolved with a command of the credential helper protocol of docker, in the form of <registry glob>=<command>, e.g. *.corp.example=/usr/local/bin/corp-auth, can be repeated, before --cloud-credentials")
+
+	pflag.StringVar(&adminToken, "admin-token", "", "bearer token required by the admin, gRPC and peer APIs and the metrics, the admin, gRPC and peer APIs are disabled if empty")
+	pflag.DurationVar(&progressInterval, "progress-interval", 10*time.Second, "how often the progress of running builds is logged")
+
+	pflag.BoolVar(&printGrafanaDashboard, "print-grafana-dashboard", false, "print the Grafana dashboard of the metrics and exit")
+	pflag.BoolVar(&printPrometheusRules, "print-prometheus-rules", false, "print the Prometheus alerting rules of the metrics and exit, with the size of the cache with --gc-max-size")
+	pflag.StringVar(&metricsJob, "metrics-job", "jitdi", "job of the Prometheus scrape config of /metrics in the printed dashboard and alerting rules")
+
+	pflag.BoolVar(&enableDelete, "enable-delete", false, "allow deleting manifests with the DELETE method, and the uploaded blobs with the admin token")
+	pflag.BoolVar(&enableUpload, "enable-upload", false, "allow pushing blobs with the upload API and the admin token, they can be referenced by digest in the mutates")
+	pflag.DurationVar(&gcInterval, "gc-interval", 0, "how often the blobs that are no longer referenced are removed, 0 disables it")
+	pflag.Int64Var(&gcMaxSize, "gc-max-size", 0, "size in bytes of the blobs over which the garbage collection evicts the layers still referenced, the evict-first ones and then the ones without a priority with --rebuild-missing-blobs, 0 disables it")
+	pflag.DurationVar(&canarySoak, "canary-soak", 0, "how long a rebuilt tag is only served to the canary clients before it is served to all, 0 serves it to all right away")
+	pflag.IntVar(&canaryPercent, "canary-percent", 0, "percentage of the clients, by their user or address, served the rebuilt tags during their soak")
+	pflag.StringSliceVar(&canaryClients, "canary-client", nil, "user name or CIDR of the clients always served the rebuilt tags during their soak, can be repeated")
+	pflag.IntVar(&tagHistory, "tag-history", 0, "number of the previous builds of every tag kept, with their blobs, for rolling the tag back with the admin API")
+	pflag.BoolVar(&readOnly, "read-only", false, "only serve the tags already in the cache shared with the instances that build them, never build")
+	pflag.StringVar(&buildWorker, "build-worker", "", "gRPC target of the workers the builds are sent to instead of building them, e.g. dns:///jitdi-worker:9090, they must share the cache")
+	pflag.StringVar(&buildWorkerToken, "build-worker-token", "", "admin token of the workers")
+	pflag.BoolVar(&buildWorkerTLS, "build-worker-tls", false, "connect to the workers over TLS")
+	pflag.IntVar(&workerConcurrency, "worker-concurrency", 0, "maximum number of builds requested by the frontends running at the same time, the others wait in line, 0 is unlimited")
+	pflag.BoolVar(&buildLock, "build-lock", false, "build each tag once across the instances sharing the cache, with lock files in the cache, the others wait for the build")
+	pflag.StringSliceVar(&peers, "peer", nil, "URL of the other instances sharing the cache that the tags built are announced to, e.g. a headless Service resolved to all its pods")
+	pflag.StringVar(&peerToken, "peer-token", "", "admin token of the peers")
+	pflag.IntVar(&warmTop, "warm-top", 0, "number of the most recently pulled tags loaded on start before the instance is ready, 0 disables it")
+	pflag.StringVar(&warmPeer, "warm-peer", "", "URL of an instance that the tags of --warm-top are copied from into the cache, instead of only loading the ones of the cache")
+	pflag.StringVar(&warmPeerToken, "warm-peer-token", "", "admin token of the instance of --warm-peer")
+
+	pflag.Int64Var(&inlineDataThreshold, "inline-data-threshold", 0, "size in bytes up to which configs and layers are embedded into the data field of OCI manifests, 0 disables it")
+
+	pflag.Int64Var(&memoryCacheSize, "memory-cache-size", 64<<20, "size in bytes of the memory that manifests and small blobs are cached in, 0 disables it")
+	pflag.Int64Var(&readyMinFreeBytes, "ready-min-free-bytes", 0, "free bytes of the file system of the cache below which /readyz fails, 0 disables it")
+
+	pflag.StringVar(&fsck, "fsck", "check", "scan the cache on start, off, check to log the broken tags, or repair to quarantine and build them again")
+	pflag.BoolVar(&fsckVerifyDigests, "fsck-verify-digests", false, "also hash every blob on start to find the ones whose content does not match their digest")
+
+	pflag.StringVar(&sendfileHeader, "sendfile-header", "", "hand the serving of blobs over to the reverse proxy, X-Accel-Redirect for nginx or X-Sendfile")
+	pflag.StringVar(&sendfilePrefix, "sendfile-prefix", "/cache", "internal location of the reverse proxy mapped to the cache directory, used with X-Accel-Redirect")
+	pflag.StringVar(&tagCacheControl, "cache-control-tag", "", "Cache-Control of the manifests pulled by tag, e.g. \"public, max-age=300\", none if empty, the rules can set their own")
+	pflag.StringVar(&digestCacheControl, "cache-control-digest", "public, max-age=31536000, immutable", "Cache-Control of the blobs and the manifests pulled by digest, none if empty, the rules can set their own for their manifests")
+	pflag.BoolVar(&redirectUpstream, "redirect-upstream", false, "leave the layers of the base images in the upstream registries and redirect the clients to them instead of storing them")
+	pflag.BoolVar(&rebuildMissingBlobs, "rebuild-missing-blobs", false, "build again the tag whose current build references a blob pulled but missing from the cache, instead of answering 404")
+	pflag.BoolVar(&reuseMutationLayers, "reuse-mutation-layers", false, "reuse the layers of the previous build of the tag for the mutations whose inputs are unchanged, only the changed mutations are built again")
+	pflag.BoolVar(&dedupStagedFiles, "dedup-staged-files", false, "keep the identical files downloaded for the builds once on the disk with hard links, and reuse the Hugging Face files already downloaded by their digests")
+	pflag.StringVar(&buildTmpDir, "build-tmp-dir", "", "directory that the temporary directories of the builds are created in, e.g. a tmpfs, the tmp of the cache if empty")
+	pflag.Int64Var(&buildMaxFiles, "build-max-files", 0, "files added by the mutations of a build at most, 0 is unlimited")
+	pflag.Int64Var(&buildMaxBytes, "build-max-bytes", 0, "bytes of the files added by the mutations of a build at most, 0 is unlimited")
+	pflag.StringSliceVar(&redirectHosts, "redirect-host", nil, "glob of the hosts that the clients are redirected to for the upstream layers, e.g. *.cloudfront.net, the other hosts than the upstream registries if empty")
+
+	pflag.StringVar(&auditLog, "audit-log", "", "file that every manifest served is appended to as a JSON line")
+	pflag.StringVar(&auditWebhook, "audit-webhook", "", "URL that every manifest served is posted to as JSON")
+
+	pflag.StringVar(&dragonflyPreheat, "dragonfly-preheat", "", "URL of the jobs API of the Dragonfly manager that a preheat job is created in for every tag built, e.g. http://dragonfly-manager:8080/oapi/v1/jobs")
+	pflag.StringVar(&dragonflyToken, "dragonfly-token", "", "personal access token of the Dragonfly manager")
+	pflag.StringVar(&dragonflyRegistryURL, "dragonfly-registry-url", "", "URL that the nodes pull jitdi as, which the preheated manifests are referenced by")
+
+	pflag.StringVar(&htpasswd, "htpasswd", "", "htpasswd file of the users that the clients authenticate as with basic auth, only bcrypt is supported")
+	pflag.StringVar(&tenants, "tenants", "", "YAML file of the tenants, the virtual registries of the hosts with their own rules, users and cache quotas")
 
-	pflag.StringVarP(&config, "config", "c", "", "config file")
+	pflag.StringVar(&logLevel, "log-level", "info", "minimum level logged, one of debug, info, warn or error")
+	pflag.StringVar(&logFormat, "log-format", "text", "format of the logs, text or json")
+	pflag.StringSliceVar(&logComponentLevels, "log-component-level", nil, "level of a component overriding --log-level, in the form of <component>=<level>, the components are rules, build, gc, audit and fsck")
+
+	pflag.StringArrayVarP(&config, "config", "c", nil, "config file, glob or directory of config files, can be repeated, a rule replaces the one of the same name loaded before it")
+	pflag.StringVar(&rulesDir, "rules-dir", "", "directory of the YAML or JSON files of the rules, reloaded when they change")
+	pflag.StringArrayVar(&adminRuleSources, "admin-rule-source", nil, "directory of the local files that the rules created by the admin API may read, can be repeated, they only read the URLs and the uploaded blobs otherwise")
+	pflag.StringVar(&secretsDir, "secrets-dir", "", "directory of the Secrets referenced by the templates of the files, as <dir>/<name>/<key>")
+	pflag.BoolVar(&kubernetes, "kubernetes", true, "watch the Image resources of the cluster, disable it when running outside of Kubernetes")
 	pflag.StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig file")
 	pflag.StringVar(&master, "master", "", "master url")
 	pflag.Parse()
@@ -44,16 +280,48 @@ func init() {
 func main() {
 	ctx := context.Background()
 
-	logger := slog.Default()
+	if settings == "" {
+		settings = os.Getenv(envName("settings"))
+	}
+	err := applySettings(pflag.CommandLine, settings)
+	if err != nil {
+		slog.Error("failed to apply settings", "err", err)
+		os.Exit(1)
+	}
+	if dockerConfig != "" {
+		os.Setenv("DOCKER_CONFIG", dockerConfig)
+	}
 
-	var staticConfig []*v1alpha1.ImageSpec
-	if config != "" {
-		file, err := os.Open(config)
+	logger, err := logging.New(os.Stderr, logging.Options{
+		Level:           logLevel,
+		Format:          logFormat,
+		ComponentLevels: logComponentLevels,
+	})
+	if err != nil {
+		slog.Error("failed to configure logging", "err", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	if printGrafanaDashboard || printPrometheusRules {
+		var raw []byte
+		if printGrafanaDashboard {
+			raw, err = handler.GrafanaDashboard(metricsJob)
+		} else {
+			raw, err = handler.PrometheusRules(metricsJob, gcMaxSize)
+		}
 		if err != nil {
-			logger.Error("failed to open config file", "err", err)
+			logger.Error("failed to generate the observability config", "err", err)
 			os.Exit(1)
 		}
-		staticConfig, err = loadConfig(file)
+		os.Stdout.Write(raw)
+		return
+	}
+
+	var staticConfig []*v1alpha1.Image
+	if len(config) != 0 {
+		var err error
+		staticConfig, err = handler.LoadConfigFiles(config)
 		if err != nil {
 			logger.Error("failed to load config", "err", err)
 			os.Exit(1)
@@ -61,7 +329,9 @@ func main() {
 	}
 
 	var clientset *versioned.Clientset
-	if kubeconfig != "" {
+	if !kubernetes {
+		logger.Info("Not watching the Image resources")
+	} else if kubeconfig != "" {
 
 		clientConfig, err := clientcmd.BuildConfigFromFlags(master, kubeconfig)
 		if err != nil {
@@ -90,60 +360,245 @@ func main() {
 		}
 	}
 
+	transportOptions := transport.Options{
+		HTTPProxy:  httpProxy,
+		HTTPSProxy: httpsProxy,
+		NoProxy:    noProxy,
+		CAFiles:    caFiles,
+	}
+	tr, err := transport.New(transportOptions)
+	if err != nil {
+		logger.Error("failed to create transport", "err", err)
+		os.Exit(1)
+	}
+
+	transportOptions.Insecure = true
+	insecureTr, err := transport.New(transportOptions)
+	if err != nil {
+		logger.Error("failed to create insecure transport", "err", err)
+		os.Exit(1)
+	}
+
+	if faultUpstreamLatency != 0 || faultUpstreamErrorRate != 0 || faultDiskWriteBandwidth != 0 {
+		logger.Warn("Injecting faults, not for production",
+			"upstreamLatency", faultUpstreamLatency, "upstreamErrorRate", faultUpstreamErrorRate,
+			"upstreamErrorStatus", faultUpstreamErrorStatus, "diskWriteBandwidth", faultDiskWriteBandwidth)
+	}
+
+	cloudProviders := make(map[string]cloudauth.Provider, len(cloudCredentials))
+	for registry, provider := range cloudCredentials {
+		cloudProviders[registry] = cloudauth.Provider(provider)
+	}
+
+	prefixes := make(map[string]string, len(upstreamPrefixes))
+	for _, p := range upstreamPrefixes {
+		prefix, registry, _ := strings.Cut(p, "=")
+		prefixes[prefix] = registry
+	}
+
+	opts := []handler.Option{
+		handler.WithConcurrency(concurrency),
+		handler.WithTransport(tr),
+		handler.WithInsecureTransport(insecureTr),
+		handler.WithInsecureRegistries(insecureRegistries...),
+		handler.WithUpstreamPrefixes(prefixes),
+		handler.WithCredentialHelpers(credentialHelpers),
+		handler.WithCloudCredentials(cloudProviders),
+		handler.WithRetryPolicy(handler.RetryPolicy{
+			Attempts:    retryAttempts,
+			Backoff:     retryBackoff,
+			StatusCodes: retryStatusCodes,
+		}),
+		handler.WithRemote(v1alpha1.Remote{
+			UserAgent:     remoteUserAgent,
+			Jobs:          remoteJobs,
+			Platform:      remotePlatform,
+			RetryAttempts: remoteRetryAttempts,
+			Headers:       remoteHeaders,
+		}),
+		handler.WithFaultInjection(handler.FaultInjection{
+			UpstreamLatency:     faultUpstreamLatency,
+			UpstreamErrorRate:   faultUpstreamErrorRate,
+			UpstreamErrorStatus: faultUpstreamErrorStatus,
+			DiskWriteBandwidth:  faultDiskWriteBandwidth,
+		}),
+		handler.WithUpstreamMaxBandwidth(upstreamMaxBandwidth),
+		handler.WithServeMaxBandwidth(serveMaxBandwidth, serveMaxClientBandwidth),
+		handler.WithCircuitBreaker(handler.CircuitBreakerOptions{
+			Threshold:   circuitBreakerThreshold,
+			MinRequests: circuitBreakerMinRequests,
+			Window:      circuitBreakerWindow,
+			Cooldown:    circuitBreakerCooldown,
+			Mirrors:     registryMirrors,
+		}),
+		handler.WithAdminToken(adminToken),
+		handler.WithProgressInterval(progressInterval),
+		handler.WithDelete(enableDelete),
+		handler.WithUpload(enableUpload),
+		handler.WithGCInterval(gcInterval),
+		handler.WithGCMaxSize(gcMaxSize),
+		handler.WithTagHistory(tagHistory),
+		handler.WithCanary(canarySoak, canaryPercent, canaryClients...),
+		handler.WithReadOnly(readOnly),
+		handler.WithRulesDir(rulesDir),
+		handler.WithAdminRuleSources(adminRuleSources),
+		handler.WithSecretsDir(secretsDir),
+		handler.WithBuildWorker(buildWorker, buildWorkerToken),
+		handler.WithBuildWorkerTLS(buildWorkerTLS),
+		handler.WithWorkerConcurrency(workerConcurrency),
+		handler.WithBuildLock(buildLock),
+		handler.WithPeers(peers, peerToken),
+		handler.WithWarm(warmTop, warmPeer, warmPeerToken),
+		handler.WithInlineDataThreshold(inlineDataThreshold),
+		handler.WithMemoryCacheSize(memoryCacheSize),
+		handler.WithReadyMinFreeBytes(readyMinFreeBytes),
+		handler.WithFsck(fsck, fsckVerifyDigests),
+		handler.WithSendfile(sendfileHeader, sendfilePrefix),
+		handler.WithCacheControl(tagCacheControl, digestCacheControl),
+		handler.WithRedirectUpstream(redirectUpstream),
+		handler.WithRedirectHosts(redirectHosts...),
+		handler.WithRebuildMissingBlobs(rebuildMissingBlobs),
+		handler.WithReuseMutationLayers(reuseMutationLayers),
+		handler.WithDedupStagedFiles(dedupStagedFiles),
+		handler.WithBuildSandbox(buildTmpDir, buildMaxFiles, buildMaxBytes),
+		handler.WithAuditWebhook(auditWebhook),
+		handler.WithDragonflyPreheat(dragonflyPreheat, dragonflyToken, dragonflyRegistryURL),
+		handler.WithHtpasswd(htpasswd),
+		handler.WithTenants(tenants),
+	}
+	if auditLog != "" {
+		f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			logger.Error("failed to open audit log", "err", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		opts = append(opts, handler.WithAuditLog(f))
+	}
+
 	mux := http.NewServeMux()
 
-	h, err := handler.NewHandler(cache, staticConfig, clientset)
+	h, err := handler.NewHandler(cache, staticConfig, clientset, opts...)
 	if err != nil {
 		logger.Error("failed to NewHandler", "err", err)
 		os.Exit(1)
 	}
 
 	mux.Handle("/v2/", h)
+	mux.Handle("/metrics", h.MetricsHandler())
+	mux.Handle("/readyz", h.ReadyHandler())
+	if adminToken != "" {
+		mux.Handle("/admin/", h.AdminHandler())
+		mux.Handle("/peer/", h.PeerHandler())
+	} else {
+		logger.Warn("the admin and peer APIs are disabled without --admin-token")
+	}
+
+	trusted, err := forwarded.ParseTrusted(trustedProxies)
+	if err != nil {
+		logger.Error("failed to parse trusted proxies", "err", err)
+		os.Exit(1)
+	}
 
 	server := http.Server{
 		BaseContext: func(listener net.Listener) context.Context {
 			return ctx
 		},
-		Handler: handlers.LoggingHandler(os.Stderr, mux),
-		Addr:    address,
+		Handler:           forwarded.Handler(trusted, handlers.LoggingHandler(os.Stderr, mux)),
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
 	}
 
-	err = server.ListenAndServe()
-	if err != nil {
-		logger.Error("failed to ListenAndServe", "err", err)
-		os.Exit(1)
+	var connections chan struct{}
+	if maxConnections > 0 {
+		connections = make(chan struct{}, maxConnections)
 	}
-}
 
-func loadConfig(r io.Reader) ([]*v1alpha1.ImageSpec, error) {
-	var images []*v1alpha1.ImageSpec
-	decoder := yaml.NewYAMLToJSONDecoder(r)
-	for {
-		var raw json.RawMessage
-		err := decoder.Decode(&raw)
+	errs := make(chan error, len(addresses)+1)
+	for _, address := range addresses {
+		listener, err := net.Listen(listenNetwork(address), address)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			return nil, fmt.Errorf("failed to decode %q: %w", raw, err)
+			logger.Error("failed to Listen", "address", address, "err", err)
+			os.Exit(1)
 		}
-		if len(raw) == 0 {
-			// Ignore empty documents
-			continue
+		if connections != nil {
+			listener = limitListener(listener, connections)
 		}
-		var img v1alpha1.Image
-		err = json.Unmarshal(raw, &img)
-		if err != nil {
-			return nil, err
+		if proxyProtocol {
+			listener = forwarded.Listener(listener, trusted)
 		}
-		if img.TypeMeta.APIVersion != v1alpha1.GroupVersion.String() {
-			return nil, fmt.Errorf("unexpected APIVersion %q", img.TypeMeta.APIVersion)
+		logger.Info("listening", "address", listener.Addr().String(), "proxyProtocol", proxyProtocol)
+		go func() {
+			errs <- server.Serve(listener)
+		}()
+	}
+
+	var grpcServer *grpc.Server
+	if grpcAddress != "" {
+		if adminToken == "" {
+			logger.Error("the gRPC build API requires --admin-token")
+			os.Exit(1)
 		}
-		if img.Kind != v1alpha1.ImageKind {
-			return nil, fmt.Errorf("unexpected Kind %q", img.Kind)
+		grpcServer = h.GRPCServer()
+		listener, err := net.Listen(listenNetwork(grpcAddress), grpcAddress)
+		if err != nil {
+			logger.Error("failed to Listen", "address", grpcAddress, "err", err)
+			os.Exit(1)
 		}
+		logger.Info("listening for gRPC", "address", listener.Addr().String())
+		go func() {
+			errs <- grpcServer.Serve(listener)
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-errs:
+	case sig := <-signals:
+		logger.Info("shutting down", "signal", sig.String())
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err = server.Shutdown(shutdownCtx)
+		if grpcServer != nil {
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-shutdownCtx.Done():
+				grpcServer.Stop()
+			}
+		}
+		cancel()
+	}
+	if cerr := h.Close(); cerr != nil {
+		logger.Error("failed to Close", "err", cerr)
+	}
+	if err != nil {
+		logger.Error("failed to Serve", "err", err)
+		os.Exit(1)
+	}
+}
 
-		images = append(images, &img.Spec)
+// listenNetwork returns the network of the address, the IPv6 addresses only listen on IPv6
+// so that they can be listened on next to the IPv4 ones, the others listen on both.
+func listenNetwork(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
 	}
-	return images, nil
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// envPrefix is the prefix of the environment variables of the flags, e.g. JITDI_CACHE for --cache.
+const envPrefix = "JITDI_"
+
+// envName returns the environment variable of the flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// applySettings sets the flags not given on the command line from their environment variables,
+// and then from the settings file if any, so that the flags take precedence over the environment variables,
+// which take precedence over the settings file and then the defaults.
+func applySettings(fs *pflag.FlagSet, settingsFile string) error {
+	var settings map[string]any
+	if settingsFile != "" {
+		var err error
+		settings, err = loadSettings(settingsFile)
+		if err != nil {
+			return fmt.Errorf("load settings %q: %w", settingsFile, err)
+		}
+		var unknown []string
+		for key := range settings {
+			if fs.Lookup(key) == nil {
+				unknown = append(unknown, key)
+			}
+		}
+		if len(unknown) != 0 {
+			sort.Strings(unknown)
+			return fmt.Errorf("unknown settings %s in %q", strings.Join(unknown, ", "), settingsFile)
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if f.Changed {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			values := []string{value}
+			// The string slices split the values on the commas themselves.
+			if f.Value.Type() == "stringArray" {
+				values = strings.Split(value, ",")
+			}
+			err := setFlag(fs, f.Name, values)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", envName(f.Name), err))
+			}
+			return
+		}
+		if value, ok := settings[f.Name]; ok {
+			values, err := settingValues(value)
+			if err == nil {
+				err = setFlag(fs, f.Name, values)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("setting %s: %w", f.Name, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func setFlag(fs *pflag.FlagSet, name string, values []string) error {
+	for _, v := range values {
+		err := fs.Set(name, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSettings decodes the YAML or JSON map of the names of the flags to their values.
+func loadSettings(p string) (map[string]any, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var settings map[string]any
+	err = yaml.NewYAMLToJSONDecoder(f).Decode(&settings)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// settingValues returns the values of a setting, a list sets the flag once for each of its items.
+func settingValues(value any) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case bool, float64:
+		raw, _ := json.Marshal(v)
+		return []string{string(raw)}, nil
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := settingValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s...)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", value)
+}
@@ -0,0 +1,109 @@
+#!/usr/bin/env bash
+
+# Runs the conformance tests of the OCI distribution spec against a jitdi serving the rules of test/conformance.yaml.
+# The tag of the rules is built first and its manifest and config are the content the pull tests read,
+# the push, the content discovery and the content management tests are skipped as jitdi builds the tags on demand.
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+DIR="$(dirname "${BASH_SOURCE[0]}")"
+
+ROOT_DIR="$(realpath "${DIR}/..")"
+
+CONFORMANCE_VERSION="${CONFORMANCE_VERSION:-v1.1.0}"
+CONFORMANCE_ADDRESS="${CONFORMANCE_ADDRESS:-127.0.0.1:5888}"
+CONFORMANCE_NAMESPACE="${CONFORMANCE_NAMESPACE:-conformance/busybox}"
+CONFORMANCE_TAG="${CONFORMANCE_TAG:-1.36}"
+CONFORMANCE_REPORT_DIR="${CONFORMANCE_REPORT_DIR:-${ROOT_DIR}/conformance}"
+
+WORK_DIR="$(mktemp -d)"
+JITDI_PID=""
+
+function cleanup() {
+  if [[ -n "${JITDI_PID}" ]]; then
+    kill "${JITDI_PID}" 2>/dev/null || true
+    wait "${JITDI_PID}" 2>/dev/null || true
+  fi
+  rm -rf "${WORK_DIR}"
+}
+
+trap cleanup EXIT
+
+function build-conformance() {
+  echo "Building the conformance tests ${CONFORMANCE_VERSION}"
+  git clone --quiet --depth 1 --branch "${CONFORMANCE_VERSION}" \
+    https://github.com/opencontainers/distribution-spec.git "${WORK_DIR}/distribution-spec"
+  (
+    cd "${WORK_DIR}/distribution-spec/conformance"
+    go test -c -o "${WORK_DIR}/conformance.test"
+  )
+}
+
+function start-jitdi() {
+  echo "Starting jitdi on ${CONFORMANCE_ADDRESS}"
+  go build -o "${WORK_DIR}/jitdi" "${ROOT_DIR}/cmd/jitdi"
+  "${WORK_DIR}/jitdi" \
+    --kubernetes=false \
+    --address "${CONFORMANCE_ADDRESS}" \
+    --cache "${WORK_DIR}/cache" \
+    -c "${ROOT_DIR}/test/conformance.yaml" \
+    >"${WORK_DIR}/jitdi.log" 2>&1 &
+  JITDI_PID=$!
+
+  for _ in $(seq 1 50); do
+    if curl -fs "http://${CONFORMANCE_ADDRESS}/readyz" >/dev/null; then
+      return
+    fi
+    sleep 0.2
+  done
+  cat "${WORK_DIR}/jitdi.log"
+  echo "jitdi is not ready" >&2
+  return 1
+}
+
+function build-tag() {
+  local url="http://${CONFORMANCE_ADDRESS}/v2/${CONFORMANCE_NAMESPACE}/manifests/${CONFORMANCE_TAG}"
+  local accept="application/vnd.oci.image.manifest.v1+json,application/vnd.docker.distribution.manifest.v2+json"
+
+  echo "Building ${CONFORMANCE_NAMESPACE}:${CONFORMANCE_TAG}"
+  if ! curl -fs -H "Accept: ${accept}" -o "${WORK_DIR}/manifest.json" -D "${WORK_DIR}/headers" "${url}"; then
+    cat "${WORK_DIR}/jitdi.log"
+    echo "failed to build ${CONFORMANCE_NAMESPACE}:${CONFORMANCE_TAG}" >&2
+    return 1
+  fi
+
+  MANIFEST_DIGEST="$(grep -i '^Docker-Content-Digest:' "${WORK_DIR}/headers" | tr -d '\r' | awk '{print $2}')"
+  # The first digest of the manifest is the one of its config.
+  BLOB_DIGEST="$(grep -o '"digest" *: *"sha256:[0-9a-f]*"' "${WORK_DIR}/manifest.json" | head -n 1 | grep -o 'sha256:[0-9a-f]*')"
+  if [[ -z "${MANIFEST_DIGEST}" || -z "${BLOB_DIGEST}" ]]; then
+    echo "no digests in the manifest of ${CONFORMANCE_NAMESPACE}:${CONFORMANCE_TAG}" >&2
+    return 1
+  fi
+}
+
+function run-conformance() {
+  mkdir -p "${CONFORMANCE_REPORT_DIR}"
+  echo "Running the conformance tests, the reports are in ${CONFORMANCE_REPORT_DIR}"
+  (
+    cd "${CONFORMANCE_REPORT_DIR}"
+    OCI_ROOT_URL="http://${CONFORMANCE_ADDRESS}" \
+      OCI_NAMESPACE="${CONFORMANCE_NAMESPACE}" \
+      OCI_TEST_PULL=1 \
+      OCI_TAG_NAME="${CONFORMANCE_TAG}" \
+      OCI_MANIFEST_DIGEST="${MANIFEST_DIGEST}" \
+      OCI_BLOB_DIGEST="${BLOB_DIGEST}" \
+      OCI_HIDE_SKIPPED_WORKFLOWS=1 \
+      OCI_REPORT_DIR="${CONFORMANCE_REPORT_DIR}" \
+      "${WORK_DIR}/conformance.test" "$@"
+  ) || {
+    cat "${WORK_DIR}/jitdi.log"
+    return 1
+  }
+}
+
+build-conformance
+start-jitdi
+build-tag
+run-conformance "$@"
@@ -11,4 +11,7 @@ import (
 
 	// controller-gen
 	_ "sigs.k8s.io/controller-tools/cmd/controller-gen"
+
+	// protoc-gen-go
+	_ "google.golang.org/protobuf/cmd/protoc-gen-go"
 )
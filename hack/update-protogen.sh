@@ -0,0 +1,32 @@
+#!/usr/bin/env bash
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+DIR="$(dirname "${BASH_SOURCE[0]}")"
+
+ROOT_DIR="$(realpath "${DIR}/..")"
+
+BIN_DIR="${ROOT_DIR}/bin"
+
+function protoc() {
+  GOBIN="${BIN_DIR}" go install google.golang.org/protobuf/cmd/protoc-gen-go
+  GOBIN="${BIN_DIR}" go install google.golang.org/grpc/cmd/protoc-gen-go-grpc@v1.3.0
+  PATH="${BIN_DIR}:${PATH}" command protoc "$@"
+}
+
+function gen() {
+  rm -rf \
+    "${ROOT_DIR}/pkg/buildapi"/*.pb.go
+  echo "Generating buildapi"
+  protoc \
+    --proto_path pkg/buildapi \
+    --go_out pkg/buildapi \
+    --go_opt paths=source_relative \
+    --go-grpc_out pkg/buildapi \
+    --go-grpc_opt paths=source_relative \
+    build.proto
+}
+
+cd "${ROOT_DIR}" && gen
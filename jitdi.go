@@ -0,0 +1,155 @@
+// Package jitdi embeds the just-in-time image building of jitdi in other Go services,
+// without running the jitdi binary.
+//
+//	srv, err := jitdi.New(jitdi.Options{
+//		Cache: "./cache",
+//		Rules: rules,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	http.Handle("/", srv)
+package jitdi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"google.golang.org/grpc"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/client/clientset/versioned"
+	"github.com/wzshiming/jitdi/pkg/handler"
+)
+
+// The types of the results of the Server, they are the ones of the admin API.
+type (
+	// Build is a build of a tag.
+	Build = handler.Build
+	// BuildStatus is the status of a build.
+	BuildStatus = handler.BuildStatus
+	// GCResult is the result of a garbage collection.
+	GCResult = handler.GCResult
+	// Option is an option of the handler, for the settings that Options has no field for.
+	Option = handler.Option
+	// Keychain resolves the credentials of the upstream registries, it is the one of go-containerregistry,
+	// so that its keychains, e.g. the ones of k8schain, are plugged in as they are.
+	Keychain = authn.Keychain
+)
+
+// The statuses of the builds.
+const (
+	BuildRunning   = handler.BuildRunning
+	BuildSucceeded = handler.BuildSucceeded
+	BuildFailed    = handler.BuildFailed
+)
+
+var (
+	// ErrNoRule is the error of the refs that no rule matches.
+	ErrNoRule = handler.ErrNoRule
+	// ErrReadOnly is the error of the changes of the cache of the read-only servers.
+	ErrReadOnly = handler.ErrReadOnly
+)
+
+// Options are the options of the Server.
+type Options struct {
+	// Cache is the directory of the cache, required.
+	Cache string
+	// Rules are the Images whose rules the tags are built with.
+	Rules []*v1alpha1.Image
+	// Clientset is the client of the cluster whose Images are watched too, nil to only use the Rules.
+	Clientset *versioned.Clientset
+	// Concurrency is the number of the layers built at once, 4 if zero.
+	Concurrency int
+	// Keychains resolve the credentials of the upstream registries before the config.json,
+	// the first one that does not leave a registry anonymous provides its credentials.
+	Keychains []Keychain
+	// AdminToken is the bearer token required by the admin, gRPC and peer APIs and the metrics,
+	// the admin, gRPC and peer APIs are disabled if empty.
+	AdminToken string
+	// HandlerOptions are the other options of the handler, the ones of the flags of the jitdi binary.
+	HandlerOptions []Option
+}
+
+// Server serves the registry API on /v2/, the metrics on /metrics, the readiness on /readyz,
+// and with an admin token the admin API on /admin/ and the peers on /peer/, like the jitdi binary.
+type Server struct {
+	handler *handler.Handler
+	mux     *http.ServeMux
+}
+
+// New returns the Server of the options.
+func New(opts Options) (*Server, error) {
+	if opts.Cache == "" {
+		return nil, fmt.Errorf("cache is required")
+	}
+	var handlerOptions []Option
+	if opts.Concurrency > 0 {
+		handlerOptions = append(handlerOptions, handler.WithConcurrency(opts.Concurrency))
+	}
+	if len(opts.Keychains) != 0 {
+		handlerOptions = append(handlerOptions, handler.WithKeychains(opts.Keychains...))
+	}
+	if opts.AdminToken != "" {
+		handlerOptions = append(handlerOptions, handler.WithAdminToken(opts.AdminToken))
+	}
+	handlerOptions = append(handlerOptions, opts.HandlerOptions...)
+
+	h, err := handler.NewHandler(opts.Cache, opts.Rules, opts.Clientset, handlerOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v2/", h)
+	mux.Handle("/metrics", h.MetricsHandler())
+	mux.Handle("/readyz", h.ReadyHandler())
+	if opts.AdminToken != "" {
+		mux.Handle("/admin/", h.AdminHandler())
+		mux.Handle("/peer/", h.PeerHandler())
+	}
+	return &Server{
+		handler: h,
+		mux:     mux,
+	}, nil
+}
+
+// ServeHTTP serves the APIs of the Server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close persists the state of the Server not persisted yet, it is called once the Server stops serving.
+func (s *Server) Close() error {
+	return s.handler.Close()
+}
+
+// RegistryHandler returns the handler of the registry API alone, to be mounted on /v2/.
+func (s *Server) RegistryHandler() http.Handler {
+	return s.handler
+}
+
+// GRPCServer returns the gRPC server of the build API and of the build workers of pkg/buildapi,
+// to be served on its own listener, it requires the admin token and is disabled without one.
+func (s *Server) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	return s.handler.GRPCServer(opts...)
+}
+
+// Build builds the tag of the ref even if it is in the cache, or waits for the build of the tag already running,
+// and returns the build. The tag of the ref defaults to latest, it fails with ErrNoRule if no rule matches it.
+func (s *Server) Build(ctx context.Context, ref string) (Build, error) {
+	return s.handler.Build(ctx, ref)
+}
+
+// Invalidate removes the tag of the ref from the cache so that it is built again on the next pull,
+// and reports whether it was in the cache. The tag of the ref defaults to latest.
+func (s *Server) Invalidate(ctx context.Context, ref string) (bool, error) {
+	return s.handler.Invalidate(ctx, ref)
+}
+
+// GC removes the blobs no longer referenced by any tag.
+func (s *Server) GC(ctx context.Context) (GCResult, error) {
+	return s.handler.GC(ctx)
+}
@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/logging"
+)
+
+// Options holds the options for the agent.
+type Options struct {
+	// Server is the URL of the admin API of jitdi whose builds are followed, none if it is empty.
+	Server string
+	// AdminToken is the bearer token of the admin API.
+	AdminToken string
+	// Registry is the host that the nodes pull jitdi as, defaults to the host of the server.
+	// It is required without a server.
+	Registry string
+	// Images are the globs of the refs pre-pulled, e.g. models/*, all of them if empty.
+	Images []string
+	// Username and Password are the credentials the images are pulled with, if jitdi requires them.
+	Username string
+	Password string
+	// Transport is the transport of the admin API.
+	Transport http.RoundTripper
+}
+
+// build is the part of a build of jitdi that the agent needs.
+type build struct {
+	ID     string `json:"id"`
+	Ref    string `json:"ref"`
+	Status string `json:"status"`
+}
+
+// Puller pulls the images into the container runtime of the node.
+type Puller interface {
+	Pull(ctx context.Context, image string, auth *Auth) (string, error)
+}
+
+// Auth is the credentials the images are pulled with.
+type Auth struct {
+	Username string
+	Password string
+}
+
+// Agent pre-pulls the images freshly built by jitdi into the container runtime of its node,
+// so that the pods scheduled on it later start without pulling them.
+type Agent struct {
+	logger *slog.Logger
+
+	server     *url.URL
+	adminToken string
+	registry   string
+	images     []string
+	auth       *Auth
+	client     *http.Client
+	puller     Puller
+
+	pulled map[string]struct{}
+	queue  chan string
+}
+
+// pullQueueSize is how many built refs are buffered for the pulls before new ones are dropped.
+const pullQueueSize = 1000
+
+// New returns an agent pulling the images with the puller.
+func New(puller Puller, opts Options) (*Agent, error) {
+	var u *url.URL
+	if opts.Server != "" {
+		var err error
+		u, err = url.Parse(opts.Server)
+		if err != nil {
+			return nil, fmt.Errorf("server %q: %w", opts.Server, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("server %q: must be a http or https url", opts.Server)
+		}
+	}
+	for _, pattern := range opts.Images {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("image %q: %w", pattern, err)
+		}
+	}
+	registry := opts.Registry
+	if registry == "" {
+		if u == nil {
+			return nil, fmt.Errorf("the registry is required without a server")
+		}
+		registry = u.Host
+	}
+	var auth *Auth
+	if opts.Username != "" {
+		auth = &Auth{
+			Username: opts.Username,
+			Password: opts.Password,
+		}
+	}
+	return &Agent{
+		logger:     slog.Default().With(logging.ComponentKey, "agent"),
+		server:     u,
+		adminToken: opts.AdminToken,
+		registry:   strings.TrimSuffix(registry, "/"),
+		images:     opts.Images,
+		auth:       auth,
+		client: &http.Client{
+			Transport: opts.Transport,
+		},
+		puller: puller,
+		pulled: map[string]struct{}{},
+		queue:  make(chan string, pullQueueSize),
+	}, nil
+}
+
+// Run follows the builds of jitdi and pulls the images of the succeeded ones until the ctx is done,
+// it reconnects with a backoff when the stream of the builds is broken.
+// Without a server it only pulls the images queued by WatchPrewarms.
+func (a *Agent) Run(ctx context.Context) error {
+	go a.runPulls(ctx)
+	if a.server == nil {
+		<-ctx.Done()
+		return nil
+	}
+
+	backoff := time.Second
+	for {
+		connected := time.Now()
+		err := a.watch(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(connected) > time.Minute {
+			backoff = time.Second
+		}
+		a.logger.Warn("watch builds", "server", a.server.String(), "err", err, "retry", backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// watch reads the server-sent events of the builds and queues the refs of the succeeded ones.
+func (a *Agent) watch(ctx context.Context) error {
+	u := a.server.JoinPath("admin", "builds")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if a.adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+a.adminToken)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http.Get(%q): %w", u, fmt.Errorf("status code %d", resp.StatusCode))
+	}
+	a.logger.Info("watching builds", "server", a.server.String())
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	var event, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "build" && data != "" {
+				a.handleBuild(data)
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = fmt.Errorf("stream closed")
+	}
+	return err
+}
+
+func (a *Agent) handleBuild(data string) {
+	var b build
+	err := json.Unmarshal([]byte(data), &b)
+	if err != nil {
+		a.logger.Warn("invalid build event", "err", err)
+		return
+	}
+	if b.Status != "Succeeded" {
+		return
+	}
+	if _, ok := a.pulled[b.ID]; ok {
+		return
+	}
+	a.pulled[b.ID] = struct{}{}
+	if !a.match(b.Ref) {
+		a.logger.Debug("build not pre-pulled", "ref", b.Ref)
+		return
+	}
+
+	a.enqueue(b.Ref)
+}
+
+func (a *Agent) enqueue(ref string) {
+	select {
+	case a.queue <- a.image(ref):
+	default:
+		a.logger.Warn("pull queue is full, image dropped", "ref", ref)
+	}
+}
+
+// match reports whether the ref is pre-pulled.
+func (a *Agent) match(ref string) bool {
+	if len(a.images) == 0 {
+		return true
+	}
+	for _, pattern := range a.images {
+		if ok, _ := path.Match(pattern, ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// image returns the image of the ref that the nodes pull, the refs of the tenants already start with their hosts.
+func (a *Agent) image(ref string) string {
+	if first, _, ok := strings.Cut(ref, "/"); ok && strings.ContainsAny(first, ".:") {
+		return ref
+	}
+	return a.registry + "/" + ref
+}
+
+func (a *Agent) runPulls(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case image := <-a.queue:
+			start := time.Now()
+			imageRef, err := a.puller.Pull(ctx, image, a.auth)
+			if err != nil {
+				a.logger.Error("pull image", "image", image, "err", err)
+				continue
+			}
+			a.logger.Info("image pulled", "image", image, "imageRef", imageRef, "duration", time.Since(start))
+		}
+	}
+}
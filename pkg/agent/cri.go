@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// CRIPuller pulls the images with the image service of the CRI of the container runtime,
+// so that they are pulled like the kubelet pulls them.
+type CRIPuller struct {
+	conn   *grpc.ClientConn
+	client runtimeapi.ImageServiceClient
+}
+
+// NewCRIPuller connects to the CRI endpoint of the container runtime, e.g. unix:///run/containerd/containerd.sock.
+func NewCRIPuller(endpoint string) (*CRIPuller, error) {
+	target := endpoint
+	if socket, ok := strings.CutPrefix(endpoint, "unix://"); ok {
+		target = "unix:" + socket
+	} else if !strings.HasPrefix(endpoint, "unix:") {
+		return nil, fmt.Errorf("runtime endpoint %q: must be a unix socket", endpoint)
+	}
+	conn, err := grpc.Dial(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("dial %q: %w", endpoint, err)
+	}
+	return &CRIPuller{
+		conn:   conn,
+		client: runtimeapi.NewImageServiceClient(conn),
+	}, nil
+}
+
+// Pull pulls the image and returns its image ref, the tags built again are pulled again
+// and only their new blobs are downloaded.
+func (p *CRIPuller) Pull(ctx context.Context, image string, auth *Auth) (string, error) {
+	req := &runtimeapi.PullImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: image},
+	}
+	if auth != nil {
+		req.Auth = &runtimeapi.AuthConfig{
+			Username: auth.Username,
+			Password: auth.Password,
+		}
+	}
+	resp, err := p.client.PullImage(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("pull image: %w", err)
+	}
+	return resp.ImageRef, nil
+}
+
+// Close closes the connection to the container runtime.
+func (p *CRIPuller) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/client/clientset/versioned"
+)
+
+// WatchPrewarms pulls the images of the ImagePrewarms whose node selectors match the labels of the node
+// every time jitdi reports new digests of them, until the ctx is done.
+func (a *Agent) WatchPrewarms(ctx context.Context, clientset versioned.Interface, nodeLabels map[string]string) {
+	// pulled is the digest last pulled of each image of each prewarm, the handlers are called one at a time.
+	pulled := map[string]map[string]string{}
+	handle := func(prewarm *v1alpha1.ImagePrewarm) {
+		selector := prewarm.Spec.NodeSelector
+		if len(selector) == 0 || !labels.SelectorFromSet(selector).Matches(labels.Set(nodeLabels)) {
+			delete(pulled, prewarm.Name)
+			return
+		}
+		digests := pulled[prewarm.Name]
+		if digests == nil {
+			digests = map[string]string{}
+			pulled[prewarm.Name] = digests
+		}
+		for _, image := range prewarm.Status.Images {
+			if image.Digest == "" || digests[image.Image] == image.Digest {
+				continue
+			}
+			digests[image.Image] = image.Digest
+			a.logger.Info("prewarm image built", "prewarm", prewarm.Name, "ref", image.Image, "digest", image.Digest)
+			a.enqueue(image.Image)
+		}
+	}
+
+	api := clientset.ApisV1alpha1().ImagePrewarms()
+	_, controller := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				return api.List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				return api.Watch(ctx, opts)
+			},
+		},
+		&v1alpha1.ImagePrewarm{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				handle(obj.(*v1alpha1.ImagePrewarm))
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				handle(newObj.(*v1alpha1.ImagePrewarm))
+			},
+			DeleteFunc: func(obj interface{}) {
+				if prewarm, ok := obj.(*v1alpha1.ImagePrewarm); ok {
+					delete(pulled, prewarm.Name)
+				}
+			},
+		},
+	)
+	controller.Run(ctx.Done())
+}
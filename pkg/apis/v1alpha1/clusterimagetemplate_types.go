@@ -0,0 +1,71 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ClusterImageTemplateKind is the kind for cluster image template.
+	ClusterImageTemplateKind = "ClusterImageTemplate"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +genclient
+// +genclient:nonNamespaced
+// +genclient:noStatus
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:rbac:groups=jitdi.zsm.io,resources=clusterimagetemplates,verbs=get;list;watch
+
+// ClusterImageTemplate is the Schema for the clusterimagetemplates API,
+// a bundle of mutations that the Images reference with the values of its parameters
+type ClusterImageTemplate struct {
+	//+k8s:conversion-gen=false
+	metav1.TypeMeta `json:",inline"`
+	// Standard list metadata.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#metadata
+	metav1.ObjectMeta `json:"metadata"`
+	// Spec defines the desired state of ClusterImageTemplate
+	Spec ClusterImageTemplateSpec `json:"spec"`
+}
+
+// ClusterImageTemplateSpec holds the specification for cluster image template
+type ClusterImageTemplateSpec struct {
+	// Parameters are the parameters that the mutations and the annotations use as "{name}",
+	// their values are given by the Images referencing the template
+	Parameters []TemplateParameter `json:"parameters,omitempty"`
+	// Mutates are applied before the ones of the Images referencing the template
+	Mutates []Mutate `json:"mutates,omitempty"`
+	// Annotations are added to the built manifests, unless the Images referencing the template override them
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// TemplateParameter holds the parameter information of a template
+type TemplateParameter struct {
+	Name string `json:"name"`
+	// Default is the value of the parameter if the Image does not give one
+	Default string `json:"default,omitempty"`
+	// Required parameters must be given by the Images referencing the template
+	Required bool `json:"required,omitempty"`
+}
+
+// TemplateRef holds the reference to a template
+type TemplateRef struct {
+	// Name is the name of the ClusterImageTemplate
+	Name string `json:"name"`
+	// Parameters are the values of the parameters of the template
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+
+// ClusterImageTemplateList is a list of ClusterImageTemplate.
+type ClusterImageTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []ClusterImageTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterImageTemplate{}, &ClusterImageTemplateList{})
+}
@@ -9,12 +9,29 @@ const (
 	ImageKind = "Image"
 )
 
+// The annotations added to the built manifests.
+const (
+	// AnnotationImage is the name of the Image that the manifest is built by.
+	AnnotationImage = "jitdi.zsm.io/image"
+	// AnnotationNamespace is the namespace of the Image that the manifest is built by.
+	AnnotationNamespace = "jitdi.zsm.io/namespace"
+	// AnnotationGeneration is the generation of the Image that the manifest is built by.
+	AnnotationGeneration = "jitdi.zsm.io/generation"
+	// AnnotationVersion is the version of jitdi that the manifest is built by.
+	AnnotationVersion = "jitdi.zsm.io/version"
+	// AnnotationSecret marks the layers of the files rendered with the values of Secrets, so that the SBOMs can exclude them.
+	AnnotationSecret = "jitdi.zsm.io/secret"
+	// AnnotationCachePriority is the cache priority of the layers of the mutations that set one.
+	AnnotationCachePriority = "jitdi.zsm.io/cache-priority"
+)
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +genclient
 // +genclient:nonNamespaced
 // +kubebuilder:subresource:status
 // +kubebuilder:resource:scope=Cluster
 // +kubebuilder:rbac:groups=jitdi.zsm.io,resources=images,verbs=create;delete;get;list;patch;update;watch
+// +kubebuilder:rbac:groups=jitdi.zsm.io,resources=images/status,verbs=get;patch;update
 
 // Image is the Schema for the images API
 type Image struct {
@@ -37,26 +54,350 @@ type ImageStatus struct {
 	// +listType=map
 	// +listMapKey=type
 	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+	// Usage is the disk usage of the tags built by the rule of the image, updated after each build
+	Usage *ImageUsage `json:"usage,omitempty"`
+}
+
+// ImageUsage holds the disk usage of the tags built by a rule
+type ImageUsage struct {
+	// Tags is the number of the tags built by the rule in the cache
+	Tags int `json:"tags"`
+	// Bytes is the size of the blobs of the tags, the blobs shared by several tags are counted once
+	Bytes int64 `json:"bytes"`
+	// Quota is the quota of the rule, if any
+	Quota string `json:"quota,omitempty"`
+	// UpdateTime is when the usage was measured
+	UpdateTime metav1.Time `json:"updateTime"`
 }
 
 // ImageSpec holds the specification for image
 type ImageSpec struct {
-	Match     string   `json:"match,omitempty"`
-	BaseImage string   `json:"baseImage,omitempty"`
-	Mutates   []Mutate `json:"mutates,omitempty"`
+	// Match is the pattern of the references that the rule matches, "{name}" matches a parameter and "*" matches anything
+	Match string `json:"match,omitempty"`
+	// Host is the pattern of the host that the clients address jitdi as, with the port if any, e.g. "{mirror}.example.com",
+	// the rule then matches the full references "<host>/<image>:<tag>" and is tried before the rules without a host,
+	// so that each host is a virtual registry with its own rules. Its parameters can be used like the ones of match.
+	Host string `json:"host,omitempty"`
+	// ExcludeTags are the globs of the tags that the rule does not match, e.g. "latest" or "*-debug",
+	// a glob prefixed with "!" matches the tags excluded by the globs before it again, the last glob matching a tag wins.
+	ExcludeTags []string `json:"excludeTags,omitempty"`
+	// TagSemver is the semantic version range of the tags that the rule matches, e.g. ">=1.2.0 <2.0.0", "^1.2" or "~1.2.3 || 2.x",
+	// the tags out of it or that are not versions fall through to the next rules.
+	TagSemver string `json:"tagSemver,omitempty"`
+	// Extends are the names of the rules that the rule is composed onto in order, it inherits their base image, the layers dropped,
+	// insecure, platforms, output media type and encryption unless it sets them, their annotations unless it overrides them,
+	// and their mutations are applied before its own. A rule without match and rewrite is a template that only serves as a base.
+	Extends []string `json:"extends,omitempty"`
+	// Templates are the ClusterImageTemplates whose mutations are applied in order after the ones of the rules extended
+	// and before the rule's own, with the values of their parameters. Their annotations are added unless the rule overrides them.
+	Templates []TemplateRef `json:"templates,omitempty"`
+	BaseImage string        `json:"baseImage,omitempty"`
+	// DropLayers are the layers of the base image removed before the mutations, by their index from 0 at the bottom or by their digest,
+	// e.g. the layers of the files that the mutations replace, so that the clients do not pull them
+	DropLayers []string `json:"dropLayers,omitempty"`
+	Mutates    []Mutate `json:"mutates,omitempty"`
+	// Insecure allows pulling the base image over plain HTTP or without verifying TLS
+	Insecure bool `json:"insecure,omitempty"`
+	// Rewrite maps a whole repository prefix to another, it replaces match and baseImage
+	Rewrite *Rewrite `json:"rewrite,omitempty"`
+	// OutputMediaType is the format of the built manifests, one of "oci", "docker" or "both",
+	// defaults to the format of the base image. With "both" the format is negotiated with the Accept header.
+	// +kubebuilder:validation:Enum=oci;docker;both
+	OutputMediaType string `json:"outputMediaType,omitempty"`
+	// DigestAlgorithm is the algorithm of the digests of the manifests of the tags served by tag, "sha256" by default.
+	// With "sha512" a copy of the manifests is also addressed by their sha512 digest, the configs and the layers stay sha256.
+	// +kubebuilder:validation:Enum=sha256;sha512
+	DigestAlgorithm string `json:"digestAlgorithm,omitempty"`
+	// Platforms limits the images of the base index that are built to the ones matching any of the platforms,
+	// all the images are built if empty.
+	Platforms []Platform `json:"platforms,omitempty"`
+	// Annotations are added to the built manifests, the values can use the parameters of match
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Encryption encrypts the layers added by the mutations with OCIcrypt,
+	// so that only the nodes with the private keys of the recipients can read them.
+	Encryption *Encryption `json:"encryption,omitempty"`
+	// AllowedClients are the user names or the CIDRs of the source addresses of the clients that the image is served to,
+	// all the clients are allowed if both AllowedClients and AllowedNamespaces are empty.
+	AllowedClients []string `json:"allowedClients,omitempty"`
+	// AllowedNamespaces are the namespaces of the clients that the image is served to,
+	// the namespace of a client is the part of its user name before the "/".
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+	// Reproducible pins the timestamps of the files in the built layers,
+	// so that the same inputs always yield the same digests.
+	Reproducible bool `json:"reproducible,omitempty"`
+	// Created is the created timestamp of the config of the built images, "upstream" keeps the one of the base image,
+	// "build" sets the time of the build and a RFC 3339 time sets it, defaults to "upstream".
+	Created string `json:"created,omitempty"`
+	// CacheControl is the Cache-Control of the manifests served, so that the caching proxies and the peer-to-peer agents
+	// keep the manifests pulled by digest and recheck the tags in time. It is inherited from the rules extended.
+	CacheControl *CacheControl `json:"cacheControl,omitempty"`
+	// Retention is how many of the tags built by the rule are kept in the cache and for how long, so that the tags
+	// rebuilt often do not evict the images of the other rules. It is inherited from the rules extended.
+	Retention *Retention `json:"retention,omitempty"`
+	// Quota is the size of the blobs of the tags built by the rule, e.g. "50Gi", the builds of the rule fail
+	// once its other tags use it, until they are deleted or expire. It is inherited from the rules extended.
+	Quota string `json:"quota,omitempty"`
+	// Remote holds the options of go-containerregistry to pull the base images and the artifacts of the rule,
+	// each one defaults to the one of the flags of jitdi. It is inherited from the rules extended.
+	Remote *Remote `json:"remote,omitempty"`
+}
+
+// Remote holds the options of go-containerregistry to reach the upstreams, the zero ones keep their defaults
+type Remote struct {
+	// UserAgent is added to the User-Agent of the requests to the upstream registries,
+	// and is the User-Agent of the requests to the urls of the mutates
+	UserAgent string `json:"userAgent,omitempty"`
+	// Headers are the headers set on the requests to the upstream registries and to the urls of the mutates,
+	// e.g. the tokens of a CDN, a User-Agent among them replaces the whole one
+	Headers map[string]string `json:"headers,omitempty"`
+	// Jobs is the number of the requests sent at once by the operations of go-containerregistry on several blobs
+	Jobs int `json:"jobs,omitempty"`
+	// Platform is the platform as os/arch[/variant] of the images pulled from the indexes without a platform to pick,
+	// e.g. the models of ollama, linux/amd64 by default
+	Platform string `json:"platform,omitempty"`
+	// RetryAttempts is the number of the attempts of go-containerregistry on the temporary errors, 3 by default,
+	// 1 disables its retries, the ones of --retry-attempts still apply
+	RetryAttempts int `json:"retryAttempts,omitempty"`
+	// HTTPProxy is the proxy of the requests to the http upstreams and urls of the mutates of the rule.
+	// The proxies of the rule replace the ones of --http-proxy, --https-proxy and --no-proxy when any of them is set
+	HTTPProxy string `json:"httpProxy,omitempty"`
+	// HTTPSProxy is the proxy of the requests to the https upstreams and urls of the mutates of the rule
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+	// NoProxy is the comma-separated list of the hosts that bypass the proxies of the rule
+	NoProxy string `json:"noProxy,omitempty"`
+	// CAData is the PEM bundle of the CA certificates trusted for the upstreams and urls of the mutates of the rule,
+	// in addition to the system ones and the ones of --ca-file
+	CAData string `json:"caData,omitempty"`
+}
+
+// Retention holds how long the tags built by a rule and their previous builds are kept, the garbage collection
+// deletes the tags out of it and their blobs, the tags deleted are built again when they are pulled
+type Retention struct {
+	// MaxTags is the number of the tags of the rule kept, the ones pulled or built the least recently are deleted first,
+	// unlimited if zero
+	MaxTags int `json:"maxTags,omitempty"`
+	// MaxAge is how long a tag of the rule is kept after it is last pulled or built, e.g. "168h", forever if empty
+	MaxAge string `json:"maxAge,omitempty"`
+	// MaxRevisions is the number of the previous builds of every tag of the rule kept for the rollbacks,
+	// defaults to the one of --tag-history
+	MaxRevisions *int `json:"maxRevisions,omitempty"`
+}
+
+// CacheControl holds the Cache-Control headers of the served manifests
+type CacheControl struct {
+	// Tag is the Cache-Control of the manifests pulled by tag, e.g. "public, max-age=300",
+	// defaults to the one of --cache-control-tag, none if it is empty as the tags are rebuilt.
+	Tag string `json:"tag,omitempty"`
+	// Digest is the Cache-Control of the manifests pulled by digest, e.g. "private, max-age=31536000, immutable",
+	// defaults to the one of --cache-control-digest.
+	Digest string `json:"digest,omitempty"`
+}
+
+// Encryption holds the encryption information of the layers
+type Encryption struct {
+	// Recipients are the RSA public keys that can decrypt the layers, in PEM,
+	// either inline or as "jwe:<path>" of a file on the filesystem of jitdi
+	Recipients []string `json:"recipients"`
+}
+
+const (
+	// CreatedUpstream keeps the created timestamp of the base image
+	CreatedUpstream = "upstream"
+	// CreatedBuild sets the created timestamp to the time of the build
+	CreatedBuild = "build"
+)
+
+// Platform holds the platform information
+type Platform struct {
+	// OS is the operating system, e.g. "linux" or "windows"
+	OS string `json:"os,omitempty"`
+	// Architecture is the CPU architecture, e.g. "amd64"
+	Architecture string `json:"architecture,omitempty"`
+	// Variant is the variant of the CPU, e.g. "v8"
+	Variant string `json:"variant,omitempty"`
+	// OSVersion is the version of the operating system, e.g. "10.0.17763",
+	// it also matches the more specific versions such as "10.0.17763.5122"
+	OSVersion string `json:"osVersion,omitempty"`
+}
+
+// Rewrite holds the repository prefix rewriting information
+type Rewrite struct {
+	// From is the prefix of the requested repository, e.g. "dockerhub/*"
+	From string `json:"from"`
+	// To is the prefix of the upstream repository, e.g. "docker.io/library/*"
+	To string `json:"to"`
 }
 
 // Mutate holds the mutate information
 type Mutate struct {
-	File   *File   `json:"file,omitempty"`
-	Ollama *Ollama `json:"ollama,omitempty"`
+	File        *File        `json:"file,omitempty"`
+	Ollama      *Ollama      `json:"ollama,omitempty"`
+	HuggingFace *HuggingFace `json:"huggingFace,omitempty"`
+	Render      *Render      `json:"render,omitempty"`
+	Patch       *Patch       `json:"patch,omitempty"`
+	Config      *Config      `json:"config,omitempty"`
+	User        *User        `json:"user,omitempty"`
+	TrustedCA   *TrustedCA   `json:"trustedCA,omitempty"`
+	Locale      *Locale      `json:"locale,omitempty"`
+	Binary      *Binary      `json:"binary,omitempty"`
+	// CachePriority is how the layers of the mutation are kept when the garbage collection evicts blobs over --gc-max-size,
+	// "evict-first" layers are evicted before the other layers and "pin" layers are never evicted.
+	// The layers are annotated with jitdi.zsm.io/cache-priority.
+	// +kubebuilder:validation:Enum=pin;evict-first
+	CachePriority string `json:"cachePriority,omitempty"`
+	// LayerOrder sorts the layers of the mutations, the ones of the lower orders are appended first and the ties keep their order,
+	// so that the layers of the content that changes often are placed last and the clients keep the layers below them
+	LayerOrder int `json:"layerOrder,omitempty"`
 }
 
+const (
+	// CachePriorityPin never evicts the layers
+	CachePriorityPin = "pin"
+	// CachePriorityEvictFirst evicts the layers first, for the large ones that are cheap to build again
+	CachePriorityEvictFirst = "evict-first"
+)
+
 // File holds the file information
 type File struct {
-	Source      string `json:"source"`
+	Source string `json:"source,omitempty"`
+	// Template is the content of the file instead of a source, the parameters of match are replaced and
+	// "{secret:<name>/<key>}" is replaced with the key of the Secret mounted in the secrets directory.
+	// The values of the Secrets are redacted from the logs, and the layers are annotated with jitdi.zsm.io/secret.
+	Template    string `json:"template,omitempty"`
 	Destination string `json:"destination"`
 	Mode        string `json:"mode,omitempty"`
+	// ChunkSize packs the files of a directory into layers of at most it, e.g. "2Gi", on the boundaries of the files,
+	// a file larger than it is whole in its own layer, a single file is never split across layers
+	ChunkSize string `json:"chunkSize,omitempty"`
+	// Extract unpacks the archive of the source into the destination directory instead of adding the archive itself
+	Extract *Extract `json:"extract,omitempty"`
+	// Replaces is the digest of the file of the base image at the destination that the file replaces, e.g. "sha256:<hex>",
+	// the build fails if the base image has no such file or it has another digest, and the file keeps its mode unless the mode is set
+	Replaces string `json:"replaces,omitempty"`
+}
+
+// Extract holds how an archive is unpacked, the tar, tar.gz, tar.bz2, tar.zst and zip archives are detected by their content.
+// The files keep the modes of the archive unless the mode of the file is set.
+type Extract struct {
+	// StripComponents removes the number of leading directories from the names of the files, like tar --strip-components
+	StripComponents int `json:"stripComponents,omitempty"`
+	// Include only the files matching any of the glob patterns, after the leading directories are removed
+	Include []string `json:"include,omitempty"`
+	// Exclude the files matching any of the glob patterns, after the leading directories are removed
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Render holds the Go template rendered into a file
+type Render struct {
+	// Template is the content of the Go template
+	Template string `json:"template,omitempty"`
+	// Source is the URL or the path of the Go template instead of the template
+	Source string `json:"source,omitempty"`
+	// Values are passed to the template with the parameters of match, e.g. {{ .model }},
+	// the parameters of match are replaced in them and they override the parameters of the same names
+	Values      map[string]string `json:"values,omitempty"`
+	Destination string            `json:"destination"`
+	Mode        string            `json:"mode,omitempty"`
+}
+
+// Patch holds the patch of a JSON or YAML file of the base image, the patched file is added in a layer over it
+type Patch struct {
+	// Path is the path of the file in the base image
+	Path string `json:"path"`
+	// Format is the format of the file, detected by the extension of the path if empty
+	// +kubebuilder:validation:Enum=json;yaml
+	Format string `json:"format,omitempty"`
+	// MergePatch is a JSON merge patch (RFC 7386) applied to the file, in JSON or YAML
+	MergePatch string `json:"mergePatch,omitempty"`
+	// Set sets the values at the dot-separated paths after the merge patch, e.g. "server.port",
+	// the values are parsed as YAML and the indexes of the lists are numbers
+	Set map[string]string `json:"set,omitempty"`
+}
+
+const (
+	// PatchFormatJSON is the format of the JSON files
+	PatchFormatJSON = "json"
+	// PatchFormatYAML is the format of the YAML files
+	PatchFormatYAML = "yaml"
+)
+
+// Config holds the changes of the config of the image, the instructions of the Dockerfiles that add no layer
+type Config struct {
+	// Healthcheck replaces the HEALTHCHECK of the image
+	Healthcheck *Healthcheck `json:"healthcheck,omitempty"`
+	// StopSignal replaces the STOPSIGNAL of the image, e.g. "SIGTERM"
+	StopSignal string `json:"stopSignal,omitempty"`
+	// ExposedPorts are exposed in addition to the ports of the image, e.g. "8080" or "53/udp"
+	ExposedPorts []string `json:"exposedPorts,omitempty"`
+	// Volumes are added to the volumes of the image
+	Volumes []string `json:"volumes,omitempty"`
+}
+
+// Healthcheck holds the HEALTHCHECK of the image
+type Healthcheck struct {
+	// Test is the check, e.g. ["CMD", "curl", "-f", "http://localhost/"] or ["CMD-SHELL", "curl -f http://localhost/"],
+	// ["NONE"] disables the healthcheck of the base image
+	Test []string `json:"test"`
+	// Interval is the time between the checks, e.g. "30s"
+	Interval string `json:"interval,omitempty"`
+	// Timeout is the time after which a check is failed, e.g. "5s"
+	Timeout string `json:"timeout,omitempty"`
+	// StartPeriod is the time that the container is given to start before the failed checks are counted, e.g. "1m"
+	StartPeriod string `json:"startPeriod,omitempty"`
+	// Retries is the number of the consecutive failed checks for the container to be unhealthy
+	Retries int `json:"retries,omitempty"`
+}
+
+// User holds the user added to the /etc/passwd, /etc/group and /etc/shadow files of the base image without running commands,
+// so that the services added run as non-root in the base images lacking the user, the user of the image is not changed
+type User struct {
+	// Name is the name of the user
+	Name string `json:"name"`
+	// UID is the id of the user
+	UID int64 `json:"uid"`
+	// Group is the name of the primary group, defaults to the name of the user
+	Group string `json:"group,omitempty"`
+	// GID is the id of the primary group, defaults to the uid, the group of the base image with the id is used if there is one
+	GID *int64 `json:"gid,omitempty"`
+	// Home is the home directory added with the user as the owner, defaults to "/home/<name>"
+	Home string `json:"home,omitempty"`
+	// Shell is the login shell, defaults to "/sbin/nologin"
+	Shell string `json:"shell,omitempty"`
+}
+
+// TrustedCA holds the CA certificates added to the system trust stores of the base image,
+// the bundles of the Debian, Ubuntu, Alpine, RHEL, Fedora and SUSE layouts found in the base image are appended
+type TrustedCA struct {
+	// Sources are the URLs, the paths or the digests of the uploaded blobs of the PEM bundles
+	Sources []string `json:"sources,omitempty"`
+	// Certificates are the PEM certificates added with the ones of the sources
+	Certificates string `json:"certificates,omitempty"`
+}
+
+// Locale holds the timezone and the locale of the image, written to the files that the common distributions read
+// and set in the TZ and LANG environment variables
+type Locale struct {
+	// Timezone is the IANA name of the timezone, e.g. "Asia/Shanghai", /etc/localtime links to its file of /usr/share/zoneinfo
+	// and /etc/timezone has the name, the file is copied from the zoneinfo of jitdi if the base image has none
+	Timezone string `json:"timezone,omitempty"`
+	// Lang is the locale written to /etc/locale.conf and /etc/default/locale, e.g. "C.UTF-8",
+	// the base image must have the locale, it is not generated
+	Lang string `json:"lang,omitempty"`
+}
+
+// Binary holds the static binary added for the platform of each image built, e.g. tini or an agent
+type Binary struct {
+	// Sources maps the platforms to the URLs, the paths or the digests of the uploaded blobs of the binaries,
+	// the platforms are "<arch>", "<os>/<arch>" or "<os>/<arch>/<variant>", e.g. "amd64" or "linux/arm/v7", the most specific one wins
+	Sources map[string]string `json:"sources,omitempty"`
+	// Index is the reference of an OCI image index of artifacts instead of the sources, the binary is the single layer
+	// of the manifest of the platform, or its layer titled with the name of the destination
+	Index       string `json:"index,omitempty"`
+	Destination string `json:"destination"`
+	// Mode is the mode of the binary, defaults to "0755"
+	Mode string `json:"mode,omitempty"`
+	// Optional skips the platforms without a binary instead of failing the build
+	Optional bool `json:"optional,omitempty"`
 }
 
 // Ollama holds the ollama information
@@ -66,6 +407,26 @@ type Ollama struct {
 	WorkDir   string `json:"workDir"`
 }
 
+// HuggingFace holds the huggingface information
+type HuggingFace struct {
+	// Repo is the repository id as owner/name, e.g. "meta-llama/Llama-2-7b-hf"
+	Repo string `json:"repo"`
+	// Revision is the branch, tag or commit, defaults to "main"
+	Revision string `json:"revision,omitempty"`
+	// Token is used to access gated or private repositories, defaults to the HF_TOKEN environment variable
+	Token string `json:"token,omitempty"`
+	// Include only the files matching any of the glob patterns
+	Include []string `json:"include,omitempty"`
+	// Exclude the files matching any of the glob patterns
+	Exclude []string `json:"exclude,omitempty"`
+	// ChunkSize has no effect, each file of the repository is whole in its own layer.
+	//
+	// Deprecated: the files are no longer split into parts.
+	ChunkSize string `json:"chunkSize,omitempty"`
+	// WorkDir is the directory in the image that the repository is placed in
+	WorkDir string `json:"workDir"`
+}
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:object:root=true
 
@@ -0,0 +1,84 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ImagePrewarmKind is the kind for image prewarm.
+	ImagePrewarmKind = "ImagePrewarm"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +genclient
+// +genclient:nonNamespaced
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:rbac:groups=jitdi.zsm.io,resources=imageprewarms,verbs=get;list;watch
+// +kubebuilder:rbac:groups=jitdi.zsm.io,resources=imageprewarms/status,verbs=get;patch;update
+
+// ImagePrewarm is the Schema for the imageprewarms API,
+// the refs built ahead of time so that the first pulls do not wait for their builds
+type ImagePrewarm struct {
+	//+k8s:conversion-gen=false
+	metav1.TypeMeta `json:",inline"`
+	// Standard list metadata.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#metadata
+	metav1.ObjectMeta `json:"metadata"`
+	// Spec defines the desired state of ImagePrewarm
+	Spec ImagePrewarmSpec `json:"spec"`
+	// Status defines the observed state of ImagePrewarm
+	Status ImagePrewarmStatus `json:"status,omitempty"`
+}
+
+// ImagePrewarmSpec holds the specification for image prewarm
+type ImagePrewarmSpec struct {
+	// Images are the refs built, e.g. models/qwen:0.5b, they are built by the rules matching them
+	Images []string `json:"images"`
+	// Schedule is the cron schedule in the five fields of minute, hour, day of month, month and day of week,
+	// e.g. "0 3 * * *", that the images are built again on even if they are in the cache,
+	// they are only built if they are not in the cache if it is empty
+	Schedule string `json:"schedule,omitempty"`
+	// NodeSelector selects the nodes whose jitdi-agent pre-pulls the built images, none if it is empty
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// ImagePrewarmStatus holds status for image prewarm
+type ImagePrewarmStatus struct {
+	// ObservedGeneration is the generation of the spec whose images are built
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastScheduleTime is the last time the images were built by the schedule
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// Images are the results of the builds of the images
+	Images []PrewarmedImage `json:"images,omitempty"`
+	// Conditions holds conditions for image prewarm.
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// PrewarmedImage holds the result of the build of an image of the prewarm
+type PrewarmedImage struct {
+	// Image is the ref built
+	Image string `json:"image"`
+	// Digest is the digest of the built manifest, empty if the build failed
+	Digest string `json:"digest,omitempty"`
+	// Error is why the build failed
+	Error string `json:"error,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+
+// ImagePrewarmList is a list of ImagePrewarm.
+type ImagePrewarmList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []ImagePrewarm `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImagePrewarm{}, &ImagePrewarmList{})
+}
@@ -28,7 +28,9 @@ import (
 
 type ApisV1alpha1Interface interface {
 	RESTClient() rest.Interface
+	ClusterImageTemplatesGetter
 	ImagesGetter
+	ImagePrewarmsGetter
 }
 
 // ApisV1alpha1Client is used to interact with features provided by the apis group.
@@ -36,10 +38,18 @@ type ApisV1alpha1Client struct {
 	restClient rest.Interface
 }
 
+func (c *ApisV1alpha1Client) ClusterImageTemplates() ClusterImageTemplateInterface {
+	return newClusterImageTemplates(c)
+}
+
 func (c *ApisV1alpha1Client) Images() ImageInterface {
 	return newImages(c)
 }
 
+func (c *ApisV1alpha1Client) ImagePrewarms() ImagePrewarmInterface {
+	return newImagePrewarms(c)
+}
+
 // NewForConfig creates a new ApisV1alpha1Client for the given config.
 // NewForConfig is equivalent to NewForConfigAndClient(c, httpClient),
 // where httpClient was generated with rest.HTTPClientFor(c).
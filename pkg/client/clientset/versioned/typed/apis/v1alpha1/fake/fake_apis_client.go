@@ -28,10 +28,18 @@ type FakeApisV1alpha1 struct {
 	*testing.Fake
 }
 
+func (c *FakeApisV1alpha1) ClusterImageTemplates() v1alpha1.ClusterImageTemplateInterface {
+	return &FakeClusterImageTemplates{c}
+}
+
 func (c *FakeApisV1alpha1) Images() v1alpha1.ImageInterface {
 	return &FakeImages{c}
 }
 
+func (c *FakeApisV1alpha1) ImagePrewarms() v1alpha1.ImagePrewarmInterface {
+	return &FakeImagePrewarms{c}
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeApisV1alpha1) RESTClient() rest.Interface {
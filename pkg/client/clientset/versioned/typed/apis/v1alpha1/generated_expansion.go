@@ -18,4 +18,8 @@ limitations under the License.
 
 package v1alpha1
 
+type ClusterImageTemplateExpansion interface{}
+
 type ImageExpansion interface{}
+
+type ImagePrewarmExpansion interface{}
@@ -0,0 +1,325 @@
+package cloudauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// ecrRegistryRegexp matches the registries of ECR, with their account, their region and the suffix of the partition of China.
+var ecrRegistryRegexp = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// awsCredentials are the credentials of AWS that the requests to its APIs are signed with.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// resolveECR returns the credentials of ECR of the authorization token of the registry.
+func resolveECR(ctx context.Context, client *http.Client, registry string) (credentials, error) {
+	m := ecrRegistryRegexp.FindStringSubmatch(registry)
+	if m == nil {
+		return credentials{}, fmt.Errorf("%q is not a registry of ECR", registry)
+	}
+	account, region, domain := m[1], m[2], "amazonaws.com"+m[3]
+
+	creds, err := awsCredentialsOf(ctx, client, region, domain)
+	if err != nil {
+		return credentials{}, fmt.Errorf("aws credentials: %w", err)
+	}
+
+	body := []byte(`{"registryIds":["` + account + `"]}`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.ecr."+region+"."+domain+"/", bytes.NewReader(body))
+	if err != nil {
+		return credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken")
+	signV4(req, body, creds, region, "ecr", time.Now())
+
+	var out struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"`
+		} `json:"authorizationData"`
+	}
+	err = getJSON(client, req, &out)
+	if err != nil {
+		return credentials{}, err
+	}
+	if len(out.AuthorizationData) == 0 {
+		return credentials{}, fmt.Errorf("no authorization token of %s", registry)
+	}
+	data := out.AuthorizationData[0]
+	raw, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+	if err != nil {
+		return credentials{}, fmt.Errorf("decode the authorization token: %w", err)
+	}
+	username, password, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return credentials{}, fmt.Errorf("invalid authorization token of %s", registry)
+	}
+	return credentials{
+		auth: authn.AuthConfig{
+			Username: username,
+			Password: password,
+		},
+		expiry: time.Unix(int64(data.ExpiresAt), 0),
+	}, nil
+}
+
+// awsCredentialsOf returns the credentials of AWS of the environment like the SDKs of AWS, in the order of
+// the static ones of $AWS_ACCESS_KEY_ID, the ones of the web identity of IRSA, the ones of the container of EKS Pod Identity and ECS,
+// and the ones of the instance profile.
+func awsCredentialsOf(ctx context.Context, client *http.Client, region, domain string) (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if file := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); file != "" {
+		return awsWebIdentityCredentials(ctx, client, file, region, domain)
+	}
+	if u := awsContainerCredentialsURL(); u != "" {
+		return awsContainerCredentials(ctx, client, u)
+	}
+	return awsInstanceCredentials(ctx, client)
+}
+
+// awsWebIdentityCredentials returns the credentials of the role of $AWS_ROLE_ARN assumed with the web identity token of the file.
+func awsWebIdentityCredentials(ctx context.Context, client *http.Client, file, region, domain string) (awsCredentials, error) {
+	token, err := os.ReadFile(file)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("read the web identity token: %w", err)
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "jitdi"
+	}
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		region = r
+	}
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://sts."+region+"."+domain+"/", strings.NewReader(query.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, responseError(req, resp)
+	}
+	var out struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string `xml:"SecretAccessKey"`
+			SessionToken    string `xml:"SessionToken"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	err = xml.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&out)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("decode the response of %s: %w", req.URL.Redacted(), err)
+	}
+	return awsCredentials{
+		AccessKeyID:     out.Credentials.AccessKeyID,
+		SecretAccessKey: out.Credentials.SecretAccessKey,
+		SessionToken:    out.Credentials.SessionToken,
+	}, nil
+}
+
+// awsContainerCredentialsURL returns the url of the credentials of the container of EKS Pod Identity or ECS, or empty if it has none.
+func awsContainerCredentialsURL() string {
+	if u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); u != "" {
+		return u
+	}
+	if p := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); p != "" {
+		return "http://169.254.170.2" + p
+	}
+	return ""
+}
+
+// awsCredentialsResponse is the response of the credentials of the containers and the instances.
+type awsCredentialsResponse struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+func (r awsCredentialsResponse) credentials() awsCredentials {
+	return awsCredentials{
+		AccessKeyID:     r.AccessKeyID,
+		SecretAccessKey: r.SecretAccessKey,
+		SessionToken:    r.Token,
+	}
+}
+
+// awsContainerCredentials returns the credentials of the container from the url,
+// authorized with the token of $AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE or $AWS_CONTAINER_AUTHORIZATION_TOKEN.
+func awsContainerCredentials(ctx context.Context, client *http.Client, u string) (awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("read the container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(raw))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	var out awsCredentialsResponse
+	err = getJSON(client, req, &out)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	return out.credentials(), nil
+}
+
+// awsInstanceCredentials returns the credentials of the instance profile from the instance metadata service, with IMDSv2.
+func awsInstanceCredentials(ctx context.Context, client *http.Client) (awsCredentials, error) {
+	const imds = "http://169.254.169.254"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imds+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	token, err := readAll(client, req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance metadata token: %w", err)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, imds+"/latest/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	role, err := readAll(client, req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance profile: %w", err)
+	}
+	role, _, _ = strings.Cut(strings.TrimSpace(role), "\n")
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, imds+"/latest/meta-data/iam/security-credentials/"+url.PathEscape(role), nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	var out awsCredentialsResponse
+	err = getJSON(client, req, &out)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	return out.credentials(), nil
+}
+
+// readAll sends the request and returns the body of its response.
+func readAll(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(req, resp)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// signV4 signs the request of the body to the service in the region with the Signature Version 4 of AWS,
+// over its host and all its headers.
+func signV4(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalPath := req.URL.EscapedPath()
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+	// The values are escaped like url.QueryEscape, but with %20 for the spaces.
+	canonicalQuery := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,121 @@
+package cloudauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+const (
+	// azureManagementScope is the scope of the tokens of Azure AD that ACR exchanges for its refresh tokens.
+	azureManagementScope = "https://management.azure.com/"
+
+	// acrUsername is the user name of the refresh tokens of ACR.
+	acrUsername = "00000000-0000-0000-0000-000000000000"
+)
+
+// resolveACR returns the credentials of ACR of the refresh token exchanged for the token of Azure AD of the identity of jitdi.
+func resolveACR(ctx context.Context, client *http.Client, registry string) (credentials, error) {
+	aadToken, expiry, err := azureToken(ctx, client)
+	if err != nil {
+		return credentials{}, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"access_token": {aadToken},
+	}
+	if tenant := os.Getenv("AZURE_TENANT_ID"); tenant != "" {
+		form.Set("tenant", tenant)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+registry+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err = getJSON(client, req, &exchange)
+	if err != nil {
+		return credentials{}, err
+	}
+	if exchange.RefreshToken == "" {
+		return credentials{}, fmt.Errorf("no refresh token from %s", registry)
+	}
+	return credentials{
+		auth: authn.AuthConfig{
+			Username: acrUsername,
+			Password: exchange.RefreshToken,
+		},
+		expiry: expiry,
+	}, nil
+}
+
+// azureToken returns the token of Azure AD of Workload Identity if its federated token file is set,
+// or else the one of Managed Identity, of the client id of $AZURE_CLIENT_ID if it is set.
+func azureToken(ctx context.Context, client *http.Client) (string, time.Time, error) {
+	var req *http.Request
+	var err error
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	if file := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); file != "" {
+		assertion, err := os.ReadFile(file)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("read the federated token: %w", err)
+		}
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = "https://login.microsoftonline.com/"
+		}
+		form := url.Values{
+			"client_id":             {clientID},
+			"scope":                 {azureManagementScope + ".default"},
+			"grant_type":            {"client_credentials"},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		}
+		u := strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(os.Getenv("AZURE_TENANT_ID")) + "/oauth2/v2.0/token"
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := url.Values{
+			"api-version": {"2018-02-01"},
+			"resource":    {azureManagementScope},
+		}
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		// ExpiresIn is a number from Azure AD and a string from the instance metadata service.
+		ExpiresIn json.Number `json:"expires_in"`
+	}
+	err = getJSON(client, req, &token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("no access token from %s", req.URL.Host)
+	}
+	expiresIn, _ := token.ExpiresIn.Int64()
+	return token.AccessToken, time.Now().Add(time.Duration(expiresIn) * time.Second), nil
+}
@@ -0,0 +1,181 @@
+// Package cloudauth resolves the credentials of the registries of the clouds from the ambient identities of jitdi,
+// e.g. IRSA or EKS Pod Identity for ECR, Workload Identity or the service account of the instance for GCR and Artifact Registry,
+// and Workload Identity or Managed Identity for ACR, so that no static secret is needed to pull from them.
+package cloudauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+const (
+	// resolveTimeout is how long the credentials of a registry are waited for.
+	resolveTimeout = 30 * time.Second
+
+	// expiryMargin is how long before their expiry the credentials are renewed.
+	expiryMargin = 5 * time.Minute
+
+	// maxResponseSize is the size of the responses of the clouds read at most.
+	maxResponseSize = 1 << 20
+)
+
+// Provider is the cloud whose ambient identity the credentials of a registry are resolved from.
+type Provider string
+
+const (
+	// ECR resolves the credentials of Amazon ECR from the AWS credentials of the environment, IRSA, EKS Pod Identity or the instance profile.
+	ECR Provider = "ecr"
+	// GCR resolves the credentials of Google Container Registry and Artifact Registry from the service account of the metadata server,
+	// which is the one of Workload Identity on GKE.
+	GCR Provider = "gcr"
+	// ACR resolves the credentials of Azure Container Registry from Workload Identity or Managed Identity.
+	ACR Provider = "acr"
+)
+
+// credentials are the credentials of a registry until their expiry.
+type credentials struct {
+	auth   authn.AuthConfig
+	expiry time.Time
+}
+
+type resolver func(ctx context.Context, client *http.Client, registry string) (credentials, error)
+
+var resolvers = map[Provider]resolver{
+	ECR: resolveECR,
+	GCR: resolveGCR,
+	ACR: resolveACR,
+}
+
+// host is a glob of the registries whose credentials are resolved from the provider.
+type host struct {
+	pattern  string
+	provider Provider
+}
+
+// Keychain resolves the credentials of the registries matching its globs from the ambient identities,
+// the other registries are anonymous to it, so that it is used before the keychain of the config.json.
+type Keychain struct {
+	hosts  []host
+	client *http.Client
+
+	mut   sync.Mutex
+	cache map[string]credentials
+}
+
+// NewKeychain returns the keychain of the providers of the globs of the registries, e.g. "*.dkr.ecr.*.amazonaws.com" = ECR,
+// the requests to the clouds are sent with the transport. The registries matched exactly are preferred,
+// then the globs of the longest patterns.
+func NewKeychain(hosts map[string]Provider, rt http.RoundTripper) (*Keychain, error) {
+	k := &Keychain{
+		client: &http.Client{Transport: rt},
+		cache:  map[string]credentials{},
+	}
+	for pattern, provider := range hosts {
+		if _, ok := resolvers[provider]; !ok {
+			return nil, fmt.Errorf("registry %q: unknown provider %q, must be %q, %q or %q", pattern, provider, ECR, GCR, ACR)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("registry %q: %w", pattern, err)
+		}
+		k.hosts = append(k.hosts, host{pattern: strings.ToLower(pattern), provider: provider})
+	}
+	sort.Slice(k.hosts, func(i, j int) bool {
+		if len(k.hosts[i].pattern) != len(k.hosts[j].pattern) {
+			return len(k.hosts[i].pattern) > len(k.hosts[j].pattern)
+		}
+		return k.hosts[i].pattern < k.hosts[j].pattern
+	})
+	return k, nil
+}
+
+// Provider returns the provider of the registry, it reports false if no glob matches the registry.
+func (k *Keychain) Provider(registry string) (Provider, bool) {
+	registry = strings.ToLower(registry)
+	for _, h := range k.hosts {
+		if h.pattern == registry {
+			return h.provider, true
+		}
+	}
+	for _, h := range k.hosts {
+		if ok, _ := path.Match(h.pattern, registry); ok {
+			return h.provider, true
+		}
+	}
+	return "", false
+}
+
+// Resolve returns the authenticator of the registry of the target, whose credentials are resolved when they are first used.
+func (k *Keychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	registry := target.RegistryStr()
+	provider, ok := k.Provider(registry)
+	if !ok {
+		return authn.Anonymous, nil
+	}
+	return &authenticator{keychain: k, provider: provider, registry: registry}, nil
+}
+
+// credentials returns the credentials of the registry, from the cache until they expire.
+func (k *Keychain) credentials(provider Provider, registry string) (authn.AuthConfig, error) {
+	key := string(provider) + "/" + registry
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	if c, ok := k.cache[key]; ok && time.Now().Add(expiryMargin).Before(c.expiry) {
+		return c.auth, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	c, err := resolvers[provider](ctx, k.client, registry)
+	if err != nil {
+		return authn.AuthConfig{}, fmt.Errorf("resolve %s credentials of %s: %w", provider, registry, err)
+	}
+	k.cache[key] = c
+	return c.auth, nil
+}
+
+type authenticator struct {
+	keychain *Keychain
+	provider Provider
+	registry string
+}
+
+func (a *authenticator) Authorization() (*authn.AuthConfig, error) {
+	auth, err := a.keychain.credentials(a.provider, a.registry)
+	if err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+// getJSON sends the request and decodes the JSON of its response into the out.
+func getJSON(client *http.Client, req *http.Request, out any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(req, resp)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(out)
+	if err != nil {
+		return fmt.Errorf("decode the response of %s: %w", req.URL.Redacted(), err)
+	}
+	return nil
+}
+
+// responseError returns the error of the response of the request, with the start of its body.
+func responseError(req *http.Request, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s %s: status code %d: %s", req.Method, req.URL.Redacted(), resp.StatusCode, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,44 @@
+package cloudauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// resolveGCR returns the credentials of GCR and Artifact Registry of the access token of the service account of the metadata server,
+// which is reached at $GCE_METADATA_HOST if it is set.
+func resolveGCR(ctx context.Context, client *http.Client, registry string) (credentials, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return credentials{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = getJSON(client, req, &token)
+	if err != nil {
+		return credentials{}, err
+	}
+	if token.AccessToken == "" {
+		return credentials{}, fmt.Errorf("no access token from the metadata server")
+	}
+	return credentials{
+		auth: authn.AuthConfig{
+			Username: "oauth2accesstoken",
+			Password: token.AccessToken,
+		},
+		expiry: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
@@ -0,0 +1,130 @@
+// Package credhelper resolves the credentials of the registries with the commands of the credential helper protocol of docker,
+// like the docker-credential-* ones, so that any auth system can provide the credentials of the upstream pulls.
+//
+// The command is run with the argument get and the registry on its stdin, and writes the credentials as JSON on its stdout:
+//
+//	{"Username": "<user>", "Secret": "<password>"}
+//
+// The Username <token> makes the Secret an identity token, and a failure whose output contains "credentials not found"
+// leaves the registry anonymous.
+package credhelper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// runTimeout is how long a command is waited for.
+const runTimeout = 30 * time.Second
+
+// helper is a glob of the registries and the command of their credentials.
+type helper struct {
+	pattern string
+	command []string
+}
+
+// Keychain resolves the credentials of the registries matching its globs with their commands,
+// the other registries are anonymous to it.
+type Keychain struct {
+	helpers []helper
+}
+
+// NewKeychain returns the keychain of the commands of the globs of the registries, e.g. "*.corp.example" = "/usr/local/bin/corp-auth --ci",
+// the commands are split on the spaces. The registries matched exactly are preferred, then the globs of the longest patterns.
+func NewKeychain(helpers map[string]string) (*Keychain, error) {
+	k := &Keychain{}
+	for pattern, command := range helpers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("registry %q: %w", pattern, err)
+		}
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("registry %q: empty command", pattern)
+		}
+		k.helpers = append(k.helpers, helper{pattern: strings.ToLower(pattern), command: args})
+	}
+	sort.Slice(k.helpers, func(i, j int) bool {
+		if len(k.helpers[i].pattern) != len(k.helpers[j].pattern) {
+			return len(k.helpers[i].pattern) > len(k.helpers[j].pattern)
+		}
+		return k.helpers[i].pattern < k.helpers[j].pattern
+	})
+	return k, nil
+}
+
+// command returns the command of the registry, or nil if no glob matches the registry.
+func (k *Keychain) command(registry string) []string {
+	registry = strings.ToLower(registry)
+	for _, h := range k.helpers {
+		if h.pattern == registry {
+			return h.command
+		}
+	}
+	for _, h := range k.helpers {
+		if ok, _ := path.Match(h.pattern, registry); ok {
+			return h.command
+		}
+	}
+	return nil
+}
+
+// Resolve returns the authenticator of the registry of the target, whose command is run when its credentials are used.
+func (k *Keychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	command := k.command(target.RegistryStr())
+	if command == nil {
+		return authn.Anonymous, nil
+	}
+	serverURL := target.RegistryStr()
+	if serverURL == name.DefaultRegistry {
+		serverURL = authn.DefaultAuthKey
+	}
+	return &authenticator{command: command, serverURL: serverURL}, nil
+}
+
+type authenticator struct {
+	command   []string
+	serverURL string
+}
+
+func (a *authenticator) Authorization() (*authn.AuthConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), runTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, a.command[0], append(a.command[1:], "get")...)
+	cmd.Stdin = strings.NewReader(a.serverURL)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		output := strings.TrimSpace(stdout.String() + " " + stderr.String())
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && strings.Contains(strings.ToLower(output), "credentials not found") {
+			return &authn.AuthConfig{}, nil
+		}
+		return nil, fmt.Errorf("credential helper %s for %s: %w: %s", a.command[0], a.serverURL, err, output)
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &creds)
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s for %s: decode its output: %w", a.command[0], a.serverURL, err)
+	}
+	if creds.Username == "<token>" {
+		return &authn.AuthConfig{IdentityToken: creds.Secret}, nil
+	}
+	return &authn.AuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
@@ -0,0 +1,464 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/metadata"
+)
+
+// AdminHandler returns the handler of the admin API served under /admin/.
+func (h *Handler) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/builds", h.adminListBuilds)
+	mux.HandleFunc("POST /admin/builds", h.adminStartBuild)
+	mux.HandleFunc("GET /admin/builds/{id}", h.adminGetBuild)
+	mux.HandleFunc("GET /admin/builds/{id}/logs", h.adminGetBuildLogs)
+	mux.HandleFunc("POST /admin/gc", h.adminGC)
+	mux.HandleFunc("GET /admin/check", h.adminCheck)
+	mux.HandleFunc("GET /admin/match", h.adminMatch)
+	mux.HandleFunc("POST /admin/dry-run", h.adminDryRun)
+	mux.HandleFunc("GET /admin/diff", h.adminDiff)
+	mux.HandleFunc("GET /admin/usage", h.adminUsage)
+	mux.HandleFunc("GET /admin/observability/grafana-dashboard", h.adminGrafanaDashboard)
+	mux.HandleFunc("GET /admin/observability/prometheus-rules", h.adminPrometheusRules)
+	mux.HandleFunc("GET /admin/tags", h.adminListTags)
+	mux.HandleFunc("GET /admin/export", h.adminExport)
+	mux.HandleFunc("DELETE /admin/tags", h.adminInvalidate)
+	mux.HandleFunc("POST /admin/tags/rollback", h.adminRollback)
+	mux.HandleFunc("GET /admin/rules", h.adminListRules)
+	mux.HandleFunc("GET /admin/rules/{name}", h.adminGetRule)
+	mux.HandleFunc("PUT /admin/rules/{name}", h.adminPutRule)
+	mux.HandleFunc("DELETE /admin/rules/{name}", h.adminDeleteRule)
+	mux.HandleFunc("GET /admin/openapi.json", h.adminOpenAPI)
+	mux.HandleFunc("GET "+uiPath, h.serveUI)
+	mux.HandleFunc("POST "+uiLoginPath, h.uiLogin)
+	return h.adminAuth(mux)
+}
+
+// adminAuth requires the admin token for the admin and peer APIs,
+// which are disabled without an admin token instead of being served unauthenticated.
+func (h *Handler) adminAuth(next http.Handler) http.Handler {
+	if h.adminToken == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "disabled without an admin token", http.StatusForbidden)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAdmin(r) {
+			if r.URL.Path == uiLoginPath && r.Method == http.MethodPost {
+				h.uiLogin(w, r)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, uiPath) && r.Method == http.MethodGet {
+				serveUILogin(w, false)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="jitdi-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether the request carries the admin token as a bearer token, or in the cookie set by the UI.
+// It is always false without an admin token.
+func (h *Handler) isAdmin(r *http.Request) bool {
+	if h.adminToken == "" {
+		return false
+	}
+	want := []byte("Bearer " + h.adminToken)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) == 1 {
+		return true
+	}
+	cookie, err := r.Cookie(uiTokenCookie)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte("Bearer "+cookie.Value), want) == 1
+}
+
+func (h *Handler) adminListBuilds(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.adminStreamBuilds(w, r)
+		return
+	}
+	serveJSON(w, h.builds.List())
+}
+
+// adminStreamBuilds sends a server-sent event every time a build is started or its progress changes.
+func (h *Handler) adminStreamBuilds(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	sent := map[string]string{}
+	for {
+		for _, build := range h.builds.List() {
+			data, err := json.Marshal(build)
+			if err != nil {
+				slog.Error("json.Marshal", "err", err)
+				return
+			}
+			if sent[build.ID] == string(data) {
+				continue
+			}
+			sent[build.ID] = string(data)
+			_, err = fmt.Fprintf(w, "event: build\nid: %s\ndata: %s\n\n", build.ID, data)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Handler) adminGetBuild(w http.ResponseWriter, r *http.Request) {
+	record, ok := h.builds.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "build not found", http.StatusNotFound)
+		return
+	}
+	serveJSON(w, record.Build())
+}
+
+func (h *Handler) adminGetBuildLogs(w http.ResponseWriter, r *http.Request) {
+	record, ok := h.builds.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "build not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range record.Logs() {
+		_, _ = w.Write([]byte(line + "\n"))
+	}
+}
+
+// adminStartBuild builds the ref in the background even if it is in the cache,
+// and returns the build to be followed by its id.
+func (h *Handler) adminStartBuild(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly {
+		http.Error(w, "the cache is read-only", http.StatusForbidden)
+		return
+	}
+	ref, ok := adminRef(w, r)
+	if !ok {
+		return
+	}
+	i := strings.LastIndex(ref, ":")
+	image, tag := ref[:i], ref[i+1:]
+	if h.matchRule(image, tag) == nil {
+		http.Error(w, fmt.Sprintf("no rule matches %q", ref), http.StatusNotFound)
+		return
+	}
+
+	record := h.startBuild(image, tag)
+	if record == nil {
+		http.Error(w, fmt.Sprintf("no rule matches %q", ref), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Location", "/admin/builds/"+record.Build().ID)
+	w.WriteHeader(http.StatusAccepted)
+	serveJSON(w, record.Build())
+}
+
+// InvalidateResult is the tag removed from the cache, with its build if it is built again.
+type InvalidateResult struct {
+	Ref     string `json:"ref"`
+	Deleted bool   `json:"deleted"`
+	Build   *Build `json:"build,omitempty"`
+}
+
+// adminInvalidate removes the tag of the ref from the cache so that it is built again on the next pull,
+// or right away with rebuild=true.
+func (h *Handler) adminInvalidate(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly {
+		http.Error(w, "the cache is read-only", http.StatusForbidden)
+		return
+	}
+	ref, ok := adminRef(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := h.Invalidate(r.Context(), ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := InvalidateResult{
+		Ref:     ref,
+		Deleted: deleted,
+	}
+	if rebuild, _ := strconv.ParseBool(r.URL.Query().Get("rebuild")); rebuild {
+		if record := h.startBuild(splitRef(ref)); record != nil {
+			build := record.Build()
+			result.Build = &build
+		}
+	}
+	serveJSON(w, result)
+}
+
+func (h *Handler) adminGC(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly {
+		http.Error(w, "the cache is read-only", http.StatusForbidden)
+		return
+	}
+	result, err := h.GC(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveJSON(w, result)
+}
+
+func (h *Handler) adminCheck(w http.ResponseWriter, r *http.Request) {
+	inconsistencies, err := h.image.Check()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveJSON(w, inconsistencies)
+}
+
+// MatchResult is the result of matching a reference against the rules.
+type MatchResult struct {
+	Ref       string            `json:"ref"`
+	Rule      string            `json:"rule,omitempty"`
+	Evaluated []RuleEvaluation  `json:"evaluated"`
+	Params    map[string]string `json:"params,omitempty"`
+	BaseImage string            `json:"baseImage,omitempty"`
+	Mutates   []v1alpha1.Mutate `json:"mutates,omitempty"`
+}
+
+// RuleEvaluation is a rule evaluated in the order of the matching.
+type RuleEvaluation struct {
+	Rule    string `json:"rule"`
+	Pattern string `json:"pattern"`
+	Matched bool   `json:"matched"`
+}
+
+// adminMatch reports which rule matches the ref, the mutates are rendered for the platform, linux/amd64 by default.
+func (h *Handler) adminMatch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ref, ok := adminRef(w, r)
+	if !ok {
+		return
+	}
+
+	var platform *v1.Platform
+	if p := query.Get("platform"); p != "" {
+		var err error
+		platform, err = v1.ParsePlatform(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result := MatchResult{
+		Ref:       ref,
+		Evaluated: []RuleEvaluation{},
+	}
+	for _, rule := range h.getRules() {
+		action, ok := rule.Match(ref)
+		result.Evaluated = append(result.Evaluated, RuleEvaluation{
+			Rule:    rule.Name(),
+			Pattern: rule.Pattern(),
+			Matched: ok,
+		})
+		if !ok {
+			continue
+		}
+		result.Rule = rule.Name()
+		result.Params = action.Params()
+		result.BaseImage = action.GetBaseImage()
+		result.Mutates = redactMutates(action.GetMutates(platform))
+		break
+	}
+	serveJSON(w, result)
+}
+
+// adminDryRun returns the manifests that would be built for the ref without building them.
+func (h *Handler) adminDryRun(w http.ResponseWriter, r *http.Request) {
+	ref, ok := adminRef(w, r)
+	if !ok {
+		return
+	}
+
+	for _, rule := range h.getRules() {
+		action, ok := rule.Match(ref)
+		if !ok {
+			continue
+		}
+		result, err := h.image.DryRun(r.Context(), ref, action)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		serveJSON(w, result)
+		return
+	}
+	http.Error(w, fmt.Sprintf("no rule matches %q", ref), http.StatusNotFound)
+}
+
+// adminDiff reports what was changed in the built image of the ref from its base image,
+// for the platform of the query, linux/amd64 by default.
+func (h *Handler) adminDiff(w http.ResponseWriter, r *http.Request) {
+	ref, ok := adminRef(w, r)
+	if !ok {
+		return
+	}
+
+	platform := defaultPlatform
+	if p := r.URL.Query().Get("platform"); p != "" {
+		parsed, err := v1.ParsePlatform(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		platform = *parsed
+	}
+
+	i := strings.LastIndex(ref, ":")
+	image, tag := ref[:i], ref[i+1:]
+	for _, rule := range h.getRules() {
+		action, ok := rule.Match(ref)
+		if !ok {
+			continue
+		}
+		result, err := h.image.Diff(r.Context(), image, tag, action, platform)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, fmt.Sprintf("%q is not built yet", ref), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		serveJSON(w, result)
+		return
+	}
+	http.Error(w, fmt.Sprintf("no rule matches %q", ref), http.StatusNotFound)
+}
+
+// adminUsage reports the disk usage of the cache with the top repositories by size, 10 by default.
+func (h *Handler) adminUsage(w http.ResponseWriter, r *http.Request) {
+	top := 10
+	if t := r.URL.Query().Get("top"); t != "" {
+		var err error
+		top, err = strconv.Atoi(t)
+		if err != nil || top < 0 {
+			http.Error(w, fmt.Sprintf("invalid top %q", t), http.StatusBadRequest)
+			return
+		}
+	}
+
+	usage, err := h.usage.get(h.image)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := *usage
+	if top != 0 && len(result.Repositories) > top {
+		result.Repositories = result.Repositories[:top]
+	}
+	serveJSON(w, result)
+}
+
+// TagInfo is a built tag of the metadata index,
+// it is stale if the rule it was built by has been changed or no longer matches it.
+type TagInfo struct {
+	metadata.Tag
+	Stale bool `json:"stale"`
+	// Size is the size of the blobs of the tag in the cache, the blobs shared with other tags included.
+	Size int64 `json:"size"`
+}
+
+// adminListTags lists the built tags, only the stale ones with stale=true.
+func (h *Handler) adminListTags(w http.ResponseWriter, r *http.Request) {
+	onlyStale := r.URL.Query().Get("stale") == "true"
+	tags, err := h.image.index.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	infos := make([]TagInfo, 0, len(tags))
+	for _, tag := range tags {
+		info := TagInfo{
+			Tag:   tag,
+			Stale: h.isStale(tag),
+		}
+		if onlyStale && !info.Stale {
+			continue
+		}
+		for _, blob := range tag.Blobs {
+			if stat, err := os.Stat(h.image.BlobsPath(blob)); err == nil {
+				info.Size += stat.Size()
+			}
+		}
+		infos = append(infos, info)
+	}
+	serveJSON(w, infos)
+}
+
+// isStale reports whether the rule the tag was built by has been changed, the tags indexed without their rule are never stale.
+func (h *Handler) isStale(tag metadata.Tag) bool {
+	if tag.RuleHash == "" {
+		return false
+	}
+	rule := h.matchRule(tag.Image, tag.Tag)
+	return rule == nil || rule.Hash() != tag.RuleHash
+}
+
+// adminRef returns the ref of the query, with the latest tag if it has none.
+func adminRef(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		http.Error(w, "ref is required", http.StatusBadRequest)
+		return "", false
+	}
+	if !strings.Contains(path.Base(ref), ":") {
+		ref += ":latest"
+	}
+	return ref, true
+}
+
+func serveJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		slog.Error("json.Encode", "err", err)
+	}
+}
@@ -0,0 +1,352 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+const (
+	// RuleSourceConfig is the source of the rules of the config file, which can not be managed by the rules API.
+	RuleSourceConfig = "config"
+	// RuleSourceKubernetes is the source of the rules stored as the Images of the cluster.
+	RuleSourceKubernetes = "kubernetes"
+	// RuleSourceLocal is the source of the rules stored in the cache when jitdi runs outside of Kubernetes.
+	RuleSourceLocal = "local"
+	// RuleSourceDirectory is the source of the rules of the files of the rules directory, which can not be managed by the rules API.
+	RuleSourceDirectory = "directory"
+	// RuleSourceTenant is the source of the rules of the tenants, which can not be managed by the rules API.
+	RuleSourceTenant = "tenant"
+	// RuleSourceUpstream is the source of the rules of the upstream prefixes, which can not be managed by the rules API.
+	RuleSourceUpstream = "upstream"
+)
+
+// RuleInfo is a rule in the order the refs are matched against, with its spec composed onto the ones of the rules it extends.
+type RuleInfo struct {
+	Name            string             `json:"name"`
+	Source          string             `json:"source"`
+	ResourceVersion string             `json:"resourceVersion,omitempty"`
+	Pattern         string             `json:"pattern"`
+	Hash            string             `json:"hash"`
+	Spec            v1alpha1.ImageSpec `json:"spec"`
+}
+
+func (h *Handler) adminListRules(w http.ResponseWriter, r *http.Request) {
+	serveJSON(w, h.ruleInfos())
+}
+
+// ruleInfos returns the rules in the order the refs are matched against, without the tokens of their specs.
+func (h *Handler) ruleInfos() []RuleInfo {
+	rules := h.getRules()
+	infos := make([]RuleInfo, 0, len(rules))
+	for _, rule := range rules {
+		image := rule.Image()
+		infos = append(infos, RuleInfo{
+			Name:            rule.Name(),
+			Source:          h.ruleSource(rule),
+			ResourceVersion: image.ResourceVersion,
+			Pattern:         rule.Pattern(),
+			Hash:            rule.Hash(),
+			Spec:            redactSpec(*rule.Spec()),
+		})
+	}
+	return infos
+}
+
+func (h *Handler) ruleSource(rule *pattern.Rule) string {
+	if h.ruleTenant(rule) != nil {
+		return RuleSourceTenant
+	}
+	if h.isUpstreamPrefixRule(rule) {
+		return RuleSourceUpstream
+	}
+	for _, r := range h.rules {
+		if r == rule {
+			return RuleSourceConfig
+		}
+	}
+	if h.rulesDir != nil && h.rulesDir.Contains(rule.Image()) {
+		return RuleSourceDirectory
+	}
+	if h.localRules != nil {
+		return RuleSourceLocal
+	}
+	return RuleSourceKubernetes
+}
+
+// fixedRule returns where the rule of the name is defined if it can not be managed by the rules API.
+func (h *Handler) fixedRule(name string) (string, bool) {
+	for _, r := range h.getRules() {
+		if r.Name() != name {
+			continue
+		}
+		switch h.ruleSource(r) {
+		case RuleSourceConfig:
+			return "config file", true
+		case RuleSourceDirectory:
+			return "rules directory", true
+		case RuleSourceTenant:
+			return "tenants file", true
+		case RuleSourceUpstream:
+			return "upstream prefixes", true
+		}
+	}
+	// The templates are not rules of their own.
+	for _, image := range h.config {
+		if image.Name != name || !pattern.IsTemplate(image) {
+			continue
+		}
+		if h.tenants != nil && h.tenants.images[image] != nil {
+			return "tenants file", true
+		}
+		return "config file", true
+	}
+	return "", false
+}
+
+// adminGetRule returns the Image of the rule, with its resource version as the ETag.
+func (h *Handler) adminGetRule(w http.ResponseWriter, r *http.Request) {
+	image, err := h.ruleStore.Get(r.Context(), r.PathValue("name"))
+	if err != nil {
+		ruleError(w, err)
+		return
+	}
+	serveRule(w, http.StatusOK, image)
+}
+
+// adminPutRule creates or replaces the rule with the Image of the body,
+// the write is conditional to the resource version of If-Match, and If-None-Match: * only creates it.
+func (h *Handler) adminPutRule(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly {
+		http.Error(w, "the cache is read-only", http.StatusForbidden)
+		return
+	}
+	name := r.PathValue("name")
+	if source, ok := h.fixedRule(name); ok {
+		http.Error(w, fmt.Sprintf("rule %q is defined by the %s", name, source), http.StatusConflict)
+		return
+	}
+
+	var image v1alpha1.Image
+	err := json.NewDecoder(r.Body).Decode(&image)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if image.Name != "" && image.Name != name {
+		http.Error(w, fmt.Sprintf("the name %q of the rule does not match the path", image.Name), http.StatusBadRequest)
+		return
+	}
+	image.Name = name
+	image.APIVersion = v1alpha1.GroupVersion.String()
+	image.Kind = v1alpha1.ImageKind
+	image.Status = v1alpha1.ImageStatus{}
+	image.ResourceVersion = etagValue(r.Header.Get("If-Match"))
+	rule, err := pattern.NewRule(&image)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(image.Spec.Extends) != 0 || len(image.Spec.Templates) != 0 {
+		// The rules extended and the templates must exist, and the rules extended must not extend the rule back.
+		var bases []*v1alpha1.Image
+		for _, other := range h.dynamicImages() {
+			if other.Name != name {
+				bases = append(bases, other)
+			}
+		}
+		h.crMut.Lock()
+		templates := h.templates()
+		h.crMut.Unlock()
+		rules := pattern.NewRules([]*v1alpha1.Image{&image}, append(bases, h.config...), templates, func(_ *v1alpha1.Image, e error) {
+			err = e
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, composed := range rules {
+			if composed.Image() == &image {
+				rule = composed
+			}
+		}
+	}
+	err = h.checkAdminRule(rule.Spec())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	status := http.StatusOK
+	var stored *v1alpha1.Image
+	if r.Header.Get("If-None-Match") == "*" {
+		status = http.StatusCreated
+		stored, err = h.ruleStore.Create(r.Context(), &image)
+	} else {
+		stored, err = h.ruleStore.Update(r.Context(), &image)
+		if errors.Is(err, errRuleNotFound) && image.ResourceVersion == "" {
+			status = http.StatusCreated
+			stored, err = h.ruleStore.Create(r.Context(), &image)
+		}
+	}
+	if err != nil {
+		ruleError(w, err)
+		return
+	}
+	h.resetCR()
+	loggerFrom(r.Context()).Info("rule stored", "rule", name, "resourceVersion", stored.ResourceVersion)
+	serveRule(w, status, stored)
+}
+
+// adminDeleteRule removes the rule, conditionally to the resource version of If-Match.
+func (h *Handler) adminDeleteRule(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly {
+		http.Error(w, "the cache is read-only", http.StatusForbidden)
+		return
+	}
+	name := r.PathValue("name")
+	if source, ok := h.fixedRule(name); ok {
+		http.Error(w, fmt.Sprintf("rule %q is defined by the %s", name, source), http.StatusConflict)
+		return
+	}
+
+	err := h.ruleStore.Delete(r.Context(), name, etagValue(r.Header.Get("If-Match")))
+	if err != nil {
+		ruleError(w, err)
+		return
+	}
+	h.resetCR()
+	loggerFrom(r.Context()).Info("rule deleted", "rule", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func serveRule(w http.ResponseWriter, status int, image *v1alpha1.Image) {
+	image = image.DeepCopy()
+	image.Spec = redactSpec(image.Spec)
+	w.Header().Set("ETag", `"`+image.ResourceVersion+`"`)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	serveJSON(w, image)
+}
+
+func ruleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errRuleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errRuleExists), errors.Is(err, errRuleConflict):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// etagValue returns the resource version of the ETag of If-Match, empty for any.
+func etagValue(etag string) string {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if etag == "*" {
+		return ""
+	}
+	return strings.Trim(etag, `"`)
+}
+
+// checkAdminRule refuses the specs of the rules of the admin API, composed onto the rules they extend and the templates,
+// that read the local files out of the directories of WithAdminRuleSources or the Secrets, or that set the headers of the requests.
+func (h *Handler) checkAdminRule(spec *v1alpha1.ImageSpec) error {
+	if spec.Remote != nil && len(spec.Remote.Headers) != 0 {
+		return fmt.Errorf("the rules of the admin API can not set headers")
+	}
+	for _, m := range spec.Mutates {
+		var sources []string
+		switch {
+		case m.File != nil:
+			if secretPattern.MatchString(m.File.Template) {
+				return fmt.Errorf("the rules of the admin API can not read Secrets")
+			}
+			sources = append(sources, m.File.Source)
+		case m.Render != nil:
+			// The templates of the sources are not known until they are read, and may read Secrets as well.
+			if m.Render.Source != "" || strings.Contains(m.Render.Template, "secret") {
+				return fmt.Errorf("the rules of the admin API can not read Secrets")
+			}
+		case m.TrustedCA != nil:
+			sources = append(sources, m.TrustedCA.Sources...)
+		case m.Binary != nil:
+			for _, source := range m.Binary.Sources {
+				sources = append(sources, source)
+			}
+		}
+		for _, source := range sources {
+			err := h.checkAdminRuleSource(source)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkAdminRuleSource allows the URLs, the digests of the uploaded blobs and the local files under the directories of WithAdminRuleSources.
+func (h *Handler) checkAdminRuleSource(source string) error {
+	if source == "" || digestRegexp.MatchString(source) {
+		return nil
+	}
+	u, err := remoteSource(source)
+	if err != nil || u != nil {
+		return err
+	}
+	source = path.Clean(source)
+	for _, dir := range h.adminRuleSources {
+		if strings.HasPrefix(source, strings.TrimSuffix(dir, "/")+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("source %q: the rules of the admin API can not read local files out of the allowed directories", source)
+}
+
+// redactSpec returns a copy of the spec without the tokens, the values of the headers of its remote,
+// which often carry the tokens of the CDNs, and the passwords of the proxies of its remote.
+func redactSpec(spec v1alpha1.ImageSpec) v1alpha1.ImageSpec {
+	spec = *spec.DeepCopy()
+	spec.Mutates = redactMutates(spec.Mutates)
+	if spec.Remote != nil {
+		for name := range spec.Remote.Headers {
+			spec.Remote.Headers[name] = "redacted"
+		}
+		spec.Remote.HTTPProxy = redactProxy(spec.Remote.HTTPProxy)
+		spec.Remote.HTTPSProxy = redactProxy(spec.Remote.HTTPSProxy)
+	}
+	return spec
+}
+
+// redactProxy returns the proxy without its password.
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return proxy
+	}
+	return u.Redacted()
+}
+
+// redactMutates returns a copy of the mutates without the tokens, the references to the Secrets
+// of the templates are kept as they are, their values are only read by the builds.
+func redactMutates(mutates []v1alpha1.Mutate) []v1alpha1.Mutate {
+	if mutates == nil {
+		return nil
+	}
+	redacted := make([]v1alpha1.Mutate, 0, len(mutates))
+	for _, m := range mutates {
+		m = *m.DeepCopy()
+		if m.HuggingFace != nil && m.HuggingFace.Token != "" {
+			m.HuggingFace.Token = "redacted"
+		}
+		redacted = append(redacted, m)
+	}
+	return redacted
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+func newTestHandler(t *testing.T, config []*v1alpha1.Image, opts ...Option) *Handler {
+	t.Helper()
+	h, err := NewHandler(t.TempDir(), config, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestAdminAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		uri        string
+		body       string
+		auth       string
+		wantStatus int
+	}{
+		{
+			name:       "admin without token",
+			method:     http.MethodGet,
+			uri:        "/admin/rules",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin without token with a bearer",
+			method:     http.MethodGet,
+			uri:        "/admin/rules",
+			auth:       "Bearer ",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "peer without token",
+			method:     http.MethodPost,
+			uri:        "/peer/built",
+			body:       `{"image":"a","tag":"b"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin without bearer",
+			token:      "secret",
+			method:     http.MethodGet,
+			uri:        "/admin/rules",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "admin with wrong bearer",
+			token:      "secret",
+			method:     http.MethodGet,
+			uri:        "/admin/rules",
+			auth:       "Bearer wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "admin with bearer",
+			token:      "secret",
+			method:     http.MethodGet,
+			uri:        "/admin/rules",
+			auth:       "Bearer secret",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "peer with wrong bearer",
+			token:      "secret",
+			method:     http.MethodPost,
+			uri:        "/peer/built",
+			body:       `{"image":"a","tag":"b"}`,
+			auth:       "Bearer wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "peer with bearer",
+			token:      "secret",
+			method:     http.MethodPost,
+			uri:        "/peer/built",
+			body:       `{"image":"a","tag":"b"}`,
+			auth:       "Bearer secret",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "verbose readiness without token",
+			method:     http.MethodGet,
+			uri:        "/readyz?verbose",
+			auth:       "Bearer ",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "verbose readiness with wrong bearer",
+			token:      "secret",
+			method:     http.MethodGet,
+			uri:        "/readyz?verbose",
+			auth:       "Bearer wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "metrics without token",
+			method:     http.MethodGet,
+			uri:        "/metrics",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "metrics without bearer",
+			token:      "secret",
+			method:     http.MethodGet,
+			uri:        "/metrics",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.token != "" {
+				opts = append(opts, WithAdminToken(tt.token))
+			}
+			h := newTestHandler(t, nil, opts...)
+			mux := http.NewServeMux()
+			mux.Handle("/admin/", h.AdminHandler())
+			mux.Handle("/peer/", h.PeerHandler())
+			mux.Handle("/metrics", h.MetricsHandler())
+			mux.Handle("/readyz", h.ReadyHandler())
+
+			req := httptest.NewRequest(tt.method, tt.uri, strings.NewReader(tt.body))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.uri, rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminMatchRedacted(t *testing.T) {
+	secrets := t.TempDir()
+	err := os.MkdirAll(path.Join(secrets, "registry"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(secrets, "registry", "token"), []byte("s3cr3t-value"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, []*v1alpha1.Image{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "a"},
+			Spec: v1alpha1.ImageSpec{
+				Match:     "a:{tag}",
+				BaseImage: "b",
+				Mutates: []v1alpha1.Mutate{
+					{HuggingFace: &v1alpha1.HuggingFace{Repo: "a/b", Token: "hf_token"}},
+					{File: &v1alpha1.File{Template: "{secret:registry/token}", Destination: "/token"}},
+				},
+			},
+		},
+	}, WithAdminToken("secret"), WithSecretsDir(secrets))
+
+	for _, uri := range []string{"/admin/match?ref=a:v1", "/admin/rules"} {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", uri, rec.Code, rec.Body.String())
+		}
+		body := rec.Body.String()
+		for _, value := range []string{"hf_token", "s3cr3t-value"} {
+			if strings.Contains(body, value) {
+				t.Errorf("GET %s leaks %q: %s", uri, value, body)
+			}
+		}
+	}
+
+	// The rule is not changed by the redaction.
+	if token := h.getRules()[0].Spec().Mutates[0].HuggingFace.Token; token != "hf_token" {
+		t.Errorf("token of the rule = %q, want hf_token", token)
+	}
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/logging"
+)
+
+// AuditEvent is the record of a manifest served to a client.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Image      string    `json:"image"`
+	Tag        string    `json:"tag"`
+	Digest     string    `json:"digest"`
+	Rule       string    `json:"rule,omitempty"`
+}
+
+// auditQueueSize is how many events are buffered for the webhook before new ones are dropped.
+const auditQueueSize = 1000
+
+// auditor records the manifests served to the file and the webhook,
+// the webhook is called in the background so that it never slows down the pulls.
+type auditor struct {
+	logger *slog.Logger
+
+	mut sync.Mutex
+	w   io.Writer
+
+	webhook string
+	client  *http.Client
+	queue   chan AuditEvent
+}
+
+func newAuditor(w io.Writer, webhook string, transport http.RoundTripper) *auditor {
+	if w == nil && webhook == "" {
+		return nil
+	}
+	a := &auditor{
+		logger:  slog.Default().With(logging.ComponentKey, "audit"),
+		w:       w,
+		webhook: webhook,
+	}
+	if webhook != "" {
+		a.client = &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+		}
+		a.queue = make(chan AuditEvent, auditQueueSize)
+		go a.run(context.Background())
+	}
+	return a
+}
+
+func (a *auditor) record(event AuditEvent) {
+	if a.w != nil {
+		raw, err := json.Marshal(event)
+		if err == nil {
+			a.mut.Lock()
+			_, err = a.w.Write(append(raw, '\n'))
+			a.mut.Unlock()
+		}
+		if err != nil {
+			a.logger.Error("write audit log", "err", err)
+		}
+	}
+
+	if a.queue != nil {
+		select {
+		case a.queue <- event:
+		default:
+			a.logger.Warn("audit webhook queue is full, event dropped", "image", event.Image, "tag", event.Tag)
+		}
+	}
+}
+
+func (a *auditor) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-a.queue:
+			err := a.send(ctx, event)
+			if err != nil {
+				a.logger.Error("send audit webhook", "image", event.Image, "tag", event.Tag, "err", err)
+			}
+		}
+	}
+}
+
+func (a *auditor) send(ctx context.Context, event AuditEvent) error {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhook, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("http.Post(%q): %w", a.webhook, fmt.Errorf("status code %d", resp.StatusCode))
+	}
+	return nil
+}
+
+// audit records the manifest served to the client, HEAD requests are not recorded as nothing is pulled.
+func (h *Handler) audit(r *http.Request, image, tag, digest string) {
+	if h.auditor == nil || r.Method != http.MethodGet || digest == "" {
+		return
+	}
+
+	event := AuditEvent{
+		Time:       time.Now(),
+		Client:     clientIdentity(r),
+		RemoteAddr: clientIP(r).String(),
+		Image:      image,
+		Tag:        tag,
+		Digest:     digest,
+	}
+	if rule := h.matchRule(image, tag); rule != nil {
+		event.Rule = rule.Name()
+	}
+	h.auditor.record(event)
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/wzshiming/jitdi/pkg/logging"
+)
+
+// loadHtpasswd loads the users of the htpasswd file, only the bcrypt hashes are supported.
+func loadHtpasswd(htpasswdPath string) (map[string][]byte, error) {
+	f, err := os.Open(htpasswdPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: invalid entry", htpasswdPath, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %q is not hashed with bcrypt", htpasswdPath, line, user)
+		}
+		users[user] = []byte(hash)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+type userKey struct{}
+
+// authenticate verifies the credentials of the request and returns the request with the user name,
+// the clients without credentials are anonymous.
+func (h *Handler) authenticate(r *http.Request) (*http.Request, bool) {
+	users := h.usersOf(r)
+	if users == nil {
+		return r, true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return r, true
+	}
+	hash, ok := users[user]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user)), true
+}
+
+// clientIdentity returns the user name the client authenticated with.
+func clientIdentity(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// clientIP returns the source address of the client.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// unauthorized asks the client to authenticate with basic auth.
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="jitdi"`)
+	registryError(w, http.StatusUnauthorized, errCodeUnauthorized, message)
+}
+
+// authorize reports whether the image is served to the client,
+// the anonymous clients are asked to authenticate and the others are denied.
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, image, tag string) bool {
+	rule := h.matchRule(image, tag)
+	if rule == nil {
+		return true
+	}
+	user, ip := clientIdentity(r), clientIP(r)
+	logger := loggerFrom(r.Context()).With(logging.ComponentKey, "rules")
+	if rule.Allow(user, ip) {
+		if rule.IsRestricted() {
+			logger.Debug("client allowed", "image", image, "tag", tag, "rule", rule.Name(), "user", user, "ip", ip)
+		}
+		return true
+	}
+	logger.Debug("client not allowed", "image", image, "tag", tag, "rule", rule.Name(), "user", user, "ip", ip)
+	if user == "" && h.usersOf(r) != nil {
+		unauthorized(w, "authentication required")
+		return false
+	}
+	registryError(w, http.StatusForbidden, errCodeDenied, fmt.Sprintf("%s:%s is not allowed for the client", image, tag))
+	return false
+}
+
+// authorizeUploaded reports whether the client may push or delete the uploaded blobs,
+// which are shared by all the repositories and referenced by the rules, so only with the admin token.
+func (h *Handler) authorizeUploaded(w http.ResponseWriter, r *http.Request) bool {
+	if h.isAdmin(r) {
+		return true
+	}
+	if h.adminToken == "" {
+		registryError(w, http.StatusForbidden, errCodeDenied, "the uploaded blobs can not be written without an admin token")
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="jitdi-admin"`)
+	registryError(w, http.StatusUnauthorized, errCodeUnauthorized, "the admin token is required")
+	return false
+}
+
+// authorizeBlob reports whether the blob is served to the client from the repository,
+// the blobs of the cache are shared by all the repositories so the client must be allowed the tag of the repository whose build references it.
+// The blobs referenced by no tag, e.g. the uploaded ones and the ones of the upstreams, are only served to the clients out of the tenants.
+func (h *Handler) authorizeBlob(w http.ResponseWriter, r *http.Request, image, digest string) bool {
+	if !h.restricted() {
+		return true
+	}
+	tags, err := h.image.blobTags(digest)
+	if err != nil {
+		loggerFrom(r.Context()).Error("look up blob in metadata index", "digest", digest, "err", err)
+		registryError(w, http.StatusInternalServerError, errCodeUnknown, err.Error())
+		return false
+	}
+	for _, tag := range tags {
+		repo, ok := h.virtualImage(r, image, tag.Tag)
+		if ok && repo == tag.Image {
+			return h.authorize(w, r, tag.Image, tag.Tag)
+		}
+	}
+	if len(tags) != 0 {
+		registryError(w, http.StatusNotFound, errCodeBlobUnknown, "blob unknown to the repository")
+		return false
+	}
+	if h.tenantOf(r) != nil {
+		registryError(w, http.StatusForbidden, errCodeDenied, fmt.Sprintf("%s is not allowed for the client", digest))
+		return false
+	}
+	return true
+}
+
+// restricted reports whether some clients are not allowed some images, by the tenants or by the allowed clients of the rules.
+func (h *Handler) restricted() bool {
+	if h.tenants != nil {
+		return true
+	}
+	for _, rule := range h.getRules() {
+		if rule.IsRestricted() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/atomic"
+	"github.com/wzshiming/jitdi/pkg/metadata"
+)
+
+func TestAuthorizeBlob(t *testing.T) {
+	content := []byte("layer")
+	digest := "sha256:" + atomic.SumSha256(content)
+	orphan := []byte("orphan")
+	orphanDigest := "sha256:" + atomic.SumSha256(orphan)
+
+	tests := []struct {
+		name           string
+		allowedClients []string
+		repo           string
+		digest         string
+		remoteAddr     string
+		wantStatus     int
+	}{
+		{
+			name:       "unrestricted",
+			repo:       "a",
+			digest:     digest,
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unrestricted from another repository",
+			repo:       "c",
+			digest:     digest,
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:           "restricted and allowed",
+			allowedClients: []string{"10.0.0.0/8"},
+			repo:           "a",
+			digest:         digest,
+			remoteAddr:     "10.1.2.3:1234",
+			wantStatus:     http.StatusOK,
+		},
+		{
+			name:           "restricted and denied",
+			allowedClients: []string{"10.0.0.0/8"},
+			repo:           "a",
+			digest:         digest,
+			remoteAddr:     "192.0.2.1:1234",
+			wantStatus:     http.StatusForbidden,
+		},
+		{
+			name:           "restricted from another repository",
+			allowedClients: []string{"10.0.0.0/8"},
+			repo:           "c",
+			digest:         digest,
+			remoteAddr:     "192.0.2.1:1234",
+			wantStatus:     http.StatusNotFound,
+		},
+		{
+			name:           "restricted and referenced by no tag",
+			allowedClients: []string{"10.0.0.0/8"},
+			repo:           "c",
+			digest:         orphanDigest,
+			remoteAddr:     "192.0.2.1:1234",
+			wantStatus:     http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, []*v1alpha1.Image{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "a"},
+					Spec:       v1alpha1.ImageSpec{Match: "a:{tag}", BaseImage: "b", AllowedClients: tt.allowedClients},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "c"},
+					Spec:       v1alpha1.ImageSpec{Match: "c:{tag}", BaseImage: "b"},
+				},
+			})
+			for blob, raw := range map[string][]byte{digest: content, orphanDigest: orphan} {
+				blobPath := h.image.BlobsPath(blob)
+				err := os.MkdirAll(path.Dir(blobPath), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(blobPath, raw, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := h.image.index.Put(metadata.Tag{Image: "a", Tag: "v1", Blobs: []string{digest}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/"+tt.repo+"/blobs/"+tt.digest, nil)
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("GET %s = %d, want %d: %s", req.URL, rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthorizeWrites(t *testing.T) {
+	content := []byte("input")
+	digest := "sha256:" + atomic.SumSha256(content)
+
+	tests := []struct {
+		name       string
+		adminToken string
+		method     string
+		uri        string
+		auth       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{
+			name:       "delete tag denied by the rule",
+			method:     http.MethodDelete,
+			uri:        "/v2/a/manifests/v1",
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "delete tag allowed by the rule",
+			method:     http.MethodDelete,
+			uri:        "/v2/a/manifests/v1",
+			remoteAddr: "10.1.2.3:1234",
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "delete uploaded blob without admin token",
+			method:     http.MethodDelete,
+			uri:        "/v2/a/blobs/" + digest,
+			remoteAddr: "10.1.2.3:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "delete uploaded blob without bearer",
+			adminToken: "secret",
+			method:     http.MethodDelete,
+			uri:        "/v2/a/blobs/" + digest,
+			remoteAddr: "10.1.2.3:1234",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "delete uploaded blob with admin token",
+			adminToken: "secret",
+			method:     http.MethodDelete,
+			uri:        "/v2/a/blobs/" + digest,
+			auth:       "Bearer secret",
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "upload without bearer",
+			adminToken: "secret",
+			method:     http.MethodPost,
+			uri:        "/v2/a/blobs/uploads/?digest=" + digest,
+			remoteAddr: "10.1.2.3:1234",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "upload with admin token",
+			adminToken: "secret",
+			method:     http.MethodPost,
+			uri:        "/v2/a/blobs/uploads/?digest=" + digest,
+			auth:       "Bearer secret",
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusCreated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{WithDelete(true), WithUpload(true)}
+			if tt.adminToken != "" {
+				opts = append(opts, WithAdminToken(tt.adminToken))
+			}
+			h := newTestHandler(t, []*v1alpha1.Image{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "a"},
+					Spec:       v1alpha1.ImageSpec{Match: "a:{tag}", BaseImage: "b", AllowedClients: []string{"10.0.0.0/8"}},
+				},
+			}, opts...)
+			manifestPath := h.image.ManifestPath("a", "v1")
+			uploadedPath := h.image.UploadedBlobPath(digest)
+			for p, raw := range map[string][]byte{manifestPath: []byte("{}"), uploadedPath: content} {
+				err := os.MkdirAll(path.Dir(p), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(p, raw, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			req := httptest.NewRequest(tt.method, tt.uri, bytes.NewReader(content))
+			req.RemoteAddr = tt.remoteAddr
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.uri, rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
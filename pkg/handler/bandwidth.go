@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// bandwidthMaxBurst is the most bytes read or written at once under a bandwidth limit.
+	bandwidthMaxBurst = 1 << 20
+
+	// clientLimiterIdle is how long the limiter of a client is kept after its last request.
+	clientLimiterIdle = 10 * time.Minute
+)
+
+// newBandwidthLimiter returns the limiter of the bytes per second, nil if unlimited.
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, bandwidthMaxBurst)))
+}
+
+// waitBandwidth waits until the n bytes are allowed by all the limiters, the nil ones are unlimited.
+func waitBandwidth(ctx context.Context, n int, limiters ...*rate.Limiter) error {
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		for rest := n; rest > 0; {
+			chunk := min(rest, l.Burst())
+			err := l.WaitN(ctx, chunk)
+			if err != nil {
+				return err
+			}
+			rest -= chunk
+		}
+	}
+	return nil
+}
+
+// limitedTransport limits the bandwidth of the bodies of the responses of the upstreams.
+type limitedTransport struct {
+	limiter *rate.Limiter
+	base    http.RoundTripper
+}
+
+func limitTransport(limiter *rate.Limiter, rt http.RoundTripper) http.RoundTripper {
+	if limiter == nil {
+		return rt
+	}
+	return &limitedTransport{limiter: limiter, base: rt}
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &limitedReader{ctx: req.Context(), limiter: t.limiter, ReadCloser: resp.Body}
+	return resp, nil
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	limiter *rate.Limiter
+	io.ReadCloser
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := waitBandwidth(r.ctx, n, r.limiter); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// clientLimiters are the bandwidth limiters of the clients served, by their users or their addresses.
+type clientLimiters struct {
+	bytesPerSecond int64
+
+	mut       sync.Mutex
+	limiters  map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+type clientLimiter struct {
+	limiter *rate.Limiter
+	last    time.Time
+}
+
+func newClientLimiters(bytesPerSecond int64) *clientLimiters {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &clientLimiters{
+		bytesPerSecond: bytesPerSecond,
+		limiters:       map[string]*clientLimiter{},
+	}
+}
+
+// get returns the limiter of the client, and forgets the ones idle for long.
+func (c *clientLimiters) get(client string, now time.Time) *rate.Limiter {
+	if c == nil {
+		return nil
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if now.Sub(c.lastSweep) > clientLimiterIdle {
+		for key, l := range c.limiters {
+			if now.Sub(l.last) > clientLimiterIdle {
+				delete(c.limiters, key)
+			}
+		}
+		c.lastSweep = now
+	}
+	l, ok := c.limiters[client]
+	if !ok {
+		l = &clientLimiter{limiter: newBandwidthLimiter(c.bytesPerSecond)}
+		c.limiters[client] = l
+	}
+	l.last = now
+	return l.limiter
+}
+
+// limitServing returns the writer of the response limited by the bandwidth of the clients and of the client,
+// which is identified by its user if authenticated, otherwise by its address.
+func (h *Handler) limitServing(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if h.serveLimiter == nil && h.clientLimiters == nil {
+		return w
+	}
+	client := clientIdentity(r)
+	if client == "" {
+		client = clientIP(r).String()
+	}
+	return &limitedWriter{
+		ctx:            r.Context(),
+		limiters:       []*rate.Limiter{h.clientLimiters.get(client, time.Now()), h.serveLimiter},
+		ResponseWriter: w,
+	}
+}
+
+// limitedWriter writes the response as fast as the limiters allow, which also disables sendfile.
+type limitedWriter struct {
+	ctx      context.Context
+	limiters []*rate.Limiter
+	http.ResponseWriter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), bandwidthMaxBurst)]
+		err := waitBandwidth(w.ctx, len(chunk), w.limiters...)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
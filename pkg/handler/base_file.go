@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+)
+
+var (
+	errBaseFileNotFound = errors.New("not found in the base image")
+	errBaseFileDigest   = errors.New("the digest of the file of the base image differs")
+	errBaseFileLink     = errors.New("the file is a link")
+)
+
+// baseFile is a file of the base image overridden by a layer, the header is nil if the base image has no such file.
+type baseFile struct {
+	name    string
+	header  *tar.Header
+	content []byte
+	changed bool
+}
+
+// readOptionalBaseFile reads the small file from the base image, the file is empty if the base image has none.
+func readOptionalBaseFile(base v1.Image, name string) (*baseFile, error) {
+	f := &baseFile{name: name}
+	if base == nil {
+		return f, nil
+	}
+	header, err := readBaseFile(base, name, false, func(header *tar.Header, r io.Reader) error {
+		if header.Size > maxPatchFileSize {
+			return fmt.Errorf("the file is larger than %d bytes", maxPatchFileSize)
+		}
+		var err error
+		f.content, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errBaseFileNotFound) {
+			return f, nil
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	f.header = header
+	return f, nil
+}
+
+// append appends the data on a new line of the file.
+func (f *baseFile) append(data []byte) {
+	if len(f.content) != 0 && !bytes.HasSuffix(f.content, []byte("\n")) {
+		f.content = append(f.content, '\n')
+	}
+	f.content = append(f.content, data...)
+	f.changed = true
+}
+
+// verifyBaseFile checks that the file of the base image has the digest before it is replaced, and returns its header.
+func verifyBaseFile(base v1.Image, p, digest string, windows bool) (*tar.Header, error) {
+	if base == nil {
+		return nil, fmt.Errorf("no base image")
+	}
+	var actual string
+	header, err := readBaseFile(base, p, windows, func(header *tar.Header, r io.Reader) error {
+		hash := digestHasher(digest)
+		_, err := io.Copy(hash, r)
+		if err != nil {
+			return err
+		}
+		actual = fmt.Sprintf("%s:%x", strings.SplitN(digest, ":", 2)[0], hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if actual != digest {
+		return nil, fmt.Errorf("%w: %s, not %s", errBaseFileDigest, actual, digest)
+	}
+	return header, nil
+}
+
+// readBaseFile reads the file with the fn from the layers of the base image, from the top layer down,
+// the files removed by the whiteouts of the upper layers are not found.
+func readBaseFile(base v1.Image, p string, windows bool, fn func(header *tar.Header, r io.Reader) error) (*tar.Header, error) {
+	target := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if windows {
+		target = path.Join("Files", target)
+	}
+	layers, err := base.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		header, hidden, err := readLayerFile(layers[i], target, fn)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			return header, nil
+		}
+		if hidden {
+			break
+		}
+	}
+	return nil, errBaseFileNotFound
+}
+
+// readLayerFile reads the file with the fn from the layer, and reports whether the layer hides it in the layers below.
+func readLayerFile(layer v1.Layer, target string, fn func(header *tar.Header, r io.Reader) error) (*tar.Header, bool, error) {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return nil, false, err
+	}
+	defer rc.Close()
+
+	var hidden bool
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, hidden, nil
+			}
+			return nil, false, err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if name == target {
+			switch header.Typeflag {
+			case tar.TypeReg:
+			case tar.TypeSymlink, tar.TypeLink:
+				return nil, false, fmt.Errorf("%w to %q", errBaseFileLink, header.Linkname)
+			default:
+				return nil, false, fmt.Errorf("not a regular file")
+			}
+			err = fn(header, tr)
+			if err != nil {
+				return nil, false, err
+			}
+			return header, false, nil
+		}
+
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+		switch {
+		case base == ".wh..wh..opq":
+			if strings.HasPrefix(target, dir+"/") || dir == "" {
+				hidden = true
+			}
+		case strings.HasPrefix(base, ".wh."):
+			removed := path.Join(dir, strings.TrimPrefix(base, ".wh."))
+			if target == removed || strings.HasPrefix(target, removed+"/") {
+				hidden = true
+			}
+		}
+	}
+}
+
+// tarBaseFile writes the file overriding the one of the base image, with the mode and the owner of its header.
+func tarBaseFile(tw *tarWriter, name string, header *tar.Header, content []byte, modTime time.Time) error {
+	err := sandboxFrom(tw.ctx).addFile(name, int64(len(content)))
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+		Mode:     header.Mode,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", name, err)
+	}
+	_, err = tw.Write(content)
+	if err != nil {
+		return err
+	}
+	tw.entries++
+	return nil
+}
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+// annotationTitle is the annotation of the layers of the artifacts that names their files.
+const annotationTitle = "org.opencontainers.image.title"
+
+// buildBinary returns the layer of the binary of the platform of the image and the description of what it adds,
+// the platform is the one of the parameters, GOOS, GOARCH and VARIANT.
+func (b *imageBuilder) buildBinary(ctx context.Context, bin *v1alpha1.Binary, params map[string]string, layerMediaType types.MediaType, creationTime time.Time, windows bool) ([]mutate.Addendum, string, error) {
+	var mode int64 = 0755
+	if bin.Mode != "" {
+		m, err := strconv.ParseUint(bin.Mode, 0, 0)
+		if err != nil {
+			return nil, "", fmt.Errorf("binary %s: invalid mode %q", bin.Destination, bin.Mode)
+		}
+		mode = int64(m)
+	}
+	platform := v1.Platform{OS: params["GOOS"], Architecture: params["GOARCH"], Variant: params["VARIANT"]}
+	builder := NewFileLayerBuilder(b.client, b.cacheTmp, mode, creationTime, layerMediaType, 0, windows)
+
+	if bin.Index != "" {
+		layer, source, err := b.binaryArtifact(ctx, bin.Index, path.Base(bin.Destination), platform)
+		if err != nil {
+			return nil, "", fmt.Errorf("binary %s: %w", bin.Destination, err)
+		}
+		if layer == nil {
+			if bin.Optional {
+				return nil, fmt.Sprintf("skip %s without a binary for %s", bin.Destination, platform.String()), nil
+			}
+			return nil, "", fmt.Errorf("binary %s: %s has no binary for %s", bin.Destination, bin.Index, platform.String())
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, "", fmt.Errorf("binary %s: %w", bin.Destination, err)
+		}
+		// The layers of the artifacts are the files themselves, not tarballs.
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, "", fmt.Errorf("binary %s: %w", bin.Destination, err)
+		}
+		defer rc.Close()
+		addendums, err := builder.BuildFile(ctx, rc, bin.Destination, size)
+		if err != nil {
+			return nil, "", fmt.Errorf("file layer builder: %w", err)
+		}
+		return addendums, fmt.Sprintf("add %s for %s from %s", bin.Destination, platform.String(), source), nil
+	}
+
+	source, ok := binarySource(bin.Sources, platform)
+	if !ok {
+		if bin.Optional {
+			return nil, fmt.Sprintf("skip %s without a binary for %s", bin.Destination, platform.String()), nil
+		}
+		return nil, "", fmt.Errorf("binary %s: no source for %s", bin.Destination, platform.String())
+	}
+	hostPath := source
+	if digestRegexp.MatchString(hostPath) {
+		// The blobs pushed by the upload API are referenced by digest.
+		hostPath = b.UploadedBlobPath(hostPath)
+	}
+	builder.staged = b.staged
+	addendums, err := builder.Build(ctx, hostPath, bin.Destination)
+	if err != nil {
+		return nil, "", fmt.Errorf("file layer builder: %w", err)
+	}
+	return addendums, fmt.Sprintf("add %s for %s from %s", bin.Destination, platform.String(), source), nil
+}
+
+// binarySource returns the source of the most specific platform of the sources matching the platform,
+// "<os>/<arch>/<variant>" before "<os>/<arch>" before "<arch>".
+func binarySource(sources map[string]string, p v1.Platform) (string, bool) {
+	keys := []string{p.OS + "/" + p.Architecture, p.Architecture}
+	if p.Variant != "" {
+		keys = append([]string{p.OS + "/" + p.Architecture + "/" + p.Variant}, keys...)
+	}
+	for _, key := range keys {
+		if source, ok := sources[key]; ok {
+			return source, true
+		}
+	}
+	return "", false
+}
+
+// binaryArtifact returns the layer of the binary of the manifest of the index for the platform and the reference of the manifest by digest,
+// the layer is the single one of the manifest or the one titled with the name, nil if the index has no manifest for the platform.
+func (b *imageBuilder) binaryArtifact(ctx context.Context, s, name string, p v1.Platform) (v1.Layer, string, error) {
+	ref, remoteOptions, err := b.parseReference(ctx, s, false)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing reference %q: %w", s, err)
+	}
+	idx, err := remote.Index(ref, append(remoteOptions, remote.WithContext(ctx))...)
+	if err != nil {
+		return nil, "", err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The manifest of the variant wins over the one without a variant.
+	var desc *v1.Descriptor
+	for i, m := range manifest.Manifests {
+		if m.Platform == nil || m.Platform.OS != p.OS || m.Platform.Architecture != p.Architecture {
+			continue
+		}
+		if m.Platform.Variant == p.Variant {
+			desc = &manifest.Manifests[i]
+			break
+		}
+		if m.Platform.Variant == "" && desc == nil {
+			desc = &manifest.Manifests[i]
+		}
+	}
+	if desc == nil {
+		return nil, "", nil
+	}
+	source := ref.Context().Digest(desc.Digest.String()).String()
+
+	img, err := idx.Image(desc.Digest)
+	if err != nil {
+		return nil, "", err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, "", err
+	}
+	var layer *v1.Descriptor
+	if len(m.Layers) == 1 {
+		layer = &m.Layers[0]
+	} else {
+		for i, l := range m.Layers {
+			if l.Annotations[annotationTitle] == name {
+				layer = &m.Layers[i]
+				break
+			}
+		}
+	}
+	if layer == nil {
+		return nil, "", fmt.Errorf("%s has %d layers and none titled %q", source, len(m.Layers), name)
+	}
+	l, err := img.LayerByDigest(layer.Digest)
+	if err != nil {
+		return nil, "", err
+	}
+	return l, source, nil
+}
@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Circuit states reported for the upstream hosts.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreakerOptions are the options of the circuit breaker of the upstream hosts.
+type CircuitBreakerOptions struct {
+	// Threshold is the ratio of the requests failed in the window above which the circuit of a host opens, zero disables it.
+	Threshold float64
+	// MinRequests is the number of the requests in the window below which the circuit never opens.
+	MinRequests int
+	// Window is how long the requests are counted for.
+	Window time.Duration
+	// Cooldown is how long the circuit stays open before a request is let through to probe the host.
+	Cooldown time.Duration
+	// Mirrors are the hosts that the requests are sent to instead while the circuit of the registry is open.
+	Mirrors map[string]string
+}
+
+// circuitOpenError is returned without reaching the upstream host while its circuit is open.
+type circuitOpenError struct {
+	host  string
+	until time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("upstream %s is failing, circuit open until %s", e.host, e.until.Format(time.RFC3339))
+}
+
+// CircuitState is the state of the circuit of an upstream host.
+type CircuitState struct {
+	Host     string     `json:"host"`
+	State    string     `json:"state"`
+	Requests int        `json:"requests"`
+	Failures int        `json:"failures"`
+	Until    *time.Time `json:"until,omitempty"`
+	Mirror   string     `json:"mirror,omitempty"`
+}
+
+// circuit counts the requests to a host in the current window.
+type circuit struct {
+	start    time.Time
+	requests int
+	failures int
+	// until is when the circuit opened lets a request through again, zero if closed.
+	until time.Time
+	// probing is set while the request let through after the cooldown is running.
+	probing bool
+}
+
+// circuitBreaker fails the requests to the upstream hosts fast while too many of them fail,
+// instead of every build waiting for the timeouts of a registry that is down.
+type circuitBreaker struct {
+	opts CircuitBreakerOptions
+
+	mut      sync.Mutex
+	circuits map[string]*circuit
+}
+
+func newCircuitBreaker(opts CircuitBreakerOptions) (*circuitBreaker, error) {
+	if opts.Threshold <= 0 {
+		return nil, nil
+	}
+	if opts.Threshold > 1 {
+		return nil, fmt.Errorf("circuit breaker threshold %v must be a ratio from 0 to 1", opts.Threshold)
+	}
+	if opts.Window <= 0 || opts.Cooldown <= 0 {
+		return nil, fmt.Errorf("circuit breaker window and cooldown must be positive")
+	}
+	mirrors := make(map[string]string, len(opts.Mirrors))
+	for registry, mirror := range opts.Mirrors {
+		reg, err := name.NewRegistry(registry)
+		if err != nil {
+			return nil, fmt.Errorf("mirror of %q: %w", registry, err)
+		}
+		mirrors[reg.RegistryStr()] = mirror
+	}
+	opts.Mirrors = mirrors
+	return &circuitBreaker{
+		opts:     opts,
+		circuits: map[string]*circuit{},
+	}, nil
+}
+
+// allow reports whether a request to the host can be sent, and the error to fail it with if not.
+func (c *circuitBreaker) allow(host string, now time.Time) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	cb := c.circuits[host]
+	if cb == nil || cb.until.IsZero() {
+		return nil
+	}
+	if now.Before(cb.until) || cb.probing {
+		return &circuitOpenError{host: host, until: cb.until}
+	}
+	cb.probing = true
+	return nil
+}
+
+// record counts the result of a request to the host, and opens or closes its circuit.
+func (c *circuitBreaker) record(host string, failed bool, now time.Time) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	cb := c.circuits[host]
+	if cb == nil {
+		cb = &circuit{start: now}
+		c.circuits[host] = cb
+	}
+
+	if cb.probing {
+		cb.probing = false
+		if failed {
+			cb.until = now.Add(c.opts.Cooldown)
+			return
+		}
+		*cb = circuit{start: now}
+	}
+
+	if now.Sub(cb.start) > c.opts.Window {
+		cb.start, cb.requests, cb.failures = now, 0, 0
+	}
+	cb.requests++
+	if failed {
+		cb.failures++
+	}
+	if cb.until.IsZero() && cb.requests >= c.opts.MinRequests && float64(cb.failures) >= c.opts.Threshold*float64(cb.requests) {
+		cb.until = now.Add(c.opts.Cooldown)
+	}
+}
+
+// release lets another request probe the host, after the probe was canceled by its client.
+func (c *circuitBreaker) release(host string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if cb := c.circuits[host]; cb != nil {
+		cb.probing = false
+	}
+}
+
+// states returns the states of the circuits of the hosts requested.
+func (c *circuitBreaker) states(now time.Time) []CircuitState {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	states := make([]CircuitState, 0, len(c.circuits))
+	for host, cb := range c.circuits {
+		state := CircuitState{
+			Host:     host,
+			State:    CircuitClosed,
+			Requests: cb.requests,
+			Failures: cb.failures,
+			Mirror:   c.opts.Mirrors[host],
+		}
+		if !cb.until.IsZero() {
+			until := cb.until
+			state.State = CircuitOpen
+			state.Until = &until
+			if cb.probing || !now.Before(cb.until) {
+				state.State = CircuitHalfOpen
+			}
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Host < states[j].Host
+	})
+	return states
+}
+
+// retryAfter returns how long until the circuit of the err lets the requests through again, if it is open.
+func retryAfter(err error) (time.Duration, bool) {
+	var open *circuitOpenError
+	if !errors.As(err, &open) {
+		return 0, false
+	}
+	return max(time.Until(open.until), time.Second), true
+}
+
+// wrap returns the transport going through the circuits of the hosts.
+func (c *circuitBreaker) wrap(rt http.RoundTripper) http.RoundTripper {
+	if c == nil {
+		return rt
+	}
+	return &breakerTransport{breaker: c, base: rt}
+}
+
+type breakerTransport struct {
+	breaker *circuitBreaker
+	base    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	err := t.breaker.allow(host, time.Now())
+	if err != nil {
+		mirror, ok := t.breaker.opts.Mirrors[host]
+		if !ok || t.breaker.allow(mirror, time.Now()) != nil {
+			return nil, err
+		}
+		// The mirror serves the same repositories, the credentials of the requests are trusted to it like to the registry.
+		req = req.Clone(req.Context())
+		req.URL.Host = mirror
+		req.Host = mirror
+		host = mirror
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	var recordErr tls.RecordHeaderError
+	switch {
+	case err != nil && errors.Is(req.Context().Err(), context.Canceled):
+		// The requests canceled by the clients are not failures of the host.
+		t.breaker.release(host)
+	case errors.As(err, &recordErr):
+		// The host answered without TLS, the insecure registries are tried over HTTPS before plain HTTP.
+		t.breaker.record(host, false, time.Now())
+	case err != nil:
+		t.breaker.record(host, true, time.Now())
+	default:
+		t.breaker.record(host, resp.StatusCode >= http.StatusInternalServerError, time.Now())
+	}
+	return resp, err
+}
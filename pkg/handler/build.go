@@ -0,0 +1,278 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildStatus is the status of a build.
+type BuildStatus string
+
+const (
+	BuildRunning   BuildStatus = "Running"
+	BuildSucceeded BuildStatus = "Succeeded"
+	BuildFailed    BuildStatus = "Failed"
+)
+
+// Build is the record of a build.
+type Build struct {
+	ID        string      `json:"id"`
+	Ref       string      `json:"ref"`
+	Rule      string      `json:"rule,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+	Status    BuildStatus `json:"status"`
+	Error     string      `json:"error,omitempty"`
+	StartTime time.Time   `json:"startTime"`
+	EndTime   *time.Time  `json:"endTime,omitempty"`
+	Progress  []Progress  `json:"progress,omitempty"`
+}
+
+type buildRecord struct {
+	mut      sync.Mutex
+	build    Build
+	logs     *logBuffer
+	progress []*progressTracker
+	redactor *redactor
+}
+
+// Build returns a snapshot of the record.
+func (r *buildRecord) Build() Build {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	build := r.build
+	for _, p := range r.progress {
+		build.Progress = append(build.Progress, p.Progress())
+	}
+	return build
+}
+
+func (r *buildRecord) addProgress(p *progressTracker) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.progress = append(r.progress, p)
+}
+
+// logProgress logs the progress of the copies that are not done yet.
+func (r *buildRecord) logProgress(logger *slog.Logger) {
+	r.mut.Lock()
+	progress := make([]Progress, 0, len(r.progress))
+	for _, p := range r.progress {
+		progress = append(progress, p.Progress())
+	}
+	r.mut.Unlock()
+
+	for _, p := range progress {
+		if p.Done {
+			continue
+		}
+		if p.Total > 0 {
+			logger.Info("progress", "name", p.Name, "current", p.Current, "total", p.Total, "percent", fmt.Sprintf("%.1f%%", p.Percent))
+		} else {
+			logger.Info("progress", "name", p.Name, "current", p.Current)
+		}
+	}
+}
+
+// Logs returns the captured log lines.
+func (r *buildRecord) Logs() []string {
+	return r.logs.Lines()
+}
+
+func (r *buildRecord) finish(err error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	now := time.Now()
+	r.build.EndTime = &now
+	if err != nil {
+		r.build.Status = BuildFailed
+		r.build.Error = r.redactor.redact(err.Error())
+	} else {
+		r.build.Status = BuildSucceeded
+	}
+}
+
+// buildRecords keeps the records of the most recent builds.
+type buildRecords struct {
+	mut      sync.Mutex
+	records  map[string]*buildRecord
+	order    []string
+	max      int
+	maxLines int
+}
+
+func newBuildRecords(max, maxLines int) *buildRecords {
+	return &buildRecords{
+		records:  map[string]*buildRecord{},
+		max:      max,
+		maxLines: maxLines,
+	}
+}
+
+// start records a new build, and returns the ctx with a logger that also writes into the build logs.
+func (b *buildRecords) start(ctx context.Context, ref, rule string) (context.Context, *buildRecord) {
+	record := &buildRecord{
+		build: Build{
+			ID:        newBuildID(),
+			Ref:       ref,
+			Rule:      rule,
+			RequestID: requestIDFrom(ctx),
+			Status:    BuildRunning,
+			StartTime: time.Now(),
+		},
+		logs:     newLogBuffer(b.maxLines),
+		redactor: &redactor{},
+	}
+
+	b.mut.Lock()
+	b.records[record.build.ID] = record
+	b.order = append(b.order, record.build.ID)
+	for len(b.order) > b.max {
+		delete(b.records, b.order[0])
+		b.order = b.order[1:]
+	}
+	b.mut.Unlock()
+
+	logger := loggerFrom(ctx)
+	logger = slog.New(redactHandler{teeHandler{
+		logger.Handler(),
+		slog.NewTextHandler(record.logs, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	}, record.redactor}).With("build", record.build.ID)
+	return withBuildRecord(withLogger(ctx, logger), record), record
+}
+
+// Get returns the record of the build.
+func (b *buildRecords) Get(id string) (*buildRecord, bool) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	r, ok := b.records[id]
+	return r, ok
+}
+
+// Latest returns the record of the most recent build of the ref.
+func (b *buildRecords) Latest(ref string) (*buildRecord, bool) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for i := len(b.order) - 1; i >= 0; i-- {
+		record := b.records[b.order[i]]
+		if record.Build().Ref == ref {
+			return record, true
+		}
+	}
+	return nil, false
+}
+
+// List returns the builds, the most recent first.
+func (b *buildRecords) List() []Build {
+	b.mut.Lock()
+	records := make([]*buildRecord, 0, len(b.order))
+	for _, id := range b.order {
+		records = append(records, b.records[id])
+	}
+	b.mut.Unlock()
+
+	builds := make([]Build, 0, len(records))
+	for _, r := range records {
+		builds = append(builds, r.Build())
+	}
+	sort.SliceStable(builds, func(i, j int) bool {
+		return builds[i].StartTime.After(builds[j].StartTime)
+	})
+	return builds
+}
+
+func newBuildID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// logBuffer is a ring buffer of log lines.
+type logBuffer struct {
+	mut   sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{
+		lines: make([]string, size),
+	}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		b.lines[b.next] = line
+		b.next++
+		if b.next == len(b.lines) {
+			b.next = 0
+			b.full = true
+		}
+	}
+	return len(p), nil
+}
+
+// Lines returns the lines in the order they were written.
+func (b *logBuffer) Lines() []string {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if !b.full {
+		return append([]string(nil), b.lines[:b.next]...)
+	}
+	return append(append([]string(nil), b.lines[b.next:]...), b.lines[:b.next]...)
+}
+
+// Tail returns the last n lines.
+func (b *logBuffer) Tail(n int) []string {
+	lines := b.Lines()
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// teeHandler is a slog.Handler that writes the records to all the handlers.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	for _, h := range t {
+		if h.Enabled(ctx, record.Level) {
+			_ = h.Handle(ctx, record.Clone())
+		}
+	}
+	return nil
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, 0, len(t))
+	for _, h := range t {
+		out = append(out, h.WithAttrs(attrs))
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, 0, len(t))
+	for _, h := range t {
+		out = append(out, h.WithGroup(name))
+	}
+	return out
+}
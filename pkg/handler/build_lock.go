@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// buildLockStale is how long a lock file is not refreshed before the instance holding it is considered gone,
+	// e.g. killed during the build, and the lock is taken over.
+	buildLockStale = time.Minute
+
+	// buildLockRefresh is how often the instance holding a lock file refreshes it.
+	buildLockRefresh = buildLockStale / 4
+
+	// buildLockPoll is how often the instances waiting for a lock check it.
+	buildLockPoll = 500 * time.Millisecond
+)
+
+// buildLocks makes the instances sharing the cache build a tag once, with the lock files of the tags in <cache>/locks:
+// the instance creating the lock file of a tag builds it, while the others wait for the file to be removed
+// and serve the tag built instead of building it again.
+type buildLocks struct {
+	dir   string
+	owner string
+
+	mut sync.Mutex
+	// wakes are closed to wake up the waiters of the tags announced by the peers, instead of waiting for the next poll.
+	wakes map[string]chan struct{}
+}
+
+func newBuildLocks(cache string) (*buildLocks, error) {
+	dir := path.Join(cache, "locks")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return &buildLocks{
+		dir:   dir,
+		owner: fmt.Sprintf("%s/%d", hostname, os.Getpid()),
+		wakes: map[string]chan struct{}{},
+	}, nil
+}
+
+// lock waits for the lock of the tag and returns the function releasing it,
+// or nil if the manifest of the tag was written by another instance while waiting, so the tag does not need to be built.
+func (l *buildLocks) lock(ctx context.Context, ref, manifestPath string) (func(), error) {
+	sum := sha256.Sum256([]byte(ref))
+	p := path.Join(l.dir, hex.EncodeToString(sum[:])+".lock")
+	before := modTime(manifestPath)
+	waited := false
+	defer l.wake(ref)
+	for {
+		if waited && modTime(manifestPath).After(before) {
+			return nil, nil
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%s %s\n", l.owner, ref)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				_ = os.Remove(p)
+				return nil, fmt.Errorf("write build lock: %w", err)
+			}
+			if waited && modTime(manifestPath).After(before) {
+				_ = os.Remove(p)
+				return nil, nil
+			}
+			return l.hold(p), nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("create build lock: %w", err)
+		}
+
+		info, err := os.Stat(p)
+		if err == nil && time.Since(info.ModTime()) > buildLockStale {
+			// Two instances taking over the same stale lock at worst build the tag twice,
+			// which is safe as the builds write the cache atomically.
+			_ = os.Remove(p)
+			continue
+		}
+		waited = true
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-l.wakeChan(ref):
+		case <-time.After(buildLockPoll):
+		}
+	}
+}
+
+func (l *buildLocks) wakeChan(ref string) chan struct{} {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	wake, ok := l.wakes[ref]
+	if !ok {
+		wake = make(chan struct{})
+		l.wakes[ref] = wake
+	}
+	return wake
+}
+
+// wake wakes up the waiters of the lock of the tag.
+func (l *buildLocks) wake(ref string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if wake, ok := l.wakes[ref]; ok {
+		close(wake)
+		delete(l.wakes, ref)
+	}
+}
+
+// hold refreshes the lock file until it is released.
+func (l *buildLocks) hold(p string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(buildLockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				_ = os.Chtimes(p, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		_ = os.Remove(p)
+	}
+}
+
+// modTime returns the modification time of the file, or the zero time if it does not exist.
+func modTime(p string) time.Time {
+	info, err := os.Stat(p)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
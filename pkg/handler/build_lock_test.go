@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+// newSlowRegistry returns the host of a registry answering the manifests after the delay,
+// with the image base:latest if withImage, so that the builds of the same tag overlap.
+func newSlowRegistry(t *testing.T, delay time.Duration, withImage bool) string {
+	t.Helper()
+	reg := registry.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") && r.Method != http.MethodPut {
+			time.Sleep(delay)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if withImage {
+		img, err := random.Image(100, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(host + "/base:latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = remote.Write(ref, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return host
+}
+
+func testBuildRules(host string) []*v1alpha1.Image {
+	return []*v1alpha1.Image{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "a"},
+			Spec:       v1alpha1.ImageSpec{Match: "a:{tag}", BaseImage: host + "/base:latest"},
+		},
+	}
+}
+
+// buildConcurrently builds the tag n times at once on each handler and returns the errors.
+func buildConcurrently(handlers []*Handler, n int) []error {
+	var mut sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for _, h := range handlers {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(h *Handler) {
+				defer wg.Done()
+				err := h.build(context.Background(), "a", "v1")
+				mut.Lock()
+				errs = append(errs, err)
+				mut.Unlock()
+			}(h)
+		}
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestBuildCoalesced(t *testing.T) {
+	tests := []struct {
+		name          string
+		instances     int
+		withImage     bool
+		wantErr       bool
+		wantRun       int64
+		wantCoalesced int64
+	}{
+		{
+			name:      "built once",
+			instances: 1,
+			withImage: true,
+			wantRun:   1,
+		},
+		{
+			name:      "error returned to the waiters",
+			instances: 1,
+			wantErr:   true,
+			wantRun:   1,
+		},
+		{
+			name:          "built once across the instances",
+			instances:     2,
+			withImage:     true,
+			wantRun:       1,
+			wantCoalesced: 1,
+		},
+		{
+			name:      "error built again by the instances waiting",
+			instances: 2,
+			wantErr:   true,
+			wantRun:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newSlowRegistry(t, 300*time.Millisecond, tt.withImage)
+			cache := t.TempDir()
+			var handlers []*Handler
+			for i := 0; i < tt.instances; i++ {
+				h, err := NewHandler(cache, testBuildRules(host), nil, WithInsecureRegistries(host), WithBuildLock(tt.instances > 1))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handlers = append(handlers, h)
+			}
+
+			for _, err := range buildConcurrently(handlers, 3) {
+				if (err != nil) != tt.wantErr {
+					t.Errorf("build error = %v, wantErr %v", err, tt.wantErr)
+				}
+			}
+			var run, coalescedLocal, coalescedCluster int64
+			for _, h := range handlers {
+				run += h.buildsRun.Load()
+				coalescedLocal += h.buildsCoalescedLocal.Load()
+				coalescedCluster += h.buildsCoalescedCluster.Load()
+			}
+			if run != tt.wantRun {
+				t.Errorf("builds run = %d, want %d", run, tt.wantRun)
+			}
+			if coalescedCluster != tt.wantCoalesced {
+				t.Errorf("builds coalesced across the instances = %d, want %d", coalescedCluster, tt.wantCoalesced)
+			}
+			if want := int64(tt.instances) * 2; coalescedLocal != want {
+				t.Errorf("builds coalesced locally = %d, want %d", coalescedLocal, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/metadata"
+)
+
+// canaryCacheControl is the Cache-Control of the tags in canary, which are not the same for all the clients.
+const canaryCacheControl = "private, no-cache"
+
+// canary selects the clients that the rebuilt tags are served to during their soak,
+// the others are served the builds before.
+type canary struct {
+	soak     time.Duration
+	percent  int
+	users    []string
+	networks []*net.IPNet
+}
+
+func newCanary(soak time.Duration, percent int, clients []string) (*canary, error) {
+	if soak <= 0 {
+		return nil, nil
+	}
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("canary percent %d must be from 0 to 100", percent)
+	}
+	c := &canary{
+		soak:    soak,
+		percent: percent,
+	}
+	for _, client := range clients {
+		if _, network, err := net.ParseCIDR(client); err == nil {
+			c.networks = append(c.networks, network)
+		} else if ip := net.ParseIP(client); ip != nil {
+			c.networks = append(c.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			c.users = append(c.users, client)
+		}
+	}
+	return c, nil
+}
+
+// selects reports whether the client is served the tag in canary, the clients of the allowlist always are,
+// a share of the percent of the others are by the hash of their user or address, so that each client sees the same build.
+func (c *canary) selects(user string, ip net.IP, ref string) bool {
+	if user != "" && slices.Contains(c.users, user) {
+		return true
+	}
+	for _, network := range c.networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	if c.percent == 0 {
+		return false
+	}
+	key := user
+	if key == "" {
+		key = ip.String()
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key + "\x00" + ref))
+	return int(h.Sum32()%100) < c.percent
+}
+
+// canaryOf returns the canary of the current build of the tag, after the previous one,
+// the previous canary is kept if the tag is rebuilt during it and no canary is started for the same build.
+func (c *canary) canaryOf(previous metadata.Tag, digest string, now time.Time) *metadata.Canary {
+	if c == nil {
+		return nil
+	}
+	if previous.Canary != nil && now.Before(previous.Canary.Until) {
+		if previous.Canary.Stable.Digest == digest {
+			return nil
+		}
+		if previous.Digest == digest {
+			return previous.Canary
+		}
+		return &metadata.Canary{Stable: previous.Canary.Stable, Until: now.Add(c.soak)}
+	}
+	if previous.Digest == digest {
+		return nil
+	}
+	return &metadata.Canary{Stable: previous.Revision(), Until: now.Add(c.soak)}
+}
+
+// canaryStable reports whether the tag is in canary, and returns the build of the tag to serve to the client out of it,
+// nil if the client is served the current one. The tags at the end of their soak are promoted.
+func (h *Handler) canaryStable(r *http.Request, image, tag string) (*metadata.Revision, bool) {
+	if h.image.canary == nil {
+		return nil, false
+	}
+	record, ok, err := h.image.index.Get(image, tag)
+	if err != nil || !ok || record.Canary == nil {
+		return nil, false
+	}
+	if !time.Now().Before(record.Canary.Until) {
+		if !h.readOnly {
+			h.promoteCanary(r, image, tag)
+		}
+		return nil, false
+	}
+	if h.image.canary.selects(clientIdentity(r), clientIP(r), image+":"+tag) || !fileExists(h.image.BlobsPath(record.Canary.Stable.Digest)) {
+		return nil, true
+	}
+	return &record.Canary.Stable, true
+}
+
+// promoteCanary clears the canary of the tag at the end of its soak, unless the tag is being built again.
+func (h *Handler) promoteCanary(r *http.Request, image, tag string) {
+	var digest string
+	err := h.lockTag(image, tag, func() error {
+		record, ok, err := h.image.index.Get(image, tag)
+		if err != nil || !ok || record.Canary == nil || time.Now().Before(record.Canary.Until) {
+			return err
+		}
+		record.Canary = nil
+		digest = record.Digest
+		return h.image.index.Put(record)
+	})
+	if err != nil {
+		if !errors.Is(err, errTagBuilding) {
+			loggerFrom(r.Context()).Warn("promote canary", "image", image, "tag", tag, "err", err)
+		}
+		return
+	}
+	if digest != "" {
+		loggerFrom(r.Context()).Info("canary promoted", "image", image, "tag", tag, "digest", digest)
+	}
+}
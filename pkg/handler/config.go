@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/logging"
+)
+
+// LoadConfigFiles loads the Images of the config files, the globs and the directories in the order of the paths,
+// the files of a glob or a directory are in the order of their names.
+// A rule replaces the rule of the same name loaded before it, and the rules matching as specifically as each other
+// are matched in the order they are loaded.
+func LoadConfigFiles(paths []string) ([]*v1alpha1.Image, error) {
+	var files []string
+	for _, p := range paths {
+		matched, err := expandConfigPath(p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matched...)
+	}
+
+	var images []*v1alpha1.Image
+	index := map[string]int{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		loaded, err := LoadConfig(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for _, image := range loaded {
+			if i, ok := index[image.Name]; ok {
+				slog.Warn("rule replaced", logging.ComponentKey, "rules", "rule", image.Name, "file", file)
+				images[i] = nil
+			}
+			index[image.Name] = len(images)
+			images = append(images, image)
+		}
+	}
+
+	merged := make([]*v1alpha1.Image, 0, len(images))
+	for _, image := range images {
+		if image != nil {
+			merged = append(merged, image)
+		}
+	}
+	return merged, nil
+}
+
+// expandConfigPath returns the config files of the path, which is a file, a glob or a directory.
+func expandConfigPath(p string) ([]string, error) {
+	if strings.ContainsAny(p, "*?[") {
+		matched, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", p, err)
+		}
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("no config files match %q", p)
+		}
+		var files []string
+		for _, m := range matched {
+			expanded, err := expandConfigPath(m)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, expanded...)
+		}
+		return files, nil
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{p}, nil
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !isRulesFile(name) {
+			continue
+		}
+		files = append(files, filepath.Join(p, name))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// LoadConfig decodes the Images of the YAML or JSON documents of the reader, the empty documents are ignored.
+func LoadConfig(r io.Reader) ([]*v1alpha1.Image, error) {
+	var images []*v1alpha1.Image
+	decoder := yaml.NewYAMLToJSONDecoder(r)
+	for {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("failed to decode %q: %w", raw, err)
+		}
+		if len(raw) == 0 {
+			// Ignore empty documents
+			continue
+		}
+		var img v1alpha1.Image
+		err = json.Unmarshal(raw, &img)
+		if err != nil {
+			return nil, err
+		}
+		if img.TypeMeta.APIVersion != v1alpha1.GroupVersion.String() {
+			return nil, fmt.Errorf("unexpected APIVersion %q", img.TypeMeta.APIVersion)
+		}
+		if img.Kind != v1alpha1.ImageKind {
+			return nil, fmt.Errorf("unexpected Kind %q", img.Kind)
+		}
+
+		images = append(images, &img)
+	}
+	return images, nil
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Inconsistency is a tag whose manifest references blobs that are missing or have the wrong sizes.
+type Inconsistency struct {
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+	Error string `json:"error"`
+}
+
+// checkManifest validates that the blobs referenced by the manifest or the index exist locally
+// with the sizes of their descriptors, the foreign layers are not checked.
+func (b *imageBuilder) checkManifest(raw []byte) error {
+	var manifest struct {
+		Config    *v1.Descriptor  `json:"config,omitempty"`
+		Layers    []v1.Descriptor `json:"layers,omitempty"`
+		Manifests []v1.Descriptor `json:"manifests,omitempty"`
+	}
+	err := json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	if manifest.Config != nil {
+		errs = append(errs, b.checkBlob(*manifest.Config))
+	}
+	for _, layer := range manifest.Layers {
+		if !layer.MediaType.IsDistributable() {
+			continue
+		}
+		errs = append(errs, b.checkBlob(layer))
+	}
+	for _, m := range manifest.Manifests {
+		err := b.checkBlob(m)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		child, err := os.ReadFile(b.BlobsPath(m.Digest.String()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = b.checkManifest(child)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("manifest %s: %w", m.Digest, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *imageBuilder) checkBlob(desc v1.Descriptor) error {
+	stat, err := os.Stat(b.BlobsPath(desc.Digest.String()))
+	if err != nil {
+		if b.isUpstream(desc.Digest.String()) {
+			return nil
+		}
+		return fmt.Errorf("blob %s is missing", desc.Digest)
+	}
+	if stat.Size() != desc.Size {
+		return fmt.Errorf("blob %s has size %d, but the descriptor has %d", desc.Digest, stat.Size(), desc.Size)
+	}
+	return nil
+}
+
+// Check validates the manifests of all the tags.
+func (b *imageBuilder) Check() ([]Inconsistency, error) {
+	inconsistencies := []Inconsistency{}
+	err := filepath.WalkDir(b.cacheManifests, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		err = b.checkManifest(raw)
+		if err != nil {
+			rel, _ := filepath.Rel(b.cacheManifests, path.Dir(p))
+			image, tag := path.Split(filepath.ToSlash(rel))
+			inconsistencies = append(inconsistencies, Inconsistency{
+				Image: strings.TrimSuffix(image, "/"),
+				Tag:   tag,
+				Error: err.Error(),
+			})
+		}
+		return nil
+	})
+	return inconsistencies, err
+}
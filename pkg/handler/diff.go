@@ -0,0 +1,322 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// DiffResult is what jitdi changed in the built image from the base image.
+type DiffResult struct {
+	Ref           string          `json:"ref"`
+	Rule          string          `json:"rule"`
+	BaseImage     string          `json:"baseImage"`
+	Platform      *v1.Platform    `json:"platform,omitempty"`
+	BaseDigest    v1.Hash         `json:"baseDigest"`
+	Digest        v1.Hash         `json:"digest"`
+	AddedLayers   []DiffLayer     `json:"addedLayers"`
+	RemovedLayers []DiffLayer     `json:"removedLayers,omitempty"`
+	AddedSize     int64           `json:"addedSize"`
+	Config        map[string]Diff `json:"config,omitempty"`
+	Annotations   map[string]Diff `json:"annotations,omitempty"`
+	History       []v1.History    `json:"history,omitempty"`
+}
+
+// DiffLayer is a layer added or removed, with the history entry that created it.
+type DiffLayer struct {
+	Digest    v1.Hash         `json:"digest"`
+	MediaType types.MediaType `json:"mediaType"`
+	Size      int64           `json:"size"`
+	CreatedBy string          `json:"createdBy,omitempty"`
+	Comment   string          `json:"comment,omitempty"`
+}
+
+// Diff is a value of the base image changed in the built image, the absent values are omitted.
+type Diff struct {
+	Base  any `json:"base,omitempty"`
+	Built any `json:"built,omitempty"`
+}
+
+// Diff compares the built image of the platform in the cache with its base image.
+func (b *imageBuilder) Diff(ctx context.Context, image, tag string, meta *pattern.Action, platform v1.Platform) (*DiffResult, error) {
+	manifest, err := b.readManifest(b.ManifestPath(image, tag))
+	if err != nil {
+		return nil, err
+	}
+
+	raw := manifest.content
+	digest, err := v1.NewHash(manifest.digest)
+	if err != nil {
+		return nil, err
+	}
+	var builtPlatform *v1.Platform
+	var builtAnnotations map[string]string
+	if types.MediaType(manifest.mediaType).IsIndex() {
+		index, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		desc, ok := selectPlatform(index, platform)
+		if !ok {
+			return nil, fmt.Errorf("no image of platform %v in %s:%s", platform, image, tag)
+		}
+		raw, err = os.ReadFile(b.BlobsPath(desc.Digest.String()))
+		if err != nil {
+			return nil, err
+		}
+		digest = desc.Digest
+		builtPlatform = desc.Platform
+		builtAnnotations = index.Annotations
+	}
+	built, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	if builtAnnotations == nil {
+		builtAnnotations = built.Annotations
+	}
+	builtConfigRaw, err := os.ReadFile(b.BlobsPath(built.Config.Digest.String()))
+	if err != nil {
+		return nil, err
+	}
+	builtConfig, err := v1.ParseConfigFile(bytes.NewReader(builtConfigRaw))
+	if err != nil {
+		return nil, err
+	}
+
+	base, baseAnnotations, err := b.diffBaseImage(ctx, meta, builtPlatform, platform)
+	if err != nil {
+		return nil, err
+	}
+	baseManifest, err := base.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting base manifest: %w", err)
+	}
+	baseConfig, err := base.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting base config: %w", err)
+	}
+	baseDigest, err := base.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("getting base digest: %w", err)
+	}
+	if baseAnnotations == nil {
+		baseAnnotations = baseManifest.Annotations
+	}
+
+	result := &DiffResult{
+		Ref:         image + ":" + tag,
+		Rule:        meta.Rule().Name(),
+		BaseImage:   meta.GetBaseImage(),
+		Platform:    builtPlatform,
+		BaseDigest:  baseDigest,
+		Digest:      digest,
+		AddedLayers: []DiffLayer{},
+		Config:      diffConfig(baseConfig, builtConfig),
+		Annotations: diffMap(baseAnnotations, builtAnnotations),
+	}
+
+	result.AddedLayers = diffLayers(built, builtConfig, baseManifest)
+	result.RemovedLayers = diffLayers(baseManifest, baseConfig, built)
+	for _, layer := range result.AddedLayers {
+		result.AddedSize += layer.Size
+	}
+	if len(builtConfig.History) > len(baseConfig.History) {
+		result.History = builtConfig.History[len(baseConfig.History):]
+	}
+	return result, nil
+}
+
+// diffBaseImage returns the base image of the platform that the image was built from,
+// with the annotations of the index if it is one.
+func (b *imageBuilder) diffBaseImage(ctx context.Context, meta *pattern.Action, builtPlatform *v1.Platform, platform v1.Platform) (v1.Image, map[string]string, error) {
+	ctx = withRuleRemote(ctx, meta.Rule().Remote())
+	src := meta.GetBaseImage()
+	ref, remoteOptions, err := b.parseReference(ctx, src, meta.IsInsecure())
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing reference %q: %w", src, err)
+	}
+	rmt, err := remote.Get(ref, append(remoteOptions, remote.WithContext(ctx))...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting remote %q: %w", src, err)
+	}
+
+	switch rmt.MediaType {
+	case types.DockerManifestList, types.OCIImageIndex:
+		index, err := rmt.ImageIndex()
+		if err != nil {
+			return nil, nil, fmt.Errorf("getting image index: %w", err)
+		}
+		indexManifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, nil, fmt.Errorf("getting index manifest: %w", err)
+		}
+		if builtPlatform != nil {
+			platform = *builtPlatform
+		}
+		desc, ok := selectPlatform(indexManifest, platform)
+		if !ok {
+			return nil, nil, fmt.Errorf("no image of platform %v in %q", platform, src)
+		}
+		img, err := index.Image(desc.Digest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("getting image %q: %w", desc.Digest, err)
+		}
+		return img, indexManifest.Annotations, nil
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		img, err := rmt.Schema1()
+		if err != nil {
+			return nil, nil, fmt.Errorf("getting image: %w", err)
+		}
+		img, err = convertSchema1(img)
+		if err != nil {
+			return nil, nil, fmt.Errorf("converting schema1 image %q: %w", src, err)
+		}
+		return img, nil, nil
+	}
+	img, err := rmt.Image()
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting image: %w", err)
+	}
+	return img, nil, nil
+}
+
+// selectPlatform returns the descriptor of the image of the platform in the index.
+func selectPlatform(index *v1.IndexManifest, platform v1.Platform) (v1.Descriptor, bool) {
+	for _, desc := range index.Manifests {
+		if desc.MediaType.IsImage() && desc.Platform != nil && desc.Platform.Satisfies(platform) {
+			return desc, true
+		}
+	}
+	if len(index.Manifests) == 1 {
+		return index.Manifests[0], true
+	}
+	return v1.Descriptor{}, false
+}
+
+// diffLayers returns the layers of the manifest that are not in the other one,
+// with the non empty history entries of the config matched to the layers in order.
+func diffLayers(manifest *v1.Manifest, configFile *v1.ConfigFile, other *v1.Manifest) []DiffLayer {
+	var histories []v1.History
+	for _, history := range configFile.History {
+		if !history.EmptyLayer {
+			histories = append(histories, history)
+		}
+	}
+	if len(histories) != len(manifest.Layers) {
+		histories = nil
+	}
+
+	seen := make(map[v1.Hash]struct{}, len(other.Layers))
+	for _, layer := range other.Layers {
+		seen[layer.Digest] = struct{}{}
+	}
+
+	var layers []DiffLayer
+	for i, layer := range manifest.Layers {
+		if _, ok := seen[layer.Digest]; ok {
+			continue
+		}
+		diff := DiffLayer{
+			Digest:    layer.Digest,
+			MediaType: layer.MediaType,
+			Size:      layer.Size,
+		}
+		if histories != nil {
+			diff.CreatedBy = histories[i].CreatedBy
+			diff.Comment = histories[i].Comment
+		}
+		layers = append(layers, diff)
+	}
+	return layers
+}
+
+// diffConfig returns the fields of the configs that differ, the environment variables and the labels are compared one by one.
+func diffConfig(base, built *v1.ConfigFile) map[string]Diff {
+	diffs := map[string]Diff{}
+	if !base.Created.Equal(built.Created.Time) {
+		diffs["created"] = Diff{Base: base.Created, Built: built.Created}
+	}
+	if base.Config.User != built.Config.User {
+		diffs["user"] = Diff{Base: base.Config.User, Built: built.Config.User}
+	}
+	if base.Config.WorkingDir != built.Config.WorkingDir {
+		diffs["workingDir"] = Diff{Base: base.Config.WorkingDir, Built: built.Config.WorkingDir}
+	}
+	if !slices.Equal(base.Config.Entrypoint, built.Config.Entrypoint) {
+		diffs["entrypoint"] = Diff{Base: base.Config.Entrypoint, Built: built.Config.Entrypoint}
+	}
+	if !slices.Equal(base.Config.Cmd, built.Config.Cmd) {
+		diffs["cmd"] = Diff{Base: base.Config.Cmd, Built: built.Config.Cmd}
+	}
+	if base.Config.StopSignal != built.Config.StopSignal {
+		diffs["stopSignal"] = Diff{Base: base.Config.StopSignal, Built: built.Config.StopSignal}
+	}
+	if !reflect.DeepEqual(base.Config.Healthcheck, built.Config.Healthcheck) {
+		diffs["healthcheck"] = Diff{Base: base.Config.Healthcheck, Built: built.Config.Healthcheck}
+	}
+	if basePorts, builtPorts := setKeys(base.Config.ExposedPorts), setKeys(built.Config.ExposedPorts); !slices.Equal(basePorts, builtPorts) {
+		diffs["exposedPorts"] = Diff{Base: basePorts, Built: builtPorts}
+	}
+	if baseVolumes, builtVolumes := setKeys(base.Config.Volumes), setKeys(built.Config.Volumes); !slices.Equal(baseVolumes, builtVolumes) {
+		diffs["volumes"] = Diff{Base: baseVolumes, Built: builtVolumes}
+	}
+	for k, d := range diffMap(envMap(base.Config.Env), envMap(built.Config.Env)) {
+		diffs["env."+k] = d
+	}
+	for k, d := range diffMap(base.Config.Labels, built.Config.Labels) {
+		diffs["labels."+k] = d
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	return diffs
+}
+
+// setKeys returns the sorted keys of the ports or the volumes of a config.
+func setKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func diffMap(base, built map[string]string) map[string]Diff {
+	diffs := map[string]Diff{}
+	for k, v := range base {
+		if nv, ok := built[k]; !ok || nv != v {
+			diffs[k] = Diff{Base: v, Built: built[k]}
+		}
+	}
+	for k, v := range built {
+		if _, ok := base[k]; !ok {
+			diffs[k] = Diff{Built: v}
+		}
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	return diffs
+}
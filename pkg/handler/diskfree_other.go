@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd)
+
+package handler
+
+import (
+	"errors"
+)
+
+// diskSpace is not supported on this platform.
+func diskSpace(path string) (*DiskSpace, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd
+
+package handler
+
+import (
+	"syscall"
+)
+
+// diskSpace returns the space of the file system of the path.
+func diskSpace(path string) (*DiskSpace, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskSpace{
+		Path:       path,
+		FreeBytes:  uint64(stat.Bavail) * uint64(stat.Bsize),
+		TotalBytes: uint64(stat.Blocks) * uint64(stat.Bsize),
+	}, nil
+}
@@ -0,0 +1,399 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// DryRunResult is the image that would be built for a reference.
+type DryRunResult struct {
+	Ref        string          `json:"ref"`
+	Rule       string          `json:"rule"`
+	BaseImage  string          `json:"baseImage"`
+	BaseDigest v1.Hash         `json:"baseDigest"`
+	MediaType  types.MediaType `json:"mediaType"`
+	Images     []DryRunImage   `json:"images"`
+	// TotalSize is the size of the config and the layers of all the images, the shared blobs are counted once.
+	TotalSize int64 `json:"totalSize"`
+	// Exact is false if the size of any of the new layers is unknown.
+	Exact bool `json:"exact"`
+}
+
+// DryRunImage is an image that would be built, the base layers followed by the new ones.
+type DryRunImage struct {
+	Platform   *v1.Platform    `json:"platform,omitempty"`
+	BaseDigest v1.Hash         `json:"baseDigest"`
+	MediaType  types.MediaType `json:"mediaType"`
+	Config     v1.Descriptor   `json:"config"`
+	Layers     []DryRunLayer   `json:"layers"`
+	Size       int64           `json:"size"`
+}
+
+// DryRunLayer is a layer of an image that would be built,
+// the digests of the new layers are only known after building them and their sizes are estimated from the files.
+type DryRunLayer struct {
+	MediaType   types.MediaType `json:"mediaType"`
+	Digest      string          `json:"digest,omitempty"`
+	Size        int64           `json:"size"`
+	Source      string          `json:"source,omitempty"`
+	Destination string          `json:"destination,omitempty"`
+	URLs        []string        `json:"urls,omitempty"`
+}
+
+// DryRun resolves the base image and the metadata of the mutates of the action without downloading or writing any blob.
+func (b *imageBuilder) DryRun(ctx context.Context, ref string, meta *pattern.Action) (*DryRunResult, error) {
+	ctx = withRuleRemote(ctx, meta.Rule().Remote())
+	src := meta.GetBaseImage()
+	baseRef, remoteOptions, err := b.parseReference(ctx, src, meta.IsInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("parsing reference %q: %w", src, err)
+	}
+	remoteOptions = append(remoteOptions, remote.WithContext(ctx))
+
+	rmt, err := remote.Get(baseRef, remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("getting remote %q: %w", src, err)
+	}
+
+	result := &DryRunResult{
+		Ref:        ref,
+		Rule:       meta.Rule().Name(),
+		BaseImage:  src,
+		BaseDigest: rmt.Digest,
+		MediaType:  rmt.MediaType,
+		Exact:      true,
+	}
+
+	d := &dryRun{
+		builder:   b,
+		ctx:       ctx,
+		meta:      meta,
+		sizes:     map[string]int64{},
+		remoteOpt: remoteOptions,
+	}
+
+	switch rmt.MediaType {
+	default:
+		return nil, fmt.Errorf("unknown media type %q", rmt.MediaType)
+	case types.DockerManifestList, types.OCIImageIndex:
+		index, err := rmt.ImageIndex()
+		if err != nil {
+			return nil, fmt.Errorf("getting image index: %w", err)
+		}
+		indexManifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, fmt.Errorf("getting index manifest: %w", err)
+		}
+		for _, desc := range indexManifest.Manifests {
+			if !meta.MatchPlatform(desc.Platform) {
+				continue
+			}
+			img, err := index.Image(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("getting image %q: %w", desc.Digest, err)
+			}
+			image, err := d.image(img, desc.Platform)
+			if err != nil {
+				return nil, err
+			}
+			result.Images = append(result.Images, *image)
+		}
+		if len(result.Images) == 0 {
+			return nil, fmt.Errorf("no valid images")
+		}
+	case types.OCIManifestSchema1, types.DockerManifestSchema2:
+		img, err := rmt.Image()
+		if err != nil {
+			return nil, fmt.Errorf("getting image: %w", err)
+		}
+		if p := imagePlatform(img, nil); !meta.MatchPlatform(p) {
+			return nil, fmt.Errorf("platform %v of %q is not matched by the rule", p, src)
+		}
+		image, err := d.image(img, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.Images = append(result.Images, *image)
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		return nil, fmt.Errorf("dry run of docker schema1 image %q is not supported", src)
+	}
+
+	seen := map[string]struct{}{}
+	for _, image := range result.Images {
+		blobs := append([]DryRunLayer{{Digest: image.Config.Digest.String(), Size: image.Config.Size}}, image.Layers...)
+		for _, blob := range blobs {
+			if blob.Size < 0 {
+				result.Exact = false
+				continue
+			}
+			if len(blob.URLs) != 0 {
+				continue
+			}
+			if blob.Digest != "" {
+				if _, ok := seen[blob.Digest]; ok {
+					continue
+				}
+				seen[blob.Digest] = struct{}{}
+			}
+			result.TotalSize += blob.Size
+		}
+	}
+	return result, nil
+}
+
+type dryRun struct {
+	builder   *imageBuilder
+	ctx       context.Context
+	meta      *pattern.Action
+	sizes     map[string]int64
+	remoteOpt []remote.Option
+}
+
+func (d *dryRun) image(img v1.Image, platform *v1.Platform) (*DryRunImage, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("getting digest: %w", err)
+	}
+	if platform == nil {
+		platform = imagePlatform(img, nil)
+	}
+
+	var layerMediaType types.MediaType
+	switch manifest.MediaType {
+	default:
+		return nil, fmt.Errorf("unknown media type %q", manifest.MediaType)
+	case types.OCIManifestSchema1:
+		layerMediaType = types.OCILayer
+	case types.DockerManifestSchema2:
+		layerMediaType = types.DockerLayer
+	}
+
+	image := &DryRunImage{
+		Platform:   platform,
+		BaseDigest: digest,
+		MediaType:  manifest.MediaType,
+		Config:     manifest.Config,
+	}
+	dropped, err := droppedLayers(manifest, d.meta.DropLayers())
+	if err != nil {
+		return nil, fmt.Errorf("drop layers: %w", err)
+	}
+	for i, layer := range manifest.Layers {
+		if dropped[i] {
+			continue
+		}
+		image.Layers = append(image.Layers, DryRunLayer{
+			MediaType: layer.MediaType,
+			Digest:    layer.Digest.String(),
+			Size:      layer.Size,
+			URLs:      layer.URLs,
+		})
+	}
+
+	// The layers of the mutates are listed by their layer orders like they are appended.
+	mutates := d.meta.GetMutates(platform)
+	slices.SortStableFunc(mutates, func(a, b v1alpha1.Mutate) int {
+		return cmp.Compare(a.LayerOrder, b.LayerOrder)
+	})
+	for _, m := range mutates {
+		layers, err := d.mutate(m, layerMediaType)
+		if err != nil {
+			return nil, err
+		}
+		image.Layers = append(image.Layers, layers...)
+	}
+
+	image.Size = image.Config.Size
+	for _, layer := range image.Layers {
+		if layer.Size > 0 && len(layer.URLs) == 0 {
+			image.Size += layer.Size
+		}
+	}
+	return image, nil
+}
+
+func (d *dryRun) mutate(m v1alpha1.Mutate, layerMediaType types.MediaType) ([]DryRunLayer, error) {
+	if m.File != nil {
+		_, err := parseChunkSize(m.File.ChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		if m.File.Template != "" {
+			// The Secrets are not read, the size of the template is an estimate of the size of the file.
+			return fileLayers(layerMediaType, "template", m.File.Destination, int64(len(m.File.Template))), nil
+		}
+		source := m.File.Source
+		if digestRegexp.MatchString(source) {
+			source = d.builder.UploadedBlobPath(source)
+		}
+		if m.File.Extract != nil {
+			// The size of the extracted files is not known before the archive is downloaded.
+			return fileLayers(layerMediaType, m.File.Source, m.File.Destination, -1), nil
+		}
+		size, err := d.sourceSize(source)
+		if err != nil {
+			return nil, fmt.Errorf("file %q: %w", m.File.Source, err)
+		}
+		return fileLayers(layerMediaType, m.File.Source, m.File.Destination, size), nil
+	} else if m.Ollama != nil {
+		ref, remoteOptions, err := d.builder.parseReference(d.ctx, m.Ollama.Model, false)
+		if err != nil {
+			return nil, fmt.Errorf("parsing reference %q: %w", m.Ollama.Model, err)
+		}
+		img, err := remote.Image(ref, append(remoteOptions, remote.WithContext(d.ctx))...)
+		if err != nil {
+			return nil, fmt.Errorf("ollama model %q: %w", m.Ollama.Model, err)
+		}
+		rawManifest, err := img.RawManifest()
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := img.Manifest()
+		if err != nil {
+			return nil, err
+		}
+		modelName := m.Ollama.ModelName
+		if modelName == "" {
+			modelName = strings.Replace(m.Ollama.Model, ":", "/", 1)
+		}
+		// The manifest and the config of the model are added before its layers.
+		layers := []DryRunLayer{
+			{MediaType: layerMediaType, Size: estimateTarSize(int64(len(rawManifest))), Source: m.Ollama.Model, Destination: path.Join(m.Ollama.WorkDir, "manifests", modelName)},
+			{MediaType: layerMediaType, Size: estimateTarSize(manifest.Config.Size), Source: m.Ollama.Model, Destination: path.Join(m.Ollama.WorkDir, "blobs", manifest.Config.Digest.String())},
+		}
+		for _, layer := range manifest.Layers {
+			layers = append(layers, DryRunLayer{
+				MediaType:   layerMediaType,
+				Size:        estimateTarSize(layer.Size),
+				Source:      m.Ollama.Model,
+				Destination: path.Join(m.Ollama.WorkDir, "blobs", layer.Digest.String()),
+			})
+		}
+		return layers, nil
+	} else if m.Config != nil {
+		// The config adds no layer.
+		return nil, nil
+	} else if m.Patch != nil {
+		// The file is not read from the base image, its size is unknown.
+		return fileLayers(layerMediaType, "patch", m.Patch.Path, -1), nil
+	} else if m.User != nil {
+		// The files of the user database are not read from the base image, their sizes are unknown.
+		return fileLayers(layerMediaType, "user", "/etc/passwd", -1), nil
+	} else if m.TrustedCA != nil {
+		// The bundles are not read from the base image, their sizes are unknown.
+		return fileLayers(layerMediaType, "trustedCA", trustStores[0].bundles[0], -1), nil
+	} else if m.Binary != nil {
+		// The binary of the platform is not resolved, its size is unknown.
+		return fileLayers(layerMediaType, "binary", m.Binary.Destination, -1), nil
+	} else if m.Locale != nil {
+		// The zoneinfo file is not read from the base image, its size is unknown.
+		return fileLayers(layerMediaType, "locale", "/etc/localtime", -1), nil
+	} else if m.Render != nil {
+		// The template is not rendered, its size is an estimate of the size of the file.
+		size := int64(len(m.Render.Template))
+		if m.Render.Source != "" {
+			size = -1
+		}
+		return fileLayers(layerMediaType, "render", m.Render.Destination, size), nil
+	} else if m.HuggingFace != nil {
+		hf := m.HuggingFace
+		_, err := parseChunkSize(hf.ChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		builder := NewHuggingFaceLayerBuilder(d.builder.client, os.Getenv("HF_ENDPOINT"), d.builder.cacheHuggingFace, nil, d.builder.concurrency)
+		_, files, err := builder.Files(d.ctx, hf.Repo, hf.Revision, hf.Token, hf.Include, hf.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("huggingface %q: %w", hf.Repo, err)
+		}
+		var layers []DryRunLayer
+		for _, file := range files {
+			size := file.Size
+			if size == 0 {
+				size = -1
+			}
+			layers = append(layers, fileLayers(layerMediaType, hf.Repo+"/"+file.Filename, path.Join(hf.WorkDir, file.Filename), size)...)
+		}
+		return layers, nil
+	}
+	return nil, nil
+}
+
+// sourceSize returns the size of the files of the source, or -1 if it is unknown.
+func (d *dryRun) sourceSize(source string) (int64, error) {
+	if size, ok := d.sizes[source]; ok {
+		return size, nil
+	}
+
+	var size int64
+	u, err := url.Parse(source)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		req, err := http.NewRequestWithContext(d.ctx, http.MethodHead, source, nil)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := d.builder.client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("http.Head(%q): %w", source, fmt.Errorf("status code %d", resp.StatusCode))
+		}
+		size = resp.ContentLength
+	} else {
+		err = filepath.WalkDir(source, func(p string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	d.sizes[source] = size
+	return size, nil
+}
+
+// fileLayers returns the layer of the file, the FileLayerBuilder splits the layers on the boundaries of the files
+// so that a file is whole in a single layer whatever the chunk size, the files of a directory are estimated as one layer.
+func fileLayers(mediaType types.MediaType, source, destination string, size int64) []DryRunLayer {
+	return []DryRunLayer{{MediaType: mediaType, Size: estimateTarSize(size), Source: source, Destination: destination}}
+}
+
+// estimateTarSize estimates the size of the uncompressed layer of a file, with its header and the end of the archive.
+func estimateTarSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	return 512 + (size+511)/512*512 + 1024
+}
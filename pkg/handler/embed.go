@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrNoRule is the error of the refs that no rule matches.
+	ErrNoRule = errors.New("no rule matches")
+	// ErrReadOnly is the error of the changes of the cache of the read-only handlers.
+	ErrReadOnly = errors.New("the cache is read-only")
+)
+
+// splitRef returns the image and the tag of the ref, the tag defaults to latest.
+func splitRef(ref string) (string, string) {
+	if !strings.Contains(path.Base(ref), ":") {
+		ref += ":latest"
+	}
+	i := strings.LastIndex(ref, ":")
+	return ref[:i], ref[i+1:]
+}
+
+// Build builds the tag of the ref even if it is in the cache, or waits for the build of the tag already running,
+// and returns the build. The tag of the ref defaults to latest.
+func (h *Handler) Build(ctx context.Context, ref string) (Build, error) {
+	if h.readOnly {
+		return Build{}, ErrReadOnly
+	}
+	image, tag := splitRef(ref)
+	ref = image + ":" + tag
+	if h.matchRule(image, tag) == nil {
+		return Build{}, fmt.Errorf("%w %q", ErrNoRule, ref)
+	}
+	err := h.build(ctx, image, tag)
+	record, ok := h.builds.Latest(ref)
+	if !ok {
+		return Build{}, err
+	}
+	build := record.Build()
+	if err == nil && build.Status == BuildFailed {
+		err = errors.New(build.Error)
+	}
+	return build, err
+}
+
+// Invalidate removes the tag of the ref from the cache so that it is built again on the next pull,
+// and reports whether it was in the cache. The tag of the ref defaults to latest.
+func (h *Handler) Invalidate(ctx context.Context, ref string) (bool, error) {
+	if h.readOnly {
+		return false, ErrReadOnly
+	}
+	image, tag := splitRef(ref)
+	deleted, err := h.image.DeleteManifest(image, tag)
+	if err != nil {
+		return false, err
+	}
+	if deleted {
+		loggerFrom(ctx).Info("tag invalidated", "image", image, "tag", tag)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,314 @@
+package handler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// The annotations and the media types of the layers encrypted with OCIcrypt.
+const (
+	annotationEncKeysJWE = "org.opencontainers.image.enc.keys.jwe"
+	annotationEncPub     = "org.opencontainers.image.enc.pub"
+
+	mediaTypeLayerEnc     types.MediaType = "application/vnd.oci.image.layer.v1.tar+encrypted"
+	mediaTypeLayerGzipEnc types.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip+encrypted"
+
+	// cipherAES256CTR is the block cipher of the layers, AES-256-CTR with a HMAC-SHA256 of the ciphertext.
+	cipherAES256CTR = "AES_256_CTR_HMAC_SHA256"
+)
+
+// loadRecipients loads the RSA public keys of the recipients, the PEM themselves or "jwe:<path>" of a PEM file.
+func loadRecipients(recipients []string) ([]*rsa.PublicKey, error) {
+	keys := make([]*rsa.PublicKey, 0, len(recipients))
+	for _, recipient := range recipients {
+		raw := []byte(recipient)
+		if !strings.HasPrefix(strings.TrimSpace(recipient), "-----BEGIN") {
+			p, ok := strings.CutPrefix(recipient, "jwe:")
+			if !ok {
+				return nil, fmt.Errorf("recipient %q: must be a PEM public key or jwe:<path>", recipient)
+			}
+			var err error
+			raw, err = os.ReadFile(p)
+			if err != nil {
+				return nil, fmt.Errorf("recipient %q: %w", recipient, err)
+			}
+		}
+		key, err := parseRecipient(raw)
+		if err != nil {
+			return nil, fmt.Errorf("recipient %q: %w", abbreviate(recipient), err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseRecipient(raw []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("only RSA public keys are supported, got %T", key)
+	}
+	return rsaKey, nil
+}
+
+// abbreviate shortens the inline PEM of the recipients in the errors.
+func abbreviate(recipient string) string {
+	if strings.HasPrefix(strings.TrimSpace(recipient), "-----BEGIN") {
+		return "inline PEM"
+	}
+	return recipient
+}
+
+// encryptMutations encrypts the layers of the mutations for the recipients,
+// the encrypted layers are only valid in the OCI manifests.
+func encryptMutations(mutations []mutation, recipients []string, mediaType types.MediaType, format string) ([]mutation, error) {
+	if format != outputMediaTypeOCI && (format != "" || mediaType != types.OCIManifestSchema1) {
+		return nil, fmt.Errorf("the encrypted layers need the OCI manifests, set outputMediaType to %q", outputMediaTypeOCI)
+	}
+	keys, err := loadRecipients(recipients)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range mutations {
+		mutations[i].addendums, err = encryptAddendums(m.addendums, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mutations, nil
+}
+
+// encryptAddendums encrypts the layers of the addendums for the recipients.
+func encryptAddendums(addendums []mutate.Addendum, recipients []*rsa.PublicKey) ([]mutate.Addendum, error) {
+	encrypted := make([]mutate.Addendum, 0, len(addendums))
+	for _, add := range addendums {
+		layer, annotations, err := encryptLayer(add.Layer, recipients)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range add.Annotations {
+			annotations[k] = v
+		}
+		add.Layer = layer
+		add.MediaType = layer.mediaType
+		add.Annotations = annotations
+		encrypted = append(encrypted, add)
+	}
+	return encrypted, nil
+}
+
+// publicOptions and privateOptions are the options of the block cipher of OCIcrypt,
+// the private ones are only readable by the recipients.
+type publicOptions struct {
+	Cipher        string            `json:"cipher"`
+	Hmac          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+type privateOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// encryptLayer returns the layer encrypted with a new key and the annotations to decrypt it,
+// which wrap the key in a JWE for the recipients like OCIcrypt.
+func encryptLayer(layer v1.Layer, recipients []*rsa.PublicKey) (*encryptedLayer, map[string]string, error) {
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return nil, nil, err
+	}
+	plainDigest, err := layer.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l := &encryptedLayer{
+		Layer:     layer,
+		key:       make([]byte, 32),
+		nonce:     make([]byte, aes.BlockSize),
+		mediaType: mediaTypeLayerGzipEnc,
+	}
+	if mediaType == types.OCIUncompressedLayer || mediaType == types.DockerUncompressedLayer {
+		l.mediaType = mediaTypeLayerEnc
+	}
+	for _, b := range [][]byte{l.key, l.nonce} {
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The layer is encrypted once for its digest and the HMAC, and again on the fly when it is read.
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+	digest := sha256.New()
+	mac := hmac.New(sha256.New, l.key)
+	_, err = io.Copy(io.MultiWriter(digest, mac), rc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encrypt layer %s: %w", plainDigest, err)
+	}
+	l.digest = v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", digest.Sum(nil))}
+
+	pub, err := json.Marshal(publicOptions{
+		Cipher:        cipherAES256CTR,
+		Hmac:          mac.Sum(nil),
+		CipherOptions: map[string][]byte{},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, err := json.Marshal(privateOptions{
+		SymmetricKey:  l.key,
+		Digest:        plainDigest.String(),
+		CipherOptions: map[string][]byte{"nonce": l.nonce},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	jwe, err := encryptJWE(priv, recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, map[string]string{
+		annotationEncPub:     base64.StdEncoding.EncodeToString(pub),
+		annotationEncKeysJWE: base64.StdEncoding.EncodeToString(jwe),
+	}, nil
+}
+
+// encryptedLayer is the layer encrypted with AES-256-CTR, it keeps the DiffID of the plain layer
+// as the layers are decrypted before they are unpacked.
+type encryptedLayer struct {
+	v1.Layer
+	key, nonce []byte
+	digest     v1.Hash
+	mediaType  types.MediaType
+}
+
+func (l *encryptedLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func (l *encryptedLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+func (l *encryptedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(l.key)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &encryptedReader{
+		Reader: cipher.StreamReader{S: cipher.NewCTR(block, l.nonce), R: rc},
+		Closer: rc,
+	}, nil
+}
+
+type encryptedReader struct {
+	io.Reader
+	io.Closer
+}
+
+// encryptJWE encrypts the payload in a JWE of the JSON serialization for the recipients,
+// with A256GCM and the content key wrapped with RSA-OAEP for each recipient.
+func encryptJWE(payload []byte, recipients []*rsa.PublicKey) ([]byte, error) {
+	type recipient struct {
+		Header       map[string]string `json:"header"`
+		EncryptedKey string            `json:"encrypted_key"`
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	for _, b := range [][]byte{cek, iv} {
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	list := make([]recipient, 0, len(recipients))
+	for _, key := range recipients {
+		wrapped, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, cek, nil)
+		if err != nil {
+			return nil, fmt.Errorf("wrap key: %w", err)
+		}
+		list = append(list, recipient{
+			Header:       map[string]string{"alg": "RSA-OAEP"},
+			EncryptedKey: b64(wrapped),
+		})
+	}
+
+	protected := b64([]byte(`{"enc":"A256GCM"}`))
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, iv, payload, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return json.Marshal(struct {
+		Protected  string      `json:"protected"`
+		Recipients []recipient `json:"recipients"`
+		IV         string      `json:"iv"`
+		Ciphertext string      `json:"ciphertext"`
+		Tag        string      `json:"tag"`
+	}{
+		Protected:  protected,
+		Recipients: list,
+		IV:         b64(iv),
+		Ciphertext: b64(ciphertext),
+		Tag:        b64(tag),
+	})
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// The error codes of the distribution spec.
+const (
+	errCodeUnknown         = "UNKNOWN"
+	errCodeUnsupported     = "UNSUPPORTED"
+	errCodeManifestUnknown = "MANIFEST_UNKNOWN"
+	errCodeUnauthorized    = "UNAUTHORIZED"
+	errCodeDenied          = "DENIED"
+	errCodeNameInvalid     = "NAME_INVALID"
+	errCodeTagInvalid      = "TAG_INVALID"
+
+	errCodeBlobUnknown       = "BLOB_UNKNOWN"
+	errCodeBlobUploadUnknown = "BLOB_UPLOAD_UNKNOWN"
+	errCodeBlobUploadInvalid = "BLOB_UPLOAD_INVALID"
+	errCodeDigestInvalid     = "DIGEST_INVALID"
+)
+
+type registryErrors struct {
+	Errors []registryErrorDetail `json:"errors"`
+}
+
+type registryErrorDetail struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Detail  *requestDetail `json:"detail,omitempty"`
+}
+
+type requestDetail struct {
+	RequestID string `json:"requestId"`
+}
+
+// registryError writes the error in the format of the distribution spec,
+// with the ID of the request in the detail so that it can be found in the logs.
+func registryError(w http.ResponseWriter, status int, code, message string) {
+	detail := registryErrorDetail{
+		Code:    code,
+		Message: message,
+	}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		detail.Detail = &requestDetail{RequestID: id}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(registryErrors{
+		Errors: []registryErrorDetail{detail},
+	})
+}
@@ -0,0 +1,269 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// The annotations of the image in the index of an OCI image layout, the tag and the name that containerd imports it as.
+const (
+	annotationRefName        = "org.opencontainers.image.ref.name"
+	annotationContainerdName = "io.containerd.image.name"
+)
+
+// exportLayout is a built tag resolved to the index and the blobs of an OCI image layout.
+type exportLayout struct {
+	index []byte
+	blobs []v1.Hash
+}
+
+// Export resolves the built tag to an OCI image layout, which containerd imports with `ctr image import`,
+// only the image of the platform if it is not nil. The blobs left in the upstream registries are stored first,
+// so that writing the layout only reads the blobs.
+func (b *imageBuilder) Export(ctx context.Context, image, tag, name string, platform *v1.Platform) (*exportLayout, error) {
+	raw, err := os.ReadFile(b.ManifestPath(image, tag))
+	if err != nil {
+		return nil, err
+	}
+	root, err := manifestDescriptor(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if platform != nil && root.MediaType.IsIndex() {
+		var index v1.IndexManifest
+		err = json.Unmarshal(raw, &index)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, desc := range index.Manifests {
+			if desc.MediaType.IsImage() && desc.Platform != nil && desc.Platform.Satisfies(*platform) {
+				root, found = desc, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no image of platform %s: %w", platform, os.ErrNotExist)
+		}
+		root.Platform = nil
+	}
+
+	layout := &exportLayout{}
+	err = b.exportBlobs(ctx, root, map[v1.Hash]struct{}{}, &layout.blobs)
+	if err != nil {
+		return nil, err
+	}
+
+	root.Annotations = map[string]string{
+		annotationRefName:        tag,
+		annotationContainerdName: name,
+	}
+	layout.index, err = json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []v1.Descriptor{root},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// writeTar writes the layout as a tarball with the blobs of the builder.
+func (l *exportLayout) writeTar(w io.Writer, b *imageBuilder) error {
+	tw := tar.NewWriter(w)
+	err := writeTarFile(tw, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	if err != nil {
+		return err
+	}
+	err = writeTarFile(tw, "index.json", l.index)
+	if err != nil {
+		return err
+	}
+	for _, digest := range l.blobs {
+		err = b.writeTarBlob(tw, digest)
+		if err != nil {
+			return fmt.Errorf("write blob %s: %w", digest, err)
+		}
+	}
+	return tw.Close()
+}
+
+// manifestDescriptor returns the descriptor of the raw manifest or index.
+func manifestDescriptor(raw []byte) (v1.Descriptor, error) {
+	var manifest struct {
+		MediaType types.MediaType `json:"mediaType"`
+	}
+	err := json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	hash, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{
+		MediaType: manifest.MediaType,
+		Size:      int64(len(raw)),
+		Digest:    hash,
+	}, nil
+}
+
+// exportBlobs appends the blobs referenced by the descriptor to the blobs, the descriptor itself first.
+// The blobs left in the upstream registries are stored, the foreign layers are skipped.
+func (b *imageBuilder) exportBlobs(ctx context.Context, desc v1.Descriptor, seen map[v1.Hash]struct{}, blobs *[]v1.Hash) error {
+	if _, ok := seen[desc.Digest]; ok || !desc.MediaType.IsDistributable() {
+		return nil
+	}
+	seen[desc.Digest] = struct{}{}
+
+	digest := desc.Digest.String()
+	if !fileExists(b.BlobsPath(digest)) {
+		repo, rt, ok, err := b.upstreamRepository(ctx, digest)
+		if !ok {
+			return fmt.Errorf("blob %s is missing", digest)
+		}
+		if err == nil {
+			err = b.saveUpstreamBlob(ctx, repo, rt, digest)
+		}
+		if err != nil {
+			return fmt.Errorf("fetch upstream blob %s: %w", digest, err)
+		}
+	}
+	*blobs = append(*blobs, desc.Digest)
+
+	if !desc.MediaType.IsIndex() && !desc.MediaType.IsImage() {
+		return nil
+	}
+	raw, err := os.ReadFile(b.BlobsPath(digest))
+	if err != nil {
+		return err
+	}
+	var manifest struct {
+		Config    *v1.Descriptor  `json:"config,omitempty"`
+		Layers    []v1.Descriptor `json:"layers,omitempty"`
+		Manifests []v1.Descriptor `json:"manifests,omitempty"`
+	}
+	err = json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return err
+	}
+	children := manifest.Manifests
+	if manifest.Config != nil {
+		children = append(children, *manifest.Config)
+	}
+	children = append(children, manifest.Layers...)
+	for _, child := range children {
+		err = b.exportBlobs(ctx, child, seen, blobs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportTime is the modification time of the files of the exported tarballs, so that the same tag yields the same tarball.
+var exportTime = time.Unix(0, 0)
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: exportTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+func (b *imageBuilder) writeTarBlob(tw *tar.Writer, digest v1.Hash) error {
+	f, err := os.Open(b.BlobsPath(digest.String()))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    "blobs/" + digest.Algorithm + "/" + digest.Hex,
+		Mode:    0644,
+		Size:    stat.Size(),
+		ModTime: exportTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// adminExport streams the built tag as a tarball of an OCI image layout, building it first if it is not in the cache,
+// so that the node agents import it into containerd without pulling it.
+func (h *Handler) adminExport(w http.ResponseWriter, r *http.Request) {
+	ref, ok := adminRef(w, r)
+	if !ok {
+		return
+	}
+	var platform *v1.Platform
+	if p := r.URL.Query().Get("platform"); p != "" {
+		var err error
+		platform, err = v1.ParsePlatform(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = r.Host + "/" + ref
+	}
+
+	i := strings.LastIndex(ref, ":")
+	image, tag := ref[:i], ref[i+1:]
+	if !fileExists(h.image.ManifestPath(image, tag)) && !h.readOnly {
+		err := h.build(context.WithoutCancel(r.Context()), image, tag)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("build %s: %s", ref, err), http.StatusBadGateway)
+			return
+		}
+	}
+	if !fileExists(h.image.ManifestPath(image, tag)) {
+		http.Error(w, fmt.Sprintf("%q is not built", ref), http.StatusNotFound)
+		return
+	}
+
+	layout, err := h.image.Export(r.Context(), image, tag, name, platform)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	err = layout.writeTar(w, h.image)
+	if err != nil {
+		// The tarball is already started, the client sees it truncated.
+		loggerFrom(r.Context()).Error("export", "ref", ref, "err", err)
+	}
+}
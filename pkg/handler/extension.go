@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+// extensionRulesPath is the extension of the registry API listing the rules, under the "_<namespace>" of the extensions of the distribution spec.
+const extensionRulesPath = "/v2/_jitdi/rules"
+
+// ExtensionRules are the rules that jitdi serves the client with, in the order the refs are matched against.
+type ExtensionRules struct {
+	Rules []ExtensionRule `json:"rules"`
+}
+
+// ExtensionRule is what a rule matches, without its base image, mutations and clients,
+// so that the tooling can tell which refs jitdi handles without seeing what it builds them from.
+type ExtensionRule struct {
+	Name            string              `json:"name"`
+	Pattern         string              `json:"pattern"`
+	Hash            string              `json:"hash"`
+	ExcludeTags     []string            `json:"excludeTags,omitempty"`
+	TagSemver       string              `json:"tagSemver,omitempty"`
+	OutputMediaType string              `json:"outputMediaType,omitempty"`
+	Platforms       []v1alpha1.Platform `json:"platforms,omitempty"`
+}
+
+// extensionRules lists the rules that the client is served by, the ones of its tenant and that allow it.
+func (h *Handler) extensionRules(w http.ResponseWriter, r *http.Request) {
+	t := h.tenantOf(r)
+	user, ip := clientIdentity(r), clientIP(r)
+	rules := ExtensionRules{Rules: []ExtensionRule{}}
+	for _, rule := range h.getRules() {
+		if h.ruleTenant(rule) != t || !rule.Allow(user, ip) {
+			continue
+		}
+		spec := rule.Spec()
+		rules.Rules = append(rules.Rules, ExtensionRule{
+			Name:            rule.Name(),
+			Pattern:         rule.Pattern(),
+			Hash:            rule.Hash(),
+			ExcludeTags:     spec.ExcludeTags,
+			TagSemver:       spec.TagSemver,
+			OutputMediaType: spec.OutputMediaType,
+			Platforms:       spec.Platforms,
+		})
+	}
+	serveJSON(w, rules)
+}
@@ -0,0 +1,306 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/klauspost/compress/zstd"
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+// Extract adds the files of the archive of the source under the directory, instead of the archive itself.
+// A zero mode of the builder keeps the modes of the archive.
+func (f *FileLayerBuilder) Extract(ctx context.Context, hostPath, dir string, extract v1alpha1.Extract) ([]mutate.Addendum, error) {
+	return f.build(ctx, func(tw *tarWriter) error {
+		archive := hostPath
+		u, err := remoteSource(hostPath)
+		if err != nil {
+			return err
+		}
+		if u != nil {
+			archive, _, err = f.fetchRemote(ctx, u)
+			if err != nil {
+				return err
+			}
+		}
+		x := &extractor{
+			f:       f,
+			tw:      tw,
+			dir:     dir,
+			extract: extract,
+			links:   map[string]struct{}{},
+		}
+		err = x.extractFile(archive)
+		if err != nil {
+			return fmt.Errorf("extract %q: %w", hostPath, err)
+		}
+		return nil
+	}, v1.History{
+		Created:   v1.Time{Time: f.modTime},
+		Author:    "jitdi",
+		CreatedBy: fmt.Sprintf("ADD %s %s", hostPath, dir),
+		Comment:   fmt.Sprintf("Extract %s to %s", hostPath, dir),
+	})
+}
+
+type extractor struct {
+	f       *FileLayerBuilder
+	tw      *tarWriter
+	dir     string
+	extract v1alpha1.Extract
+	// links are the symbolic links extracted, no file is extracted through them.
+	links map[string]struct{}
+}
+
+var (
+	magicZip   = []byte("PK\x03\x04")
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicBzip2 = []byte("BZh")
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicTar   = []byte("ustar")
+)
+
+// extractFile detects the format of the archive by its content.
+func (x *extractor) extractFile(archive string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 262)
+	n, err := io.ReadFull(file, magic)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	magic = magic[:n]
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, magicZip):
+		stat, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(file, stat.Size())
+		if err != nil {
+			return err
+		}
+		return x.extractZip(zr)
+	case bytes.HasPrefix(magic, magicGzip):
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		return x.extractTar(tar.NewReader(gr))
+	case bytes.HasPrefix(magic, magicBzip2):
+		return x.extractTar(tar.NewReader(bzip2.NewReader(file)))
+	case bytes.HasPrefix(magic, magicZstd):
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return x.extractTar(tar.NewReader(zr))
+	case len(magic) > 257 && bytes.HasPrefix(magic[257:], magicTar):
+		return x.extractTar(tar.NewReader(file))
+	}
+	return fmt.Errorf("not a tar, tar.gz, tar.bz2, tar.zst or zip archive")
+}
+
+func (x *extractor) extractTar(tr *tar.Reader) error {
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		name, ok, err := x.name(header.Name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeReg:
+			err = x.f.tarFileMode(x.tw, tr, name, header.Size, x.mode(mode))
+		case tar.TypeDir:
+			err = x.dirEntry(name, mode)
+		case tar.TypeSymlink:
+			err = x.linkEntry(tar.TypeSymlink, name, header.Linkname)
+		case tar.TypeLink:
+			target, ok, err := x.name(header.Linkname)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("hard link %q: the target %q is not extracted", header.Name, header.Linkname)
+			}
+			err = x.linkEntry(tar.TypeLink, name, target)
+			if err != nil {
+				return err
+			}
+		default:
+			// The devices and the fifos are not added.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) extractZip(zr *zip.Reader) error {
+	for _, zf := range zr.File {
+		name, ok, err := x.name(zf.Name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = x.dirEntry(name, mode)
+		case mode&fs.ModeSymlink != 0:
+			err = x.zipLink(zf, name)
+		case mode.IsRegular():
+			err = x.zipFile(zf, name, mode)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) zipFile(zf *zip.File, name string, mode fs.FileMode) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return x.f.tarFileMode(x.tw, r, name, int64(zf.UncompressedSize64), x.mode(mode))
+}
+
+func (x *extractor) zipLink(zf *zip.File, name string) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	target, err := io.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return err
+	}
+	return x.linkEntry(tar.TypeSymlink, name, string(target))
+}
+
+// name returns the name of the file in the image, and whether it is extracted.
+func (x *extractor) name(name string) (string, bool, error) {
+	segments := make([]string, 0, strings.Count(name, "/")+1)
+	for _, segment := range strings.Split(name, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return "", false, fmt.Errorf("file name %q must not contain \"..\"", name)
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) <= x.extract.StripComponents {
+		return "", false, nil
+	}
+	rel := strings.Join(segments[x.extract.StripComponents:], "/")
+	if !matchFilters(rel, x.extract.Include, x.extract.Exclude) {
+		return "", false, nil
+	}
+	name = path.Join(x.dir, rel)
+	for p := path.Dir(name); p != "." && p != "/"; p = path.Dir(p) {
+		if _, ok := x.links[p]; ok {
+			return "", false, fmt.Errorf("file %q is under the symbolic link %q", name, p)
+		}
+	}
+	return name, true, nil
+}
+
+// mode returns the mode of the file, the one of the archive if the builder has none.
+func (x *extractor) mode(mode fs.FileMode) int64 {
+	if x.f.mode != 0 {
+		return x.f.mode
+	}
+	return int64(mode.Perm())
+}
+
+func (x *extractor) dirEntry(name string, mode fs.FileMode) error {
+	err := sandboxFrom(x.tw.ctx).addFile(name, 0)
+	if err != nil {
+		return err
+	}
+	perm := int64(mode.Perm())
+	if perm == 0 {
+		perm = 0755
+	}
+	err = x.tw.WriteHeader(&tar.Header{
+		Name:     name + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     perm,
+		ModTime:  x.f.modTime,
+	})
+	if err != nil {
+		return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", name, err)
+	}
+	x.tw.entries++
+	return nil
+}
+
+func (x *extractor) linkEntry(typeflag byte, name, target string) error {
+	if x.f.windows {
+		return fmt.Errorf("link %q: the links are not extracted in the windows images", name)
+	}
+	err := sandboxFrom(x.tw.ctx).addFile(name, 0)
+	if err != nil {
+		return err
+	}
+	err = x.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Linkname: target,
+		Typeflag: typeflag,
+		Mode:     0777,
+		ModTime:  x.f.modTime,
+	})
+	if err != nil {
+		return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", name, err)
+	}
+	if typeflag == tar.TypeSymlink {
+		x.links[name] = struct{}{}
+	}
+	x.tw.entries++
+	return nil
+}
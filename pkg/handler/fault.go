@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// FaultInjection are the faults injected to test the timeouts and the retries of the clients against a slow or failing jitdi,
+// they are not meant for production.
+type FaultInjection struct {
+	// UpstreamLatency is the delay added before every request to the upstreams.
+	UpstreamLatency time.Duration
+	// UpstreamErrorRate is the ratio of the requests to the upstreams failed, from 0 to 1.
+	UpstreamErrorRate float64
+	// UpstreamErrorStatus is the status code of the requests failed, their connections are reset instead if zero.
+	UpstreamErrorStatus int
+	// DiskWriteBandwidth is the bytes per second written to the blobs of the cache at most, zero is unlimited.
+	DiskWriteBandwidth int64
+}
+
+// faultInjector injects the faults, it is nil if none is.
+type faultInjector struct {
+	FaultInjection
+	disk *rate.Limiter
+}
+
+func newFaultInjector(f FaultInjection) (*faultInjector, error) {
+	if f.UpstreamLatency < 0 {
+		return nil, fmt.Errorf("fault upstream latency %s must not be negative", f.UpstreamLatency)
+	}
+	if f.UpstreamErrorRate < 0 || f.UpstreamErrorRate > 1 {
+		return nil, fmt.Errorf("fault upstream error rate %v must be between 0 and 1", f.UpstreamErrorRate)
+	}
+	if f.UpstreamErrorStatus != 0 && (f.UpstreamErrorStatus < 400 || f.UpstreamErrorStatus > 599) {
+		return nil, fmt.Errorf("fault upstream error status %d must be an error status code", f.UpstreamErrorStatus)
+	}
+	if f.DiskWriteBandwidth < 0 {
+		return nil, fmt.Errorf("fault disk write bandwidth %d must not be negative", f.DiskWriteBandwidth)
+	}
+	if f.UpstreamLatency == 0 && f.UpstreamErrorRate == 0 && f.DiskWriteBandwidth == 0 {
+		return nil, nil
+	}
+	return &faultInjector{
+		FaultInjection: f,
+		disk:           newBandwidthLimiter(f.DiskWriteBandwidth),
+	}, nil
+}
+
+// wrap returns the transport delaying and failing the requests to the upstreams.
+func (f *faultInjector) wrap(rt http.RoundTripper) http.RoundTripper {
+	if f == nil || (f.UpstreamLatency == 0 && f.UpstreamErrorRate == 0) {
+		return rt
+	}
+	return &faultTransport{faults: f, base: rt}
+}
+
+// diskReader returns the reader of a blob written to the cache, as slow as the disk write bandwidth.
+func (f *faultInjector) diskReader(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if f == nil || f.disk == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, limiter: f.disk, ReadCloser: r}
+}
+
+type faultTransport struct {
+	faults *faultInjector
+	base   http.RoundTripper
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.faults.UpstreamLatency > 0 {
+		timer := time.NewTimer(t.faults.UpstreamLatency)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+	if t.faults.UpstreamErrorRate == 0 || rand.Float64() >= t.faults.UpstreamErrorRate {
+		return t.base.RoundTrip(req)
+	}
+
+	loggerFrom(req.Context()).Warn("injecting upstream fault", "url", req.URL.String(), "status", t.faults.UpstreamErrorStatus)
+	if t.faults.UpstreamErrorStatus == 0 {
+		return nil, fmt.Errorf("injected fault: %w", syscall.ECONNRESET)
+	}
+	body := "injected fault"
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", t.faults.UpstreamErrorStatus, http.StatusText(t.faults.UpstreamErrorStatus)),
+		StatusCode:    t.faults.UpstreamErrorStatus,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
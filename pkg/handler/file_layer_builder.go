@@ -2,9 +2,11 @@ package handler
 
 import (
 	"archive/tar"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"net/url"
@@ -18,93 +20,183 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
-
-	"github.com/wzshiming/jitdi/pkg/atomic"
 )
 
 type FileLayerBuilder struct {
+	client    *http.Client
 	mode      int64
 	modTime   time.Time
 	tmpPath   string
 	mediaType types.MediaType
+	chunkSize int64
+	windows   bool
+
+	// staged deduplicates the remote files downloaded, nil if disabled.
+	staged *stagedContent
 }
 
-func NewFileLayerBuilder(tmpPath string, mode int64, modTime time.Time, mediaType types.MediaType) *FileLayerBuilder {
+func NewFileLayerBuilder(client *http.Client, tmpPath string, mode int64, modTime time.Time, mediaType types.MediaType, chunkSize int64, windows bool) *FileLayerBuilder {
 	return &FileLayerBuilder{
+		client:    client,
 		mode:      mode,
 		modTime:   modTime,
 		tmpPath:   tmpPath,
 		mediaType: mediaType,
+		chunkSize: chunkSize,
+		windows:   windows,
 	}
 }
 
-func (f *FileLayerBuilder) Build(hostPath, newPath string) ([]mutate.Addendum, error) {
-	tmp, err := os.CreateTemp(f.tmpPath, "tmp-")
-	if err != nil {
-		return nil, err
+// tarWriter is a tar.Writer that also collects the layers of the files that do not fit in the chunk size.
+type tarWriter struct {
+	*tar.Writer
+	ctx     context.Context
+	tmp     *os.File
+	sum     hash.Hash
+	entries int
+	// size is the size of the files written.
+	size   int64
+	chunks []mutate.Addendum
+	// chunk is the layer accumulating the files once the layers before it are full.
+	chunk   *tarWriter
+	history v1.History
+
+	windows       bool
+	windowsHeader bool
+}
+
+// userOwnerAndGroupSID is the security descriptor of BUILTIN/Users which makes the files executable in Windows containers.
+const userOwnerAndGroupSID = "AQAAgBQAAAAkAAAAAAAAAAAAAAABAgAAAAAABSAAAAAhAgAAAQIAAAAAAAUgAAAAIQIAAA=="
+
+// WriteHeader writes the header, the layers of Windows images keep the files under the Files directory.
+func (tw *tarWriter) WriteHeader(header *tar.Header) error {
+	if !tw.windows {
+		return tw.Writer.WriteHeader(header)
 	}
 
-	sum := sha256.New()
+	if !tw.windowsHeader {
+		tw.windowsHeader = true
+		for _, dir := range []string{"Files", "Hives"} {
+			err := tw.Writer.WriteHeader(&tar.Header{
+				Name:     dir,
+				Typeflag: tar.TypeDir,
+				Mode:     0555,
+				ModTime:  header.ModTime,
+				Format:   tar.FormatPAX,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	header.Name = path.Join("Files", header.Name)
+	header.Format = tar.FormatPAX
+	if header.PAXRecords == nil {
+		header.PAXRecords = map[string]string{}
+	}
+	header.PAXRecords["MSWINDOWS.rawsd"] = userOwnerAndGroupSID
+	return tw.Writer.WriteHeader(header)
+}
 
-	tw := tar.NewWriter(io.MultiWriter(tmp, sum))
+func (f *FileLayerBuilder) Build(ctx context.Context, hostPath, newPath string) ([]mutate.Addendum, error) {
+	return f.build(ctx, func(tw *tarWriter) error {
+		return f.tarAny(tw, hostPath, newPath)
+	}, v1.History{
+		Created:   v1.Time{Time: f.modTime},
+		Author:    "jitdi",
+		CreatedBy: fmt.Sprintf("COPY %s %s", hostPath, newPath),
+		Comment:   fmt.Sprintf("Copy %s to %s", hostPath, newPath),
+	})
+}
 
-	err = f.tarAny(tw, hostPath, newPath)
+func (f *FileLayerBuilder) BuildFile(ctx context.Context, file io.Reader, newPath string, size int64) ([]mutate.Addendum, error) {
+	return f.build(ctx, func(tw *tarWriter) error {
+		return f.tarFile(tw, file, newPath, size)
+	}, v1.History{
+		Created:   v1.Time{Time: f.modTime},
+		Author:    "jitdi",
+		CreatedBy: fmt.Sprintf("ADD %s", newPath),
+		Comment:   fmt.Sprintf("Add %s", newPath),
+	})
+}
+
+func (f *FileLayerBuilder) build(ctx context.Context, fn func(tw *tarWriter) error, history v1.History) ([]mutate.Addendum, error) {
+	var chunks []mutate.Addendum
+	var entries int
+	dataLayer, err := f.buildLayer(ctx, func(tw *tarWriter) error {
+		tw.history = history
+		err := fn(tw)
+		if err == nil {
+			err = f.closeChunk(tw)
+		}
+		chunks = tw.chunks
+		entries = tw.entries
+		return err
+	})
 	if err != nil {
-		tw.Close()
-		tmp.Close()
 		return nil, err
 	}
-	tw.Close()
-	tmp.Close()
 
-	hash := hex.EncodeToString(sum.Sum(nil))
-	cachePath := path.Join(f.tmpPath, "sha256:"+hash)
-	err = os.Rename(tmp.Name(), cachePath)
+	var addendums []mutate.Addendum
+	if entries != 0 || len(chunks) == 0 {
+		addendums = append(addendums, mutate.Addendum{
+			Layer:   dataLayer,
+			History: history,
+		})
+	}
+	return append(addendums, chunks...), nil
+}
+
+func (f *FileLayerBuilder) buildLayer(ctx context.Context, fn func(tw *tarWriter) error) (v1.Layer, error) {
+	tw, err := f.openLayer(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	dataLayer, err := tarball.LayerFromFile(cachePath,
-		tarball.WithMediaType(f.mediaType),
-		tarball.WithCompressionLevel(0),
-	)
+	err = fn(tw)
 	if err != nil {
-		return nil, fmt.Errorf("toLayer: %w", err)
+		tw.abort()
+		return nil, err
 	}
-
-	return []mutate.Addendum{
-		{
-			Layer: dataLayer,
-			History: v1.History{
-				Author:    "jitdi",
-				CreatedBy: fmt.Sprintf("COPY %s %s", hostPath, newPath),
-				Comment:   fmt.Sprintf("Copy %s to %s", hostPath, newPath),
-			},
-		},
-	}, nil
+	return f.closeLayer(tw)
 }
 
-func (f *FileLayerBuilder) BuildFile(file io.Reader, newPath string, size int64) ([]mutate.Addendum, error) {
-	tmp, err := os.CreateTemp(f.tmpPath, "tmp-")
+// openLayer starts to write a layer to a temporary file, until closeLayer turns it into the layer.
+func (f *FileLayerBuilder) openLayer(ctx context.Context) (*tarWriter, error) {
+	tmp, err := os.CreateTemp(sandboxFrom(ctx).layerDir(f.tmpPath), "tmp-")
 	if err != nil {
 		return nil, err
 	}
 
 	sum := sha256.New()
+	return &tarWriter{
+		Writer:  tar.NewWriter(io.MultiWriter(tmp, sum)),
+		ctx:     ctx,
+		tmp:     tmp,
+		sum:     sum,
+		windows: f.windows,
+	}, nil
+}
 
-	tw := tar.NewWriter(io.MultiWriter(tmp, sum))
-
-	err = f.tarFile(tw, file, newPath, size)
-	if err != nil {
-		tw.Close()
-		tmp.Close()
-		return nil, err
+// abort removes the temporary files of the layer and of the layer accumulating the files after it.
+func (tw *tarWriter) abort() {
+	if tw.chunk != nil {
+		tw.chunk.abort()
+		tw.chunk = nil
 	}
 	tw.Close()
-	tmp.Close()
+	tw.tmp.Close()
+	_ = os.Remove(tw.tmp.Name())
+}
+
+func (f *FileLayerBuilder) closeLayer(tw *tarWriter) (v1.Layer, error) {
+	tw.Close()
+	tw.tmp.Close()
 
-	cachePath := path.Join(f.tmpPath, "sha256:"+hex.EncodeToString(sum.Sum(nil)))
-	err = os.Rename(tmp.Name(), cachePath)
+	digest := hex.EncodeToString(tw.sum.Sum(nil))
+	cachePath := path.Join(path.Dir(tw.tmp.Name()), "sha256:"+digest)
+	err := os.Rename(tw.tmp.Name(), cachePath)
 	if err != nil {
 		return nil, err
 	}
@@ -116,61 +208,50 @@ func (f *FileLayerBuilder) BuildFile(file io.Reader, newPath string, size int64)
 	if err != nil {
 		return nil, fmt.Errorf("toLayer: %w", err)
 	}
-
-	return []mutate.Addendum{
-		{
-			Layer: dataLayer,
-			History: v1.History{
-				Author:    "jitdi",
-				CreatedBy: fmt.Sprintf("ADD %s", newPath),
-				Comment:   fmt.Sprintf("Add %s", newPath),
-			},
-		},
-	}, nil
+	return dataLayer, nil
 }
 
-func (f *FileLayerBuilder) tarAny(tw *tar.Writer, hostPath, newPath string) error {
-	u, err := url.Parse(hostPath)
-	if err == nil {
-		switch u.Scheme {
-		case "http", "https":
-			return f.tarRemote(tw, u, newPath)
-		}
+func (f *FileLayerBuilder) tarAny(tw *tarWriter, hostPath, newPath string) error {
+	u, err := remoteSource(hostPath)
+	if err != nil {
+		return err
+	}
+	if u != nil {
+		return f.tarRemote(tw, u, newPath)
 	}
 
 	return f.tarLocal(tw, hostPath, newPath)
 }
 
-func (f *FileLayerBuilder) tarRemote(tw *tar.Writer, u *url.URL, newPath string) error {
+// remoteSource returns the URL of the source if it is remote, nil if it is a local path.
+func remoteSource(hostPath string) (*url.URL, error) {
+	u, err := url.Parse(hostPath)
+	if err != nil {
+		return nil, nil
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return u, nil
+	case "file":
+		return nil, fmt.Errorf("source %q: file:// is not allowed, use the path", hostPath)
+	}
+	if u.Scheme != "" && strings.Contains(hostPath, "://") {
+		return nil, fmt.Errorf("source %q: unsupported scheme %q", hostPath, u.Scheme)
+	}
+	return nil, nil
+}
+
+func (f *FileLayerBuilder) tarRemote(tw *tarWriter, u *url.URL, newPath string) error {
 	if strings.HasSuffix(newPath, "/") {
 		return f.tarRemoteFileInDir(tw, u, newPath)
 	}
 	return f.tarRemoteFileToFile(tw, u, newPath)
 }
 
-func (f *FileLayerBuilder) tarRemoteFileToFile(tw *tar.Writer, u *url.URL, newPath string) error {
-	srcPath := path.Join(f.tmpPath, u.Scheme, u.Path)
-	stat, _ := os.Stat(srcPath)
-	if stat == nil {
-		resp, err := http.Get(u.String())
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("http.Get(%q): %w", u.String(), fmt.Errorf("status code %d", resp.StatusCode))
-		}
-
-		err = atomic.WriteFileWithReader(srcPath, resp.Body, 0644)
-		if err != nil {
-			return err
-		}
-
-		stat, err = os.Stat(srcPath)
-		if err != nil {
-			return err
-		}
+func (f *FileLayerBuilder) tarRemoteFileToFile(tw *tarWriter, u *url.URL, newPath string) error {
+	srcPath, stat, err := f.fetchRemote(tw.ctx, u)
+	if err != nil {
+		return err
 	}
 
 	file, err := os.Open(srcPath)
@@ -182,11 +263,26 @@ func (f *FileLayerBuilder) tarRemoteFileToFile(tw *tar.Writer, u *url.URL, newPa
 	return f.tarFile(tw, file, newPath, stat.Size())
 }
 
-func (f *FileLayerBuilder) tarRemoteFileInDir(tw *tar.Writer, u *url.URL, dir string) error {
+// fetchRemote stages the remote file under the tmp, and returns its path.
+func (f *FileLayerBuilder) fetchRemote(ctx context.Context, u *url.URL) (string, os.FileInfo, error) {
+	// The file is staged under the tmp by its URL, which must not climb out of it.
+	err := checkEntryName(path.Join(u.Host, u.Path))
+	if err != nil {
+		return "", nil, fmt.Errorf("source %q: %w", u.Redacted(), err)
+	}
+	srcPath := path.Join(f.tmpPath, u.Scheme, u.Host, u.Path)
+	stat, err := fetchRemoteFile(ctx, f.client, f.staged, u.String(), srcPath)
+	if err != nil {
+		return "", nil, err
+	}
+	return srcPath, stat, nil
+}
+
+func (f *FileLayerBuilder) tarRemoteFileInDir(tw *tarWriter, u *url.URL, dir string) error {
 	return f.tarRemoteFileToFile(tw, u, path.Join(dir, path.Base(u.Path)))
 }
 
-func (f *FileLayerBuilder) tarLocal(tw *tar.Writer, hostPath, newPath string) error {
+func (f *FileLayerBuilder) tarLocal(tw *tarWriter, hostPath, newPath string) error {
 	info, err := os.Stat(hostPath)
 	if err != nil {
 		return err
@@ -201,7 +297,7 @@ func (f *FileLayerBuilder) tarLocal(tw *tar.Writer, hostPath, newPath string) er
 	return f.tarFileToFile(tw, hostPath, newPath, info)
 }
 
-func (f *FileLayerBuilder) tarDirToDir(tw *tar.Writer, hostPath, newPath string) error {
+func (f *FileLayerBuilder) tarDirToDir(tw *tarWriter, hostPath, newPath string) error {
 	return filepath.Walk(hostPath, func(p string, info os.FileInfo, err error) error {
 		if hostPath == p {
 			return nil
@@ -210,15 +306,28 @@ func (f *FileLayerBuilder) tarDirToDir(tw *tar.Writer, hostPath, newPath string)
 			return fmt.Errorf("filepath.Walk(%q): %w", hostPath, err)
 		}
 
+		name := path.Join(newPath, path.Base(p))
+		if info.Mode()&os.ModeSymlink != 0 {
+			// The links are followed only to the files inside of the source.
+			target, targetInfo, err := resolveInside(hostPath, p)
+			if err != nil {
+				return err
+			}
+			if targetInfo.IsDir() {
+				return fmt.Errorf("symbolic link %q points to a directory", p)
+			}
+			return f.tarFileToFile(tw, target, name, targetInfo)
+		}
+
 		if info.IsDir() {
-			return f.tarDirToDir(tw, p, path.Join(newPath, path.Base(p)))
+			return f.tarDirToDir(tw, p, name)
 		}
 
-		return f.tarFileToFile(tw, p, path.Join(newPath, path.Base(p)), info)
+		return f.tarFileToFile(tw, p, name, info)
 	})
 }
 
-func (f *FileLayerBuilder) tarFileToFile(tw *tar.Writer, hostPath, newPath string, info os.FileInfo) error {
+func (f *FileLayerBuilder) tarFileToFile(tw *tarWriter, hostPath, newPath string, info os.FileInfo) error {
 	file, err := os.Open(hostPath)
 	if err != nil {
 		return fmt.Errorf("os.Open(%q): %w", hostPath, err)
@@ -229,12 +338,52 @@ func (f *FileLayerBuilder) tarFileToFile(tw *tar.Writer, hostPath, newPath strin
 	return f.tarFile(tw, file, newPath, size)
 }
 
-func (f *FileLayerBuilder) tarFile(tw *tar.Writer, reader io.Reader, newPath string, size int64) error {
+func (f *FileLayerBuilder) tarFile(tw *tarWriter, reader io.Reader, newPath string, size int64) error {
+	return f.tarFileMode(tw, reader, newPath, size, f.mode)
+}
+
+func (f *FileLayerBuilder) tarFileMode(tw *tarWriter, reader io.Reader, newPath string, size int64, mode int64) error {
+	err := checkEntryName(newPath)
+	if err != nil {
+		return err
+	}
+	err = sandboxFrom(tw.ctx).addFile(newPath, size)
+	if err != nil {
+		return err
+	}
+
+	if f.chunkSize <= 0 {
+		return f.writeFile(tw, reader, newPath, size, mode)
+	}
+	if size > f.chunkSize {
+		return f.tarFileLayer(tw, reader, newPath, size, mode)
+	}
+
+	// The files go to the layer accumulating them, a new one is started when it is full.
+	ctw := tw
+	if tw.chunk != nil {
+		ctw = tw.chunk
+	}
+	if ctw.size+size > f.chunkSize {
+		err = f.closeChunk(tw)
+		if err != nil {
+			return err
+		}
+		tw.chunk, err = f.openLayer(tw.ctx)
+		if err != nil {
+			return err
+		}
+		ctw = tw.chunk
+	}
+	return f.writeFile(ctw, reader, newPath, size, mode)
+}
+
+func (f *FileLayerBuilder) writeFile(tw *tarWriter, reader io.Reader, newPath string, size int64, mode int64) error {
 	header := &tar.Header{
 		Name:     newPath,
 		Size:     size,
 		Typeflag: tar.TypeReg,
-		Mode:     f.mode,
+		Mode:     mode,
 		ModTime:  f.modTime,
 	}
 	err := tw.WriteHeader(header)
@@ -249,9 +398,59 @@ func (f *FileLayerBuilder) tarFile(tw *tar.Writer, reader io.Reader, newPath str
 	if n != size {
 		return fmt.Errorf("io.Copy(%q, %q): short write: %d != %d", newPath, reader, n, size)
 	}
+	tw.entries++
+	tw.size += size
+	return nil
+}
+
+// closeChunk adds the layer accumulating the files to the layers, with the history of the build.
+func (f *FileLayerBuilder) closeChunk(tw *tarWriter) error {
+	if tw.chunk == nil {
+		return nil
+	}
+	layer, err := f.closeLayer(tw.chunk)
+	tw.chunk = nil
+	if err != nil {
+		return err
+	}
+	tw.chunks = append(tw.chunks, mutate.Addendum{
+		Layer:   layer,
+		History: tw.history,
+	})
 	return nil
 }
 
-func (f *FileLayerBuilder) tarFileInDir(tw *tar.Writer, hostPath, dir string, info os.FileInfo) error {
+// tarFileLayer writes the file larger than the chunk size alone in its own layer.
+// The layers are split on the boundaries of the files, so that the files are whole at their paths,
+// a single file is never split across layers.
+func (f *FileLayerBuilder) tarFileLayer(tw *tarWriter, reader io.Reader, newPath string, size int64, mode int64) error {
+	layer, err := f.buildLayer(tw.ctx, func(ctw *tarWriter) error {
+		return f.writeFile(ctw, reader, newPath, size, mode)
+	})
+	if err != nil {
+		return err
+	}
+
+	tw.chunks = append(tw.chunks, mutate.Addendum{
+		Layer: layer,
+		History: v1.History{
+			Created:   v1.Time{Time: f.modTime},
+			Author:    "jitdi",
+			CreatedBy: fmt.Sprintf("ADD %s", newPath),
+			Comment:   fmt.Sprintf("Add %s", newPath),
+		},
+	})
+	return nil
+}
+
+// describeSource adds the source of the files to the comments of the histories of the layers.
+func describeSource(addendums []mutate.Addendum, source string) []mutate.Addendum {
+	for i := range addendums {
+		addendums[i].History.Comment += " from " + source
+	}
+	return addendums
+}
+
+func (f *FileLayerBuilder) tarFileInDir(tw *tarWriter, hostPath, dir string, info os.FileInfo) error {
 	return f.tarFileToFile(tw, hostPath, path.Join(dir, path.Base(hostPath)), info)
 }
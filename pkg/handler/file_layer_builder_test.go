@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestFileLayerBuilderChunkSize(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]int{
+		"a": 3,
+		"b": 3,
+		"c": 5,
+		"d": 10,
+	}
+	for name, size := range files {
+		err := os.WriteFile(path.Join(src, name), []byte(strings.Repeat(name, size)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		chunkSize int64
+		want      [][]string
+	}{
+		{
+			name: "one layer",
+			want: [][]string{{"/data/a", "/data/b", "/data/c", "/data/d"}},
+		},
+		{
+			name:      "split on the boundaries of the files",
+			chunkSize: 6,
+			want:      [][]string{{"/data/a", "/data/b"}, {"/data/d"}, {"/data/c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewFileLayerBuilder(nil, t.TempDir(), 0644, time.Unix(0, 0), types.DockerLayer, tt.chunkSize, false)
+			addendums, err := b.Build(context.Background(), src, "/data")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := layerFiles(t, addendums, func(name string) string {
+				return strings.Repeat(name, files[name])
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("layers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileLayerBuilderChunkPacking(t *testing.T) {
+	src := t.TempDir()
+	for i := 0; i != 10; i++ {
+		err := os.WriteFile(path.Join(src, strconv.Itoa(i)), []byte("xx"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := NewFileLayerBuilder(nil, t.TempDir(), 0644, time.Unix(0, 0), types.DockerLayer, 6, false)
+	addendums, err := b.Build(context.Background(), src, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The small files are packed into layers of at most the chunk size, not one layer per file.
+	got := layerFiles(t, addendums, func(string) string { return "xx" })
+	want := [][]string{
+		{"/data/0", "/data/1", "/data/2"},
+		{"/data/3", "/data/4", "/data/5"},
+		{"/data/6", "/data/7", "/data/8"},
+		{"/data/9"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("layers = %v, want %v", got, want)
+	}
+	for _, a := range addendums {
+		if a.History.CreatedBy != "COPY "+src+" /data" {
+			t.Errorf("history = %q, want the history of the copy", a.History.CreatedBy)
+		}
+	}
+}
+
+// layerFiles returns the names of the files of each layer, checking that they are whole with their content.
+func layerFiles(t *testing.T, addendums []mutate.Addendum, content func(name string) string) [][]string {
+	t.Helper()
+	var got [][]string
+	for _, a := range addendums {
+		rc, err := a.Layer.Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		tr := tar.NewReader(rc)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The files are whole in their layers.
+			if want := content(path.Base(header.Name)); string(data) != want {
+				t.Errorf("%s = %q, want %q", header.Name, data, want)
+			}
+			names = append(names, header.Name)
+		}
+		rc.Close()
+		got = append(got, names)
+	}
+	return got
+}
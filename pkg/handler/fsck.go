@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/logging"
+)
+
+const (
+	// fsckCheck only reports the broken tags and blobs.
+	fsckCheck = "check"
+	// fsckRepair quarantines the broken tags and blobs, and builds the tags again.
+	fsckRepair = "repair"
+)
+
+func checkFsckMode(mode string) error {
+	switch mode {
+	case "", "off", fsckCheck, fsckRepair:
+		return nil
+	}
+	return fmt.Errorf("invalid fsck mode %q, must be off, %s or %s", mode, fsckCheck, fsckRepair)
+}
+
+// FsckResult is the summary of a scan of the cache.
+type FsckResult struct {
+	Tags        int             `json:"tags"`
+	Blobs       int             `json:"blobs"`
+	BrokenTags  []Inconsistency `json:"brokenTags,omitempty"`
+	BrokenBlobs []string        `json:"brokenBlobs,omitempty"`
+	Quarantined int             `json:"quarantined"`
+}
+
+// fsck scans the cache for the tags whose manifests are unreadable or reference blobs that are missing or truncated,
+// and with verifyDigests for the blobs whose content does not match their digest.
+// With repair the broken blobs and tags are moved to the quarantine directory, so that the tags are built again.
+func (b *imageBuilder) fsck(logger *slog.Logger, repair, verifyDigests bool) (FsckResult, error) {
+	var result FsckResult
+	quarantine := path.Join(b.cache, "quarantine", time.Now().UTC().Format("20060102T150405Z"))
+
+	entries, err := os.ReadDir(b.cacheBlobs)
+	if err != nil {
+		return result, fmt.Errorf("read blobs: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !digestRegexp.MatchString(name) {
+			continue
+		}
+		result.Blobs++
+		if !verifyDigests {
+			continue
+		}
+		blobPath := path.Join(b.cacheBlobs, name)
+		ok, err := verifyBlob(blobPath, name)
+		if err != nil {
+			return result, err
+		}
+		if ok {
+			continue
+		}
+		logger.Warn("blob digest mismatch", "blob", name)
+		result.BrokenBlobs = append(result.BrokenBlobs, name)
+		if !repair {
+			continue
+		}
+		err = moveToQuarantine(blobPath, path.Join(quarantine, "blobs", name))
+		if err != nil {
+			return result, err
+		}
+		_ = os.Remove(path.Join(b.cacheMediaTypes, name))
+		b.memory.remove(blobPath)
+		result.Quarantined++
+	}
+
+	err = filepath.WalkDir(b.cacheManifests, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != "manifest.json" {
+			return nil
+		}
+		result.Tags++
+		tagPath := filepath.Dir(p)
+		rel, err := filepath.Rel(b.cacheManifests, tagPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		image, tag := path.Dir(rel), path.Base(rel)
+
+		var errs []string
+		for _, manifestPath := range []string{p, b.AlternateManifestPath(image, tag)} {
+			raw, err := os.ReadFile(manifestPath)
+			if err != nil {
+				if os.IsNotExist(err) && manifestPath != p {
+					continue
+				}
+				errs = append(errs, err.Error())
+				continue
+			}
+			err = b.checkManifest(raw)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(errs) == 0 {
+			return nil
+		}
+
+		broken := Inconsistency{
+			Image: image,
+			Tag:   tag,
+			Error: strings.Join(errs, "\n"),
+		}
+		logger.Warn("broken tag", "image", image, "tag", tag, "err", broken.Error)
+		result.BrokenTags = append(result.BrokenTags, broken)
+		if !repair {
+			return nil
+		}
+		err = moveToQuarantine(tagPath, path.Join(quarantine, "manifests", rel))
+		if err != nil {
+			return err
+		}
+		b.memory.removePrefix(tagPath)
+		result.Quarantined++
+		err = b.index.Delete(image, tag)
+		if err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// verifyBlob reports whether the content of the blob matches the digest, of any algorithm of digestRegexp.
+func verifyBlob(blobPath, digest string) (bool, error) {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := digestHasher(digest)
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return false, fmt.Errorf("read blob %s: %w", blobPath, err)
+	}
+	_, want, _ := strings.Cut(digest, ":")
+	return hex.EncodeToString(h.Sum(nil)) == want, nil
+}
+
+func moveToQuarantine(src, dst string) error {
+	err := os.MkdirAll(path.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// runFsck scans the cache before serving it, and builds the repaired tags again in the background.
+func (h *Handler) runFsck(mode string, verifyDigests bool) error {
+	if mode == "" || mode == "off" {
+		return nil
+	}
+	logger := slog.Default().With(logging.ComponentKey, "fsck")
+	start := time.Now()
+	repair := mode == fsckRepair
+	result, err := h.image.fsck(logger, repair, verifyDigests)
+	if err != nil {
+		return err
+	}
+	logger.Info("fsck done",
+		"tags", result.Tags,
+		"blobs", result.Blobs,
+		"brokenTags", len(result.BrokenTags),
+		"brokenBlobs", len(result.BrokenBlobs),
+		"quarantined", result.Quarantined,
+		"duration", time.Since(start),
+	)
+	if !repair || len(result.BrokenTags) == 0 {
+		return nil
+	}
+
+	go func() {
+		ctx := context.Background()
+		for _, broken := range result.BrokenTags {
+			err := h.build(ctx, broken.Image, broken.Tag)
+			if err != nil {
+				logger.Error("rebuild", "image", broken.Image, "tag", broken.Tag, "err", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestFsckVerifyDigests(t *testing.T) {
+	content := []byte("blob")
+	sum256 := sha256.Sum256(content)
+	sum512 := sha512.Sum512(content)
+	sha256Blob := "sha256:" + hex.EncodeToString(sum256[:])
+	sha512Blob := "sha512:" + hex.EncodeToString(sum512[:])
+	sum512 = sha512.Sum512([]byte("other"))
+	brokenBlob := "sha512:" + hex.EncodeToString(sum512[:])
+
+	h := newTestHandler(t, nil)
+	for _, name := range []string{sha256Blob, sha512Blob, brokenBlob} {
+		err := os.WriteFile(path.Join(h.image.cacheBlobs, name), content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := h.image.fsck(slog.Default(), false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Blobs != 3 {
+		t.Errorf("blobs = %d, want 3", result.Blobs)
+	}
+	if want := []string{brokenBlob}; !reflect.DeepEqual(result.BrokenBlobs, want) {
+		t.Errorf("broken blobs = %v, want %v", result.BrokenBlobs, want)
+	}
+}
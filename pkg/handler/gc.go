@@ -0,0 +1,377 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/logging"
+	"github.com/wzshiming/jitdi/pkg/metadata"
+)
+
+// gcGracePeriod is how long a blob is kept after being written even if it is not referenced,
+// so that the blobs of the builds in progress are not removed.
+const gcGracePeriod = time.Hour
+
+// GCResult is the result of a garbage collection.
+type GCResult struct {
+	Scanned int `json:"scanned"`
+	Removed int `json:"removed"`
+	// Evicted are the blobs still referenced that are removed over the max size of the cache, included in the freed bytes.
+	Evicted int `json:"evicted,omitempty"`
+	// Expired are the tags deleted out of the retentions of their rules.
+	Expired    int   `json:"expired,omitempty"`
+	FreedBytes int64 `json:"freedBytes"`
+}
+
+// gc removes the blobs that are not referenced by any tag, directly or through an index,
+// the references are read from the metadata index.
+func (b *imageBuilder) gc(ctx context.Context, grace time.Duration) (GCResult, error) {
+	marked := map[string]struct{}{}
+	err := b.markIndexed(marked)
+	if err != nil {
+		return GCResult{}, fmt.Errorf("mark: %w", err)
+	}
+
+	var result GCResult
+	entries, err := os.ReadDir(b.cacheBlobs)
+	if err != nil {
+		return GCResult{}, fmt.Errorf("sweep: %w", err)
+	}
+	now := time.Now()
+	var kept []fs.FileInfo
+	var keptSize int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !digestRegexp.MatchString(name) {
+			continue
+		}
+		result.Scanned++
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if _, ok := marked[name]; ok || now.Sub(info.ModTime()) < grace {
+			kept = append(kept, info)
+			keptSize += info.Size()
+			continue
+		}
+		if !b.removeBlob(ctx, name) {
+			continue
+		}
+		result.Removed++
+		result.FreedBytes += info.Size()
+	}
+
+	if b.gcMaxSize > 0 && keptSize > b.gcMaxSize {
+		evicted, freed, err := b.evict(ctx, kept, keptSize-b.gcMaxSize, now.Add(-grace))
+		if err != nil {
+			return result, fmt.Errorf("evict: %w", err)
+		}
+		result.Evicted = evicted
+		result.FreedBytes += freed
+	}
+
+	b.staged.prune(ctx)
+
+	// The upstream repositories of the layers that are no longer referenced are forgotten.
+	upstreams, err := os.ReadDir(b.cacheUpstreams)
+	if err != nil {
+		return result, fmt.Errorf("sweep upstreams: %w", err)
+	}
+	for _, entry := range upstreams {
+		name := entry.Name()
+		if _, ok := marked[name]; ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < grace {
+			continue
+		}
+		err = os.Remove(b.UpstreamPath(name))
+		if err != nil {
+			loggerFrom(ctx).Warn("remove upstream", "blob", name, "err", err)
+		}
+	}
+	return result, nil
+}
+
+// removeBlob removes the blob and its media type from the cache, and reports whether it did.
+func (b *imageBuilder) removeBlob(ctx context.Context, name string) bool {
+	err := os.Remove(path.Join(b.cacheBlobs, name))
+	if err != nil {
+		loggerFrom(ctx).Warn("remove blob", "blob", name, "err", err)
+		return false
+	}
+	_ = os.Remove(path.Join(b.cacheMediaTypes, name))
+	b.memory.remove(path.Join(b.cacheBlobs, name))
+	return true
+}
+
+// evict removes the layers still referenced until the size is freed, the largest first among the layers of the same priority:
+// the layers annotated "evict-first", then the layers without a priority if the tags of the blobs missing are built again on pull.
+// The layers annotated "pin", the configs and the manifests are never evicted, nor are the blobs written after the time.
+func (b *imageBuilder) evict(ctx context.Context, blobs []fs.FileInfo, size int64, before time.Time) (int, int64, error) {
+	priorities := map[string]string{}
+	err := b.indexedPriorities(priorities)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var evictFirst, unannotated []fs.FileInfo
+	for _, info := range blobs {
+		if info.ModTime().After(before) {
+			continue
+		}
+		priority, ok := priorities[info.Name()]
+		switch {
+		case !ok:
+			// Not a layer.
+		case priority == v1alpha1.CachePriorityEvictFirst:
+			evictFirst = append(evictFirst, info)
+		case priority == "" && b.rebuildMissingBlobs:
+			unannotated = append(unannotated, info)
+		}
+	}
+	largestFirst := func(x, y fs.FileInfo) int {
+		return cmp.Compare(y.Size(), x.Size())
+	}
+	slices.SortFunc(evictFirst, largestFirst)
+	slices.SortFunc(unannotated, largestFirst)
+
+	logger := loggerFrom(ctx)
+	var evicted int
+	var freed int64
+	for _, info := range append(evictFirst, unannotated...) {
+		if freed >= size {
+			break
+		}
+		if !b.removeBlob(ctx, info.Name()) {
+			continue
+		}
+		logger.Info("blob evicted over the max size", "blob", info.Name(), "size", info.Size(), "priority", priorities[info.Name()])
+		evicted++
+		freed += info.Size()
+	}
+	if freed < size {
+		logger.Warn("cache over the max size with no more blobs to evict", "over", size-freed)
+	}
+	return evicted, freed, nil
+}
+
+// indexedPriorities records the cache priorities of the layers of the tags of the metadata index,
+// and of their previous builds and the stable builds of their canaries, an empty one for the layers without any.
+func (b *imageBuilder) indexedPriorities(priorities map[string]string) error {
+	tags, err := b.index.List()
+	if err != nil {
+		return err
+	}
+	seen := map[string]struct{}{}
+	for _, tag := range tags {
+		revisions := append([]metadata.Revision{tag.Revision()}, tag.History...)
+		if tag.Canary != nil {
+			revisions = append(revisions, tag.Canary.Stable)
+		}
+		for _, revision := range revisions {
+			for _, digest := range []string{revision.Digest, revision.AlternateDigest} {
+				err := b.layerPriorities(digest, seen, priorities)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// layerPriorities records the cache priorities of the layers of the manifest or of the manifests of the index.
+func (b *imageBuilder) layerPriorities(digest string, seen map[string]struct{}, priorities map[string]string) error {
+	if digest == "" {
+		return nil
+	}
+	if _, ok := seen[digest]; ok {
+		return nil
+	}
+	seen[digest] = struct{}{}
+	raw, err := os.ReadFile(b.BlobsPath(digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var manifest struct {
+		Layers    []v1.Descriptor `json:"layers,omitempty"`
+		Manifests []v1.Descriptor `json:"manifests,omitempty"`
+	}
+	err = json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return fmt.Errorf("manifest %s: %w", digest, err)
+	}
+	for _, layer := range manifest.Layers {
+		name := layer.Digest.String()
+		priority := layer.Annotations[v1alpha1.AnnotationCachePriority]
+		// A layer shared by several images is only as evictable as the least evictable of them.
+		if previous, ok := priorities[name]; ok && previous != priority {
+			if previous == v1alpha1.CachePriorityPin || priority == v1alpha1.CachePriorityPin {
+				priority = v1alpha1.CachePriorityPin
+			} else {
+				priority = ""
+			}
+		}
+		priorities[name] = priority
+	}
+	for _, m := range manifest.Manifests {
+		err := b.layerPriorities(m.Digest.String(), seen, priorities)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mark marks the blobs referenced by the manifest or the index.
+func (b *imageBuilder) mark(raw []byte, marked map[string]struct{}) error {
+	var manifest struct {
+		Config    *v1.Descriptor  `json:"config,omitempty"`
+		Layers    []v1.Descriptor `json:"layers,omitempty"`
+		Manifests []v1.Descriptor `json:"manifests,omitempty"`
+	}
+	err := json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Config != nil {
+		marked[manifest.Config.Digest.String()] = struct{}{}
+	}
+	for _, layer := range manifest.Layers {
+		marked[layer.Digest.String()] = struct{}{}
+	}
+	for _, m := range manifest.Manifests {
+		digest := m.Digest.String()
+		if _, ok := marked[digest]; ok {
+			continue
+		}
+		marked[digest] = struct{}{}
+		child, err := os.ReadFile(b.BlobsPath(digest))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		err = b.mark(child, marked)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteManifest removes the tag, or all the tags of the image pointing at the digest.
+// The blobs are left to the garbage collection.
+func (b *imageBuilder) DeleteManifest(image, reference string) (bool, error) {
+	// The tags never contain a colon, the digests are of any algorithm of digestRegexp.
+	if !strings.Contains(reference, ":") {
+		tagPath := path.Dir(b.ManifestPath(image, reference))
+		_, err := os.Stat(tagPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		b.memory.removePrefix(tagPath)
+		err = os.RemoveAll(tagPath)
+		if err != nil {
+			return false, err
+		}
+		return true, b.index.Delete(image, reference)
+	}
+
+	if !digestRegexp.MatchString(reference) {
+		return false, nil
+	}
+	algorithm, _, _ := strings.Cut(reference, ":")
+	imagePath := cachePath(b.cacheManifests, image)
+	tags, err := os.ReadDir(imagePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	deleted := false
+	for _, tag := range tags {
+		if !tag.IsDir() {
+			continue
+		}
+		for _, manifestPath := range []string{b.ManifestPath(image, tag.Name()), b.AlternateManifestPath(image, tag.Name())} {
+			raw, err := os.ReadFile(manifestPath)
+			if err != nil {
+				continue
+			}
+			if manifestDigest(algorithm, raw) != reference {
+				continue
+			}
+			tagPath := path.Join(imagePath, tag.Name())
+			b.memory.removePrefix(tagPath)
+			err = os.RemoveAll(tagPath)
+			if err != nil {
+				return deleted, err
+			}
+			err = b.index.Delete(image, tag.Name())
+			if err != nil {
+				return deleted, err
+			}
+			deleted = true
+			break
+		}
+	}
+	return deleted, nil
+}
+
+// runGC runs the garbage collection periodically.
+func (h *Handler) runGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.GC(ctx)
+		}
+	}
+}
+
+// GC removes the blobs that are no longer referenced by any tag.
+func (h *Handler) GC(ctx context.Context) (GCResult, error) {
+	logger := loggerFrom(ctx).With(logging.ComponentKey, "gc")
+	ctx = withLogger(ctx, logger)
+	expired, err := h.applyRetention(ctx, time.Now())
+	if err != nil {
+		logger.Error("gc failed", "err", err)
+		return GCResult{}, err
+	}
+	result, err := h.image.gc(ctx, gcGracePeriod)
+	result.Expired = expired
+	if err != nil {
+		logger.Error("gc failed", "err", err)
+		return result, err
+	}
+	logger.Info("gc finished", "scanned", result.Scanned, "removed", result.Removed, "expired", result.Expired, "freedBytes", result.FreedBytes)
+	return result, nil
+}
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/wzshiming/jitdi/pkg/buildapi"
+)
+
+// GRPCServer returns the gRPC server of the build API, the Builder service of pkg/buildapi,
+// which serves the builds, the rules and the invalidations of the admin API to the pipelines,
+// and the Worker service, which builds the tags requested by the frontends.
+// Like the admin API, it requires the admin token as a bearer token in the authorization metadata
+// and is disabled without an admin token.
+func (h *Handler) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{grpc.ChainUnaryInterceptor(h.grpcAuth)}, opts...)
+	server := grpc.NewServer(opts...)
+	buildapi.RegisterBuilderServer(server, &builderServer{h: h})
+	buildapi.RegisterWorkerServer(server, &workerServer{h: h})
+	return server
+}
+
+// grpcAuth requires the admin token for the gRPC services, which are disabled without an admin token.
+func (h *Handler) grpcAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if h.adminToken == "" {
+		return nil, status.Error(codes.PermissionDenied, "disabled without an admin token")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	want := []byte("Bearer " + h.adminToken)
+	for _, got := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(got), want) == 1 {
+			return handler(ctx, req)
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// grpcError returns the status of the err.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrNoRule):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+type builderServer struct {
+	buildapi.UnimplementedBuilderServer
+	h *Handler
+}
+
+func (s *builderServer) BuildImage(ctx context.Context, req *buildapi.BuildImageRequest) (*buildapi.Build, error) {
+	if req.Ref == "" {
+		return nil, status.Error(codes.InvalidArgument, "ref is required")
+	}
+	if s.h.readOnly {
+		return nil, grpcError(ErrReadOnly)
+	}
+	image, tag := splitRef(req.Ref)
+	if s.h.matchRule(image, tag) == nil {
+		return nil, grpcError(fmt.Errorf("%w %q", ErrNoRule, image+":"+tag))
+	}
+
+	if req.Wait {
+		build, err := s.h.Build(ctx, req.Ref)
+		// The failed builds are reported by their status.
+		if err != nil && (build.ID == "" || ctx.Err() != nil) {
+			return nil, grpcError(err)
+		}
+		return buildProto(build), nil
+	}
+
+	record := s.h.startBuild(image, tag)
+	if record == nil {
+		return nil, grpcError(fmt.Errorf("%w %q", ErrNoRule, image+":"+tag))
+	}
+	return buildProto(record.Build()), nil
+}
+
+func (s *builderServer) GetBuildStatus(ctx context.Context, req *buildapi.GetBuildStatusRequest) (*buildapi.Build, error) {
+	record, ok := s.h.builds.Get(req.Id)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "build %q not found", req.Id)
+	}
+	return buildProto(record.Build()), nil
+}
+
+func (s *builderServer) ListRules(ctx context.Context, req *buildapi.ListRulesRequest) (*buildapi.ListRulesResponse, error) {
+	infos := s.h.ruleInfos()
+	resp := &buildapi.ListRulesResponse{
+		Rules: make([]*buildapi.Rule, 0, len(infos)),
+	}
+	for _, info := range infos {
+		spec, err := json.Marshal(info.Spec)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		resp.Rules = append(resp.Rules, &buildapi.Rule{
+			Name:            info.Name,
+			Source:          info.Source,
+			ResourceVersion: info.ResourceVersion,
+			Pattern:         info.Pattern,
+			Hash:            info.Hash,
+			Spec:            string(spec),
+		})
+	}
+	return resp, nil
+}
+
+func (s *builderServer) InvalidateImage(ctx context.Context, req *buildapi.InvalidateImageRequest) (*buildapi.InvalidateImageResponse, error) {
+	if req.Ref == "" {
+		return nil, status.Error(codes.InvalidArgument, "ref is required")
+	}
+	image, tag := splitRef(req.Ref)
+	deleted, err := s.h.Invalidate(ctx, req.Ref)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &buildapi.InvalidateImageResponse{
+		Ref:     image + ":" + tag,
+		Deleted: deleted,
+	}
+	if req.Rebuild {
+		if record := s.h.startBuild(image, tag); record != nil {
+			resp.Build = buildProto(record.Build())
+		}
+	}
+	return resp, nil
+}
+
+var buildStatusProto = map[BuildStatus]buildapi.BuildStatus{
+	BuildRunning:   buildapi.BuildStatus_BUILD_STATUS_RUNNING,
+	BuildSucceeded: buildapi.BuildStatus_BUILD_STATUS_SUCCEEDED,
+	BuildFailed:    buildapi.BuildStatus_BUILD_STATUS_FAILED,
+}
+
+// buildProto returns the build as the message of the build API.
+func buildProto(build Build) *buildapi.Build {
+	b := &buildapi.Build{
+		Id:        build.ID,
+		Ref:       build.Ref,
+		Rule:      build.Rule,
+		RequestId: build.RequestID,
+		Status:    buildStatusProto[build.Status],
+		Error:     build.Error,
+		StartTime: timestamppb.New(build.StartTime),
+	}
+	if build.EndTime != nil {
+		b.EndTime = timestamppb.New(*build.EndTime)
+	}
+	for _, p := range build.Progress {
+		b.Progress = append(b.Progress, &buildapi.Progress{
+			Name:    p.Name,
+			Current: p.Current,
+			Total:   p.Total,
+			Percent: p.Percent,
+			Done:    p.Done,
+		})
+	}
+	return b
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/wzshiming/jitdi/pkg/buildapi"
+)
+
+// newTestGRPCConn serves the gRPC server of the handler in memory and returns a connection to it.
+func newTestGRPCConn(t *testing.T, h *Handler) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := h.GRPCServer()
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func withBearer(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestGRPCAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		auth     string
+		wantCode codes.Code
+	}{
+		{
+			name:     "without token",
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:     "without token with a bearer",
+			auth:     "secret",
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:     "missing bearer",
+			token:    "secret",
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "wrong bearer",
+			token:    "secret",
+			auth:     "wrong",
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "bearer",
+			token:    "secret",
+			auth:     "secret",
+			wantCode: codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, nil, WithAdminToken(tt.token))
+			client := buildapi.NewBuilderClient(newTestGRPCConn(t, h))
+			ctx := context.Background()
+			if tt.auth != "" {
+				ctx = withBearer(tt.auth)
+			}
+			_, err := client.ListRules(ctx, &buildapi.ListRulesRequest{})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("ListRules = %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestGRPCBuilder(t *testing.T) {
+	host := newSlowRegistry(t, 0, true)
+	h := newTestHandler(t, testBuildRules(host), WithAdminToken("secret"), WithInsecureRegistries(host))
+	client := buildapi.NewBuilderClient(newTestGRPCConn(t, h))
+	ctx := withBearer("secret")
+
+	rules, err := client.ListRules(ctx, &buildapi.ListRulesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Rules) != 1 || rules.Rules[0].Name != "a" || rules.Rules[0].Spec == "" {
+		t.Errorf("ListRules = %v, want the rule a", rules.Rules)
+	}
+
+	_, err = client.BuildImage(ctx, &buildapi.BuildImageRequest{Ref: "b:v1"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("BuildImage without rule = %v, want %v", err, codes.NotFound)
+	}
+	_, err = client.BuildImage(ctx, &buildapi.BuildImageRequest{})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("BuildImage without ref = %v, want %v", err, codes.InvalidArgument)
+	}
+
+	build, err := client.BuildImage(ctx, &buildapi.BuildImageRequest{Ref: "a:v1", Wait: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Ref != "a:v1" || build.Status != buildapi.BuildStatus_BUILD_STATUS_SUCCEEDED || build.EndTime == nil {
+		t.Errorf("BuildImage = %v, want a:v1 succeeded", build)
+	}
+
+	got, err := client.GetBuildStatus(ctx, &buildapi.GetBuildStatusRequest{Id: build.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != build.Id || got.Status != build.Status {
+		t.Errorf("GetBuildStatus = %v, want %v", got, build)
+	}
+	_, err = client.GetBuildStatus(ctx, &buildapi.GetBuildStatusRequest{Id: "unknown"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("GetBuildStatus of an unknown build = %v, want %v", err, codes.NotFound)
+	}
+
+	invalidated, err := client.InvalidateImage(ctx, &buildapi.InvalidateImageRequest{Ref: "a:v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !invalidated.Deleted || invalidated.Build != nil {
+		t.Errorf("InvalidateImage = %v, want deleted without build", invalidated)
+	}
+	invalidated, err = client.InvalidateImage(ctx, &buildapi.InvalidateImageRequest{Ref: "a:v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invalidated.Deleted {
+		t.Errorf("InvalidateImage of an invalidated tag = %v, want not deleted", invalidated)
+	}
+}
@@ -1,17 +1,27 @@
 package handler
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	stdatomic "sync/atomic"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/time/rate"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
@@ -20,52 +30,336 @@ import (
 	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
 	"github.com/wzshiming/jitdi/pkg/atomic"
 	"github.com/wzshiming/jitdi/pkg/client/clientset/versioned"
+	"github.com/wzshiming/jitdi/pkg/cloudauth"
+	"github.com/wzshiming/jitdi/pkg/credhelper"
+	"github.com/wzshiming/jitdi/pkg/logging"
+	"github.com/wzshiming/jitdi/pkg/metadata"
 	"github.com/wzshiming/jitdi/pkg/pattern"
 )
 
 type Handler struct {
-	buildMutex atomic.SyncMap[string, *sync.RWMutex]
+	buildCalls atomic.SyncMap[string, *buildCall]
 	image      *imageBuilder
+	builds     *buildRecords
+	adminToken string
+	auditor    *auditor
+	preheater  *preheater
+	users      map[string][]byte
+	usage      usageCache
+
+	progressInterval time.Duration
+	enableDelete     bool
+	enableUpload     bool
+	readOnly         bool
+
+	worker      *buildWorker
+	workerSlots chan struct{}
+	// workerWaiting is the number of the builds requested by the frontends waiting for a slot.
+	workerWaiting stdatomic.Int64
+
+	buildLocks *buildLocks
+	// buildsRun counts the builds run, and the coalesced ones the builds waited for instead of being run,
+	// of the same instance or of another instance sharing the cache.
+	buildsRun              stdatomic.Int64
+	buildsCoalescedLocal   stdatomic.Int64
+	buildsCoalescedCluster stdatomic.Int64
+
+	peers       *peers
+	peerNotices stdatomic.Int64
+
+	warmer *warmer
+
+	informers         informers
+	upstreamChecks    upstreamChecks
+	readyMinFreeBytes int64
+	breaker           *circuitBreaker
+
+	serveLimiter   *rate.Limiter
+	clientLimiters *clientLimiters
+
+	sendfileHeader string
+	sendfilePrefix string
+
+	tagCacheControl    string
+	digestCacheControl string
 
 	rules []*pattern.Rule
+	// prefixRules are the rules of the upstream prefixes, which are sorted with the others after them.
+	prefixRules []*pattern.Rule
+	// config are the images of the config file, including the templates, which the other rules can extend.
+	config []*v1alpha1.Image
 
-	crMut     sync.Mutex
-	cr        []*pattern.Rule
-	store     cache.Store
-	clientset *versioned.Clientset
+	crMut         sync.Mutex
+	cr            []*pattern.Rule
+	store         cache.Store
+	templateStore cache.Store
+	clientset     *versioned.Clientset
+
+	ruleStore        ruleStore
+	localRules       *fileRuleStore
+	rulesDir         *rulesDir
+	adminRuleSources []string
+
+	tenants *tenants
 }
 
-func NewHandler(cache string, config []*v1alpha1.ImageSpec, clientset *versioned.Clientset) (*Handler, error) {
-	rules := make([]*pattern.Rule, 0, len(config))
-	for _, c := range config {
-		r, err := pattern.NewRule(c)
+func NewHandler(cache string, config []*v1alpha1.Image, clientset *versioned.Clientset, opts ...Option) (*Handler, error) {
+	o := options{
+		concurrency:      4,
+		transport:        remote.DefaultTransport,
+		maxBuildRecords:  100,
+		maxBuildLogLines: 1000,
+		progressInterval: 10 * time.Second,
+
+		digestCacheControl: immutableCacheControl,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.insecureTransport == nil {
+		t := remote.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		o.insecureTransport = t
+	}
+
+	err := checkSendfileHeader(o.sendfileHeader)
+	if err != nil {
+		return nil, err
+	}
+	err = checkFsckMode(o.fsckMode)
+	if err != nil {
+		return nil, err
+	}
+	err = checkReadOnly(o)
+	if err != nil {
+		return nil, err
+	}
+
+	var ts *tenants
+	if o.tenants != "" {
+		var images []*v1alpha1.Image
+		ts, images, err = loadTenants(o.tenants)
+		if err != nil {
+			return nil, fmt.Errorf("load tenants: %w", err)
+		}
+		config = append(config[:len(config):len(config)], images...)
+	}
+
+	var errs []error
+	rules := pattern.NewRules(config, nil, nil, func(image *v1alpha1.Image, err error) {
+		errs = append(errs, fmt.Errorf("rule %q: %w", image.Name, err))
+	})
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+	breaker, err := newCircuitBreaker(o.circuitBreaker)
+	if err != nil {
+		return nil, err
+	}
+	err = o.retryPolicy.check()
+	if err != nil {
+		return nil, err
+	}
+	faults, err := newFaultInjector(o.faultInjection)
+	if err != nil {
+		return nil, err
+	}
+	err = pattern.ValidateRemote(o.remote)
+	if err != nil {
+		return nil, fmt.Errorf("remote: %w", err)
+	}
+	upstreamLimiter := newBandwidthLimiter(o.upstreamMaxBandwidth)
+	transport := o.retryPolicy.wrap(breaker.wrap(limitTransport(upstreamLimiter, faults.wrap(&headerTransport{global: o.remote, base: newRuleTransport(o.transport)}))))
+	insecureTransport := o.retryPolicy.wrap(breaker.wrap(limitTransport(upstreamLimiter, faults.wrap(&headerTransport{global: o.remote, base: newRuleTransport(o.insecureTransport)}))))
+	builder, err := newImageBuilder(cache, o.concurrency, transport, insecureTransport, o.insecureRegistries, o.inlineDataThreshold)
+	if err != nil {
+		return nil, err
+	}
+	builder.retry = o.retryPolicy.enabled()
+	builder.faults = faults
+	builder.remote = o.remote
+	keychains := append([]authn.Keychain{}, o.keychains...)
+	if len(o.credentialHelpers) != 0 {
+		helpers, err := credhelper.NewKeychain(o.credentialHelpers)
+		if err != nil {
+			return nil, fmt.Errorf("credential helpers: %w", err)
+		}
+		keychains = append(keychains, helpers)
+	}
+	if len(o.cloudCredentials) != 0 {
+		cloud, err := cloudauth.NewKeychain(o.cloudCredentials, o.transport)
+		if err != nil {
+			return nil, fmt.Errorf("cloud credentials: %w", err)
+		}
+		keychains = append(keychains, cloud)
+	}
+	if len(keychains) != 0 {
+		builder.keychain = authn.NewMultiKeychain(append(keychains, authn.DefaultKeychain)...)
+	}
+	builder.memory = newMemoryCache(o.memoryCacheSize)
+	builder.secretsDir = o.secretsDir
+	builder.redirectUpstream = o.redirectUpstream
+	for _, host := range o.redirectHosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("redirect host %q: %w", host, err)
+		}
+		builder.redirectHosts = append(builder.redirectHosts, strings.ToLower(host))
+	}
+	builder.shared = o.readOnly || o.buildWorker != ""
+	builder.index = o.metadataIndex
+	builder.tagHistory = o.tagHistory
+	builder.gcMaxSize = o.gcMaxSize
+	builder.rebuildMissingBlobs = o.rebuildMissingBlobs
+	builder.reuseMutationLayers = o.reuseMutationLayers
+	builder.buildTmpDir = o.buildTmpDir
+	builder.buildMaxFiles = o.buildMaxFiles
+	builder.buildMaxBytes = o.buildMaxBytes
+	if o.dedupStagedFiles {
+		builder.staged, err = newStagedContent(path.Join(builder.cacheTmp, "content"))
 		if err != nil {
 			return nil, err
 		}
-		rules = append(rules, r)
 	}
-	builder, err := newImageBuilder(cache)
+	builder.canary, err = newCanary(o.canarySoak, o.canaryPercent, o.canaryClients)
+	if err != nil {
+		return nil, err
+	}
+	if builder.index == nil {
+		builder.index, err = metadata.NewFileIndex(path.Join(cache, "index.json"))
+		if err != nil {
+			return nil, fmt.Errorf("load metadata index: %w", err)
+		}
+	}
+	if !o.readOnly {
+		err = builder.indexUnindexed()
+		if err != nil {
+			return nil, fmt.Errorf("index tags: %w", err)
+		}
+	}
+
+	var users map[string][]byte
+	if o.htpasswd != "" {
+		users, err = loadHtpasswd(o.htpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("load htpasswd: %w", err)
+		}
+	}
+
+	preheater, err := newPreheater(o.preheatEndpoint, o.preheatToken, o.preheatRegistryURL, o.transport)
+	if err != nil {
+		return nil, fmt.Errorf("dragonfly preheat: %w", err)
+	}
+
+	peers, err := newPeers(o.peers, o.peerToken, o.transport)
+	if err != nil {
+		return nil, err
+	}
+
+	warmer, err := newWarmer(o.warmTop, o.warmPeer, o.warmPeerToken, o.transport)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixRules, err := upstreamPrefixRules(o.upstreamPrefixes)
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Slice(rules, func(i, j int) bool {
+	// The rules of the same specificity keep the order they are loaded in.
+	sort.SliceStable(rules, func(i, j int) bool {
 		return rules[i].LessThan(rules[j])
 	})
 	h := &Handler{
-		image:     builder,
-		rules:     rules,
-		clientset: clientset,
+		image:      builder,
+		builds:     newBuildRecords(o.maxBuildRecords, o.maxBuildLogLines),
+		adminToken: o.adminToken,
+		auditor:    newAuditor(o.auditLog, o.auditWebhook, o.transport),
+		preheater:  preheater,
+		peers:      peers,
+		warmer:     warmer,
+		users:      users,
+
+		progressInterval:  o.progressInterval,
+		enableDelete:      o.enableDelete,
+		enableUpload:      o.enableUpload,
+		readOnly:          o.readOnly,
+		readyMinFreeBytes: o.readyMinFreeBytes,
+		breaker:           breaker,
+		serveLimiter:      newBandwidthLimiter(o.serveMaxBandwidth),
+		clientLimiters:    newClientLimiters(o.serveMaxClientBandwidth),
+		sendfileHeader:    o.sendfileHeader,
+		sendfilePrefix:    o.sendfilePrefix,
+
+		tagCacheControl:    o.tagCacheControl,
+		digestCacheControl: o.digestCacheControl,
+
+		rules:       rules,
+		prefixRules: prefixRules,
+		config:      config,
+		clientset:   clientset,
+		tenants:     ts,
+	}
+	h.worker, err = newBuildWorker(o.buildWorker, o.buildWorkerToken, o.buildWorkerTLS)
+	if err != nil {
+		return nil, fmt.Errorf("build worker: %w", err)
+	}
+	if o.workerConcurrency > 0 {
+		h.workerSlots = make(chan struct{}, o.workerConcurrency)
+	}
+	if o.buildLock && !o.readOnly && o.buildWorker == "" {
+		h.buildLocks, err = newBuildLocks(cache)
+		if err != nil {
+			return nil, fmt.Errorf("build locks: %w", err)
+		}
+		// The tags are built by the other instances as well, the manifests cached in memory are checked against the cache.
+		builder.shared = true
+	}
+	if clientset != nil {
+		h.ruleStore = &crdRuleStore{clientset: clientset}
+	} else {
+		h.localRules, err = newFileRuleStore(path.Join(cache, "rules.json"))
+		if err != nil {
+			return nil, fmt.Errorf("load rules: %w", err)
+		}
+		h.ruleStore = h.localRules
+	}
+	for _, dir := range o.adminRuleSources {
+		h.adminRuleSources = append(h.adminRuleSources, path.Clean(dir))
+	}
+	if o.rulesDir != "" {
+		h.rulesDir, err = newRulesDir(o.rulesDir)
+		if err != nil {
+			return nil, err
+		}
+		go h.rulesDir.watch(context.Background(), h.resetCR)
+	}
+
+	err = h.runFsck(o.fsckMode, o.fsckVerifyDigests)
+	if err != nil {
+		return nil, fmt.Errorf("fsck: %w", err)
+	}
+
+	if h.warmer != nil {
+		go h.runWarm(context.Background())
 	}
 
 	if clientset != nil {
 		go h.start(context.Background())
 	}
 
+	if o.gcInterval > 0 {
+		go h.runGC(context.Background(), o.gcInterval)
+	}
+
 	return h, nil
 }
 
 func (h *Handler) start(ctx context.Context) {
+	go h.startTemplates(ctx)
+	if !h.readOnly {
+		go h.startPrewarms(ctx)
+	}
+
 	api := h.clientset.ApisV1alpha1().Images()
 	store, controller := cache.NewInformer(
 		&cache.ListWatch{
@@ -90,10 +384,56 @@ func (h *Handler) start(ctx context.Context) {
 			},
 		},
 	)
+	h.informers.add("images", controller.HasSynced)
 	h.store = store
 	controller.Run(ctx.Done())
 }
 
+// startTemplates watches the ClusterImageTemplates, the rules are composed again when they change.
+func (h *Handler) startTemplates(ctx context.Context) {
+	api := h.clientset.ApisV1alpha1().ClusterImageTemplates()
+	store, controller := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				return api.List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				return api.Watch(ctx, opts)
+			},
+		},
+		&v1alpha1.ClusterImageTemplate{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				h.resetCR()
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				h.resetCR()
+			},
+			DeleteFunc: func(obj interface{}) {
+				h.resetCR()
+			},
+		},
+	)
+	h.informers.add("clusterimagetemplates", controller.HasSynced)
+	h.crMut.Lock()
+	h.templateStore = store
+	h.crMut.Unlock()
+	controller.Run(ctx.Done())
+}
+
+// templates returns the ClusterImageTemplates that the rules can reference, the caller holds the crMut.
+func (h *Handler) templates() []*v1alpha1.ClusterImageTemplate {
+	if h.templateStore == nil {
+		return nil
+	}
+	var list []*v1alpha1.ClusterImageTemplate
+	for _, item := range h.templateStore.List() {
+		list = append(list, item.(*v1alpha1.ClusterImageTemplate))
+	}
+	return list
+}
+
 func (h *Handler) resetCR() {
 	h.crMut.Lock()
 	defer h.crMut.Unlock()
@@ -101,29 +441,24 @@ func (h *Handler) resetCR() {
 }
 
 func (h *Handler) getRules() []*pattern.Rule {
-	if h.store == nil {
+	if h.store == nil && h.localRules == nil && h.rulesDir == nil && len(h.prefixRules) == 0 {
 		return h.rules
 	}
 
 	h.crMut.Lock()
 	defer h.crMut.Unlock()
 	if h.cr == nil {
-		list := h.store.List()
-		cr := make([]*pattern.Rule, 0, len(h.rules)+len(list))
+		list := h.dynamicImages()
+		cr := make([]*pattern.Rule, 0, len(h.rules)+len(list)+len(h.prefixRules))
 		cr = append(cr, h.rules...)
-
-		for _, item := range list {
-			image := item.(*v1alpha1.Image)
-			r, err := pattern.NewRule(&image.Spec)
-			if err != nil {
-				slog.Error("newImageRule", "err", err)
-				continue
-			}
-			cr = append(cr, r)
-		}
-		sort.Slice(cr, func(i, j int) bool {
+		cr = append(cr, pattern.NewRules(list, h.config, h.templates(), func(image *v1alpha1.Image, err error) {
+			slog.Error("newImageRule", "rule", image.Name, "err", err)
+		})...)
+		cr = append(cr, h.prefixRules...)
+		sort.SliceStable(cr, func(i, j int) bool {
 			return cr[i].LessThan(cr[j])
 		})
+		slog.Debug("rules loaded", logging.ComponentKey, "rules", "static", len(h.rules), "images", len(list))
 
 		h.cr = cr
 	}
@@ -131,7 +466,59 @@ func (h *Handler) getRules() []*pattern.Rule {
 	return h.cr
 }
 
+// dynamicImages returns the images of the rules that are not of the config file, which can change at runtime.
+func (h *Handler) dynamicImages() []*v1alpha1.Image {
+	var list []*v1alpha1.Image
+	if h.store != nil {
+		for _, item := range h.store.List() {
+			list = append(list, item.(*v1alpha1.Image))
+		}
+	}
+	if h.localRules != nil {
+		list = append(list, h.localRules.List()...)
+	}
+	if h.rulesDir != nil {
+		list = append(list, h.rulesDir.List()...)
+	}
+	return list
+}
+
+// Close persists the changes of the metadata index not persisted yet, such as the access times of the tags,
+// and closes the connection to the workers.
+func (h *Handler) Close() error {
+	if h.worker != nil {
+		_ = h.worker.Close()
+	}
+	return h.image.index.Close()
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(w, r)
+	r, ok := h.authenticate(r)
+	if !ok {
+		unauthorized(w, "invalid credentials")
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v2/") {
+		code, err := checkRegistryPath(r.URL.RawPath, r.URL.Path)
+		if err != nil {
+			registryError(w, http.StatusBadRequest, code, err.Error())
+			return
+		}
+	}
+
+	if parts := strings.Split(r.URL.Path, "/"); len(parts) >= 6 && parts[1] == "v2" &&
+		parts[len(parts)-3] == "blobs" && parts[len(parts)-2] == "uploads" {
+		h.uploads(w, r, strings.Join(parts[2:len(parts)-3], "/"), parts[len(parts)-1])
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		h.delete(w, r)
+		return
+	}
+
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -143,10 +530,20 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.URL.Path == "/v2/" {
+		// Challenge the anonymous clients so that they send the credentials if they have any.
+		if h.usersOf(r) != nil && clientIdentity(r) == "" {
+			unauthorized(w, "authentication required")
+			return
+		}
 		w.Write([]byte("ok"))
 		return
 	}
 
+	if r.URL.Path == extensionRulesPath {
+		h.extensionRules(w, r)
+		return
+	}
+
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) < 4 {
 		http.Error(w, "not found", http.StatusNotFound)
@@ -155,6 +552,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	image := strings.Join(parts[2:len(parts)-2], "/")
 
+	w = h.limitServing(w, r)
 	typ := parts[len(parts)-2]
 	switch typ {
 	case "blobs":
@@ -164,86 +562,603 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request) {
+	if !h.enableDelete {
+		registryError(w, http.StatusMethodNotAllowed, errCodeUnsupported, "deletion is disabled")
+		return
+	}
+
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 5 || parts[0] != "" || parts[1] != "v2" {
+		http.NotFound(w, r)
+		return
+	}
+
+	image := strings.Join(parts[2:len(parts)-2], "/")
+	reference := parts[len(parts)-1]
+	if parts[len(parts)-2] == "manifests" {
+		var ok bool
+		image, ok = h.virtualImage(r, image, reference)
+		if !ok {
+			registryError(w, http.StatusNotFound, errCodeManifestUnknown, "manifest unknown")
+			return
+		}
+		if !h.authorize(w, r, image, reference) {
+			return
+		}
+	}
+	switch parts[len(parts)-2] {
+	default:
+		http.NotFound(w, r)
+		return
+	case "blobs":
+		h.deleteBlob(w, r, image, reference)
+		return
+	case "manifests":
+	}
+	deleted, err := h.image.DeleteManifest(image, reference)
+	if err != nil {
+		loggerFrom(r.Context()).Error("image.DeleteManifest", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		registryError(w, http.StatusNotFound, errCodeManifestUnknown, "manifest unknown")
+		return
+	}
+	loggerFrom(r.Context()).Info("manifest deleted", "image", image, "reference", reference)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// deleteBlob removes the blob pushed by the upload API with the admin token,
+// the blobs of the built images are left to the garbage collection.
+func (h *Handler) deleteBlob(w http.ResponseWriter, r *http.Request, image, digest string) {
+	if !h.authorizeUploaded(w, r) {
+		return
+	}
+	if !digestRegexp.MatchString(digest) {
+		registryError(w, http.StatusBadRequest, errCodeDigestInvalid, fmt.Sprintf("invalid digest %q", digest))
+		return
+	}
+	uploaded := h.image.UploadedBlobPath(digest)
+	h.image.memory.remove(uploaded)
+	err := os.Remove(uploaded)
+	if err != nil {
+		if os.IsNotExist(err) {
+			registryError(w, http.StatusNotFound, errCodeBlobUnknown, "blob unknown")
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	loggerFrom(r.Context()).Info("blob deleted", "image", image, "digest", digest)
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func (h *Handler) blobs(w http.ResponseWriter, r *http.Request, image, hash string) {
-	http.ServeFile(w, r, h.image.BlobsPath(hash))
+	if !h.authorizeBlob(w, r, image, hash) {
+		return
+	}
+	blobPath := h.image.BlobsPath(hash)
+	stat, err := os.Stat(blobPath)
+	if err != nil && digestRegexp.MatchString(hash) {
+		uploaded := h.image.UploadedBlobPath(hash)
+		if uploadedStat, uploadedErr := os.Stat(uploaded); uploadedErr == nil {
+			blobPath, stat, err = uploaded, uploadedStat, nil
+		}
+	}
+	if digestRegexp.MatchString(hash) {
+		w.Header().Set("Docker-Content-Digest", hash)
+		if err != nil && h.serveUpstreamBlob(w, r, hash) {
+			return
+		}
+		// The HEAD only checks whether the blob exists and never builds.
+		if err != nil && r.Method == http.MethodGet && h.rebuildBlob(r, hash) {
+			stat, err = os.Stat(blobPath)
+		}
+		// The blobs missing are not cached, they may be built later.
+		if err == nil && h.digestCacheControl != "" {
+			w.Header().Set("Cache-Control", h.digestCacheControl)
+		}
+	}
+
+	if r.Method == http.MethodHead {
+		h.headBlob(w, stat, err)
+		return
+	}
+	if entry, ok := h.image.readSmallBlob(blobPath); ok {
+		w.Header().Set("Content-Type", entry.mediaType)
+		http.ServeContent(w, r, hash, entry.modTime, bytes.NewReader(entry.content))
+		return
+	}
+	h.serveBlobFile(w, r, blobPath)
+}
+
+// rebuildBlob builds again the tag whose current build references the blob missing from the cache,
+// only if its rule has not changed since so that the build is likely to yield the same blob, and reports whether it did.
+func (h *Handler) rebuildBlob(r *http.Request, digest string) bool {
+	if !h.image.rebuildMissingBlobs || h.readOnly {
+		return false
+	}
+	logger := loggerFrom(r.Context())
+	record, ok, err := h.image.blobTag(digest)
+	if err != nil {
+		logger.Warn("look up blob in metadata index", "digest", digest, "err", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	rule := h.matchRule(record.Image, record.Tag)
+	if rule == nil || rule.Hash() != record.RuleHash {
+		return false
+	}
+	logger.Info("rebuild tag of missing blob", "digest", digest, "image", record.Image, "tag", record.Tag)
+	err = h.build(context.WithoutCancel(r.Context()), record.Image, record.Tag)
+	if err != nil {
+		logger.Error("image.Build", "err", err)
+		return false
+	}
+	return true
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
 }
 
 func (h *Handler) manifests(w http.ResponseWriter, r *http.Request, image, tag string) {
-	if strings.HasPrefix(tag, "sha256:") {
-		serveManifest(w, r, h.image.BlobsPath(tag))
+	if onlyAcceptsSchema1(r.Header.Values("Accept")) {
+		registryError(w, http.StatusNotAcceptable, errCodeUnsupported, "docker schema1 manifests are not supported, the client must accept schema2 or OCI manifests")
+		return
+	}
+
+	image, ok := h.virtualImage(r, image, tag)
+	if !ok {
+		registryError(w, http.StatusNotFound, errCodeManifestUnknown, "manifest unknown")
+		return
+	}
+	if !h.authorize(w, r, image, tag) {
+		return
+	}
+
+	// The tags never contain a colon, the manifests of any digest algorithm are looked up in the blobs.
+	if strings.Contains(tag, ":") {
+		digest := h.serveManifest(w, r, h.image.BlobsPath(tag), h.manifestCacheControl(image, tag, true), "")
+		h.audit(r, image, tag, digest)
 		return
 	}
 
 	manifestPath := h.image.ManifestPath(image, tag)
 	_, err := os.Stat(manifestPath)
 	if err != nil {
-		err := h.build(image, tag)
+		if h.readOnly {
+			registryError(w, http.StatusNotFound, errCodeManifestUnknown, "manifest unknown")
+			return
+		}
+		err := h.build(context.WithoutCancel(r.Context()), image, tag)
 		if err != nil {
-			slog.Error("image.Build", "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("image.Build", "err", err)
+			if after, ok := retryAfter(err); ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(after.Seconds())))
+				registryError(w, http.StatusServiceUnavailable, errCodeUnknown, fmt.Sprintf("build %s:%s: %s", image, tag, err))
+				return
+			}
+			if errors.Is(err, errQuotaExceeded) {
+				registryError(w, http.StatusForbidden, errCodeDenied, fmt.Sprintf("build %s:%s: %s", image, tag, err))
+				return
+			}
+			registryError(w, http.StatusInternalServerError, errCodeUnknown, fmt.Sprintf("build %s:%s: %s", image, tag, err))
 			return
 		}
 	}
 
-	serveManifest(w, r, h.image.ManifestPath(image, tag))
+	alternatePath := h.image.AlternateManifestPath(image, tag)
+	cacheControl := h.manifestCacheControl(image, tag, false)
+	if stable, ok := h.canaryStable(r, image, tag); ok {
+		cacheControl = canaryCacheControl
+		if stable != nil {
+			manifestPath, alternatePath = h.image.BlobsPath(stable.Digest), ""
+			if stable.AlternateDigest != "" {
+				alternatePath = h.image.BlobsPath(stable.AlternateDigest)
+			}
+		}
+	}
+
+	manifestPath = h.negotiateManifest(r, image, tag, manifestPath, alternatePath)
+	if manifestPath == "" {
+		registryError(w, http.StatusNotFound, errCodeManifestUnknown, "no manifest of the tag is acceptable by the client")
+		return
+	}
+	// The manifest of the tag is negotiated with the Accept header.
+	w.Header().Set("Vary", "Accept")
+	digest := h.serveManifest(w, r, manifestPath, cacheControl, h.manifestDigestAlgorithm(image, tag))
+	h.audit(r, image, tag, digest)
+	if t := h.tenantOf(r); t != nil && digest != "" {
+		t.pulls.Add(1)
+	}
+	if digest != "" && !h.readOnly {
+		err := h.image.index.Touch(image, tag, time.Now())
+		if err != nil {
+			loggerFrom(r.Context()).Warn("touch metadata index", "image", image, "tag", tag, "err", err)
+		}
+	}
 }
 
-func (h *Handler) build(image, tag string) error {
-	ref := image + ":" + tag
+// negotiateManifest returns the path of the manifest of the tag which is acceptable by the client, of the manifest or the alternate one,
+// the alternate manifest is only used if the primary one is not acceptable.
+// Clients not accepting the OCI index get the Docker manifest list converted from it if they accept it,
+// or the image of the default platform, converted to Docker if they do not accept OCI.
+// An empty path is returned if there is no manifest acceptable.
+func (h *Handler) negotiateManifest(r *http.Request, image, tag, manifestPath, alternatePath string) string {
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return manifestPath
+	}
 
-	mut, ok := h.buildMutex.LoadOrStore(ref, &sync.RWMutex{})
-	if ok {
-		mut.RLock()
-		defer mut.RUnlock()
-		return nil
+	candidates := []string{manifestPath}
+	if alternatePath != "" && fileExists(alternatePath) {
+		candidates = append(candidates, alternatePath)
+	}
+
+	var manifests []*memoryCacheEntry
+	for _, candidate := range candidates {
+		manifest, err := h.image.readManifest(candidate)
+		if err != nil {
+			// Let serveManifest report the error.
+			return manifestPath
+		}
+		if acceptsMediaType(accept, types.MediaType(manifest.mediaType)) {
+			return candidate
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	for _, manifest := range manifests {
+		mediaType := types.MediaType(manifest.mediaType)
+		if !mediaType.IsIndex() {
+			continue
+		}
+		if mediaType == types.OCIImageIndex && acceptsMediaType(accept, types.DockerManifestList) {
+			indexPath, err := h.image.convertManifestBlob(manifest.content, outputMediaTypeDocker)
+			if err != nil {
+				loggerFrom(r.Context()).Error("convertManifestBlob", "image", image, "tag", tag, "err", err)
+				continue
+			}
+			return indexPath
+		}
+		imagePath, err := h.image.negotiatePlatformManifest(manifest.content, accept)
+		if err != nil {
+			loggerFrom(r.Context()).Error("negotiatePlatformManifest", "image", image, "tag", tag, "err", err)
+			continue
+		}
+		if imagePath != "" {
+			return imagePath
+		}
+	}
+	return ""
+}
+
+// defaultPlatform is the platform of the image served to the clients not accepting the index.
+var defaultPlatform = v1.Platform{OS: "linux", Architecture: "amd64"}
+
+// negotiatePlatformManifest returns the path of the image of the default platform in the index which is acceptable by the client,
+// the OCI image is converted to Docker if the client only accepts Docker.
+func (b *imageBuilder) negotiatePlatformManifest(raw []byte, accept []string) (string, error) {
+	index, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+
+	for _, desc := range index.Manifests {
+		if !desc.MediaType.IsImage() || desc.Platform == nil || !desc.Platform.Satisfies(defaultPlatform) {
+			continue
+		}
+		imagePath := b.BlobsPath(desc.Digest.String())
+		if acceptsMediaType(accept, desc.MediaType) {
+			return imagePath, nil
+		}
+		if desc.MediaType != types.OCIManifestSchema1 || !acceptsMediaType(accept, types.DockerManifestSchema2) {
+			continue
+		}
+
+		manifest, err := b.readManifest(imagePath)
+		if err != nil {
+			return "", err
+		}
+		return b.convertManifestBlob(manifest.content, outputMediaTypeDocker)
+	}
+	return "", nil
+}
+
+// convertManifestBlob converts the manifest to the format and returns the path of the converted one.
+func (b *imageBuilder) convertManifestBlob(raw []byte, format string) (string, error) {
+	converted, err := b.convertManifest(raw, format)
+	if err != nil {
+		return "", err
+	}
+	hash, err := writeManifestBlob(b.cacheBlobs, converted)
+	if err != nil {
+		return "", err
+	}
+	return b.BlobsPath(hash.String()), nil
+}
+
+// virtualImage returns the name that the image of the request is built and cached as,
+// the full reference with the host of the request if it is matched by a rule with a host,
+// or with the first host of the tenant of the request. It reports false if the tag is not served to the client,
+// the clients of a tenant are only served by the rules of the tenant and the rules of a tenant only serve its clients.
+func (h *Handler) virtualImage(r *http.Request, image, tag string) (string, bool) {
+	t := h.tenantOf(r)
+	if t != nil {
+		image = t.host + "/" + image
+	} else {
+		image = h.hostImage(strings.ToLower(r.Host), image, tag)
+	}
+	if rule := h.matchRule(image, tag); rule != nil && h.ruleTenant(rule) != t {
+		return image, false
 	}
+	return image, true
+}
 
-	mut.Lock()
+// hostImage returns the full reference of the image with the host if it is matched by a rule with a host.
+func (h *Handler) hostImage(host, image, tag string) string {
+	for _, rule := range h.getRules() {
+		// The rules with a host are sorted first.
+		if !rule.HasHost() {
+			break
+		}
+		if _, ok := rule.Match(host + "/" + image + ":" + tag); ok && host != "" {
+			return host + "/" + image
+		}
+		if _, ok := rule.Match(image + ":" + tag); ok {
+			return image
+		}
+	}
+	return image
+}
+
+// matchRule returns the rule that the image is built by, or nil if there is none.
+func (h *Handler) matchRule(image, tag string) *pattern.Rule {
+	ref := image + ":" + tag
+	for _, rule := range h.getRules() {
+		if _, ok := rule.Match(ref); ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// buildCall is the build of a tag running, the builds of the same tag started meanwhile wait for it and return its error.
+type buildCall struct {
+	done chan struct{}
+	err  error
+}
+
+func (h *Handler) build(ctx context.Context, image, tag string) error {
+	ref := image + ":" + tag
+
+	call := &buildCall{done: make(chan struct{})}
+	if running, loaded := h.buildCalls.LoadOrStore(ref, call); loaded {
+		h.buildsCoalescedLocal.Add(1)
+		select {
+		case <-running.done:
+			return running.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 	defer func() {
-		h.buildMutex.Delete(ref)
-		mut.Unlock()
+		h.buildCalls.Delete(ref)
+		close(call.done)
 	}()
+	call.err = h.buildOnce(ctx, ref, image, tag)
+	return call.err
+}
 
+// buildOnce builds the tag with the first rule matching it, on the worker if there is one,
+// or once across the instances sharing the cache with the build locks.
+func (h *Handler) buildOnce(ctx context.Context, ref, image, tag string) error {
+	logger := loggerFrom(ctx).With(logging.ComponentKey, "rules")
 	rules := h.getRules()
 	for _, rule := range rules {
-		mutates, ok := rule.Match(ref)
-		if ok {
-			err := h.image.Build(ref, mutates)
+		action, ok := rule.Match(ref)
+		if !ok {
+			logger.Debug("rule not matched", "ref", ref, "rule", rule.Name())
+			continue
+		}
+		logger.Debug("rule matched", "ref", ref, "rule", rule.Name(), "params", action.Params(), "baseImage", action.GetBaseImage())
+		if h.worker != nil {
+			return h.remoteBuild(ctx, ref, image, tag, action)
+		}
+		if h.buildLocks != nil {
+			unlock, err := h.buildLocks.lock(ctx, ref, h.image.ManifestPath(image, tag))
 			if err != nil {
 				return err
 			}
-			break
+			if unlock == nil {
+				h.buildsCoalescedCluster.Add(1)
+				logger.Info("tag built by another instance", "ref", ref)
+				return nil
+			}
+			defer unlock()
 		}
+		return h.runBuild(ctx, ref, action)
 	}
+	logger.Debug("no rule matched", "ref", ref, "rules", len(rules))
 	return nil
 }
 
-func serveManifest(w http.ResponseWriter, r *http.Request, manifestPath string) {
-	f, err := os.Open(manifestPath)
+// startBuild builds the tag in the background even if it is in the cache, and returns the record of the build,
+// or of the build of the tag already running. The record is nil if no rule matches the tag.
+func (h *Handler) startBuild(image, tag string) *buildRecord {
+	ref := image + ":" + tag
+	if record, ok := h.builds.Latest(ref); ok && record.Build().Status == BuildRunning {
+		return record
+	}
+
+	started := make(chan *buildRecord, 1)
+	go func() {
+		ctx := withBuildStarted(context.Background(), started)
+		err := h.build(ctx, image, tag)
+		if err != nil {
+			loggerFrom(ctx).Error("image.Build", "err", err)
+		}
+		close(started)
+	}()
+	record, ok := <-started
+	if !ok {
+		// The tag was being built before its build was recorded.
+		record, _ = h.builds.Latest(ref)
+	}
+	return record
+}
+
+func (h *Handler) runBuild(ctx context.Context, ref string, action *pattern.Action) error {
+	rule := action.Rule()
+	ctx = withLogger(ctx, loggerFrom(ctx).With(logging.ComponentKey, "build"))
+	ctx, record := h.builds.start(ctx, ref, rule.Name())
+	notifyBuildStarted(ctx, record)
+	h.buildsRun.Add(1)
+	logger := loggerFrom(ctx)
+	logger.Info("build started", "ref", ref, "rule", rule.Name())
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(h.progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				record.logProgress(logger)
+			}
+		}
+	}()
+
+	err := h.checkQuota(rule, ref)
+	if err == nil {
+		err = h.image.Build(ctx, ref, action)
+	}
+	close(done)
+	record.finish(err)
 	if err != nil {
-		http.NotFound(w, r)
-		return
+		logger.Error("build failed", "ref", ref, "err", err)
+	} else {
+		logger.Info("build succeeded", "ref", ref)
+		t := h.ruleTenant(rule)
+		if t != nil {
+			h.enforceQuota(ctx, t, ref)
+		}
+		i := strings.LastIndex(ref, ":")
+		if h.preheater != nil {
+			h.preheater.preheat(h.preheater.manifestURL(t, ref[:i], ref[i+1:]))
+		}
+		h.announceBuild(ref[:i], ref[i+1:])
 	}
-	defer f.Close()
 
-	mediaType := struct {
-		MediaType types.MediaType `json:"mediaType,omitempty"`
-	}{}
+	go h.updateStatus(context.Background(), rule, record)
+	return err
+}
 
-	err = json.NewDecoder(f).Decode(&mediaType)
+// remoteBuild waits for a worker to build the tag into the shared cache,
+// the build is recorded without the progress which is only known by the worker.
+func (h *Handler) remoteBuild(ctx context.Context, ref, image, tag string, action *pattern.Action) error {
+	rule := action.Rule()
+	ctx = withLogger(ctx, loggerFrom(ctx).With(logging.ComponentKey, "build"))
+	ctx, record := h.builds.start(ctx, ref, rule.Name())
+	notifyBuildStarted(ctx, record)
+	logger := loggerFrom(ctx)
+	logger.Info("build sent to worker", "ref", ref, "rule", rule.Name())
+
+	result, err := h.worker.build(ctx, image, tag)
+	record.finish(err)
 	if err != nil {
-		slog.Error("json.Decode", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logger.Error("build failed", "ref", ref, "err", err)
+		return err
 	}
-	stat, err := f.Stat()
+	logger.Info("build succeeded", "ref", ref, "digest", result.Digest)
+	return nil
+}
+
+// serveManifest serves the manifest and returns its digest, of the algorithm if not empty,
+// or an empty string if it is not served.
+func (h *Handler) serveManifest(w http.ResponseWriter, r *http.Request, manifestPath, cacheControl, digestAlgorithm string) string {
+	entry, err := h.image.readManifest(manifestPath)
 	if err != nil {
-		slog.Error("Stat", "err", err)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return ""
+		}
+		loggerFrom(r.Context()).Error("readManifest", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return ""
+	}
+
+	digest := entry.digest
+	if digestAlgorithm != "" && !strings.HasPrefix(digest, digestAlgorithm+":") {
+		digest = manifestDigest(digestAlgorithm, entry.content)
+		// The tags built before the rule chose the algorithm are addressed by it from now on.
+		if !h.readOnly {
+			err = h.image.writeManifestDigest(entry.content, digestAlgorithm)
+			if err != nil {
+				loggerFrom(r.Context()).Warn("write manifest digest", "digest", digest, "err", err)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", entry.mediaType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	// The digest is the ETag, ServeContent answers the If-None-Match of the clients polling the tags with 304.
+	w.Header().Set("ETag", `"`+digest+`"`)
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
 	}
+	http.ServeContent(w, r, path.Base(r.URL.Path), entry.modTime, bytes.NewReader(entry.content))
+	return digest
+}
 
-	w.Header().Set("Content-Type", string(mediaType.MediaType))
-	_, _ = f.Seek(0, 0)
-	http.ServeContent(w, r, path.Base(r.URL.Path), stat.ModTime(), f)
+// manifestDigestAlgorithm returns the algorithm of the digest of the manifest of the tag, the one of its rule.
+func (h *Handler) manifestDigestAlgorithm(image, tag string) string {
+	if rule := h.matchRule(image, tag); rule != nil {
+		return rule.DigestAlgorithm()
+	}
+	return ""
+}
+
+// manifestCacheControl returns the Cache-Control of the manifest pulled by tag or by digest,
+// the one of the rule of the image if it sets it, otherwise the default one.
+func (h *Handler) manifestCacheControl(image, tag string, byDigest bool) string {
+	if rule := h.matchRule(image, tag); rule != nil {
+		if cacheControl := rule.CacheControl(byDigest); cacheControl != "" {
+			return cacheControl
+		}
+	}
+	if byDigest {
+		return h.digestCacheControl
+	}
+	return h.tagCacheControl
+}
+
+// checkReadOnly rejects the options which write to the cache in the read-only mode.
+func checkReadOnly(o options) error {
+	if !o.readOnly {
+		return nil
+	}
+	switch {
+	case o.enableDelete:
+		return fmt.Errorf("deletion can not be enabled in the read-only mode")
+	case o.enableUpload:
+		return fmt.Errorf("upload can not be enabled in the read-only mode")
+	case o.gcInterval > 0:
+		return fmt.Errorf("garbage collection can not be enabled in the read-only mode")
+	case o.fsckMode == fsckRepair:
+		return fmt.Errorf("fsck can not repair in the read-only mode")
+	case o.buildWorker != "":
+		return fmt.Errorf("builds can not be sent to workers in the read-only mode")
+	case o.warmPeer != "":
+		return fmt.Errorf("tags can not be copied from a peer in the read-only mode")
+	}
+	return nil
 }
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+func TestManifestCacheControl(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl *v1alpha1.CacheControl
+		wantTag      string
+		wantDigest   string
+	}{
+		{
+			name:       "flags",
+			wantTag:    "no-cache",
+			wantDigest: "public, max-age=31536000, immutable",
+		},
+		{
+			name:         "rule",
+			cacheControl: &v1alpha1.CacheControl{Tag: "public, max-age=300", Digest: "private, max-age=600"},
+			wantTag:      "public, max-age=300",
+			wantDigest:   "private, max-age=600",
+		},
+		{
+			name:         "rule without digest",
+			cacheControl: &v1alpha1.CacheControl{Tag: "public, max-age=300"},
+			wantTag:      "public, max-age=300",
+			wantDigest:   "public, max-age=31536000, immutable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newSlowRegistry(t, 0, true)
+			rules := testBuildRules(host)
+			rules[0].Spec.CacheControl = tt.cacheControl
+			h := newTestHandler(t, rules, WithInsecureRegistries(host), WithCacheControl("no-cache", "public, max-age=31536000, immutable"))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/a/manifests/v1", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET by tag = %d: %s", rec.Code, rec.Body.String())
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.wantTag {
+				t.Errorf("Cache-Control by tag = %q, want %q", got, tt.wantTag)
+			}
+
+			digest := rec.Header().Get("Docker-Content-Digest")
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/a/manifests/"+digest, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET by digest %q = %d: %s", digest, rec.Code, rec.Body.String())
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.wantDigest {
+				t.Errorf("Cache-Control by digest = %q, want %q", got, tt.wantDigest)
+			}
+		})
+	}
+}
+
+func TestDigestAlgorithmSha512(t *testing.T) {
+	host := newSlowRegistry(t, 0, true)
+	rules := testBuildRules(host)
+	rules[0].Spec.DigestAlgorithm = "sha512"
+	h := newTestHandler(t, rules, WithInsecureRegistries(host), WithDelete(true), WithUpload(true), WithAdminToken("secret"))
+	serve := func(method, uri string, body []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, uri, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Pushed and pulled by a sha512 digest.
+	content := []byte("input")
+	sum := sha512.Sum512(content)
+	blob := "sha512:" + hex.EncodeToString(sum[:])
+	if rec := serve(http.MethodPost, "/v2/inputs/blobs/uploads/?digest="+blob, content); rec.Code != http.StatusCreated {
+		t.Fatalf("POST %s = %d: %s", blob, rec.Code, rec.Body.String())
+	}
+	if rec := serve(http.MethodGet, "/v2/inputs/blobs/"+blob, nil); rec.Code != http.StatusOK || rec.Body.String() != string(content) {
+		t.Fatalf("GET %s = %d: %s", blob, rec.Code, rec.Body.String())
+	}
+
+	// The tag is served by its sha512 digest.
+	rec := serve(http.MethodGet, "/v2/a/manifests/v1", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET by tag = %d: %s", rec.Code, rec.Body.String())
+	}
+	digest := rec.Header().Get("Docker-Content-Digest")
+	if want := manifestDigest("sha512", rec.Body.Bytes()); digest != want {
+		t.Fatalf("Docker-Content-Digest by tag = %q, want %q", digest, want)
+	}
+	rec = serve(http.MethodGet, "/v2/a/manifests/"+digest, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Docker-Content-Digest") != digest {
+		t.Fatalf("GET by digest = %d, Docker-Content-Digest %q: %s", rec.Code, rec.Header().Get("Docker-Content-Digest"), rec.Body.String())
+	}
+
+	// The garbage collection keeps the sha512 manifest of the tag, and the usage counts it.
+	_, err := h.image.gc(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(h.image.BlobsPath(digest)) {
+		t.Fatalf("the sha512 manifest of the tag is collected")
+	}
+	usage, err := h.image.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(h.image.cacheBlobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Blobs != len(entries) {
+		t.Errorf("usage blobs = %d, want %d", usage.Blobs, len(entries))
+	}
+
+	// Deleted by the sha512 digest, then collected.
+	if rec := serve(http.MethodDelete, "/v2/a/manifests/"+digest, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("DELETE %s = %d: %s", digest, rec.Code, rec.Body.String())
+	}
+	if fileExists(h.image.ManifestPath("a", "v1")) {
+		t.Errorf("the tag is not deleted")
+	}
+	_, err = h.image.gc(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(h.image.BlobsPath(digest)) {
+		t.Errorf("the sha512 manifest of the deleted tag is not collected")
+	}
+}
@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	"github.com/wzshiming/jitdi/pkg/atomic"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+type HuggingFaceLayerBuilder struct {
+	client    *http.Client
+	endpoint  string
+	cachePath string
+
+	fileBuilder *FileLayerBuilder
+	concurrency int
+
+	// staged deduplicates the files downloaded, nil if disabled.
+	staged *stagedContent
+}
+
+func NewHuggingFaceLayerBuilder(client *http.Client, endpoint string, cachePath string, fileBuilder *FileLayerBuilder, concurrency int) *HuggingFaceLayerBuilder {
+	if endpoint == "" {
+		endpoint = "https://huggingface.co"
+	}
+	return &HuggingFaceLayerBuilder{
+		client:      client,
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		cachePath:   cachePath,
+		fileBuilder: fileBuilder,
+		concurrency: concurrency,
+	}
+}
+
+type huggingFaceRevision struct {
+	Sha      string            `json:"sha"`
+	Siblings []huggingFaceFile `json:"siblings"`
+}
+
+type huggingFaceFile struct {
+	Filename string `json:"rfilename"`
+	Size     int64  `json:"size,omitempty"`
+	// LFS is set for the files stored with Git LFS, whose content is known by its digest before downloading it.
+	LFS *huggingFaceLFS `json:"lfs,omitempty"`
+}
+
+type huggingFaceLFS struct {
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Build returns the layers of the files of the repository and the repository at the commit of the revision.
+func (b *HuggingFaceLayerBuilder) Build(ctx context.Context, repo, revision, token string, include, exclude []string, workDir string) ([]mutate.Addendum, string, error) {
+	if token == "" {
+		token = os.Getenv("HF_TOKEN")
+	}
+
+	sha, files, err := b.Files(ctx, repo, revision, token, include, exclude)
+	if err != nil {
+		return nil, "", err
+	}
+
+	results := make([][]mutate.Addendum, len(files))
+	// The files take the slots of the build shared with the other mutates.
+	ctx = withBuildSlots(ctx, b.concurrency)
+	slots := buildSlotsFrom(ctx)
+	err = runParallel(len(files), func(i int) error {
+		release, err := slots.acquire(ctx)
+		if err != nil {
+			return fmt.Errorf("file %q: %w", files[i].Filename, err)
+		}
+		defer release()
+		a, err := b.buildFile(ctx, repo, sha, token, files[i], workDir)
+		if err != nil {
+			return fmt.Errorf("file %q: %w", files[i].Filename, err)
+		}
+		results[i] = a
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var addendums []mutate.Addendum
+	for _, a := range results {
+		addendums = append(addendums, a...)
+	}
+	return addendums, repo + "@" + sha, nil
+}
+
+// Files returns the commit of the revision and the files of the repository selected by the include and exclude patterns.
+func (b *HuggingFaceLayerBuilder) Files(ctx context.Context, repo, revision, token string, include, exclude []string) (string, []huggingFaceFile, error) {
+	if revision == "" {
+		revision = "main"
+	}
+	if token == "" {
+		token = os.Getenv("HF_TOKEN")
+	}
+	// The repository is joined to the paths of the cache, its params are replaced by the clients.
+	if !pattern.HuggingFaceRepoRegexp.MatchString(repo) {
+		return "", nil, fmt.Errorf("invalid huggingface repo %q, must be owner/name", repo)
+	}
+
+	info, err := b.getRevision(ctx, repo, revision, token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var files []huggingFaceFile
+	for _, sibling := range info.Siblings {
+		if matchFilters(sibling.Filename, include, exclude) {
+			files = append(files, sibling)
+		}
+	}
+	if len(files) == 0 {
+		return "", nil, fmt.Errorf("no files matched in %s@%s", repo, revision)
+	}
+	// The layers are in the order of the names, whatever the order of the api.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Filename < files[j].Filename
+	})
+	return info.Sha, files, nil
+}
+
+func (b *HuggingFaceLayerBuilder) getRevision(ctx context.Context, repo, revision, token string) (*huggingFaceRevision, error) {
+	u := fmt.Sprintf("%s/api/models/%s/revision/%s?blobs=true", b.endpoint, escapePath(repo), url.PathEscape(revision))
+	resp, err := b.get(ctx, u, token)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var info huggingFaceRevision
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		return nil, fmt.Errorf("decode revision of %q: %w", repo, err)
+	}
+	if info.Sha == "" {
+		return nil, fmt.Errorf("revision %q of %q not found", revision, repo)
+	}
+	// The commit and the names come from the hub, they are joined to the paths of the cache and of the image.
+	err = checkHuggingFaceName(info.Sha)
+	if err != nil || strings.Contains(info.Sha, "/") {
+		return nil, fmt.Errorf("revision %q of %q: invalid commit %q", revision, repo, info.Sha)
+	}
+	for _, sibling := range info.Siblings {
+		err = checkHuggingFaceName(sibling.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("revision %q of %q: %w", revision, repo, err)
+		}
+	}
+	return &info, nil
+}
+
+// checkHuggingFaceName fails for the names of the files of the hub that are not relative paths staying under their directory.
+func checkHuggingFaceName(name string) error {
+	if name == "" || path.IsAbs(name) || strings.ContainsRune(name, '\\') {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return checkEntryName(name)
+}
+
+func (b *HuggingFaceLayerBuilder) buildFile(ctx context.Context, repo, sha, token string, hfFile huggingFaceFile, workDir string) ([]mutate.Addendum, error) {
+	name := hfFile.Filename
+	// The names come from the hub, they must stay in the cache and the working directory.
+	err := checkHuggingFaceName(name)
+	if err != nil {
+		return nil, fmt.Errorf("huggingface %s@%s: %w", repo, sha, err)
+	}
+	srcPath := path.Join(b.cachePath, repo, sha, name)
+	stat, _ := os.Stat(srcPath)
+	if stat == nil && hfFile.LFS != nil {
+		// The same content staged for another repository or revision is not downloaded again.
+		ok, err := b.staged.link("sha256:"+hfFile.LFS.Sha256, srcPath)
+		if err != nil {
+			return nil, fmt.Errorf("link staged content: %w", err)
+		}
+		if ok {
+			loggerFrom(ctx).Info("huggingface file already staged", "repo", repo, "file", name, "digest", "sha256:"+hfFile.LFS.Sha256)
+			stat, _ = os.Stat(srcPath)
+		}
+	}
+	if stat == nil {
+		u := fmt.Sprintf("%s/%s/resolve/%s/%s", b.endpoint, escapePath(repo), url.PathEscape(sha), escapePath(name))
+		resp, err := b.get(ctx, u, token)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		hash := sha256.New()
+		err = atomic.WriteFileWithReader(srcPath, io.TeeReader(trackProgress(ctx, u, resp.ContentLength, resp.Body), hash), 0644)
+		if err != nil {
+			return nil, err
+		}
+		digest := hex.EncodeToString(hash.Sum(nil))
+		// The files of Git LFS are known by their digest, a truncated or altered download is not cached.
+		if hfFile.LFS != nil && digest != hfFile.LFS.Sha256 {
+			_ = os.Remove(srcPath)
+			return nil, fmt.Errorf("huggingface %s@%s: file %q has the digest sha256:%s, want sha256:%s", repo, sha, name, digest, hfFile.LFS.Sha256)
+		}
+		err = b.staged.store("sha256:"+digest, srcPath)
+		if err != nil {
+			return nil, fmt.Errorf("store staged content: %w", err)
+		}
+
+		stat, err = os.Stat(srcPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	addendums, err := b.fileBuilder.BuildFile(ctx, file, path.Join(workDir, name), stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	return describeSource(addendums, fmt.Sprintf("huggingface %s@%s", repo, sha)), nil
+}
+
+// escapePath escapes each segment of the slash-separated path.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (b *HuggingFaceLayerBuilder) get(ctx context.Context, u string, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("http.Get(%q): %w", u, fmt.Errorf("status code %d", resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// matchFilters reports whether the name is selected by the include and exclude glob patterns.
+func matchFilters(name string, include, exclude []string) bool {
+	for _, pat := range exclude {
+		if matchGlob(pat, name) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, pat := range include {
+		if matchGlob(pat, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches the pattern against the full name, or against the base name when the pattern has no slash.
+func matchGlob(pat, name string) bool {
+	if ok, _ := path.Match(pat, name); ok {
+		return true
+	}
+	if !strings.Contains(pat, "/") {
+		ok, _ := path.Match(pat, path.Base(name))
+		return ok
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestHuggingFaceFilesNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		sha      string
+		filename string
+		wantErr  bool
+	}{
+		{
+			name:     "nested",
+			sha:      "abc",
+			filename: "a/config.json",
+		},
+		{
+			name:     "parent",
+			sha:      "abc",
+			filename: "../../../etc/cron.d/x",
+			wantErr:  true,
+		},
+		{
+			name:     "parent after a directory",
+			sha:      "abc",
+			filename: "a/../../../x",
+			wantErr:  true,
+		},
+		{
+			name:     "absolute",
+			sha:      "abc",
+			filename: "/etc/passwd",
+			wantErr:  true,
+		},
+		{
+			name:     "backslash",
+			sha:      "abc",
+			filename: `..\x`,
+			wantErr:  true,
+		},
+		{
+			name:     "empty",
+			sha:      "abc",
+			filename: "",
+			wantErr:  true,
+		},
+		{
+			name:     "commit out of the repository",
+			sha:      "../..",
+			filename: "config.json",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(huggingFaceRevision{
+					Sha:      tt.sha,
+					Siblings: []huggingFaceFile{{Filename: tt.filename}},
+				})
+			}))
+			t.Cleanup(hub.Close)
+
+			b := NewHuggingFaceLayerBuilder(hub.Client(), hub.URL, t.TempDir(), nil, 1)
+			_, files, err := b.Files(context.Background(), "a/b", "main", "", nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Files error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(files) != 1 || files[0].Filename != tt.filename) {
+				t.Errorf("Files = %v, want %q", files, tt.filename)
+			}
+		})
+	}
+}
+
+func TestHuggingFaceFilesRepo(t *testing.T) {
+	tests := []struct {
+		repo    string
+		wantErr bool
+	}{
+		{repo: "openai-community/gpt2"},
+		{repo: "a/b.c_d-e"},
+		{repo: "../../../etc", wantErr: true},
+		{repo: "a/..", wantErr: true},
+		{repo: "a", wantErr: true},
+		{repo: "a/b/c", wantErr: true},
+		{repo: "a/b?c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(huggingFaceRevision{
+					Sha:      "abc",
+					Siblings: []huggingFaceFile{{Filename: "config.json"}},
+				})
+			}))
+			t.Cleanup(hub.Close)
+
+			b := NewHuggingFaceLayerBuilder(hub.Client(), hub.URL, t.TempDir(), nil, 1)
+			_, _, err := b.Files(context.Background(), tt.repo, "main", "", nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Files error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHuggingFaceBuildLFSDigest(t *testing.T) {
+	content := "weights"
+	sum := sha256.Sum256([]byte(content))
+	tests := []struct {
+		name    string
+		sha256  string
+		wantErr bool
+	}{
+		{
+			name:   "matching",
+			sha256: hex.EncodeToString(sum[:]),
+		},
+		{
+			name:    "mismatching",
+			sha256:  strings.Repeat("0", 64),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The name is escaped in the url of the file.
+			const filename = "dir/model#1.bin"
+			hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/models/a/b/revision/main":
+					_ = json.NewEncoder(w).Encode(huggingFaceRevision{
+						Sha: "abc",
+						Siblings: []huggingFaceFile{
+							{Filename: filename, LFS: &huggingFaceLFS{Sha256: tt.sha256, Size: int64(len(content))}},
+						},
+					})
+				case "/a/b/resolve/abc/" + filename:
+					_, _ = w.Write([]byte(content))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			t.Cleanup(hub.Close)
+
+			cache := t.TempDir()
+			fileBuilder := NewFileLayerBuilder(nil, t.TempDir(), 0644, time.Unix(0, 0), types.DockerLayer, 0, false)
+			b := NewHuggingFaceLayerBuilder(hub.Client(), hub.URL, cache, fileBuilder, 1)
+			addendums, _, err := b.Build(context.Background(), "a/b", "main", "", nil, nil, "/models")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Build error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, statErr := os.Stat(path.Join(cache, "a/b/abc", filename))
+			if tt.wantErr {
+				if !os.IsNotExist(statErr) {
+					t.Errorf("the file not matching its digest is cached: %v", statErr)
+				}
+				return
+			}
+			if statErr != nil || len(addendums) != 1 {
+				t.Errorf("Build got %d layers, cached file: %v", len(addendums), statErr)
+			}
+		})
+	}
+}
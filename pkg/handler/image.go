@@ -1,19 +1,22 @@
 package handler
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log/slog"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1"
@@ -22,52 +25,129 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"golang.org/x/sync/errgroup"
+	"k8s.io/apimachinery/pkg/api/resource"
 
 	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
 	"github.com/wzshiming/jitdi/pkg/atomic"
+	"github.com/wzshiming/jitdi/pkg/metadata"
 	"github.com/wzshiming/jitdi/pkg/pattern"
+	"github.com/wzshiming/jitdi/pkg/version"
 )
 
 type imageBuilder struct {
+	cache            string
 	cacheOllamaBlobs string
+	cacheHuggingFace string
 	cacheTmp         string
 	cacheBlobs       string
 	cacheManifests   string
+	cacheUploads     string
+	cacheTmpUploads  string
+	cacheMediaTypes  string
+	cacheUpstreams   string
+
+	concurrency int
+	transport   http.RoundTripper
+	client      *http.Client
+
+	insecureTransport  http.RoundTripper
+	insecureRegistries map[string]struct{}
+	// retry is set if the transports retry the requests, the status codes are not retried by go-containerregistry too.
+	retry bool
+	// faults are the faults injected to the writes of the blobs, nil if none.
+	faults *faultInjector
+	// remote are the global options of go-containerregistry, the ones of the rules override them.
+	remote v1alpha1.Remote
+	// keychain resolves the credentials of the upstream registries.
+	keychain authn.Keychain
+
+	inlineDataThreshold int64
+
+	// redirectUpstream leaves the layers of the base images in the upstream registries,
+	// the clients are redirected to them instead of the layers being stored.
+	redirectUpstream bool
+	// redirectHosts are the globs of the hosts that the clients can be redirected to.
+	redirectHosts []string
+
+	// secretsDir is where the Secrets referenced by the templates of the files are mounted.
+	secretsDir string
+
+	memory *memoryCache
+	index  metadata.Index
+	// staged deduplicates the files downloaded for the builds, nil if disabled.
+	staged *stagedContent
+	// buildTmpDir is where the temporary directories of the builds are created, e.g. a tmpfs, the tmp of the cache if empty.
+	buildTmpDir string
+	// buildMaxFiles and buildMaxBytes bound the files added by the mutations of a build, zero is unbounded.
+	buildMaxFiles int64
+	buildMaxBytes int64
+	// rebuildMissingBlobs builds again the tags of the blobs pulled but missing from the cache.
+	rebuildMissingBlobs bool
+	// reuseMutationLayers reuses the layers of the previous build of the tag for the mutations whose inputs are unchanged.
+	reuseMutationLayers bool
+	// gcMaxSize is the size of the blobs over which the garbage collection evicts the layers still referenced, zero disables it.
+	gcMaxSize int64
+	// tagHistory is how many previous builds of every tag are kept for the rollbacks.
+	tagHistory int
+	// canary selects the clients served the rebuilt tags during their soak, nil if the rebuilt tags are served to all.
+	canary *canary
+
+	// shared revalidates the tag manifests cached in memory, as they are written by another instance.
+	shared bool
 }
 
-func newImageBuilder(cache string) (*imageBuilder, error) {
+func newImageBuilder(cache string, concurrency int, transport, insecureTransport http.RoundTripper, insecureRegistries []string, inlineDataThreshold int64) (*imageBuilder, error) {
 	cacheBlobs := path.Join(cache, "blobs")
 	cacheManifests := path.Join(cache, "manifests")
 	cacheTmp := path.Join(cache, "tmp")
 	cacheOllamaBlobs := path.Join(cacheTmp, "ollama", "blobs")
+	cacheHuggingFace := path.Join(cacheTmp, "huggingface")
+	cacheUploads := path.Join(cache, "uploads")
+	cacheTmpUploads := path.Join(cacheTmp, "uploads")
+	cacheMediaTypes := path.Join(cache, "mediatypes")
+	cacheUpstreams := path.Join(cache, "upstreams")
 
-	for _, p := range []string{cacheBlobs, cacheManifests, cacheOllamaBlobs} {
+	for _, p := range []string{cacheBlobs, cacheManifests, cacheOllamaBlobs, cacheHuggingFace, cacheUploads, cacheTmpUploads, cacheMediaTypes, cacheUpstreams} {
 		err := os.MkdirAll(p, 0755)
 		if err != nil {
 			return nil, err
 		}
 	}
+	insecure := make(map[string]struct{}, len(insecureRegistries))
+	for _, r := range insecureRegistries {
+		insecure[r] = struct{}{}
+	}
 	return &imageBuilder{
+		cache:            cache,
 		cacheOllamaBlobs: cacheOllamaBlobs,
+		cacheHuggingFace: cacheHuggingFace,
 		cacheBlobs:       cacheBlobs,
 		cacheManifests:   cacheManifests,
+		cacheUploads:     cacheUploads,
+		cacheTmpUploads:  cacheTmpUploads,
+		cacheMediaTypes:  cacheMediaTypes,
+		cacheUpstreams:   cacheUpstreams,
 		cacheTmp:         cacheTmp,
-	}, nil
-}
+		concurrency:      concurrency,
+		transport:        transport,
+		client:           &http.Client{Transport: transport},
+		keychain:         authn.DefaultKeychain,
 
-func (b *imageBuilder) Build(newImage string, meta *pattern.Action) error {
-	o := crane.GetOptions()
+		insecureTransport:  insecureTransport,
+		insecureRegistries: insecure,
 
-	src := meta.GetBaseImage()
-	ref, err := name.ParseReference(src, o.Name...)
-	if err != nil {
-		return fmt.Errorf("parsing reference %q: %w", src, err)
-	}
+		inlineDataThreshold: inlineDataThreshold,
+	}, nil
+}
 
-	rmt, err := remote.Get(ref, o.Remote...)
+func (b *imageBuilder) Build(ctx context.Context, newImage string, meta *pattern.Action) error {
+	ctx, cleanup, err := b.sandbox(ctx)
 	if err != nil {
-		return fmt.Errorf("getting remote %q: %w", src, err)
+		return fmt.Errorf("creating build directory: %w", err)
 	}
+	defer cleanup()
+	// The platforms and the mutates of the build share its slots.
+	ctx = withBuildSlots(ctx, b.concurrency)
 
 	var (
 		image string
@@ -82,6 +162,32 @@ func (b *imageBuilder) Build(newImage string, meta *pattern.Action) error {
 		tag = s[1]
 	}
 
+	// The encrypted layers are not reused, the layers are encrypted again on every build.
+	if b.reuseMutationLayers && len(meta.EncryptionRecipients()) == 0 {
+		previous, _, err := b.index.Get(image, tag)
+		if err != nil {
+			return fmt.Errorf("getting previous build: %w", err)
+		}
+		pinned := meta.IsReproducible() || os.Getenv("SOURCE_DATE_EPOCH") != ""
+		ctx = withMutationLayers(ctx, previous.Mutations, pinned)
+	}
+
+	ctx = withRuleRemote(ctx, meta.Rule().Remote())
+	src := meta.GetBaseImage()
+	ref, remoteOptions, err := b.parseReference(ctx, src, meta.IsInsecure())
+	if err != nil {
+		return fmt.Errorf("parsing reference %q: %w", src, err)
+	}
+
+	rmt, err := remote.Get(ref, append(remoteOptions, remote.WithContext(ctx))...)
+	if err != nil {
+		return fmt.Errorf("getting remote %q: %w", src, err)
+	}
+
+	annotations := meta.GetAnnotations()
+	annotations[v1alpha1.AnnotationVersion] = version.Get()
+
+	var raw []byte
 	switch rmt.MediaType {
 	default:
 		return fmt.Errorf("unknown media type %q", rmt.MediaType)
@@ -99,20 +205,29 @@ func (b *imageBuilder) Build(newImage string, meta *pattern.Action) error {
 
 		images := make([]v1.Image, len(indexManifest.Manifests))
 		for i, manifest := range indexManifest.Manifests {
+			if !meta.MatchPlatform(manifest.Platform) {
+				loggerFrom(ctx).Info("skip platform", "digest", manifest.Digest, "platform", manifest.Platform)
+				continue
+			}
 			img, err := imageIndex.Image(manifest.Digest)
 			if err != nil {
 				return fmt.Errorf("getting image %q: %w", manifest.Digest, err)
 			}
-			img = cache.Image(img, newFilesystemCache(b.cacheBlobs))
+			img = cache.Image(img, newFilesystemCache(loggerFrom(ctx), b.cacheBlobs))
 
 			index := i
 			doMutate := func() error {
-				img, err := b.mutateManifest(img, meta, manifest.Platform, manifest.MediaType)
+				upstream, err := b.recordUpstreamLayers(img, ref, meta.IsInsecure())
+				if err != nil {
+					return fmt.Errorf("record upstream layers: %w", err)
+				}
+				img, err := b.mutateManifest(ctx, img, meta, manifest.Platform, manifest.MediaType)
 				if err != nil {
 					return fmt.Errorf("mutate manifest: %w", err)
 				}
+				img = mutate.Annotations(img, annotations).(v1.Image)
 
-				err = saveManifest(img, b.cacheBlobs, "", "", "")
+				err = saveManifest(ctx, img, b.cacheBlobs, b.cacheMediaTypes, upstream, b.faults)
 				if err != nil {
 					return fmt.Errorf("save manifest: %w", err)
 				}
@@ -161,7 +276,13 @@ func (b *imageBuilder) Build(newImage string, meta *pattern.Action) error {
 		}
 
 		indexManifest.Manifests = manifests
-		err = saveIndexManifest(indexManifest, b.cacheBlobs, b.cacheManifests, image, tag)
+		if indexManifest.Annotations == nil {
+			indexManifest.Annotations = map[string]string{}
+		}
+		for k, v := range annotations {
+			indexManifest.Annotations[k] = v
+		}
+		raw, err = saveIndexManifest(indexManifest, b.cacheBlobs)
 		if err != nil {
 			return fmt.Errorf("save index manifest: %w", err)
 		}
@@ -170,38 +291,107 @@ func (b *imageBuilder) Build(newImage string, meta *pattern.Action) error {
 		if err != nil {
 			return fmt.Errorf("getting image: %w", err)
 		}
-		img = cache.Image(img, newFilesystemCache(b.cacheBlobs))
+		img = cache.Image(img, newFilesystemCache(loggerFrom(ctx), b.cacheBlobs))
+
+		if p := imagePlatform(img, nil); !meta.MatchPlatform(p) {
+			return fmt.Errorf("platform %v of %q is not matched by the rule", p, src)
+		}
 
-		img, err = b.mutateManifest(img, meta, rmt.Platform, rmt.MediaType)
+		upstream, err := b.recordUpstreamLayers(img, ref, meta.IsInsecure())
+		if err != nil {
+			return fmt.Errorf("record upstream layers: %w", err)
+		}
+		img, err = b.mutateManifest(ctx, img, meta, nil, rmt.MediaType)
 		if err != nil {
 			return fmt.Errorf("mutate manifest: %w", err)
 		}
+		img = mutate.Annotations(img, annotations).(v1.Image)
 
-		err = saveManifest(img, b.cacheBlobs, b.cacheManifests, image, tag)
+		err = saveManifest(ctx, img, b.cacheBlobs, b.cacheMediaTypes, upstream, b.faults)
 		if err != nil {
 			return fmt.Errorf("save manifest: %w", err)
 		}
-	case types.DockerManifestSchema1:
+
+		raw, err = img.RawManifest()
+		if err != nil {
+			return fmt.Errorf("getting raw manifest: %w", err)
+		}
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
 		img, err := rmt.Schema1()
 		if err != nil {
 			return fmt.Errorf("getting image: %w", err)
 		}
-		img = cache.Image(img, newFilesystemCache(b.cacheBlobs))
+		img = cache.Image(img, newFilesystemCache(loggerFrom(ctx), b.cacheBlobs))
 
-		img, err = b.mutateManifest(img, meta, rmt.Platform, rmt.MediaType)
+		loggerFrom(ctx).Info("convert schema1 to schema2", "image", src)
+		img, err = convertSchema1(img)
+		if err != nil {
+			return fmt.Errorf("converting schema1 image %q: %w", src, err)
+		}
+
+		img, err = b.mutateManifest(ctx, img, meta, rmt.Platform, types.DockerManifestSchema2)
 		if err != nil {
 			return fmt.Errorf("mutate manifest: %w", err)
 		}
+		img = mutate.Annotations(img, annotations).(v1.Image)
 
-		err = saveManifest(img, b.cacheBlobs, b.cacheManifests, image, tag)
+		err = saveManifest(ctx, img, b.cacheBlobs, b.cacheMediaTypes, nil, b.faults)
 		if err != nil {
 			return fmt.Errorf("save manifest: %w", err)
 		}
+
+		raw, err = img.RawManifest()
+		if err != nil {
+			return fmt.Errorf("getting raw manifest: %w", err)
+		}
+	}
+
+	err = b.checkManifest(raw)
+	if err != nil {
+		return fmt.Errorf("check manifest: %w", err)
+	}
+
+	err = b.saveTag(raw, meta.OutputMediaType(), meta.DigestAlgorithm(), image, tag)
+	if err != nil {
+		return fmt.Errorf("save tag: %w", err)
+	}
+
+	err = b.indexTag(image, tag, meta.Rule(), mutationLayersFrom(ctx).mutations())
+	if err != nil {
+		return fmt.Errorf("index tag: %w", err)
 	}
 	return nil
 }
 
-func (b *imageBuilder) buildAddendum(mediaType types.MediaType, mutates []v1alpha1.Mutate) ([]mutate.Addendum, error) {
+// buildTime returns the time of the build, which is SOURCE_DATE_EPOCH if it is set,
+// the reproducible builds are pinned to the Unix epoch without it.
+func buildTime(reproducible bool) (time.Time, error) {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+		}
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	if reproducible {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	return time.Now(), nil
+}
+
+// mutation is the layers added by a mutate and the history entry describing it.
+type mutation struct {
+	addendums []mutate.Addendum
+	// config changes the config of the image after the layers are appended, nil if the mutate changes no config.
+	config *v1alpha1.Config
+	// env sets the environment variables of the image after the layers are appended.
+	env []string
+	// order is the layer order of the mutate, the mutations are appended by it.
+	order   int
+	history v1.History
+}
+
+func (b *imageBuilder) buildMutations(ctx context.Context, mediaType types.MediaType, base v1.Image, mutates []v1alpha1.Mutate, params map[string]string, creationTime time.Time, windows bool) ([]mutation, error) {
 	var layerMediaType types.MediaType
 	switch mediaType {
 	default:
@@ -212,152 +402,496 @@ func (b *imageBuilder) buildAddendum(mediaType types.MediaType, mutates []v1alph
 		layerMediaType = types.DockerLayer
 	}
 
-	var layers []mutate.Addendum
-
-	creationTime := time.Now()
-
-	for _, m := range mutates {
-		if m.File != nil {
-			var mode int64 = 0644
-			if m.File.Mode != "" {
-				m, err := strconv.ParseUint(m.File.Mode, 0, 0)
-				if err == nil {
-					mode = int64(m)
+	reuse := mutationLayersFrom(ctx)
+	results := make([]mutation, len(mutates))
+	// The mutates wait for the slots of the build, the ones of Hugging Face for each of their files.
+	ctx = withBuildSlots(ctx, b.concurrency)
+	slots := buildSlotsFrom(ctx)
+	err := runParallel(len(mutates), func(i int) error {
+		var (
+			addendums   []mutate.Addendum
+			description string
+			fingerprint string
+			reused      bool
+		)
+		if reuse != nil {
+			f, ok, err := reuse.fingerprint(base, mutates[i], params, layerMediaType, creationTime, windows)
+			if err != nil {
+				return fmt.Errorf("mutate %d: fingerprint: %w", i, err)
+			}
+			if ok {
+				fingerprint = f
+				addendums, description, reused = reuse.reuse(b, fingerprint)
+			}
+		}
+		if reused {
+			loggerFrom(ctx).Info("reuse mutation layers", "mutate", i, "fingerprint", fingerprint)
+		} else {
+			if mutates[i].HuggingFace == nil {
+				release, err := slots.acquire(ctx)
+				if err != nil {
+					return fmt.Errorf("mutate %d: %w", i, err)
+				}
+				defer release()
+			}
+			var err error
+			addendums, description, err = b.buildMutate(ctx, base, mutates[i], params, layerMediaType, creationTime, windows)
+			if err != nil {
+				return fmt.Errorf("mutate %d: %w", i, err)
+			}
+		}
+		if priority := mutates[i].CachePriority; priority != "" {
+			for j := range addendums {
+				if addendums[j].Annotations == nil {
+					addendums[j].Annotations = map[string]string{}
 				}
+				addendums[j].Annotations[v1alpha1.AnnotationCachePriority] = priority
 			}
+		}
+		if fingerprint != "" {
+			err := reuse.record(fingerprint, description, addendums)
+			if err != nil {
+				return fmt.Errorf("mutate %d: record layers: %w", i, err)
+			}
+		}
+		results[i] = mutation{
+			addendums: addendums,
+			config:    mutates[i].Config,
+			env:       localeEnv(mutates[i].Locale),
+			order:     mutates[i].LayerOrder,
+			history: v1.History{
+				Created:    v1.Time{Time: creationTime},
+				Author:     "jitdi",
+				CreatedBy:  "jitdi: " + description,
+				Comment:    fmt.Sprintf("Mutate %d/%d", i+1, len(mutates)),
+				EmptyLayer: true,
+			},
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
 
-			builder := NewFileLayerBuilder(b.cacheTmp, mode, creationTime, layerMediaType)
-			addendums, err := builder.Build(m.File.Source, m.File.Destination)
+// buildMutate returns the layers of the mutate and the description of what it adds,
+// the templates of the renders are executed with the parameters and the binaries are picked for the platform of the parameters,
+// the patches, the users, the trusted CAs and the locales read the files of the base image.
+func (b *imageBuilder) buildMutate(ctx context.Context, base v1.Image, m v1alpha1.Mutate, params map[string]string, layerMediaType types.MediaType, creationTime time.Time, windows bool) ([]mutate.Addendum, string, error) {
+	if m.File != nil {
+		var mode int64 = 0644
+		if m.File.Extract != nil {
+			// The extracted files keep the modes of the archive.
+			mode = 0
+		}
+		if m.File.Mode != "" {
+			m, err := strconv.ParseUint(m.File.Mode, 0, 0)
+			if err == nil {
+				mode = int64(m)
+			}
+		}
+
+		chunkSize, err := parseChunkSize(m.File.ChunkSize)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if m.File.Replaces != "" {
+			header, err := verifyBaseFile(base, m.File.Destination, m.File.Replaces, windows)
 			if err != nil {
-				return nil, fmt.Errorf("file layer builder: %w", err)
+				return nil, "", fmt.Errorf("file %s: %w", m.File.Destination, err)
+			}
+			if m.File.Mode == "" {
+				mode = header.Mode
 			}
+		}
 
-			return addendums, nil
-		} else if m.Ollama != nil {
+		if m.File.Template != "" {
+			return b.buildTemplate(ctx, m.File, mode, chunkSize, layerMediaType, creationTime, windows)
+		}
+
+		// The blobs pushed by the upload API are referenced by digest.
+		source := m.File.Source
+		if digestRegexp.MatchString(source) {
+			source = b.UploadedBlobPath(source)
+		}
 
-			builder := NewOllamaLayerBuilder(b.cacheOllamaBlobs, NewFileLayerBuilder(b.cacheTmp, 0644, creationTime, layerMediaType))
-			addendums, err := builder.Build(m.Ollama.Model, m.Ollama.WorkDir, m.Ollama.ModelName)
+		builder := NewFileLayerBuilder(b.client, b.cacheTmp, mode, creationTime, layerMediaType, chunkSize, windows)
+		builder.staged = b.staged
+		if m.File.Extract != nil {
+			addendums, err := builder.Extract(ctx, source, m.File.Destination, *m.File.Extract)
 			if err != nil {
-				return nil, fmt.Errorf("ollama layer builder: %w", err)
+				return nil, "", fmt.Errorf("file layer builder: %w", err)
 			}
+			return addendums, fmt.Sprintf("extract %s from %s", m.File.Destination, m.File.Source), nil
+		}
+		addendums, err := builder.Build(ctx, source, m.File.Destination)
+		if err != nil {
+			return nil, "", fmt.Errorf("file layer builder: %w", err)
+		}
 
-			return addendums, nil
+		if m.File.Replaces != "" {
+			return addendums, fmt.Sprintf("replace %s %s from %s", m.File.Destination, m.File.Replaces, m.File.Source), nil
 		}
+		return addendums, fmt.Sprintf("add %s from %s", m.File.Destination, m.File.Source), nil
+	} else if m.Ollama != nil {
+
+		builder := NewOllamaLayerBuilder(b.parseReference, b.cacheOllamaBlobs, NewFileLayerBuilder(b.client, b.cacheTmp, 0644, creationTime, layerMediaType, 0, windows))
+		addendums, source, err := builder.Build(ctx, m.Ollama.Model, m.Ollama.WorkDir, m.Ollama.ModelName)
+		if err != nil {
+			return nil, "", fmt.Errorf("ollama layer builder: %w", err)
+		}
+
+		return addendums, fmt.Sprintf("add %s from ollama://%s", m.Ollama.WorkDir, source), nil
+	} else if m.HuggingFace != nil {
+		hf := m.HuggingFace
+		chunkSize, err := parseChunkSize(hf.ChunkSize)
+		if err != nil {
+			return nil, "", err
+		}
+
+		builder := NewHuggingFaceLayerBuilder(b.client, os.Getenv("HF_ENDPOINT"), b.cacheHuggingFace, NewFileLayerBuilder(b.client, b.cacheTmp, 0644, creationTime, layerMediaType, chunkSize, windows), b.concurrency)
+		builder.staged = b.staged
+		addendums, source, err := builder.Build(ctx, hf.Repo, hf.Revision, hf.Token, hf.Include, hf.Exclude, hf.WorkDir)
+		if err != nil {
+			return nil, "", fmt.Errorf("huggingface layer builder: %w", err)
+		}
+
+		return addendums, fmt.Sprintf("add %s from huggingface://%s", hf.WorkDir, source), nil
+	} else if m.Render != nil {
+		return b.buildRender(ctx, m.Render, params, layerMediaType, creationTime, windows)
+	} else if m.Patch != nil {
+		return b.buildPatch(ctx, m.Patch, base, layerMediaType, creationTime, windows)
+	} else if m.User != nil {
+		return b.buildUser(ctx, m.User, base, layerMediaType, creationTime, windows)
+	} else if m.TrustedCA != nil {
+		return b.buildTrustedCA(ctx, m.TrustedCA, base, layerMediaType, creationTime, windows)
+	} else if m.Locale != nil {
+		return b.buildLocale(ctx, m.Locale, base, layerMediaType, creationTime, windows)
+	} else if m.Binary != nil {
+		return b.buildBinary(ctx, m.Binary, params, layerMediaType, creationTime, windows)
+	} else if m.Config != nil {
+		// The config is changed once the layers of the mutations are appended.
+		return nil, describeConfig(m.Config), nil
+	}
+
+	return nil, "", nil
+}
+
+// buildTemplate returns the layers of the file of the template and the description of what it adds,
+// the layers are annotated if the template references Secrets.
+func (b *imageBuilder) buildTemplate(ctx context.Context, file *v1alpha1.File, mode, chunkSize int64, layerMediaType types.MediaType, creationTime time.Time, windows bool) ([]mutate.Addendum, string, error) {
+	if file.Source != "" {
+		return nil, "", fmt.Errorf("file %s: source and template are exclusive", file.Destination)
+	}
+	if strings.HasSuffix(file.Destination, "/") {
+		return nil, "", fmt.Errorf("file %s: the destination of a template must be a file", file.Destination)
+	}
+	content, secret, err := b.renderTemplate(ctx, file.Template)
+	if err != nil {
+		return nil, "", fmt.Errorf("file %s: %w", file.Destination, err)
+	}
+
+	builder := NewFileLayerBuilder(b.client, b.cacheTmp, mode, creationTime, layerMediaType, chunkSize, windows)
+	addendums, err := builder.BuildFile(ctx, bytes.NewReader(content), file.Destination, int64(len(content)))
+	if err != nil {
+		return nil, "", fmt.Errorf("file layer builder: %w", err)
+	}
+	if !secret {
+		return addendums, fmt.Sprintf("add %s from a template", file.Destination), nil
+	}
+	for i := range addendums {
+		addendums[i].Annotations = map[string]string{v1alpha1.AnnotationSecret: "true"}
+	}
+	return addendums, fmt.Sprintf("add %s from a template with secrets", file.Destination), nil
+}
+
+// parseReference parses the reference and returns the remote options to pull it in the build of the context,
+// the registry is treated as insecure if it is listed in insecure registries or the insecure is set.
+func (b *imageBuilder) parseReference(ctx context.Context, s string, insecure bool) (name.Reference, []remote.Option, error) {
+	o := crane.GetOptions(crane.WithAuthFromKeychain(b.keychain))
+
+	ref, err := name.ParseReference(s, o.Name...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !b.isInsecure(ref.Context().Registry, insecure) {
+		return ref, append(o.Remote, b.remoteOptions(ctx, b.transport)...), nil
+	}
+
+	ref, err = name.ParseReference(s, append(o.Name, name.Insecure)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ref, append(o.Remote, b.remoteOptions(ctx, b.insecureTransport)...), nil
+}
+
+// remoteOptions returns the options of go-containerregistry to reach the upstreams with the transport,
+// tuned by the global options and the ones of the rule of the build of the context.
+func (b *imageBuilder) remoteOptions(ctx context.Context, rt http.RoundTripper) []remote.Option {
+	opts := []remote.Option{remote.WithTransport(rt)}
+	if b.retry {
+		opts = append(opts, remote.WithRetryStatusCodes())
+	}
+	return append(opts, remoteTuning(mergeRemote(b.remote, ruleRemoteFrom(ctx)))...)
+}
+
+// isInsecure reports whether the registry is insecure, either listed in insecure registries or the insecure is set.
+func (b *imageBuilder) isInsecure(registry name.Registry, insecure bool) bool {
+	if insecure {
+		return true
 	}
+	_, ok := b.insecureRegistries[registry.RegistryStr()]
+	return ok
+}
 
-	return layers, nil
+func parseChunkSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0, fmt.Errorf("parsing chunk size %q: %w", s, err)
+	}
+	return q.Value(), nil
 }
 
 func (b *imageBuilder) ManifestPath(image, tag string) string {
-	return path.Join(b.cacheManifests, image, tag, "manifest.json")
+	return cachePath(b.cacheManifests, image, tag, "manifest.json")
+}
+
+// AlternateManifestPath is the path of the docker manifest when the output media type is "both".
+func (b *imageBuilder) AlternateManifestPath(image, tag string) string {
+	return cachePath(b.cacheManifests, image, tag, "manifest.docker.json")
+}
+
+// UploadPath is the path of the upload session.
+func (b *imageBuilder) UploadPath(id string) string {
+	return cachePath(b.cacheTmpUploads, id)
+}
+
+// UploadedBlobPath is the path of the blob pushed by the upload API.
+func (b *imageBuilder) UploadedBlobPath(digest string) string {
+	return cachePath(b.cacheUploads, digest)
 }
 
 func (b *imageBuilder) BlobsPath(hex string) string {
-	switch len(hex) {
-	case 64:
-		return path.Join(b.cacheBlobs, "sha256:"+hex)
-	case 71:
-		return path.Join(b.cacheBlobs, hex)
+	switch {
+	case len(hex) == 64:
+		return cachePath(b.cacheBlobs, "sha256:"+hex)
+	case len(hex) == 71, digestRegexp.MatchString(hex):
+		return cachePath(b.cacheBlobs, hex)
 	}
-	return path.Join(b.cacheBlobs, "unknown:"+hex)
+	return cachePath(b.cacheBlobs, "unknown:"+hex)
 }
 
-func (b *imageBuilder) mutateManifest(img v1.Image, meta *pattern.Action, p *v1.Platform, mediaType types.MediaType) (v1.Image, error) {
-	mutates := meta.GetMutates(p)
-	if len(mutates) == 0 {
-		return img, nil
+func (b *imageBuilder) mutateManifest(ctx context.Context, img v1.Image, meta *pattern.Action, p *v1.Platform, mediaType types.MediaType) (v1.Image, error) {
+	creationTime, err := buildTime(meta.IsReproducible())
+	if err != nil {
+		return nil, err
 	}
 
-	addendums, err := b.buildAddendum(mediaType, mutates)
-	if err != nil {
-		return nil, fmt.Errorf("build addendum: %w", err)
+	p = imagePlatform(img, p)
+	if drop := meta.DropLayers(); len(drop) != 0 {
+		img, err = dropLayers(img, drop)
+		if err != nil {
+			return nil, fmt.Errorf("drop layers: %w", err)
+		}
 	}
 
-	if len(addendums) != 0 {
-		img, err = mutate.Append(img, addendums...)
+	mutates := meta.GetMutates(p)
+	if len(mutates) != 0 {
+		mutations, err := b.buildMutations(ctx, mediaType, img, mutates, meta.GetParams(p), creationTime, p != nil && p.OS == "windows")
 		if err != nil {
-			return nil, fmt.Errorf("mutate append: %w", err)
+			return nil, fmt.Errorf("build mutations: %w", err)
+		}
+
+		if recipients := meta.EncryptionRecipients(); len(recipients) != 0 {
+			mutations, err = encryptMutations(mutations, recipients, mediaType, meta.OutputMediaType())
+			if err != nil {
+				return nil, fmt.Errorf("encrypt mutations: %w", err)
+			}
+		}
+
+		sortMutations(mutations)
+
+		// Each mutation is followed by an empty layer history entry describing it.
+		for _, m := range mutations {
+			if len(m.addendums) != 0 {
+				img, err = mutate.Append(img, m.addendums...)
+				if err != nil {
+					return nil, fmt.Errorf("mutate append: %w", err)
+				}
+			}
+			if m.config != nil {
+				img, err = applyConfig(img, m.config)
+				if err != nil {
+					return nil, fmt.Errorf("apply config: %w", err)
+				}
+			}
+			if len(m.env) != 0 {
+				img, err = applyEnv(img, m.env)
+				if err != nil {
+					return nil, fmt.Errorf("apply env: %w", err)
+				}
+			}
+			img, err = appendHistory(img, m.history)
+			if err != nil {
+				return nil, fmt.Errorf("append history: %w", err)
+			}
 		}
 	}
 
+	if created, ok := meta.Created(creationTime); ok {
+		img, err = mutate.CreatedAt(img, v1.Time{Time: created})
+		if err != nil {
+			return nil, fmt.Errorf("mutate created at: %w", err)
+		}
+	}
 	return img, nil
 }
 
-func saveIndexManifest(index *v1.IndexManifest, cacheBlobs, cacheManifest, name, tag string) error {
-	manifestBlob, err := json.Marshal(index)
+// appendHistory appends the history entry to the config of the image.
+func appendHistory(img v1.Image, history v1.History) (v1.Image, error) {
+	configFile, err := img.ConfigFile()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	configFile = configFile.DeepCopy()
+	configFile.History = append(configFile.History, history)
+	return mutate.ConfigFile(img, configFile)
+}
 
-	err = atomic.WriteFile(path.Join(cacheBlobs, "sha256:"+atomic.SumSha256(manifestBlob)), manifestBlob, 0644)
-	if err != nil {
-		return fmt.Errorf("write manifest: %w", err)
+// imagePlatform returns the platform of the image, which is read from the config if it is not in the index.
+func imagePlatform(img v1.Image, p *v1.Platform) *v1.Platform {
+	if p != nil {
+		return p
 	}
-
-	err = atomic.WriteFile(path.Join(cacheManifest, name, tag, "manifest.json"), manifestBlob, 0644)
+	configFile, err := img.ConfigFile()
 	if err != nil {
-		return fmt.Errorf("write manifest: %w", err)
+		return nil
 	}
-	return err
+	return configFile.Platform()
 }
 
-func saveManifest(img v1.Image, cacheBlobs, cacheManifest, name, tag string) error {
-	layers, err := img.Layers()
+func saveIndexManifest(index *v1.IndexManifest, cacheBlobs string) ([]byte, error) {
+	manifestBlob, err := json.Marshal(index)
 	if err != nil {
-		return fmt.Errorf("getting layers: %w", err)
+		return nil, err
 	}
 
-	for _, layer := range layers {
-		err = saveLayer(layer, cacheBlobs)
-		if err != nil {
-			return fmt.Errorf("save layer: %w", err)
-		}
+	_, err = writeManifestBlob(cacheBlobs, manifestBlob)
+	if err != nil {
+		return nil, err
 	}
+	return manifestBlob, nil
+}
 
-	manifestBlob, err := img.RawManifest()
+// saveManifest writes the layers, the config and the manifest of the image to the blobs, except the upstream layers,
+// and records the media types of the layers and the config if cacheMediaTypes is not empty.
+// The layers are written as slowly as the faults inject, if any.
+func saveManifest(ctx context.Context, img v1.Image, cacheBlobs, cacheMediaTypes string, upstream map[v1.Hash]struct{}, faults *faultInjector) error {
+	manifest, err := img.Manifest()
 	if err != nil {
-		return fmt.Errorf("getting raw manifest: %w", err)
+		return fmt.Errorf("getting manifest: %w", err)
 	}
 
-	err = atomic.WriteFile(path.Join(cacheBlobs, "sha256:"+atomic.SumSha256(manifestBlob)), manifestBlob, 0644)
+	layers, err := img.Layers()
 	if err != nil {
-		return fmt.Errorf("write manifest: %w", err)
+		return fmt.Errorf("getting layers: %w", err)
 	}
 
-	if name != "" {
-		if tag == "" {
-			tag = "latest"
+	for i, layer := range layers {
+		// Foreign layers are pulled by the clients from their urls, keep only their descriptors.
+		mediaType, err := layer.MediaType()
+		if err == nil && !mediaType.IsDistributable() {
+			digest, _ := layer.Digest()
+			loggerFrom(ctx).Info("skip foreign layer", "digest", digest, "mediaType", mediaType)
+			continue
 		}
 
-		err = atomic.WriteFile(path.Join(cacheManifest, name, tag, "manifest.json"), manifestBlob, 0644)
+		digest, err := layer.Digest()
 		if err != nil {
-			return fmt.Errorf("write manifest: %w", err)
+			return fmt.Errorf("getting digest: %w", err)
+		}
+		if _, ok := upstream[digest]; !ok {
+			err = saveLayer(ctx, layer, cacheBlobs, faults)
+			if err != nil {
+				return fmt.Errorf("save layer: %w", err)
+			}
+		}
+
+		if i < len(manifest.Layers) {
+			err = saveMediaType(cacheMediaTypes, manifest.Layers[i].Digest, manifest.Layers[i].MediaType)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	// Write the config.
-	configName, err := img.ConfigName()
-	if err != nil {
-		return fmt.Errorf("getting config name: %w", err)
-	}
 	configBlob, err := img.RawConfigFile()
 	if err != nil {
 		return fmt.Errorf("getting raw config file: %w", err)
 	}
 
-	err = atomic.WriteFile(path.Join(cacheBlobs, configName.String()), configBlob, 0644)
+	err = atomic.WriteFile(path.Join(cacheBlobs, manifest.Config.Digest.String()), configBlob, 0644)
 	if err != nil {
 		return fmt.Errorf("write config: %w", err)
 	}
 
+	err = saveMediaType(cacheMediaTypes, manifest.Config.Digest, manifest.Config.MediaType)
+	if err != nil {
+		return err
+	}
+
+	manifestBlob, err := img.RawManifest()
+	if err != nil {
+		return fmt.Errorf("getting raw manifest: %w", err)
+	}
+
+	_, err = writeManifestBlob(cacheBlobs, manifestBlob)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func saveLayer(layer v1.Layer, cacheBlobs string) (retErr error) {
+// saveMediaType records the media type of the blob, so that it is served with it.
+func saveMediaType(cacheMediaTypes string, digest v1.Hash, mediaType types.MediaType) error {
+	if cacheMediaTypes == "" || mediaType == "" {
+		return nil
+	}
+	p := path.Join(cacheMediaTypes, digest.String())
+	old, err := os.ReadFile(p)
+	if err == nil && string(old) == string(mediaType) {
+		return nil
+	}
+	err = atomic.WriteFile(p, []byte(mediaType), 0644)
+	if err != nil {
+		return fmt.Errorf("write media type: %w", err)
+	}
+	return nil
+}
+
+// BlobMediaType returns the media type recorded for the blob, or application/octet-stream.
+func (b *imageBuilder) BlobMediaType(digest string) string {
+	mediaType, err := os.ReadFile(cachePath(b.cacheMediaTypes, digest))
+	if err != nil || len(mediaType) == 0 {
+		return "application/octet-stream"
+	}
+	return string(mediaType)
+}
+
+func saveLayer(ctx context.Context, layer v1.Layer, cacheBlobs string, faults *faultInjector) (retErr error) {
 	r, err := layer.Compressed()
 	if err != nil {
 		return fmt.Errorf("getting compressed: %w", err)
 	}
+	r = faults.diskReader(ctx, r)
 	defer func() {
 		err := r.Close()
 		if err != nil {
@@ -386,7 +920,7 @@ func saveLayer(layer v1.Layer, cacheBlobs string) (retErr error) {
 	cachePath := path.Join(cacheBlobs, digest.String())
 	_, err = os.Stat(cachePath)
 	if err == nil {
-		slog.Info("skip layer", "path", cachePath, "size", size)
+		loggerFrom(ctx).Info("skip layer", "path", cachePath, "size", size)
 		return nil
 	}
 
@@ -396,7 +930,7 @@ func saveLayer(layer v1.Layer, cacheBlobs string) (retErr error) {
 		return fmt.Errorf("open file with writer: %w", err)
 	}
 
-	n, err := io.Copy(wc, io.TeeReader(r, sum))
+	n, err := io.Copy(wc, io.TeeReader(trackProgress(ctx, digest.String(), size, r), sum))
 	if err != nil {
 		_ = wc.Abort()
 		return fmt.Errorf("copy: %w", err)
@@ -419,7 +953,7 @@ func saveLayer(layer v1.Layer, cacheBlobs string) (retErr error) {
 		return fmt.Errorf("close: %w", err)
 	}
 
-	slog.Info("save layer", "path", cachePath, "size", size)
+	loggerFrom(ctx).Info("save layer", "path", cachePath, "size", size)
 
 	return nil
 }
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// describeConfig returns the description of the changes of the config, like the instructions of a Dockerfile.
+func describeConfig(c *v1alpha1.Config) string {
+	var instructions []string
+	if hc := c.Healthcheck; hc != nil {
+		instructions = append(instructions, "HEALTHCHECK "+strings.Join(hc.Test, " "))
+	}
+	if c.StopSignal != "" {
+		instructions = append(instructions, "STOPSIGNAL "+c.StopSignal)
+	}
+	if len(c.ExposedPorts) != 0 {
+		instructions = append(instructions, "EXPOSE "+strings.Join(c.ExposedPorts, " "))
+	}
+	if len(c.Volumes) != 0 {
+		instructions = append(instructions, "VOLUME "+strings.Join(c.Volumes, " "))
+	}
+	return "config " + strings.Join(instructions, ", ")
+}
+
+// applyConfig changes the config of the image, the ports and the volumes are added to the ones of the image.
+func applyConfig(img v1.Image, c *v1alpha1.Config) (v1.Image, error) {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	configFile = configFile.DeepCopy()
+	config := &configFile.Config
+
+	if hc := c.Healthcheck; hc != nil {
+		health := &v1.HealthConfig{
+			Test:    hc.Test,
+			Retries: hc.Retries,
+		}
+		for _, d := range []struct {
+			value string
+			to    *time.Duration
+		}{
+			{hc.Interval, &health.Interval},
+			{hc.Timeout, &health.Timeout},
+			{hc.StartPeriod, &health.StartPeriod},
+		} {
+			if d.value == "" {
+				continue
+			}
+			*d.to, err = time.ParseDuration(d.value)
+			if err != nil {
+				return nil, fmt.Errorf("healthcheck: %w", err)
+			}
+		}
+		config.Healthcheck = health
+	}
+	if c.StopSignal != "" {
+		config.StopSignal = c.StopSignal
+	}
+	for _, port := range c.ExposedPorts {
+		number, protocol, err := pattern.ParsePort(port)
+		if err != nil {
+			return nil, err
+		}
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = map[string]struct{}{}
+		}
+		config.ExposedPorts[strconv.Itoa(number)+"/"+protocol] = struct{}{}
+	}
+	for _, volume := range c.Volumes {
+		if config.Volumes == nil {
+			config.Volumes = map[string]struct{}{}
+		}
+		config.Volumes[volume] = struct{}{}
+	}
+	return mutate.ConfigFile(img, configFile)
+}
+
+// applyEnv sets the environment variables of the image, the ones of the image with the same names are replaced.
+func applyEnv(img v1.Image, env []string) (v1.Image, error) {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	configFile = configFile.DeepCopy()
+	config := &configFile.Config
+	for _, e := range env {
+		name, _, _ := strings.Cut(e, "=")
+		config.Env = slices.DeleteFunc(config.Env, func(old string) bool {
+			return strings.HasPrefix(old, name+"=")
+		})
+		config.Env = append(config.Env, e)
+	}
+	return mutate.ConfigFile(img, configFile)
+}
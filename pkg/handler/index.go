@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/atomic"
+	"github.com/wzshiming/jitdi/pkg/metadata"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// indexTag records the manifests of the tag and the blobs they reference in the metadata index,
+// with the layers of the mutations of the build for the next build to reuse.
+func (b *imageBuilder) indexTag(image, tag string, rule *pattern.Rule, mutations []metadata.Mutation) error {
+	record, err := b.tagRecord(image, tag)
+	if err != nil {
+		return err
+	}
+	maxRevisions := b.tagHistory
+	if rule != nil {
+		record.Rule = rule.Name()
+		record.RuleHash = rule.Hash()
+		if _, _, n := rule.Retention(); n >= 0 {
+			maxRevisions = n
+		}
+	}
+	record.Mutations = mutations
+	previous, ok, err := b.index.Get(image, tag)
+	if err != nil {
+		return err
+	}
+	if ok {
+		record.AccessTime = previous.AccessTime
+		record.History = pushRevision(previous, record.Digest, maxRevisions)
+		record.Canary = b.canary.canaryOf(previous, record.Digest, time.Now())
+	}
+	return b.index.Put(record)
+}
+
+// pushRevision returns the history of the tag built again with the digest, with the previous build first
+// unless it is of the same digest, and without the builds of the digest, at most max builds long.
+func pushRevision(previous metadata.Tag, digest string, max int) []metadata.Revision {
+	revisions := previous.History
+	if previous.Digest != digest {
+		revisions = append([]metadata.Revision{previous.Revision()}, revisions...)
+	}
+	history := make([]metadata.Revision, 0, min(len(revisions), max))
+	for _, revision := range revisions {
+		if len(history) >= max {
+			break
+		}
+		if revision.Digest != digest {
+			history = append(history, revision)
+		}
+	}
+	if len(history) == 0 {
+		return nil
+	}
+	return history
+}
+
+// tagRecord reads the metadata of the tag from its manifests.
+func (b *imageBuilder) tagRecord(image, tag string) (metadata.Tag, error) {
+	manifestPath := b.ManifestPath(image, tag)
+	stat, err := os.Stat(manifestPath)
+	if err != nil {
+		return metadata.Tag{}, err
+	}
+	manifest, err := b.readManifest(manifestPath)
+	if err != nil {
+		return metadata.Tag{}, err
+	}
+
+	marked := map[string]struct{}{
+		manifest.digest: {},
+	}
+	err = b.mark(manifest.content, marked)
+	if err != nil {
+		return metadata.Tag{}, err
+	}
+	b.markManifestDigest(manifest.content, marked)
+	var alternateDigest string
+	if alternate, err := os.ReadFile(b.AlternateManifestPath(image, tag)); err == nil {
+		alternateDigest = "sha256:" + atomic.SumSha256(alternate)
+		marked[alternateDigest] = struct{}{}
+		b.markManifestDigest(alternate, marked)
+		err = b.mark(alternate, marked)
+		if err != nil {
+			return metadata.Tag{}, err
+		}
+	}
+
+	blobs := make([]string, 0, len(marked))
+	for digest := range marked {
+		blobs = append(blobs, digest)
+	}
+	sort.Strings(blobs)
+	return metadata.Tag{
+		Image:     image,
+		Tag:       tag,
+		Digest:    manifest.digest,
+		MediaType: manifest.mediaType,
+		Blobs:     blobs,
+		BuildTime: stat.ModTime(),
+
+		AlternateDigest: alternateDigest,
+	}, nil
+}
+
+// markManifestDigest marks the copy of the manifest addressed by its sha512 digest, if the rule of the tag writes one.
+func (b *imageBuilder) markManifestDigest(raw []byte, marked map[string]struct{}) {
+	if digest := manifestDigest("sha512", raw); fileExists(b.BlobsPath(digest)) {
+		marked[digest] = struct{}{}
+	}
+}
+
+// indexUnindexed records the tags in the cache that are missing from the metadata index,
+// such as the ones built before the index was introduced.
+func (b *imageBuilder) indexUnindexed() error {
+	return filepath.WalkDir(b.cacheManifests, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != "manifest.json" {
+			return nil
+		}
+		rel, err := filepath.Rel(b.cacheManifests, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		image, tag := path.Dir(rel), path.Base(rel)
+		_, ok, err := b.index.Get(image, tag)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		return b.indexTag(image, tag, nil, nil)
+	})
+}
+
+// blobTag returns the tag of the metadata index whose current build references the blob.
+func (b *imageBuilder) blobTag(digest string) (metadata.Tag, bool, error) {
+	tags, err := b.index.List()
+	if err != nil {
+		return metadata.Tag{}, false, err
+	}
+	for _, tag := range tags {
+		for _, blob := range tag.Blobs {
+			if blob == digest {
+				return tag, true, nil
+			}
+		}
+	}
+	return metadata.Tag{}, false, nil
+}
+
+// blobTags returns the records of the tags whose builds reference the blob, the current ones, the previous ones
+// and the stable builds of their canaries.
+func (b *imageBuilder) blobTags(digest string) ([]metadata.Tag, error) {
+	tags, err := b.index.List()
+	if err != nil {
+		return nil, err
+	}
+	var found []metadata.Tag
+	for _, tag := range tags {
+		revisions := tag.History
+		if tag.Canary != nil {
+			revisions = append(revisions[:len(revisions):len(revisions)], tag.Canary.Stable)
+		}
+		if slices.Contains(tag.Blobs, digest) || slices.ContainsFunc(revisions, func(revision metadata.Revision) bool {
+			return slices.Contains(revision.Blobs, digest)
+		}) {
+			found = append(found, tag)
+		}
+	}
+	return found, nil
+}
+
+// markIndexed marks the blobs referenced by the tags of the metadata index, and by their previous builds and the stable builds of their canaries.
+func (b *imageBuilder) markIndexed(marked map[string]struct{}) error {
+	err := b.indexUnindexed()
+	if err != nil {
+		return fmt.Errorf("index tags: %w", err)
+	}
+	tags, err := b.index.List()
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		for _, blob := range tag.Blobs {
+			if digestRegexp.MatchString(blob) {
+				marked[blob] = struct{}{}
+			}
+		}
+		revisions := tag.History
+		if tag.Canary != nil {
+			revisions = append(revisions[:len(revisions):len(revisions)], tag.Canary.Stable)
+		}
+		for _, revision := range revisions {
+			for _, blob := range revision.Blobs {
+				if digestRegexp.MatchString(blob) {
+					marked[blob] = struct{}{}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// inlineData embeds the config and the layers of the OCI manifests that are not larger than the threshold
+// into the data field of their descriptors, so that clients can skip fetching them.
+func (b *imageBuilder) inlineData(raw []byte) ([]byte, error) {
+	if b.inlineDataThreshold <= 0 {
+		return raw, nil
+	}
+	return b.rewriteManifest(raw, func(manifest *v1.Manifest) (bool, error) {
+		if manifest.MediaType != types.OCIManifestSchema1 {
+			return false, nil
+		}
+
+		descs := []*v1.Descriptor{&manifest.Config}
+		for i := range manifest.Layers {
+			descs = append(descs, &manifest.Layers[i])
+		}
+
+		changed := false
+		for _, desc := range descs {
+			if desc.Data != nil || desc.Size > b.inlineDataThreshold || !desc.MediaType.IsDistributable() {
+				continue
+			}
+			data, err := os.ReadFile(b.BlobsPath(desc.Digest.String()))
+			if err != nil {
+				if os.IsNotExist(err) && b.isUpstream(desc.Digest.String()) {
+					continue
+				}
+				return false, fmt.Errorf("read blob %s: %w", desc.Digest, err)
+			}
+			if int64(len(data)) != desc.Size {
+				return false, fmt.Errorf("blob %s has size %d, but the descriptor has %d", desc.Digest, len(data), desc.Size)
+			}
+			desc.Data = data
+			changed = true
+		}
+		return changed, nil
+	}, nil)
+}
@@ -14,11 +14,15 @@ import (
 )
 
 type fscache struct {
-	path string
+	logger *slog.Logger
+	path   string
 }
 
-func newFilesystemCache(path string) cache.Cache {
-	return &fscache{path}
+func newFilesystemCache(logger *slog.Logger, path string) cache.Cache {
+	return &fscache{
+		logger: logger,
+		path:   path,
+	}
 }
 
 func (fs *fscache) Put(l v1.Layer) (v1.Layer, error) {
@@ -28,11 +32,11 @@ func (fs *fscache) Put(l v1.Layer) (v1.Layer, error) {
 func (fs *fscache) Get(h v1.Hash) (v1.Layer, error) {
 	l, err := tarball.LayerFromFile(cachepath(fs.path, h))
 	if os.IsNotExist(err) || errors.Is(err, io.ErrUnexpectedEOF) {
-		slog.Info("cache miss", "path", path.Join(fs.path, h.String()))
+		fs.logger.Info("cache miss", "path", path.Join(fs.path, h.String()))
 		return nil, cache.ErrNotFound
 	}
 
-	slog.Info("cache hit", "path", path.Join(fs.path, h.String()))
+	fs.logger.Info("cache hit", "path", path.Join(fs.path, h.String()))
 	return l, err
 }
 
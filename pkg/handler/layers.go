@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// droppedLayers reports which layers of the manifest are dropped by their indexes from 0 at the bottom or by their digests,
+// and fails if the manifest has no such layer.
+func droppedLayers(manifest *v1.Manifest, drop []string) ([]bool, error) {
+	dropped := make([]bool, len(manifest.Layers))
+	for _, d := range drop {
+		if i, err := strconv.Atoi(d); err == nil {
+			if i < 0 || i >= len(manifest.Layers) {
+				return nil, fmt.Errorf("the base image has %d layers, no layer %d", len(manifest.Layers), i)
+			}
+			dropped[i] = true
+			continue
+		}
+		var found bool
+		for i, layer := range manifest.Layers {
+			if layer.Digest.String() == d {
+				dropped[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("the base image has no layer %s", d)
+		}
+	}
+	return dropped, nil
+}
+
+// dropLayers returns the image without the layers dropped, the history entries of the layers are dropped with them
+// unless the history does not match the layers, e.g. in the images built without history.
+func dropLayers(img v1.Image, drop []string) (v1.Image, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	dropped, err := droppedLayers(manifest, drop)
+	if err != nil {
+		return nil, err
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	history := configFile.History
+	var nonEmpty int
+	for _, h := range history {
+		if !h.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty == len(layers) {
+		history = nil
+		var i int
+		for _, h := range configFile.History {
+			if !h.EmptyLayer {
+				i++
+				if dropped[i-1] {
+					continue
+				}
+			}
+			history = append(history, h)
+		}
+	}
+
+	// The image is assembled again on the config of the base image, the layers keep their descriptors.
+	configFile = configFile.DeepCopy()
+	configFile.RootFS.DiffIDs = nil
+	configFile.History = nil
+	out, err := mutate.ConfigFile(empty.Image, configFile)
+	if err != nil {
+		return nil, err
+	}
+	out = mutate.MediaType(out, manifest.MediaType)
+	out = mutate.ConfigMediaType(out, manifest.Config.MediaType)
+	if len(manifest.Annotations) != 0 {
+		out = mutate.Annotations(out, manifest.Annotations).(v1.Image)
+	}
+	var adds []mutate.Addendum
+	for i, layer := range layers {
+		if dropped[i] {
+			continue
+		}
+		adds = append(adds, mutate.Addendum{
+			Layer:       layer,
+			Annotations: manifest.Layers[i].Annotations,
+			URLs:        manifest.Layers[i].URLs,
+			MediaType:   manifest.Layers[i].MediaType,
+		})
+	}
+	out, err = mutate.Append(out, adds...)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, err = out.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	configFile = configFile.DeepCopy()
+	configFile.History = history
+	return mutate.ConfigFile(out, configFile)
+}
+
+// sortMutations sorts the mutations by the layer orders of their mutates, the ties keep their order.
+func sortMutations(mutations []mutation) {
+	slices.SortStableFunc(mutations, func(a, b mutation) int {
+		return cmp.Compare(a.order, b.order)
+	})
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// maxZoneinfoSize is the size of a zoneinfo file read at most.
+const maxZoneinfoSize = 1 << 20
+
+// zoneinfoDirs are the directories of the zoneinfo files of the host of jitdi, the ones that the time package reads.
+var zoneinfoDirs = []string{"/usr/share/zoneinfo", "/usr/share/lib/zoneinfo", "/usr/lib/locale/TZ", "/etc/zoneinfo"}
+
+// buildLocale returns the layer of /etc/localtime, /etc/timezone, /etc/locale.conf and /etc/default/locale, and the description of what it adds.
+// /etc/localtime links to the zoneinfo file of the base image, the base images without it, e.g. the distroless ones,
+// get the file of the host of jitdi so that the TZ environment variable also resolves.
+func (b *imageBuilder) buildLocale(ctx context.Context, l *v1alpha1.Locale, base v1.Image, layerMediaType types.MediaType, creationTime time.Time, windows bool) ([]mutate.Addendum, string, error) {
+	if windows {
+		return nil, "", fmt.Errorf("locale: the locale is not set in the windows images")
+	}
+	if l.Timezone != "" && !pattern.TimezoneRegexp.MatchString(l.Timezone) {
+		return nil, "", fmt.Errorf("locale: invalid timezone %q", l.Timezone)
+	}
+	if l.Lang != "" && !pattern.LangRegexp.MatchString(l.Lang) {
+		return nil, "", fmt.Errorf("locale: invalid lang %q", l.Lang)
+	}
+
+	zonePath := path.Join("/usr/share/zoneinfo", l.Timezone)
+	var zoneinfo []byte
+	if l.Timezone != "" {
+		found, err := hasZoneinfo(base, zonePath)
+		if err != nil {
+			return nil, "", fmt.Errorf("locale %s: %w", l.Timezone, err)
+		}
+		if !found {
+			zoneinfo, err = readHostZoneinfo(l.Timezone)
+			if err != nil {
+				return nil, "", fmt.Errorf("locale %s: %w", l.Timezone, err)
+			}
+		}
+	}
+
+	var files []*baseFile
+	if zoneinfo != nil {
+		files = append(files, &baseFile{name: zonePath, content: zoneinfo})
+	}
+	if l.Timezone != "" {
+		files = append(files, &baseFile{name: "/etc/timezone", content: []byte(l.Timezone + "\n")})
+	}
+	if l.Lang != "" {
+		// /etc/locale.conf is read by systemd and the RHEL and Arch layouts, /etc/default/locale by the Debian layout.
+		conf := []byte("LANG=" + l.Lang + "\n")
+		files = append(files,
+			&baseFile{name: "/etc/locale.conf", content: conf},
+			&baseFile{name: "/etc/default/locale", content: conf},
+		)
+	}
+
+	builder := NewFileLayerBuilder(b.client, b.cacheTmp, 0644, creationTime, layerMediaType, 0, windows)
+	addendums, err := builder.build(ctx, func(tw *tarWriter) error {
+		for _, f := range files {
+			err := tarBaseFile(tw, f.name, &tar.Header{Mode: 0644}, f.content, creationTime)
+			if err != nil {
+				return err
+			}
+		}
+		if l.Timezone == "" {
+			return nil
+		}
+		err := sandboxFrom(ctx).addFile("/etc/localtime", 0)
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:     "/etc/localtime",
+			Linkname: zonePath,
+			Typeflag: tar.TypeSymlink,
+			Mode:     0777,
+			ModTime:  creationTime,
+		})
+		if err != nil {
+			return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", "/etc/localtime", err)
+		}
+		tw.entries++
+		return nil
+	}, v1.History{
+		Created:   v1.Time{Time: creationTime},
+		Author:    "jitdi",
+		CreatedBy: "SET LOCALE " + strings.Join(localeEnv(l), " "),
+		Comment:   "Set the timezone and the locale",
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("file layer builder: %w", err)
+	}
+	return addendums, "locale " + strings.Join(localeEnv(l), " "), nil
+}
+
+// localeEnv returns the TZ and LANG environment variables of the locale.
+func localeEnv(l *v1alpha1.Locale) []string {
+	if l == nil {
+		return nil
+	}
+	var env []string
+	if l.Timezone != "" {
+		env = append(env, "TZ="+l.Timezone)
+	}
+	if l.Lang != "" {
+		env = append(env, "LANG="+l.Lang)
+	}
+	return env
+}
+
+// hasZoneinfo reports whether the base image has the zoneinfo file, the links are taken as found.
+func hasZoneinfo(base v1.Image, p string) (bool, error) {
+	if base == nil {
+		return false, nil
+	}
+	_, err := readBaseFile(base, p, false, func(header *tar.Header, r io.Reader) error {
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errBaseFileNotFound) {
+			return false, nil
+		}
+		if errors.Is(err, errBaseFileLink) {
+			return true, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// readHostZoneinfo reads the zoneinfo file of the timezone from the host of jitdi.
+func readHostZoneinfo(timezone string) ([]byte, error) {
+	for _, dir := range zoneinfoDirs {
+		f, err := os.Open(path.Join(dir, timezone))
+		if err != nil {
+			continue
+		}
+		raw, err := io.ReadAll(io.LimitReader(f, maxZoneinfoSize+1))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) > maxZoneinfoSize {
+			return nil, fmt.Errorf("the zoneinfo file is larger than %d bytes", maxZoneinfoSize)
+		}
+		_, err = time.LoadLocationFromTZData(timezone, raw)
+		if err != nil {
+			return nil, fmt.Errorf("zoneinfo of %s: %w", dir, err)
+		}
+		return raw, nil
+	}
+	return nil, fmt.Errorf("neither the base image nor the host of jitdi has the zoneinfo of the timezone")
+}
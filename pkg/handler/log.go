@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+type loggerKey struct{}
+
+// withLogger returns a copy of the ctx carrying the logger.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger carried by the ctx, or the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// requestIDHeader is the header that the request ID is accepted from and returned in.
+const requestIDHeader = "X-Request-Id"
+
+var requestIDRegexp = regexp.MustCompile(`^[0-9A-Za-z._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// withRequestID returns the request with the ID of the client, or a new one if it has none,
+// and the logger of its ctx logging the ID. The ID is also returned in the response.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDRegexp.MatchString(id) {
+		id = newBuildID()
+	}
+	w.Header().Set(requestIDHeader, id)
+
+	ctx := r.Context()
+	ctx = withLogger(ctx, loggerFrom(ctx).With("request", id))
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return r.WithContext(ctx)
+}
+
+// requestIDFrom returns the request ID carried by the ctx.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
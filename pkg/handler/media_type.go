@@ -0,0 +1,328 @@
+package handler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/wzshiming/jitdi/pkg/atomic"
+)
+
+// The output media types of the built manifests.
+const (
+	outputMediaTypeOCI    = "oci"
+	outputMediaTypeDocker = "docker"
+	outputMediaTypeBoth   = "both"
+)
+
+var ociToDocker = map[types.MediaType]types.MediaType{
+	types.OCIImageIndex:        types.DockerManifestList,
+	types.OCIManifestSchema1:   types.DockerManifestSchema2,
+	types.OCIConfigJSON:        types.DockerConfigJSON,
+	types.OCILayer:             types.DockerLayer,
+	types.OCIUncompressedLayer: types.DockerUncompressedLayer,
+	types.OCIRestrictedLayer:   types.DockerForeignLayer,
+}
+
+var dockerToOCI = func() map[types.MediaType]types.MediaType {
+	m := make(map[types.MediaType]types.MediaType, len(ociToDocker))
+	for k, v := range ociToDocker {
+		m[v] = k
+	}
+	return m
+}()
+
+// convertMediaType returns the media type in the format, the media types that are not part of either format are kept.
+func convertMediaType(mediaType types.MediaType, format string) (types.MediaType, error) {
+	table := dockerToOCI
+	if format == outputMediaTypeDocker {
+		table = ociToDocker
+	}
+	if mt, ok := table[mediaType]; ok {
+		return mt, nil
+	}
+	if format == outputMediaTypeDocker && strings.HasPrefix(string(mediaType), "application/vnd.oci.image.") {
+		return "", fmt.Errorf("media type %q can not be converted to docker", mediaType)
+	}
+	return mediaType, nil
+}
+
+// convertManifest converts the manifest or the index to the format,
+// the manifests referenced by an index are converted and written to the blobs as well.
+// The raw manifest is returned as is if nothing needs to be converted.
+func (b *imageBuilder) convertManifest(raw []byte, format string) ([]byte, error) {
+	convert := func(changed *bool, mt *types.MediaType) error {
+		n, err := convertMediaType(*mt, format)
+		if err != nil {
+			return err
+		}
+		if n != *mt {
+			*mt = n
+			*changed = true
+		}
+		return nil
+	}
+
+	return b.rewriteManifest(raw, func(manifest *v1.Manifest) (bool, error) {
+		changed := false
+		err := convert(&changed, &manifest.MediaType)
+		if err != nil {
+			return false, err
+		}
+		err = convert(&changed, &manifest.Config.MediaType)
+		if err != nil {
+			return false, err
+		}
+		for i := range manifest.Layers {
+			err = convert(&changed, &manifest.Layers[i].MediaType)
+			if err != nil {
+				return false, err
+			}
+		}
+		if format == outputMediaTypeDocker {
+			// Docker manifests have no data field.
+			changed = dropData(&manifest.Config) || changed
+			for i := range manifest.Layers {
+				changed = dropData(&manifest.Layers[i]) || changed
+			}
+		}
+		return changed, nil
+	}, func(index *v1.IndexManifest) (bool, error) {
+		changed := false
+		err := convert(&changed, &index.MediaType)
+		if err != nil {
+			return false, err
+		}
+		for i := range index.Manifests {
+			err = convert(&changed, &index.Manifests[i].MediaType)
+			if err != nil {
+				return false, err
+			}
+		}
+		return changed, nil
+	})
+}
+
+func dropData(desc *v1.Descriptor) bool {
+	if desc.Data == nil {
+		return false
+	}
+	desc.Data = nil
+	return true
+}
+
+// rewriteManifest rewrites the image manifest, or the image manifests referenced by the index and then the index,
+// the rewritten manifests referenced by an index are written to the blobs and their descriptors are updated.
+// The raw manifest is returned as is if nothing is changed.
+func (b *imageBuilder) rewriteManifest(raw []byte, rewriteImage func(*v1.Manifest) (bool, error), rewriteIndex func(*v1.IndexManifest) (bool, error)) ([]byte, error) {
+	mediaType := struct {
+		MediaType types.MediaType `json:"mediaType,omitempty"`
+	}{}
+	err := json.Unmarshal(raw, &mediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	var out any
+	changed := false
+	switch {
+	default:
+		return nil, fmt.Errorf("unknown media type %q", mediaType.MediaType)
+	case mediaType.MediaType.IsIndex():
+		var index v1.IndexManifest
+		err = json.Unmarshal(raw, &index)
+		if err != nil {
+			return nil, err
+		}
+		for i, desc := range index.Manifests {
+			if !desc.MediaType.IsImage() {
+				continue
+			}
+			child, err := os.ReadFile(b.BlobsPath(desc.Digest.String()))
+			if err != nil {
+				return nil, fmt.Errorf("read manifest %q: %w", desc.Digest, err)
+			}
+			rewritten, err := b.rewriteManifest(child, rewriteImage, rewriteIndex)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite manifest %q: %w", desc.Digest, err)
+			}
+			hash, err := writeManifestBlob(b.cacheBlobs, rewritten)
+			if err != nil {
+				return nil, err
+			}
+			if hash != desc.Digest {
+				index.Manifests[i].Digest = hash
+				index.Manifests[i].Size = int64(len(rewritten))
+				changed = true
+			}
+		}
+		if rewriteIndex != nil {
+			c, err := rewriteIndex(&index)
+			if err != nil {
+				return nil, err
+			}
+			changed = changed || c
+		}
+		out = &index
+	case mediaType.MediaType.IsImage():
+		var manifest v1.Manifest
+		err = json.Unmarshal(raw, &manifest)
+		if err != nil {
+			return nil, err
+		}
+		if rewriteImage != nil {
+			changed, err = rewriteImage(&manifest)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out = &manifest
+	}
+
+	if !changed {
+		return raw, nil
+	}
+	return json.Marshal(out)
+}
+
+// saveTag writes the manifest of the tag in the output media type,
+// with "both" the docker one is written to the alternate manifest path.
+// With the sha512 digest algorithm the manifests are also written to the blobs addressed by their sha512 digest.
+func (b *imageBuilder) saveTag(raw []byte, format, digestAlgorithm, name, tag string) error {
+	manifestPath := b.ManifestPath(name, tag)
+	alternatePath := b.AlternateManifestPath(name, tag)
+
+	var primary, alternate []byte
+	var err error
+	switch format {
+	default:
+		return fmt.Errorf("unknown output media type %q", format)
+	case "":
+		primary = raw
+	case outputMediaTypeOCI, outputMediaTypeDocker:
+		primary, err = b.convertManifest(raw, format)
+		if err != nil {
+			return fmt.Errorf("convert manifest to %s: %w", format, err)
+		}
+	case outputMediaTypeBoth:
+		primary, err = b.convertManifest(raw, outputMediaTypeOCI)
+		if err != nil {
+			return fmt.Errorf("convert manifest to %s: %w", outputMediaTypeOCI, err)
+		}
+		alternate, err = b.convertManifest(raw, outputMediaTypeDocker)
+		if err != nil {
+			return fmt.Errorf("convert manifest to %s: %w", outputMediaTypeDocker, err)
+		}
+	}
+
+	primary, err = b.inlineData(primary)
+	if err != nil {
+		return fmt.Errorf("inline data: %w", err)
+	}
+	_, err = writeManifestBlob(b.cacheBlobs, primary)
+	if err != nil {
+		return err
+	}
+	err = b.writeManifestDigest(primary, digestAlgorithm)
+	if err != nil {
+		return err
+	}
+	if alternate != nil {
+		_, err = writeManifestBlob(b.cacheBlobs, alternate)
+		if err != nil {
+			return err
+		}
+		err = b.writeManifestDigest(alternate, digestAlgorithm)
+		if err != nil {
+			return err
+		}
+		err = atomic.WriteFile(alternatePath, alternate, 0644)
+		if err != nil {
+			return fmt.Errorf("write manifest: %w", err)
+		}
+	} else {
+		err = os.Remove(alternatePath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove manifest: %w", err)
+		}
+	}
+
+	err = atomic.WriteFile(manifestPath, primary, 0644)
+	if err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	b.memory.remove(manifestPath, alternatePath)
+	return nil
+}
+
+// manifestDigest returns the digest of the manifest with the algorithm, sha256 or sha512.
+func manifestDigest(algorithm string, raw []byte) string {
+	hash := digestHasher(algorithm + ":")
+	hash.Write(raw)
+	return algorithm + ":" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// writeManifestDigest writes the manifest to the blob of its digest of the algorithm, if it is not sha256 whose blob is always written.
+func (b *imageBuilder) writeManifestDigest(raw []byte, algorithm string) error {
+	if algorithm == "" || algorithm == "sha256" {
+		return nil
+	}
+	blobPath := b.BlobsPath(manifestDigest(algorithm, raw))
+	if fileExists(blobPath) {
+		return nil
+	}
+	err := atomic.WriteFile(blobPath, raw, 0644)
+	if err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return nil
+}
+
+func writeManifestBlob(cacheBlobs string, manifestBlob []byte) (v1.Hash, error) {
+	hash := v1.Hash{
+		Algorithm: "sha256",
+		Hex:       atomic.SumSha256(manifestBlob),
+	}
+	err := atomic.WriteFile(path.Join(cacheBlobs, hash.String()), manifestBlob, 0644)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("write manifest: %w", err)
+	}
+	return hash, nil
+}
+
+// acceptsMediaType reports whether the media type is acceptable by the Accept headers,
+// everything is acceptable if there are no Accept headers.
+func acceptsMediaType(accept []string, mediaType types.MediaType) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	for _, header := range accept {
+		for _, v := range strings.Split(header, ",") {
+			v, _, _ = strings.Cut(v, ";")
+			v = strings.TrimSpace(v)
+			if v == "*/*" || v == string(mediaType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onlyAcceptsSchema1 reports whether the client is a legacy one which can only handle Docker schema1 manifests.
+func onlyAcceptsSchema1(accept []string) bool {
+	if len(accept) == 0 {
+		return false
+	}
+	for _, mt := range []types.MediaType{types.DockerManifestSchema2, types.DockerManifestList, types.OCIManifestSchema1, types.OCIImageIndex} {
+		if acceptsMediaType(accept, mt) {
+			return false
+		}
+	}
+	return acceptsMediaType(accept, types.DockerManifestSchema1) || acceptsMediaType(accept, types.DockerManifestSchema1Signed)
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"container/list"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/atomic"
+)
+
+// memoryCacheEntry is the content of a file kept in memory.
+type memoryCacheEntry struct {
+	key       string
+	content   []byte
+	mediaType string
+	digest    string
+	modTime   time.Time
+}
+
+// memoryCache is a size bounded LRU of the manifests and the small blobs fronting the filesystem,
+// a nil memoryCache caches nothing.
+type memoryCache struct {
+	mut     sync.Mutex
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	lru     *list.List
+}
+
+func newMemoryCache(maxSize int64) *memoryCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &memoryCache{
+		maxSize: maxSize,
+		items:   map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// maxEntrySize is the size up to which the files are cached, so that a few large ones do not evict all the others.
+func (c *memoryCache) maxEntrySize() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.maxSize / 16
+}
+
+func (c *memoryCache) get(key string) (*memoryCacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*memoryCacheEntry), true
+}
+
+func (c *memoryCache) add(entry *memoryCacheEntry) {
+	size := int64(len(entry.content))
+	if c == nil || size > c.maxEntrySize() {
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if elem, ok := c.items[entry.key]; ok {
+		c.removeElement(elem)
+	}
+	c.items[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// remove invalidates the files.
+func (c *memoryCache) remove(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, key := range keys {
+		if elem, ok := c.items[key]; ok {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// removePrefix invalidates the files under the directory.
+func (c *memoryCache) removePrefix(dir string) {
+	if c == nil {
+		return
+	}
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for key, elem := range c.items {
+		if strings.HasPrefix(key, dir) {
+			c.removeElement(elem)
+		}
+	}
+}
+
+func (c *memoryCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*memoryCacheEntry)
+	delete(c.items, entry.key)
+	c.size -= int64(len(entry.content))
+}
+
+// readManifest reads the manifest with its media type and digest, from the memory if it is cached.
+func (b *imageBuilder) readManifest(manifestPath string) (*memoryCacheEntry, error) {
+	entry, ok := b.memory.get(manifestPath)
+	if ok && !b.shared {
+		return entry, nil
+	}
+
+	stat, err := os.Stat(manifestPath)
+	if err != nil {
+		if ok {
+			b.memory.remove(manifestPath)
+		}
+		return nil, err
+	}
+	if ok && entry.modTime.Equal(stat.ModTime()) {
+		return entry, nil
+	}
+	raw, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType := struct {
+		MediaType string `json:"mediaType,omitempty"`
+	}{}
+	err = json.Unmarshal(raw, &mediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	// The manifests of the blobs are addressed by the algorithm of their name, the ones of the tags by sha256.
+	digest := "sha256:" + atomic.SumSha256(raw)
+	if name := path.Base(manifestPath); digestRegexp.MatchString(name) && !strings.HasPrefix(name, "sha256:") {
+		algorithm, _, _ := strings.Cut(name, ":")
+		digest = manifestDigest(algorithm, raw)
+	}
+	entry = &memoryCacheEntry{
+		key:       manifestPath,
+		content:   raw,
+		mediaType: mediaType.MediaType,
+		digest:    digest,
+		modTime:   stat.ModTime(),
+	}
+	b.memory.add(entry)
+	return entry, nil
+}
+
+// readSmallBlob reads the blob with its media type if it is small enough to be cached,
+// the larger ones are left to be served from the filesystem.
+func (b *imageBuilder) readSmallBlob(blobPath string) (*memoryCacheEntry, bool) {
+	if entry, ok := b.memory.get(blobPath); ok {
+		return entry, true
+	}
+
+	maxSize := b.memory.maxEntrySize()
+	if maxSize <= 0 {
+		return nil, false
+	}
+	stat, err := os.Stat(blobPath)
+	if err != nil || stat.IsDir() || stat.Size() > maxSize {
+		return nil, false
+	}
+	raw, err := os.ReadFile(blobPath)
+	if err != nil {
+		return nil, false
+	}
+
+	digest := stat.Name()
+	entry := &memoryCacheEntry{
+		key:       blobPath,
+		content:   raw,
+		mediaType: b.BlobMediaType(digest),
+		digest:    digest,
+		modTime:   stat.ModTime(),
+	}
+	b.memory.add(entry)
+	return entry, true
+}
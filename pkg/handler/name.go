@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// maxRepositoryLength is the longest repository name accepted, like the distribution registry.
+const maxRepositoryLength = 255
+
+// The grammars of the distribution spec.
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	digestPattern     = regexp.MustCompile(`^[a-z0-9]+([+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+)
+
+// checkRegistryPath checks the repository name and the reference of the path of a request under /v2/ before any rule is matched,
+// and returns the error code if they are invalid. The path must not encode slashes so that the name is the same as the one the rules see.
+func checkRegistryPath(rawPath, urlPath string) (string, error) {
+	if strings.Contains(strings.ToLower(rawPath), "%2f") {
+		return errCodeNameInvalid, fmt.Errorf("the path must not encode slashes")
+	}
+	parts := strings.Split(urlPath, "/")
+	if len(parts) < 5 {
+		return "", nil
+	}
+	name, kind, reference := strings.Join(parts[2:len(parts)-2], "/"), parts[len(parts)-2], parts[len(parts)-1]
+	if len(parts) >= 6 && parts[len(parts)-3] == "blobs" && parts[len(parts)-2] == "uploads" {
+		name, kind = strings.Join(parts[2:len(parts)-3], "/"), "uploads"
+	}
+	if len(name) > maxRepositoryLength {
+		return errCodeNameInvalid, fmt.Errorf("repository name of %d characters is longer than %d", len(name), maxRepositoryLength)
+	}
+	if !repositoryPattern.MatchString(name) {
+		return errCodeNameInvalid, fmt.Errorf("invalid repository name %q", name)
+	}
+
+	switch kind {
+	case "manifests":
+		if strings.Contains(reference, ":") {
+			if !digestPattern.MatchString(reference) {
+				return errCodeDigestInvalid, fmt.Errorf("invalid digest %q", reference)
+			}
+		} else if !tagPattern.MatchString(reference) {
+			return errCodeTagInvalid, fmt.Errorf("invalid tag %q", reference)
+		}
+	case "blobs":
+		if !digestPattern.MatchString(reference) {
+			return errCodeDigestInvalid, fmt.Errorf("invalid digest %q", reference)
+		}
+	}
+	return "", nil
+}
+
+// invalidCachePath is the name returned for the paths that would leave the directories of the cache,
+// the NUL byte makes every read and write of it fail.
+const invalidCachePath = "\x00invalid"
+
+// cachePath joins the elements under the directory of the cache,
+// the elements with segments that are empty or traverse the directories, e.g. "..", give a path that can not be opened,
+// with as many elements so that its parents are never the directory itself.
+func cachePath(dir string, elems ...string) string {
+	for _, elem := range elems {
+		for _, segment := range strings.Split(elem, "/") {
+			if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, "\x00\\") {
+				invalid := []string{dir}
+				for range elems {
+					invalid = append(invalid, invalidCachePath)
+				}
+				return path.Join(invalid...)
+			}
+		}
+	}
+	return path.Join(append([]string{dir}, elems...)...)
+}
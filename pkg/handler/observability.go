@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMetricsJob is the job of the Prometheus scrape config of /metrics assumed by the dashboard and the alerting rules.
+const defaultMetricsJob = "jitdi"
+
+// dashboardPanel is a panel of the Grafana dashboard.
+type dashboardPanel struct {
+	ID          int               `json:"id"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Description string            `json:"description,omitempty"`
+	GridPos     dashboardGridPos  `json:"gridPos"`
+	Datasource  map[string]string `json:"datasource"`
+	Targets     []dashboardTarget `json:"targets"`
+	FieldConfig map[string]any    `json:"fieldConfig"`
+	Options     map[string]any    `json:"options,omitempty"`
+}
+
+type dashboardGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type dashboardTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	Format       string `json:"format,omitempty"`
+	RefID        string `json:"refId"`
+}
+
+// GrafanaDashboard returns the Grafana dashboard of the metrics of /metrics scraped by the Prometheus job,
+// with a variable of the Prometheus datasource and one of the instances.
+func GrafanaDashboard(job string) ([]byte, error) {
+	if job == "" {
+		job = defaultMetricsJob
+	}
+	selector := fmt.Sprintf(`job=%q,instance=~"$instance"`, job)
+	datasource := map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+	type panelSpec struct {
+		typ, title, description, unit string
+		targets                       [][2]string
+		w                             int
+	}
+	specs := []panelSpec{
+		{typ: "timeseries", title: "Cache size", unit: "bytes", w: 12,
+			description: "The size of all the files in the cache and of its blobs",
+			targets: [][2]string{
+				{`sum by (instance) (jitdi_cache_bytes{` + selector + `})`, "files {{instance}}"},
+				{`sum by (instance) (jitdi_cache_blob_bytes{` + selector + `})`, "blobs {{instance}}"},
+			}},
+		{typ: "timeseries", title: "Blobs", unit: "short", w: 12,
+			description: "The number of the blobs in the cache",
+			targets: [][2]string{
+				{`sum by (instance) (jitdi_cache_blobs{` + selector + `})`, "{{instance}}"},
+			}},
+		{typ: "bargauge", title: "Ages of the blobs", unit: "short", w: 12,
+			description: "The number of the blobs written at most this long ago",
+			targets: [][2]string{
+				{`sum by (le) (jitdi_cache_blob_age_seconds_bucket{` + selector + `})`, "{{le}}s"},
+			}},
+		{typ: "bargauge", title: "Largest repositories", unit: "bytes", w: 12,
+			description: "The size of the blobs referenced by the tags of the repositories",
+			targets: [][2]string{
+				{`topk(10, max by (repository) (jitdi_cache_repository_bytes{` + selector + `}))`, "{{repository}}"},
+			}},
+		{typ: "timeseries", title: "Builds", unit: "short", w: 24,
+			description: "The builds run in the last 5 minutes, and the ones waited for instead of being run, of the same instance or of another instance with --build-lock",
+			targets: [][2]string{
+				{`sum (increase(jitdi_builds_total{` + selector + `}[5m]))`, "run"},
+				{`sum by (scope) (increase(jitdi_builds_coalesced_total{` + selector + `}[5m]))`, "coalesced {{scope}}"},
+			}},
+		{typ: "timeseries", title: "Tenant usage of the quotas", unit: "percentunit", w: 12,
+			description: "The size of the blobs referenced by the tags of the tenants over their quotas, with --tenants",
+			targets: [][2]string{
+				{`max by (tenant) (jitdi_tenant_cache_bytes{` + selector + `}) / max by (tenant) (jitdi_tenant_quota_bytes{` + selector + `} > 0)`, "{{tenant}}"},
+			}},
+		{typ: "timeseries", title: "Tenant cache size", unit: "bytes", w: 12,
+			description: "The size of the blobs referenced by the tags of the tenants, with --tenants",
+			targets: [][2]string{
+				{`max by (tenant) (jitdi_tenant_cache_bytes{` + selector + `})`, "{{tenant}}"},
+			}},
+		{typ: "timeseries", title: "Tenant pulls", unit: "reqps", w: 8,
+			description: "The manifests served to the clients of the tenants per second, with --tenants",
+			targets: [][2]string{
+				{`sum by (tenant) (rate(jitdi_tenant_pulls_total{` + selector + `}[5m]))`, "{{tenant}}"},
+			}},
+		{typ: "timeseries", title: "Tenant tags", unit: "short", w: 8,
+			description: "The number of the tags of the tenants in the cache, with --tenants",
+			targets: [][2]string{
+				{`max by (tenant) (jitdi_tenant_tags{` + selector + `})`, "{{tenant}}"},
+			}},
+		{typ: "timeseries", title: "Tenant evictions", unit: "short", w: 8,
+			description: "The tags of the tenants evicted over their quotas in the last hour, with --tenants",
+			targets: [][2]string{
+				{`sum by (tenant) (increase(jitdi_tenant_evicted_tags_total{` + selector + `}[1h]))`, "{{tenant}}"},
+			}},
+	}
+
+	panels := make([]dashboardPanel, 0, len(specs))
+	var x, y int
+	for i, spec := range specs {
+		if x+spec.w > 24 {
+			x = 0
+			y += 8
+		}
+		panel := dashboardPanel{
+			ID:          i + 1,
+			Type:        spec.typ,
+			Title:       spec.title,
+			Description: spec.description,
+			GridPos:     dashboardGridPos{H: 8, W: spec.w, X: x, Y: y},
+			Datasource:  datasource,
+			FieldConfig: map[string]any{
+				"defaults":  map[string]any{"unit": spec.unit},
+				"overrides": []any{},
+			},
+		}
+		for j, target := range spec.targets {
+			panel.Targets = append(panel.Targets, dashboardTarget{
+				Expr:         target[0],
+				LegendFormat: target[1],
+				RefID:        string(rune('A' + j)),
+			})
+		}
+		if spec.typ == "bargauge" {
+			panel.Options = map[string]any{"orientation": "horizontal", "displayMode": "gradient"}
+			panel.Targets[0].Format = "time_series"
+		}
+		panels = append(panels, panel)
+		x += spec.w
+	}
+
+	dashboard := map[string]any{
+		"uid":           "jitdi",
+		"title":         "jitdi",
+		"description":   "The cache and the tenants of jitdi",
+		"tags":          []string{"jitdi"},
+		"editable":      true,
+		"schemaVersion": 39,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"templating": map[string]any{
+			"list": []map[string]any{
+				{
+					"name":  "datasource",
+					"label": "Datasource",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				{
+					"name":       "instance",
+					"label":      "Instance",
+					"type":       "query",
+					"datasource": datasource,
+					"query":      fmt.Sprintf(`label_values(jitdi_cache_bytes{job=%q}, instance)`, job),
+					"refresh":    2,
+					"multi":      true,
+					"includeAll": true,
+					"current":    map[string]any{"text": "All", "value": "$__all"},
+				},
+			},
+		},
+		"panels": panels,
+	}
+	return json.MarshalIndent(dashboard, "", "  ")
+}
+
+// alertingRule is a Prometheus alerting rule.
+type alertingRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// PrometheusRules returns the Prometheus alerting rules of the metrics of /metrics scraped by the Prometheus job,
+// the size of the cache is alerted on only with the max size of the garbage collection.
+func PrometheusRules(job string, gcMaxSize int64) ([]byte, error) {
+	if job == "" {
+		job = defaultMetricsJob
+	}
+	selector := fmt.Sprintf(`job=%q`, job)
+	rules := []alertingRule{
+		{
+			Alert:  "JitdiDown",
+			Expr:   `up{` + selector + `} == 0`,
+			For:    "5m",
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "jitdi is down",
+				"description": "The metrics of jitdi on {{ $labels.instance }} could not be scraped for 5 minutes.",
+			},
+		},
+		{
+			Alert:  "JitdiMetricsAbsent",
+			Expr:   `absent(jitdi_cache_bytes{` + selector + `})`,
+			For:    "15m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "jitdi reports no metrics",
+				"description": "No instance of the job " + job + " has reported the size of its cache for 15 minutes, check the scrape config and the admin token.",
+			},
+		},
+		{
+			Alert:  "JitdiStaleBlobs",
+			Expr:   `1 - jitdi_cache_blob_age_seconds_bucket{` + selector + `,le="2592000"} / ignoring(le) jitdi_cache_blob_age_seconds_count{` + selector + `} > 0.5`,
+			For:    "1h",
+			Labels: map[string]string{"severity": "info"},
+			Annotations: map[string]string{
+				"summary":     "Most of the blobs of the cache are older than 30 days",
+				"description": "{{ $value | humanizePercentage }} of the blobs of the cache on {{ $labels.instance }} were written more than 30 days ago, check that the garbage collection runs.",
+			},
+		},
+		{
+			Alert:  "JitdiTenantNearQuota",
+			Expr:   `jitdi_tenant_cache_bytes{` + selector + `} / (jitdi_tenant_quota_bytes{` + selector + `} > 0) > 0.9`,
+			For:    "15m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "A tenant uses most of its quota",
+				"description": "The tenant {{ $labels.tenant }} uses {{ $value | humanizePercentage }} of its quota on {{ $labels.instance }}, its least recently used tags are evicted over it.",
+			},
+		},
+		{
+			Alert:  "JitdiTenantEvictions",
+			Expr:   `increase(jitdi_tenant_evicted_tags_total{` + selector + `}[1h]) > 10`,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "The tags of a tenant are evicted over its quota",
+				"description": "{{ $value | humanize }} tags of the tenant {{ $labels.tenant }} were evicted over its quota on {{ $labels.instance }} in the last hour, they are built again when they are pulled.",
+			},
+		},
+	}
+	if gcMaxSize > 0 {
+		rules = append(rules, alertingRule{
+			Alert:  "JitdiCacheNearMaxSize",
+			Expr:   `jitdi_cache_blob_bytes{` + selector + `} > ` + strconv.FormatInt(gcMaxSize/10*9, 10),
+			For:    "30m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "The cache is near the max size of the garbage collection",
+				"description": "The blobs of the cache on {{ $labels.instance }} use {{ $value | humanize1024 }}B, over 90% of --gc-max-size, the garbage collection evicts the layers still referenced over it.",
+			},
+		})
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err := enc.Encode(map[string]any{
+		"groups": []map[string]any{
+			{
+				"name":  "jitdi",
+				"rules": rules,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *Handler) adminGrafanaDashboard(w http.ResponseWriter, r *http.Request) {
+	raw, err := GrafanaDashboard(r.URL.Query().Get("job"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
+
+func (h *Handler) adminPrometheusRules(w http.ResponseWriter, r *http.Request) {
+	raw, err := PrometheusRules(r.URL.Query().Get("job"), h.image.gcMaxSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(raw)
+}
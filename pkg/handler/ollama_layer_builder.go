@@ -2,11 +2,11 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"path"
 	"strings"
 
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/cache"
@@ -17,47 +17,53 @@ import (
 )
 
 type OllamaLayerBuilder struct {
+	parseReference func(ctx context.Context, s string, insecure bool) (name.Reference, []remote.Option, error)
 	modelCachePath string
 
 	fileBuilder *FileLayerBuilder
 }
 
-func NewOllamaLayerBuilder(modelCachePath string, fileBuilder *FileLayerBuilder) *OllamaLayerBuilder {
+func NewOllamaLayerBuilder(parseReference func(ctx context.Context, s string, insecure bool) (name.Reference, []remote.Option, error), modelCachePath string, fileBuilder *FileLayerBuilder) *OllamaLayerBuilder {
 	return &OllamaLayerBuilder{
+		parseReference: parseReference,
 		modelCachePath: modelCachePath,
 		fileBuilder:    fileBuilder,
 	}
 }
 
-func (b *OllamaLayerBuilder) Build(modelPath, workDir, modelName string) ([]mutate.Addendum, error) {
-	o := crane.GetOptions()
-
-	ref, err := name.ParseReference(modelPath, o.Name...)
+// Build returns the layers of the model and the reference of the model by digest.
+func (b *OllamaLayerBuilder) Build(ctx context.Context, modelPath, workDir, modelName string) ([]mutate.Addendum, string, error) {
+	ref, remoteOptions, err := b.parseReference(ctx, modelPath, false)
 	if err != nil {
-		return nil, fmt.Errorf("parsing reference %q: %w", modelPath, err)
+		return nil, "", fmt.Errorf("parsing reference %q: %w", modelPath, err)
 	}
 
-	rmt, err := remote.Get(ref, o.Remote...)
+	rmt, err := remote.Get(ref, append(remoteOptions, remote.WithContext(ctx))...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	img, err := rmt.Image()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	img = cache.Image(img, newFilesystemCache(b.modelCachePath))
+	img = cache.Image(img, newFilesystemCache(loggerFrom(ctx), b.modelCachePath))
 
-	err = saveManifest(img, b.modelCachePath, "", "", "")
+	err = saveManifest(ctx, img, b.modelCachePath, "", nil, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return b.tarModel(img, modelPath, workDir, modelName)
+	source := ref.Context().Digest(rmt.Digest.String()).String()
+	addendums, err := b.tarModel(ctx, img, modelPath, workDir, modelName)
+	if err != nil {
+		return nil, "", err
+	}
+	return describeSource(addendums, "ollama model "+source), source, nil
 }
 
-func (b *OllamaLayerBuilder) tarModel(image v1.Image, modelPath, workDir, modelName string) ([]mutate.Addendum, error) {
+func (b *OllamaLayerBuilder) tarModel(ctx context.Context, image v1.Image, modelPath, workDir, modelName string) ([]mutate.Addendum, error) {
 	layers, err := image.Layers()
 	if err != nil {
 		return nil, err
@@ -65,13 +71,13 @@ func (b *OllamaLayerBuilder) tarModel(image v1.Image, modelPath, workDir, modelN
 
 	var addendums []mutate.Addendum
 
-	a, err := b.tarManifest(image, modelPath, workDir, modelName)
+	a, err := b.tarManifest(ctx, image, modelPath, workDir, modelName)
 	if err != nil {
 		return nil, err
 	}
 	addendums = append(addendums, a...)
 
-	a, err = b.tarConfig(image, workDir)
+	a, err = b.tarConfig(ctx, image, workDir)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +85,7 @@ func (b *OllamaLayerBuilder) tarModel(image v1.Image, modelPath, workDir, modelN
 	addendums = append(addendums, a...)
 
 	for _, layer := range layers {
-		a, err = b.tarLayer(layer, workDir)
+		a, err = b.tarLayer(ctx, layer, workDir)
 		if err != nil {
 			return nil, err
 		}
@@ -90,7 +96,7 @@ func (b *OllamaLayerBuilder) tarModel(image v1.Image, modelPath, workDir, modelN
 	return addendums, nil
 }
 
-func (b *OllamaLayerBuilder) tarConfig(image v1.Image, workDir string) ([]mutate.Addendum, error) {
+func (b *OllamaLayerBuilder) tarConfig(ctx context.Context, image v1.Image, workDir string) ([]mutate.Addendum, error) {
 	confBlob, err := image.RawConfigFile()
 	if err != nil {
 		return nil, err
@@ -98,10 +104,10 @@ func (b *OllamaLayerBuilder) tarConfig(image v1.Image, workDir string) ([]mutate
 
 	newPath := path.Join(workDir, "blobs", "sha256:"+atomic.SumSha256(confBlob))
 	size := int64(len(confBlob))
-	return b.fileBuilder.BuildFile(bytes.NewBuffer(confBlob), newPath, size)
+	return b.fileBuilder.BuildFile(ctx, bytes.NewBuffer(confBlob), newPath, size)
 
 }
-func (b *OllamaLayerBuilder) tarManifest(image v1.Image, modelPath, workDir, modelName string) ([]mutate.Addendum, error) {
+func (b *OllamaLayerBuilder) tarManifest(ctx context.Context, image v1.Image, modelPath, workDir, modelName string) ([]mutate.Addendum, error) {
 	m, err := image.RawManifest()
 	if err != nil {
 		return nil, err
@@ -114,10 +120,10 @@ func (b *OllamaLayerBuilder) tarManifest(image v1.Image, modelPath, workDir, mod
 	newPath := path.Join(workDir, "manifests", modelName)
 	size := int64(len(m))
 
-	return b.fileBuilder.BuildFile(bytes.NewBuffer(m), newPath, size)
+	return b.fileBuilder.BuildFile(ctx, bytes.NewBuffer(m), newPath, size)
 }
 
-func (b *OllamaLayerBuilder) tarLayer(layer v1.Layer, workDir string) ([]mutate.Addendum, error) {
+func (b *OllamaLayerBuilder) tarLayer(ctx context.Context, layer v1.Layer, workDir string) ([]mutate.Addendum, error) {
 	l, err := layer.Uncompressed()
 	if err != nil {
 		return nil, err
@@ -136,5 +142,5 @@ func (b *OllamaLayerBuilder) tarLayer(layer v1.Layer, workDir string) ([]mutate.
 
 	newPath := path.Join(workDir, "blobs", digest.String())
 
-	return b.fileBuilder.BuildFile(l, newPath, size)
+	return b.fileBuilder.BuildFile(ctx, l, newPath, size)
 }
@@ -0,0 +1,347 @@
+package handler
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/version"
+)
+
+// apiOperation is an operation of the OpenAPI document, the schemas of the bodies are generated from their Go types.
+type apiOperation struct {
+	method  string
+	path    string
+	tag     string
+	summary string
+	params  []apiParam
+	// body is a value of the type of the JSON request body, if any.
+	body any
+	// status is the status of the successful response, 200 by default.
+	status int
+	// response is a value of the type of the JSON response, if any.
+	response any
+	// contentType is the type of the response if it is not JSON.
+	contentType string
+	headers     []string
+}
+
+type apiParam struct {
+	name        string
+	in          string
+	typ         string
+	required    bool
+	description string
+}
+
+var (
+	refParam      = apiParam{name: "ref", in: "query", typ: "string", required: true, description: "The image and tag, the tag defaults to latest"}
+	platformParam = apiParam{name: "platform", in: "query", typ: "string", description: "The platform as os/arch[/variant], linux/amd64 by default"}
+	idParam       = apiParam{name: "id", in: "path", typ: "string", required: true}
+	nameParam     = apiParam{name: "name", in: "path", typ: "string", required: true}
+	ifMatchParam  = apiParam{name: "If-Match", in: "header", typ: "string", description: "The resource version the rule must still have"}
+	jobParam      = apiParam{name: "job", in: "query", typ: "string", description: "The job of the Prometheus scrape config of /metrics, jitdi by default"}
+
+	repoParam   = apiParam{name: "name", in: "path", typ: "string", required: true, description: "The repository, it can contain slashes"}
+	digestParam = apiParam{name: "digest", in: "path", typ: "string", required: true}
+)
+
+// apiOperations are the operations of the admin API and the ones jitdi adds to the distribution spec.
+var apiOperations = []apiOperation{
+	{method: "GET", path: "/admin/builds", tag: "builds", summary: "List the recent builds, or watch them with Accept: text/event-stream", response: []Build{}},
+	{method: "POST", path: "/admin/builds", tag: "builds", summary: "Build a tag in the background even if it is in the cache", params: []apiParam{refParam}, status: http.StatusAccepted, response: Build{}, headers: []string{"Location"}},
+	{method: "GET", path: "/admin/builds/{id}", tag: "builds", summary: "Get a build", params: []apiParam{idParam}, response: Build{}},
+	{method: "GET", path: "/admin/builds/{id}/logs", tag: "builds", summary: "Get the logs of a build", params: []apiParam{idParam}, contentType: "text/plain"},
+	{method: "POST", path: "/admin/gc", tag: "cache", summary: "Remove the blobs no longer referenced by any tag", response: GCResult{}},
+	{method: "GET", path: "/admin/check", tag: "cache", summary: "List the tags referencing missing or truncated blobs", response: []Inconsistency{}},
+	{method: "GET", path: "/admin/usage", tag: "cache", summary: "Report the disk usage of the cache", params: []apiParam{{name: "top", in: "query", typ: "integer", description: "The number of repositories reported, 10 by default"}}, response: Usage{}},
+	{method: "GET", path: "/admin/tags", tag: "cache", summary: "List the built tags", params: []apiParam{{name: "stale", in: "query", typ: "boolean", description: "Only list the tags built by a rule that has changed"}}, response: []TagInfo{}},
+	{method: "DELETE", path: "/admin/tags", tag: "cache", summary: "Remove a tag from the cache", params: []apiParam{refParam, {name: "rebuild", in: "query", typ: "boolean", description: "Build the tag again right away"}}, response: InvalidateResult{}},
+	{method: "POST", path: "/admin/tags/rollback", tag: "cache", summary: "Point a tag at one of its previous builds kept with --tag-history", params: []apiParam{refParam, {name: "digest", in: "query", typ: "string", description: "The digest of the previous build, the latest one by default"}}, response: RollbackResult{}},
+	{method: "GET", path: "/admin/export", tag: "cache", summary: "Export a tag as a tarball of an OCI image layout for ctr image import, built first if it is not in the cache", params: []apiParam{refParam, platformParam, {name: "name", in: "query", typ: "string", description: "The name containerd imports the image as, the host and the ref by default"}}, contentType: "application/x-tar"},
+	{method: "GET", path: "/admin/match", tag: "rules", summary: "Show the rules evaluated for a ref and the one matching", params: []apiParam{refParam, platformParam}, response: MatchResult{}},
+	{method: "POST", path: "/admin/dry-run", tag: "rules", summary: "Show the manifests that would be built for a ref", params: []apiParam{refParam}, response: DryRunResult{}},
+	{method: "GET", path: "/admin/diff", tag: "rules", summary: "Compare a built image with its base image", params: []apiParam{refParam, platformParam}, response: DiffResult{}},
+	{method: "GET", path: "/admin/rules", tag: "rules", summary: "List the rules in the order they are matched", response: []RuleInfo{}},
+	{method: "GET", path: "/admin/rules/{name}", tag: "rules", summary: "Get a rule managed by the API", params: []apiParam{nameParam}, response: v1alpha1.Image{}, headers: []string{"ETag"}},
+	{method: "PUT", path: "/admin/rules/{name}", tag: "rules", summary: "Create or replace a rule managed by the API", params: []apiParam{nameParam, ifMatchParam, {name: "If-None-Match", in: "header", typ: "string", description: "Only create the rule with *"}}, body: v1alpha1.Image{}, response: v1alpha1.Image{}, headers: []string{"ETag"}},
+	{method: "DELETE", path: "/admin/rules/{name}", tag: "rules", summary: "Remove a rule managed by the API", params: []apiParam{nameParam, ifMatchParam}, status: http.StatusNoContent},
+	{method: "GET", path: "/admin/openapi.json", tag: "admin", summary: "Get this document", response: map[string]any{}},
+	{method: "GET", path: "/metrics", tag: "admin", summary: "Get the metrics of the cache and of the builds in the Prometheus text format", contentType: "text/plain"},
+	{method: "GET", path: "/admin/observability/grafana-dashboard", tag: "admin", summary: "Get a Grafana dashboard of the metrics", params: []apiParam{jobParam}, response: map[string]any{}},
+	{method: "GET", path: "/admin/observability/prometheus-rules", tag: "admin", summary: "Get the Prometheus alerting rules of the metrics, with the size of the cache with --gc-max-size", params: []apiParam{jobParam}, contentType: "application/yaml"},
+	{method: "GET", path: "/readyz", tag: "admin", summary: "Check the readiness of the instance, with the informers, the disk, the builds and the upstream registries as JSON if verbose", params: []apiParam{{name: "verbose", in: "query", typ: "boolean", description: "Return the details as JSON, with the admin token"}}, response: Ready{}},
+	{method: "POST", path: "/peer/built", tag: "workers", summary: "Read again from the shared cache a tag built by a peer, and wake up the builds waiting for its lock", body: PeerBuildNotice{}, status: http.StatusNoContent},
+
+	{method: "GET", path: extensionRulesPath, tag: "registry", summary: "List the rules that serve the client and what they match", response: ExtensionRules{}},
+	{method: "GET", path: "/v2/{name}/manifests/{reference}", tag: "registry", summary: "Get a manifest, built on demand by the first rule matching the repository and tag", params: []apiParam{repoParam, {name: "reference", in: "path", typ: "string", required: true}, {name: "If-None-Match", in: "header", typ: "string", description: "Answered with 304 if it is the quoted digest of the manifest"}}, contentType: "application/vnd.oci.image.manifest.v1+json", headers: []string{"Docker-Content-Digest", "ETag"}},
+	{method: "DELETE", path: "/v2/{name}/manifests/{reference}", tag: "registry", summary: "Remove a tag, or the tags of a digest, so that it is built again, with --enable-delete", params: []apiParam{repoParam, {name: "reference", in: "path", typ: "string", required: true}}, status: http.StatusAccepted},
+	{method: "POST", path: "/v2/{name}/blobs/uploads/", tag: "registry", summary: "Start an upload of a mutation input, or upload it at once with the digest, with --enable-upload", params: []apiParam{repoParam, {name: "digest", in: "query", typ: "string"}, {name: "mount", in: "query", typ: "string"}}, status: http.StatusAccepted, headers: []string{"Location", "Docker-Upload-UUID"}},
+	{method: "PATCH", path: "/v2/{name}/blobs/uploads/{uuid}", tag: "registry", summary: "Append a chunk to an upload", params: []apiParam{repoParam, {name: "uuid", in: "path", typ: "string", required: true}}, status: http.StatusAccepted, headers: []string{"Location", "Range"}},
+	{method: "PUT", path: "/v2/{name}/blobs/uploads/{uuid}", tag: "registry", summary: "Finish an upload", params: []apiParam{repoParam, {name: "uuid", in: "path", typ: "string", required: true}, {name: "digest", in: "query", typ: "string", required: true}}, status: http.StatusCreated, headers: []string{"Location", "Docker-Content-Digest"}},
+	{method: "DELETE", path: "/v2/{name}/blobs/{digest}", tag: "registry", summary: "Remove an uploaded mutation input, with --enable-delete", params: []apiParam{repoParam, digestParam}, status: http.StatusAccepted},
+}
+
+var openAPIDocument = sync.OnceValue(func() []byte {
+	raw, err := json.MarshalIndent(newOpenAPIDocument(apiOperations), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return raw
+})
+
+func (h *Handler) adminOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPIDocument())
+}
+
+// newOpenAPIDocument returns the OpenAPI 3 document of the operations.
+func newOpenAPIDocument(operations []apiOperation) map[string]any {
+	g := &schemaGenerator{
+		names:   map[reflect.Type]string{},
+		schemas: map[string]any{},
+	}
+	errorResponse := map[string]any{
+		"description": "The error of the distribution spec",
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(registryErrors{}))},
+		},
+	}
+
+	paths := map[string]map[string]any{}
+	for _, op := range operations {
+		operation := map[string]any{
+			"tags":        []string{op.tag},
+			"summary":     op.summary,
+			"operationId": operationID(op),
+		}
+		if strings.HasPrefix(op.path, "/v2/") {
+			operation["security"] = []map[string][]string{{"basicAuth": {}}, {}}
+			operation["responses"] = map[string]any{"default": errorResponse}
+		} else {
+			operation["security"] = []map[string][]string{{"bearerAuth": {}}}
+			operation["responses"] = map[string]any{}
+		}
+
+		var params []map[string]any
+		for _, p := range op.params {
+			param := map[string]any{
+				"name":   p.name,
+				"in":     p.in,
+				"schema": map[string]any{"type": p.typ},
+			}
+			if p.required {
+				param["required"] = true
+			}
+			if p.description != "" {
+				param["description"] = p.description
+			}
+			params = append(params, param)
+		}
+		if len(params) != 0 {
+			operation["parameters"] = params
+		}
+
+		if op.body != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.body))},
+				},
+			}
+		}
+
+		status := op.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := map[string]any{
+			"description": http.StatusText(status),
+		}
+		switch {
+		case op.response != nil:
+			response["content"] = map[string]any{
+				"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.response))},
+			}
+		case op.contentType != "":
+			response["content"] = map[string]any{
+				op.contentType: map[string]any{"schema": map[string]any{"type": "string"}},
+			}
+		}
+		if len(op.headers) != 0 {
+			headers := map[string]any{}
+			for _, header := range op.headers {
+				headers[header] = map[string]any{"schema": map[string]any{"type": "string"}}
+			}
+			response["headers"] = headers
+		}
+		operation["responses"].(map[string]any)[strconv.Itoa(status)] = response
+
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]any{}
+		}
+		paths[op.path][strings.ToLower(op.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "jitdi",
+			"version": version.Get(),
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "description": "The admin token"},
+				"basicAuth":  map[string]any{"type": "http", "scheme": "basic", "description": "The users of the registry, if any"},
+			},
+		},
+	}
+}
+
+// operationID returns the id of the operation, e.g. getAdminBuildsId for GET /admin/builds/{id}.
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.method)
+	for _, part := range strings.FieldsFunc(op.path, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+var (
+	timeTypes = map[reflect.Type]struct{}{
+		reflect.TypeOf(time.Time{}):        {},
+		reflect.TypeOf(metav1.Time{}):      {},
+		reflect.TypeOf(metav1.MicroTime{}): {},
+	}
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaGenerator generates the JSON schemas of the Go types as encoded by encoding/json,
+// the structs are components referenced by their names.
+type schemaGenerator struct {
+	names   map[reflect.Type]string
+	schemas map[string]any
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	// The types encoding themselves are strings, like the times and the digests, or anything.
+	if _, ok := timeTypes[t]; ok {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	ptr := reflect.PointerTo(t)
+	if t.Implements(textMarshalerType) || ptr.Implements(textMarshalerType) {
+		return map[string]any{"type": "string"}
+	}
+	if t.Implements(jsonMarshalerType) || ptr.Implements(jsonMarshalerType) {
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.structRef(t)
+	}
+	return map[string]any{}
+}
+
+// structRef returns the reference to the component of the struct, which is added on the first use.
+func (g *schemaGenerator) structRef(t reflect.Type) map[string]any {
+	name, ok := g.names[t]
+	if !ok {
+		name = g.componentName(t)
+		g.names[t] = name
+		// The placeholder stops the recursion of the types referencing themselves.
+		g.schemas[name] = nil
+		properties := map[string]any{}
+		var required []string
+		g.addFields(t, properties, &required)
+		schema := map[string]any{
+			"type":       "object",
+			"properties": properties,
+		}
+		if len(required) != 0 {
+			schema["required"] = required
+		}
+		g.schemas[name] = schema
+	}
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+// componentName returns the name of the type, prefixed by its package if another type has the same name.
+func (g *schemaGenerator) componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	if _, ok := g.schemas[string(name)]; !ok {
+		return string(name)
+	}
+	pkg := []rune(path.Base(t.PkgPath()))
+	pkg[0] = unicode.ToUpper(pkg[0])
+	return string(pkg) + string(name)
+}
+
+// addFields adds the fields of the struct, and the fields of its embedded structs like encoding/json.
+func (g *schemaGenerator) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(ft, properties, required)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
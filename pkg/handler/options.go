@@ -0,0 +1,502 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/cloudauth"
+	"github.com/wzshiming/jitdi/pkg/metadata"
+)
+
+type options struct {
+	concurrency int
+	transport   http.RoundTripper
+
+	insecureTransport  http.RoundTripper
+	insecureRegistries []string
+
+	adminToken       string
+	maxBuildRecords  int
+	maxBuildLogLines int
+	progressInterval time.Duration
+
+	enableDelete bool
+	enableUpload bool
+	gcInterval   time.Duration
+	gcMaxSize    int64
+
+	inlineDataThreshold int64
+	memoryCacheSize     int64
+	readyMinFreeBytes   int64
+	circuitBreaker      CircuitBreakerOptions
+	retryPolicy         RetryPolicy
+	faultInjection      FaultInjection
+	remote              v1alpha1.Remote
+	cloudCredentials    map[string]cloudauth.Provider
+	credentialHelpers   map[string]string
+	keychains           []authn.Keychain
+	upstreamPrefixes    map[string]string
+
+	upstreamMaxBandwidth    int64
+	serveMaxBandwidth       int64
+	serveMaxClientBandwidth int64
+
+	sendfileHeader string
+	sendfilePrefix string
+
+	tagCacheControl    string
+	digestCacheControl string
+
+	redirectUpstream bool
+	redirectHosts    []string
+
+	rebuildMissingBlobs bool
+	reuseMutationLayers bool
+	dedupStagedFiles    bool
+
+	buildTmpDir   string
+	buildMaxFiles int64
+	buildMaxBytes int64
+
+	auditLog     io.Writer
+	auditWebhook string
+
+	preheatEndpoint    string
+	preheatToken       string
+	preheatRegistryURL string
+
+	htpasswd string
+	tenants  string
+
+	metadataIndex metadata.Index
+	tagHistory    int
+
+	canarySoak    time.Duration
+	canaryPercent int
+	canaryClients []string
+
+	fsckMode          string
+	fsckVerifyDigests bool
+
+	readOnly bool
+
+	rulesDir         string
+	adminRuleSources []string
+
+	secretsDir string
+
+	buildWorker       string
+	buildWorkerToken  string
+	buildWorkerTLS    bool
+	workerConcurrency int
+	buildLock         bool
+
+	peers     []string
+	peerToken string
+
+	warmTop       int
+	warmPeer      string
+	warmPeerToken string
+}
+
+// Option is an option for the Handler.
+type Option func(*options)
+
+// WithConcurrency sets how many mutation sources are fetched at the same time during a build.
+func WithConcurrency(concurrency int) Option {
+	return func(o *options) {
+		o.concurrency = concurrency
+	}
+}
+
+// WithTransport sets the transport used to pull base images and fetch mutation sources.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = transport
+	}
+}
+
+// WithInsecureTransport sets the transport used for insecure registries.
+func WithInsecureTransport(transport http.RoundTripper) Option {
+	return func(o *options) {
+		o.insecureTransport = transport
+	}
+}
+
+// WithCircuitBreaker fails the requests to the upstream hosts fast while too many of them fail,
+// and sends them to the mirrors of the registries if any.
+func WithCircuitBreaker(opts CircuitBreakerOptions) Option {
+	return func(o *options) {
+		o.circuitBreaker = opts
+	}
+}
+
+// WithRetryPolicy retries the requests to the upstreams failed transiently with the policy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithFaultInjection injects the faults to the requests to the upstreams and to the writes of the blobs,
+// to test the timeouts and the retries of the clients.
+func WithFaultInjection(f FaultInjection) Option {
+	return func(o *options) {
+		o.faultInjection = f
+	}
+}
+
+// WithRemote sets the options of go-containerregistry to reach the upstreams, the user agent, the jobs,
+// the default platform and the attempts of its retries, the ones of the rules override them.
+func WithRemote(r v1alpha1.Remote) Option {
+	return func(o *options) {
+		o.remote = r
+	}
+}
+
+// WithCloudCredentials resolves the credentials of the registries matching the globs from the ambient identity of jitdi
+// in the cloud of their providers, before the ones of the config.json, e.g. "*.dkr.ecr.*.amazonaws.com" = cloudauth.ECR.
+func WithCloudCredentials(hosts map[string]cloudauth.Provider) Option {
+	return func(o *options) {
+		o.cloudCredentials = hosts
+	}
+}
+
+// WithCredentialHelpers resolves the credentials of the registries matching the globs with the commands of the credential helper
+// protocol of docker, before the cloud credentials, e.g. "*.corp.example" = "/usr/local/bin/corp-auth --ci".
+func WithCredentialHelpers(helpers map[string]string) Option {
+	return func(o *options) {
+		o.credentialHelpers = helpers
+	}
+}
+
+// WithKeychains resolves the credentials of the upstream registries with the keychains before the credential helpers,
+// the first one that does not leave a registry anonymous provides its credentials.
+func WithKeychains(keychains ...authn.Keychain) Option {
+	return func(o *options) {
+		o.keychains = append(o.keychains, keychains...)
+	}
+}
+
+// WithUpstreamPrefixes serves the images of the registries under their path prefixes without any mutation, e.g. /v2/docker.io/library/nginx,
+// the prefixes are the hosts of the registries or the registries are set for them, e.g. "registry.local" = "127.0.0.1:5000".
+// The rules matching the images of a prefix more specifically apply their mutations to them.
+func WithUpstreamPrefixes(prefixes map[string]string) Option {
+	return func(o *options) {
+		o.upstreamPrefixes = prefixes
+	}
+}
+
+// WithUpstreamMaxBandwidth limits the bytes per second pulled from the upstreams, zero is unlimited.
+func WithUpstreamMaxBandwidth(bytesPerSecond int64) Option {
+	return func(o *options) {
+		o.upstreamMaxBandwidth = bytesPerSecond
+	}
+}
+
+// WithServeMaxBandwidth limits the bytes per second served to all the clients and to each of them, zero is unlimited.
+func WithServeMaxBandwidth(bytesPerSecond, perClient int64) Option {
+	return func(o *options) {
+		o.serveMaxBandwidth = bytesPerSecond
+		o.serveMaxClientBandwidth = perClient
+	}
+}
+
+// WithInsecureRegistries sets the registries that are allowed to be pulled over plain HTTP or without verifying TLS.
+func WithInsecureRegistries(registries ...string) Option {
+	return func(o *options) {
+		o.insecureRegistries = append(o.insecureRegistries, registries...)
+	}
+}
+
+// WithAdminToken sets the bearer token required by the admin API.
+func WithAdminToken(token string) Option {
+	return func(o *options) {
+		o.adminToken = token
+	}
+}
+
+// WithProgressInterval sets how often the progress of running builds is logged.
+func WithProgressInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.progressInterval = interval
+	}
+}
+
+// WithDelete enables deleting manifests with the DELETE method of the distribution spec.
+func WithDelete(enable bool) Option {
+	return func(o *options) {
+		o.enableDelete = enable
+	}
+}
+
+// WithUpload enables pushing blobs with the upload API of the distribution spec.
+func WithUpload(enable bool) Option {
+	return func(o *options) {
+		o.enableUpload = enable
+	}
+}
+
+// WithGCInterval sets how often the blobs that are no longer referenced are removed, zero disables it.
+func WithGCInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.gcInterval = interval
+	}
+}
+
+// WithGCMaxSize sets the size of the blobs over which the garbage collection also evicts the layers still referenced,
+// by their cache priorities, zero disables it.
+func WithGCMaxSize(size int64) Option {
+	return func(o *options) {
+		o.gcMaxSize = size
+	}
+}
+
+// WithInlineDataThreshold sets the size up to which the blobs are embedded into the data field of the OCI descriptors, zero disables it.
+func WithInlineDataThreshold(size int64) Option {
+	return func(o *options) {
+		o.inlineDataThreshold = size
+	}
+}
+
+// WithAuditLog sets the writer that every manifest served is recorded to as a JSON line.
+func WithAuditLog(w io.Writer) Option {
+	return func(o *options) {
+		o.auditLog = w
+	}
+}
+
+// WithAuditWebhook sets the URL that every manifest served is posted to as JSON.
+func WithAuditWebhook(url string) Option {
+	return func(o *options) {
+		o.auditWebhook = url
+	}
+}
+
+// WithTenants sets the tenants file of the virtual registries with their own rules, users and quotas.
+func WithTenants(tenantsPath string) Option {
+	return func(o *options) {
+		o.tenants = tenantsPath
+	}
+}
+
+// WithHtpasswd sets the htpasswd file of the users that the clients authenticate as with basic auth.
+func WithHtpasswd(htpasswdPath string) Option {
+	return func(o *options) {
+		o.htpasswd = htpasswdPath
+	}
+}
+
+// WithMemoryCacheSize sets the size of the memory that the manifests and the small blobs are cached in, zero disables it.
+func WithMemoryCacheSize(size int64) Option {
+	return func(o *options) {
+		o.memoryCacheSize = size
+	}
+}
+
+// WithReadyMinFreeBytes sets the free space of the file system of the cache below which the instance is not ready, zero disables it.
+func WithReadyMinFreeBytes(size int64) Option {
+	return func(o *options) {
+		o.readyMinFreeBytes = size
+	}
+}
+
+// WithSendfile hands the serving of the blobs over to the reverse proxy with the header,
+// X-Accel-Redirect for nginx with the internal location prefix mapped to the cache directory,
+// or X-Sendfile with the absolute path. The small blobs cached in memory are still served directly.
+func WithSendfile(header, prefix string) Option {
+	return func(o *options) {
+		o.sendfileHeader = header
+		o.sendfilePrefix = prefix
+	}
+}
+
+// WithCacheControl sets the Cache-Control of the manifests pulled by tag, none if empty,
+// and of the blobs and the manifests pulled by digest, the rules can set their own for their manifests.
+func WithCacheControl(tag, digest string) Option {
+	return func(o *options) {
+		o.tagCacheControl = tag
+		o.digestCacheControl = digest
+	}
+}
+
+// WithTagHistory keeps the previous builds of every tag in the metadata index,
+// so that the tags can be rolled back to them with the admin API. Their blobs are kept by the garbage collection.
+func WithTagHistory(n int) Option {
+	return func(o *options) {
+		o.tagHistory = n
+	}
+}
+
+// WithCanary serves the rebuilt tags for the soak only to the percent of the clients and to the clients,
+// user names or CIDRs, and the builds before to the others, zero soak serves the rebuilt tags to all the clients right away.
+func WithCanary(soak time.Duration, percent int, clients ...string) Option {
+	return func(o *options) {
+		o.canarySoak = soak
+		o.canaryPercent = percent
+		o.canaryClients = clients
+	}
+}
+
+// WithMetadataIndex sets the index of the metadata of the built tags, defaults to a file in the cache.
+func WithMetadataIndex(index metadata.Index) Option {
+	return func(o *options) {
+		o.metadataIndex = index
+	}
+}
+
+// WithFsck scans the cache on start with the mode, "check" reports the broken tags
+// and "repair" quarantines them and builds them again, verifyDigests also hashes every blob.
+func WithFsck(mode string, verifyDigests bool) Option {
+	return func(o *options) {
+		o.fsckMode = mode
+		o.fsckVerifyDigests = verifyDigests
+	}
+}
+
+// WithReadOnly only serves the tags already in the cache, which is shared with the instances that build them,
+// the tags not in the cache are not found instead of being built.
+func WithReadOnly(readOnly bool) Option {
+	return func(o *options) {
+		o.readOnly = readOnly
+	}
+}
+
+// WithBuildWorker sends the builds to the gRPC Worker service of the workers behind the target instead of building them,
+// the workers must share the cache with the frontend and accept the token if it is not empty.
+func WithBuildWorker(target, token string) Option {
+	return func(o *options) {
+		o.buildWorker = target
+		o.buildWorkerToken = token
+	}
+}
+
+// WithBuildWorkerTLS connects to the workers over TLS.
+func WithBuildWorkerTLS(withTLS bool) Option {
+	return func(o *options) {
+		o.buildWorkerTLS = withTLS
+	}
+}
+
+// WithWorkerConcurrency sets how many builds requested by the frontends run at the same time on the worker,
+// the others wait in line, 0 is unlimited.
+func WithWorkerConcurrency(concurrency int) Option {
+	return func(o *options) {
+		o.workerConcurrency = concurrency
+	}
+}
+
+// WithBuildLock makes the instances sharing the cache build each tag once, with lock files in the cache,
+// the requests of a tag being built by another instance wait for its build instead of building it again.
+func WithBuildLock(lock bool) Option {
+	return func(o *options) {
+		o.buildLock = lock
+	}
+}
+
+// WithPeers announces the tags built to the other instances sharing the cache behind the endpoints,
+// e.g. a headless Service whose host is resolved to the addresses of all its pods, and which accept the token if it is not empty.
+func WithPeers(endpoints []string, token string) Option {
+	return func(o *options) {
+		o.peers = endpoints
+		o.peerToken = token
+	}
+}
+
+// WithWarm loads the top most recently pulled tags on start, the instance is not ready until they are loaded.
+// The tags are copied first from the peer if it is not empty, which accepts the token if it is not empty,
+// and the manifests and the small blobs of the tags in the cache are loaded into the memory, the other blobs into the page cache.
+func WithWarm(top int, peer, token string) Option {
+	return func(o *options) {
+		o.warmTop = top
+		o.warmPeer = peer
+		o.warmPeerToken = token
+	}
+}
+
+// WithRulesDir loads the rules of the YAML and JSON files of the directory, and reloads them when they change.
+func WithRulesDir(dir string) Option {
+	return func(o *options) {
+		o.rulesDir = dir
+	}
+}
+
+// WithAdminRuleSources allows the rules created by the admin API to read the local files under the directories,
+// they can only read the URLs and the uploaded blobs otherwise.
+func WithAdminRuleSources(dirs []string) Option {
+	return func(o *options) {
+		o.adminRuleSources = dirs
+	}
+}
+
+// WithSecretsDir reads the Secrets referenced by the templates of the files from the directory,
+// the keys of a Secret at <dir>/<name>/<key> like the Secrets mounted as volumes.
+func WithSecretsDir(dir string) Option {
+	return func(o *options) {
+		o.secretsDir = dir
+	}
+}
+
+// WithRedirectUpstream leaves the layers of the base images in the upstream registries instead of storing them,
+// the clients pulling them are redirected to the upstream registries.
+func WithRedirectUpstream(redirect bool) Option {
+	return func(o *options) {
+		o.redirectUpstream = redirect
+	}
+}
+
+// WithRebuildMissingBlobs builds again the tags of the metadata index whose current builds reference the blobs pulled
+// but missing from the cache, e.g. by the clients keeping the manifests in their own caches.
+func WithRebuildMissingBlobs(rebuild bool) Option {
+	return func(o *options) {
+		o.rebuildMissingBlobs = rebuild
+	}
+}
+
+// WithReuseMutationLayers reuses the layers of the mutations whose inputs are unchanged when the tags are built again,
+// by the fingerprints of the inputs recorded in the metadata index, only the layers of the changed mutations are built.
+func WithReuseMutationLayers(reuse bool) Option {
+	return func(o *options) {
+		o.reuseMutationLayers = reuse
+	}
+}
+
+// WithDedupStagedFiles keeps the files downloaded for the builds once on the disk by their digests with hard links,
+// the files of Hugging Face already downloaded for another repository or revision are not downloaded again.
+func WithDedupStagedFiles(dedup bool) Option {
+	return func(o *options) {
+		o.dedupStagedFiles = dedup
+	}
+}
+
+// WithBuildSandbox creates the temporary directories of the builds under the dir, e.g. a tmpfs, and bounds the number
+// and the size of the files that the mutations of a build add, zero is unbounded.
+func WithBuildSandbox(dir string, maxFiles, maxBytes int64) Option {
+	return func(o *options) {
+		o.buildTmpDir = dir
+		o.buildMaxFiles = maxFiles
+		o.buildMaxBytes = maxBytes
+	}
+}
+
+// WithRedirectHosts limits the hosts that the clients are redirected to for the upstream layers to the globs,
+// e.g. "*.cloudfront.net", the layers redirected elsewhere are stored and served locally.
+func WithRedirectHosts(hosts ...string) Option {
+	return func(o *options) {
+		o.redirectHosts = hosts
+	}
+}
+
+// WithDragonflyPreheat creates a preheat job in the manager of Dragonfly for every tag built,
+// the endpoint is the URL of its jobs API and the registry URL is the URL that the nodes pull jitdi as.
+func WithDragonflyPreheat(endpoint, token, registryURL string) Option {
+	return func(o *options) {
+		o.preheatEndpoint = endpoint
+		o.preheatToken = token
+		o.preheatRegistryURL = registryURL
+	}
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/logging"
+)
+
+// immutableCacheControl is the default Cache-Control of the content addressed blobs and manifests,
+// so that the peer-to-peer agents and the caching proxies keep them.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// preheatQueueSize is how many built tags are buffered for the preheat before new ones are dropped.
+const preheatQueueSize = 1000
+
+// preheater announces the built tags to the manager of Dragonfly, which preheats their blobs into its peers,
+// so that the nodes pull the huge layers from each other instead of all from jitdi.
+type preheater struct {
+	logger *slog.Logger
+
+	endpoint    string
+	token       string
+	registryURL *url.URL
+	client      *http.Client
+	queue       chan string
+}
+
+func newPreheater(endpoint, token, registryURL string, transport http.RoundTripper) (*preheater, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	if registryURL == "" {
+		return nil, fmt.Errorf("the registry url is required")
+	}
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, fmt.Errorf("registry url %q: %w", registryURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("registry url %q: must be a http or https url", registryURL)
+	}
+	p := &preheater{
+		logger:      slog.Default().With(logging.ComponentKey, "preheat"),
+		endpoint:    endpoint,
+		token:       token,
+		registryURL: u,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+		},
+		queue: make(chan string, preheatQueueSize),
+	}
+	go p.run(context.Background())
+	return p, nil
+}
+
+// manifestURL returns the URL of the manifest of the tag that the nodes pull, the host of the tenant for the tags of a tenant.
+func (p *preheater) manifestURL(t *tenant, image, tag string) string {
+	u := *p.registryURL
+	if t != nil {
+		u.Host = t.host
+		image = strings.TrimPrefix(image, t.host+"/")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v2/" + image + "/manifests/" + tag
+	return u.String()
+}
+
+func (p *preheater) preheat(manifestURL string) {
+	select {
+	case p.queue <- manifestURL:
+	default:
+		p.logger.Warn("preheat queue is full, tag dropped", "url", manifestURL)
+	}
+}
+
+func (p *preheater) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case manifestURL := <-p.queue:
+			err := p.send(ctx, manifestURL)
+			if err != nil {
+				p.logger.Error("send preheat", "url", manifestURL, "err", err)
+				continue
+			}
+			p.logger.Info("preheat sent", "url", manifestURL)
+		}
+	}
+}
+
+// send creates the preheat job of the image of the manifest in the manager of Dragonfly.
+func (p *preheater) send(ctx context.Context, manifestURL string) error {
+	raw, err := json.Marshal(map[string]any{
+		"type": "preheat",
+		"args": map[string]string{
+			"type": "image",
+			"url":  manifestURL,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("http.Post(%q): %w", p.endpoint, fmt.Errorf("status code %d", resp.StatusCode))
+	}
+	return nil
+}
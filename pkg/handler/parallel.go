@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// runParallel calls fn for each index in [0, count) at the same time, and returns all the errors joined together.
+// The calls are not bounded here, the fetches they make take the buildSlots of the build which bound them.
+func runParallel(count int, fn func(i int) error) error {
+	errs := make([]error, count)
+	wg := sync.WaitGroup{}
+	for i := 0; i != count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// buildSlots bounds the sources fetched at the same time by a build. It is shared by the mutates of the build
+// and the files of their repositories, so that the nested pools do not multiply the concurrency:
+// only the fetches take a slot, the pools waiting for them do not.
+type buildSlots chan struct{}
+
+type buildSlotsKey struct{}
+
+// withBuildSlots returns the ctx carrying the slots of the build, unless it already carries some.
+func withBuildSlots(ctx context.Context, limit int) context.Context {
+	if buildSlotsFrom(ctx) != nil {
+		return ctx
+	}
+	if limit <= 0 {
+		limit = 1
+	}
+	return context.WithValue(ctx, buildSlotsKey{}, make(buildSlots, limit))
+}
+
+func buildSlotsFrom(ctx context.Context) buildSlots {
+	s, _ := ctx.Value(buildSlotsKey{}).(buildSlots)
+	return s
+}
+
+// acquire waits for a slot of the build and returns its release, the slots are unlimited without a build.
+func (s buildSlots) acquire(ctx context.Context) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	select {
+	case s <- struct{}{}:
+		return func() { <-s }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
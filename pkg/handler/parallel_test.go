@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+func TestRunParallel(t *testing.T) {
+	var called atomic.Int64
+	err := runParallel(5, func(i int) error {
+		called.Add(1)
+		if i%2 == 1 {
+			return fmt.Errorf("error %d", i)
+		}
+		return nil
+	})
+	if got := called.Load(); got != 5 {
+		t.Errorf("called = %d, want 5", got)
+	}
+	if want := errors.Join(fmt.Errorf("error 1"), fmt.Errorf("error 3")); err == nil || err.Error() != want.Error() {
+		t.Errorf("err = %v, want %v", err, want)
+	}
+}
+
+func TestBuildMutationsConcurrency(t *testing.T) {
+	var running, maxRunning atomic.Int64
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/models/") {
+			_ = json.NewEncoder(w).Encode(huggingFaceRevision{
+				Sha: "abc",
+				Siblings: []huggingFaceFile{
+					{Filename: "1"}, {Filename: "2"}, {Filename: "3"}, {Filename: "4"},
+				},
+			})
+			return
+		}
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	t.Cleanup(hub.Close)
+	t.Setenv("HF_ENDPOINT", hub.URL)
+
+	h := newTestHandler(t, nil, WithConcurrency(2))
+	base, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutates []v1alpha1.Mutate
+	for _, repo := range []string{"a/b", "c/d", "e/f"} {
+		mutates = append(mutates, v1alpha1.Mutate{
+			HuggingFace: &v1alpha1.HuggingFace{Repo: repo, WorkDir: "/models/" + repo},
+		})
+	}
+	mutations, err := h.image.buildMutations(context.Background(), types.DockerManifestSchema2, base, mutates, nil, time.Unix(0, 0), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mutations) != len(mutates) {
+		t.Fatalf("got %d mutations, want %d", len(mutations), len(mutates))
+	}
+	if got := maxRunning.Load(); got != 2 {
+		t.Errorf("files fetched at the same time = %d, want 2", got)
+	}
+}
@@ -0,0 +1,333 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"gopkg.in/yaml.v3"
+)
+
+// maxPatchFileSize is the size of the file of the base image patched at most.
+const maxPatchFileSize = 16 << 20
+
+// buildPatch returns the layer of the file of the base image patched, which keeps the mode and the owner of the file,
+// and the description of what it adds.
+func (b *imageBuilder) buildPatch(ctx context.Context, patch *v1alpha1.Patch, base v1.Image, layerMediaType types.MediaType, creationTime time.Time, windows bool) ([]mutate.Addendum, string, error) {
+	if base == nil {
+		return nil, "", fmt.Errorf("patch %s: no base image", patch.Path)
+	}
+	format := patch.Format
+	if format == "" {
+		format = v1alpha1.PatchFormatYAML
+		if path.Ext(patch.Path) == ".json" {
+			format = v1alpha1.PatchFormatJSON
+		}
+	}
+
+	err := checkEntryName(patch.Path)
+	if err != nil {
+		return nil, "", fmt.Errorf("patch %s: %w", patch.Path, err)
+	}
+	var content []byte
+	header, err := readBaseFile(base, patch.Path, windows, func(header *tar.Header, r io.Reader) error {
+		if header.Size > maxPatchFileSize {
+			return fmt.Errorf("the file is larger than %d bytes", maxPatchFileSize)
+		}
+		var err error
+		content, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("patch %s: %w", patch.Path, err)
+	}
+	content, err = patchDocument(content, format, patch.MergePatch, patch.Set)
+	if err != nil {
+		return nil, "", fmt.Errorf("patch %s: %w", patch.Path, err)
+	}
+
+	builder := NewFileLayerBuilder(b.client, b.cacheTmp, header.Mode, creationTime, layerMediaType, 0, windows)
+	addendums, err := builder.build(ctx, func(tw *tarWriter) error {
+		return tarBaseFile(tw, patch.Path, header, content, creationTime)
+	}, v1.History{
+		Created:   v1.Time{Time: creationTime},
+		Author:    "jitdi",
+		CreatedBy: fmt.Sprintf("PATCH %s", patch.Path),
+		Comment:   fmt.Sprintf("Patch %s", patch.Path),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("file layer builder: %w", err)
+	}
+	return addendums, fmt.Sprintf("patch %s", patch.Path), nil
+}
+
+// patchDocument applies the JSON merge patch and then sets the values at the paths of the first document,
+// the YAML keeps its comments and the order of its keys.
+func patchDocument(content []byte, format, mergePatch string, set map[string]string) ([]byte, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	var docs []*yaml.Node
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("parse %s: %w", format, err)
+		}
+		docs = append(docs, &doc)
+	}
+	if len(docs) == 0 {
+		docs = append(docs, &yaml.Node{Kind: yaml.DocumentNode})
+	}
+	if len(docs[0].Content) == 0 {
+		docs[0].Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	root := docs[0].Content[0]
+
+	if mergePatch != "" {
+		var patch yaml.Node
+		err := yaml.Unmarshal([]byte(mergePatch), &patch)
+		if err != nil {
+			return nil, fmt.Errorf("parse mergePatch: %w", err)
+		}
+		if len(patch.Content) != 0 {
+			root = mergeNode(root, patch.Content[0])
+		}
+	}
+
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var value yaml.Node
+		err := yaml.Unmarshal([]byte(set[k]), &value)
+		if err != nil {
+			return nil, fmt.Errorf("parse set %q: %w", k, err)
+		}
+		node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+		if len(value.Content) != 0 {
+			node = value.Content[0]
+		}
+		root, err = setNode(root, strings.Split(k, "."), node)
+		if err != nil {
+			return nil, fmt.Errorf("set %q: %w", k, err)
+		}
+	}
+	docs[0].Content[0] = root
+
+	var buf bytes.Buffer
+	if format == v1alpha1.PatchFormatJSON {
+		err := writeJSONNode(&buf, root)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		err = json.Indent(&out, buf.Bytes(), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		out.WriteByte('\n')
+		return out.Bytes(), nil
+	}
+
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	for _, doc := range docs {
+		err := encoder.Encode(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mergeNode merges the patch into the target like RFC 7386, the nulls remove the keys and the other values replace them.
+func mergeNode(target, patch *yaml.Node) *yaml.Node {
+	if patch.Kind != yaml.MappingNode {
+		return replaceNode(target, patch)
+	}
+	if target == nil || target.Kind != yaml.MappingNode {
+		target = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	for i := 0; i+1 < len(patch.Content); i += 2 {
+		key, value := patch.Content[i], patch.Content[i+1]
+		j := mappingIndex(target, key.Value)
+		if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+			if j >= 0 {
+				target.Content = append(target.Content[:j], target.Content[j+2:]...)
+			}
+			continue
+		}
+		if j >= 0 {
+			target.Content[j+1] = mergeNode(target.Content[j+1], value)
+		} else {
+			target.Content = append(target.Content, blockNode(key), mergeNode(nil, value))
+		}
+	}
+	return target
+}
+
+// setNode sets the value at the path, the missing keys are added.
+func setNode(node *yaml.Node, segments []string, value *yaml.Node) (*yaml.Node, error) {
+	if len(segments) == 0 {
+		return replaceNode(node, value), nil
+	}
+	segment := segments[0]
+	if node == nil || node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		j := mappingIndex(node, segment)
+		if j < 0 {
+			child, err := setNode(nil, segments[1:], value)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: segment}, child)
+			return node, nil
+		}
+		child, err := setNode(node.Content[j+1], segments[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		node.Content[j+1] = child
+		return node, nil
+	case yaml.SequenceNode:
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 || index > len(node.Content) {
+			return nil, fmt.Errorf("invalid index %q of a list of %d", segment, len(node.Content))
+		}
+		if index == len(node.Content) {
+			child, err := setNode(nil, segments[1:], value)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, child)
+			return node, nil
+		}
+		child, err := setNode(node.Content[index], segments[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		node.Content[index] = child
+		return node, nil
+	}
+	return nil, fmt.Errorf("%q is not a map or a list", segment)
+}
+
+func mappingIndex(node *yaml.Node, key string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// replaceNode returns the value replacing the node, with the comments of the node.
+func replaceNode(node, value *yaml.Node) *yaml.Node {
+	value = blockNode(value)
+	if node != nil {
+		value.HeadComment = node.HeadComment
+		value.LineComment = node.LineComment
+		value.FootComment = node.FootComment
+	}
+	return value
+}
+
+// blockNode resets the styles of the node written in JSON, so that it is added to the YAML in the block style.
+func blockNode(node *yaml.Node) *yaml.Node {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockNode(child)
+	}
+	return node
+}
+
+// writeJSONNode writes the node in JSON, keeping the order of the keys.
+func writeJSONNode(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeJSONNode(buf, node.Content[0])
+	case yaml.AliasNode:
+		return writeJSONNode(buf, node.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(node.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			err := writeJSONNode(buf, node.Content[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, child := range node.Content {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			err := writeJSONNode(buf, child)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+
+	switch node.Tag {
+	case "!!int", "!!float":
+		// The numbers are kept as they are written.
+		if json.Valid([]byte(node.Value)) {
+			buf.WriteString(node.Value)
+			return nil
+		}
+	case "!!str":
+		raw, _ := json.Marshal(node.Value)
+		buf.Write(raw)
+		return nil
+	}
+	var value any
+	err := node.Decode(&value)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	buf.Write(raw)
+	return nil
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/logging"
+)
+
+// peerQueueSize is how many built tags are buffered for the announcements before new ones are dropped.
+const peerQueueSize = 1000
+
+// PeerBuildNotice is the build of a tag announced by an instance to its peers sharing the cache.
+type PeerBuildNotice struct {
+	Image  string `json:"image"`
+	Tag    string `json:"tag"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// peers announces the tags built by the instance to the other instances sharing the cache,
+// which read the manifests from the cache instead of waiting for the locks of the tags or serving the ones cached in their memory.
+type peers struct {
+	logger *slog.Logger
+
+	endpoints []*url.URL
+	token     string
+	client    *http.Client
+	queue     chan PeerBuildNotice
+}
+
+func newPeers(endpoints []string, token string, transport http.RoundTripper) (*peers, error) {
+	if len(endpoints) == 0 {
+		return nil, nil
+	}
+	p := &peers{
+		logger: slog.Default().With(logging.ComponentKey, "peers"),
+		token:  token,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+		},
+		queue: make(chan PeerBuildNotice, peerQueueSize),
+	}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("peer %q: %w", endpoint, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("peer %q: must be a http or https url", endpoint)
+		}
+		p.endpoints = append(p.endpoints, u)
+	}
+	go p.run(context.Background())
+	return p, nil
+}
+
+func (p *peers) announce(notice PeerBuildNotice) {
+	select {
+	case p.queue <- notice:
+	default:
+		p.logger.Warn("peer queue is full, tag dropped", "image", notice.Image, "tag", notice.Tag)
+	}
+}
+
+func (p *peers) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notice := <-p.queue:
+			for _, endpoint := range p.endpoints {
+				for _, u := range p.resolve(ctx, endpoint) {
+					err := p.send(ctx, u, notice)
+					if err != nil {
+						p.logger.Error("send build notice", "peer", u, "err", err)
+						continue
+					}
+					p.logger.Debug("build notice sent", "peer", u, "image", notice.Image, "tag", notice.Tag)
+				}
+			}
+		}
+	}
+}
+
+// resolve returns the URLs of every address of the host of the endpoint, e.g. of the pods of a headless Service,
+// or the endpoint itself if its host is an address or is not resolved.
+func (p *peers) resolve(ctx context.Context, endpoint *url.URL) []string {
+	host := endpoint.Hostname()
+	if net.ParseIP(host) != nil {
+		return []string{endpoint.String()}
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return []string{endpoint.String()}
+	}
+	urls := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		u := *endpoint
+		if port := endpoint.Port(); port != "" {
+			u.Host = net.JoinHostPort(addr, port)
+		} else if strings.Contains(addr, ":") {
+			u.Host = "[" + addr + "]"
+		} else {
+			u.Host = addr
+		}
+		urls = append(urls, u.String())
+	}
+	return urls
+}
+
+func (p *peers) send(ctx context.Context, endpoint string, notice PeerBuildNotice) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/peer/built", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("status code %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// announceBuild announces the tag built to the peers.
+func (h *Handler) announceBuild(image, tag string) {
+	if h.peers == nil {
+		return
+	}
+	notice := PeerBuildNotice{
+		Image: image,
+		Tag:   tag,
+	}
+	entry, err := h.image.readManifest(h.image.ManifestPath(image, tag))
+	if err == nil {
+		notice.Digest = entry.digest
+	}
+	h.peers.announce(notice)
+}
+
+// PeerHandler returns the handler of the peer API served under /peer/,
+// which receives the tags built by the other instances sharing the cache, it is protected by the admin token like the admin API.
+func (h *Handler) PeerHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /peer/built", h.peerBuilt)
+	return h.adminAuth(mux)
+}
+
+func (h *Handler) peerBuilt(w http.ResponseWriter, r *http.Request) {
+	var notice PeerBuildNotice
+	err := json.NewDecoder(r.Body).Decode(&notice)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if notice.Image == "" || notice.Tag == "" {
+		http.Error(w, "image and tag are required", http.StatusBadRequest)
+		return
+	}
+	h.peerNotices.Add(1)
+
+	// The manifest is read again from the cache, replacing the one cached in memory.
+	manifestPath := h.image.ManifestPath(notice.Image, notice.Tag)
+	h.image.memory.remove(manifestPath)
+	entry, err := h.image.readManifest(manifestPath)
+	if err != nil {
+		loggerFrom(r.Context()).Warn("read the manifest built by a peer", "image", notice.Image, "tag", notice.Tag, "err", err)
+	} else if notice.Digest != "" && entry.digest != notice.Digest {
+		loggerFrom(r.Context()).Warn("manifest built by a peer differs in the cache", "image", notice.Image, "tag", notice.Tag, "digest", entry.digest, "peerDigest", notice.Digest)
+	}
+	if h.buildLocks != nil {
+		h.buildLocks.wake(notice.Image + ":" + notice.Tag)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/logging"
+)
+
+const (
+	// ConditionPrewarmed is the condition type reporting whether all the images of the prewarm are built.
+	ConditionPrewarmed = "Prewarmed"
+
+	// prewarmQueueSize is how many prewarms are buffered for their builds.
+	prewarmQueueSize = 100
+
+	// prewarmScheduleInterval is how often the schedules of the prewarms are checked.
+	prewarmScheduleInterval = time.Minute
+)
+
+// prewarmRequest is a prewarm to build, scheduled builds its images even if they are in the cache.
+type prewarmRequest struct {
+	name      string
+	scheduled bool
+}
+
+// startPrewarms watches the ImagePrewarms and builds their images one prewarm at a time,
+// when they are created or changed for the images not in the cache, and on their schedules for all of them.
+func (h *Handler) startPrewarms(ctx context.Context) {
+	logger := slog.Default().With(logging.ComponentKey, "prewarm")
+	ctx = withLogger(ctx, logger)
+	queue := make(chan prewarmRequest, prewarmQueueSize)
+	enqueue := func(req prewarmRequest) {
+		select {
+		case queue <- req:
+		default:
+			logger.Warn("prewarm queue is full, prewarm dropped", "prewarm", req.name)
+		}
+	}
+
+	api := h.clientset.ApisV1alpha1().ImagePrewarms()
+	store, controller := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				return api.List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				return api.Watch(ctx, opts)
+			},
+		},
+		&v1alpha1.ImagePrewarm{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				enqueue(prewarmRequest{name: obj.(*v1alpha1.ImagePrewarm).Name})
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				prewarm := newObj.(*v1alpha1.ImagePrewarm)
+				// The updates of the status by the builds are not changes of the spec.
+				if prewarm.Generation != oldObj.(*v1alpha1.ImagePrewarm).Generation {
+					enqueue(prewarmRequest{name: prewarm.Name})
+				}
+			},
+		},
+	)
+	h.informers.add("imageprewarms", controller.HasSynced)
+	go controller.Run(ctx.Done())
+
+	ticker := time.NewTicker(prewarmScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-queue:
+			obj, ok, err := store.GetByKey(req.name)
+			if err != nil || !ok {
+				continue
+			}
+			h.runPrewarm(ctx, obj.(*v1alpha1.ImagePrewarm), req.scheduled)
+		case now := <-ticker.C:
+			for _, obj := range store.List() {
+				prewarm := obj.(*v1alpha1.ImagePrewarm)
+				if prewarmDue(prewarm, now) {
+					enqueue(prewarmRequest{name: prewarm.Name, scheduled: true})
+				}
+			}
+		}
+	}
+}
+
+// prewarmDue reports whether the schedule of the prewarm has come since it was last built by the schedule or created.
+func prewarmDue(prewarm *v1alpha1.ImagePrewarm, now time.Time) bool {
+	if prewarm.Spec.Schedule == "" {
+		return false
+	}
+	schedule, err := parseCron(prewarm.Spec.Schedule)
+	if err != nil {
+		return false
+	}
+	last := prewarm.CreationTimestamp.Time
+	if prewarm.Status.LastScheduleTime != nil {
+		last = prewarm.Status.LastScheduleTime.Time
+	}
+	next := schedule.next(last)
+	return !next.IsZero() && !next.After(now)
+}
+
+// runPrewarm builds the images of the prewarm and reports their digests on its status.
+func (h *Handler) runPrewarm(ctx context.Context, prewarm *v1alpha1.ImagePrewarm, scheduled bool) {
+	logger := loggerFrom(ctx)
+	status := h.buildPrewarm(ctx, prewarm, scheduled)
+	if scheduled {
+		now := metav1.Now()
+		status.LastScheduleTime = &now
+	}
+
+	api := h.clientset.ApisV1alpha1().ImagePrewarms()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := api.Get(ctx, prewarm.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		latest.Status.ObservedGeneration = status.ObservedGeneration
+		latest.Status.Images = status.Images
+		if status.LastScheduleTime != nil {
+			latest.Status.LastScheduleTime = status.LastScheduleTime
+		}
+		latest.Status.Conditions = setCondition(latest.Status.Conditions, status.Conditions[0])
+		_, err = api.UpdateStatus(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		logger.Error("update prewarm status", "prewarm", prewarm.Name, "err", err)
+	}
+}
+
+// buildPrewarm builds the images of the prewarm, only the ones not in the cache unless it is scheduled,
+// and returns the status with their digests and the Prewarmed condition.
+func (h *Handler) buildPrewarm(ctx context.Context, prewarm *v1alpha1.ImagePrewarm, scheduled bool) v1alpha1.ImagePrewarmStatus {
+	logger := loggerFrom(ctx)
+	status := v1alpha1.ImagePrewarmStatus{
+		ObservedGeneration: prewarm.Generation,
+	}
+	var failed []string
+	for _, ref := range prewarm.Spec.Images {
+		if !strings.Contains(path.Base(ref), ":") {
+			ref += ":latest"
+		}
+		i := strings.LastIndex(ref, ":")
+		image, tag := ref[:i], ref[i+1:]
+
+		result := v1alpha1.PrewarmedImage{Image: ref}
+		if scheduled || !fileExists(h.image.ManifestPath(image, tag)) {
+			logger.Info("prewarm build", "prewarm", prewarm.Name, "ref", ref, "scheduled", scheduled)
+			err := h.build(ctx, image, tag)
+			if err != nil {
+				result.Error = err.Error()
+			}
+		}
+		if result.Error == "" {
+			raw, err := os.ReadFile(h.image.ManifestPath(image, tag))
+			if err != nil {
+				if os.IsNotExist(err) {
+					result.Error = fmt.Sprintf("no rule matches %q", ref)
+				} else {
+					result.Error = err.Error()
+				}
+			} else if desc, err := manifestDescriptor(raw); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Digest = desc.Digest.String()
+			}
+		}
+		if result.Error != "" {
+			failed = append(failed, ref+": "+result.Error)
+		}
+		status.Images = append(status.Images, result)
+	}
+
+	cond := v1alpha1.Condition{
+		Type:               ConditionPrewarmed,
+		Status:             v1alpha1.ConditionTrue,
+		Reason:             "BuildSucceeded",
+		Message:            fmt.Sprintf("%d images built", len(status.Images)),
+		LastTransitionTime: metav1.NewTime(time.Now()),
+	}
+	if len(failed) != 0 {
+		cond.Status = v1alpha1.ConditionFalse
+		cond.Reason = "BuildFailed"
+		cond.Message = fmt.Sprintf("%d of %d images failed: %s", len(failed), len(status.Images), strings.Join(failed, "; "))
+		if len(cond.Message) > maxConditionMessage {
+			cond.Message = cond.Message[:maxConditionMessage]
+		}
+	}
+	if prewarm.Spec.Schedule != "" {
+		_, err := parseCron(prewarm.Spec.Schedule)
+		if err != nil {
+			cond.Status = v1alpha1.ConditionFalse
+			cond.Reason = "InvalidSchedule"
+			cond.Message = err.Error()
+		}
+	}
+	status.Conditions = []v1alpha1.Condition{cond}
+	return status
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+// Progress is the progress of copying a layer or a file during a build.
+type Progress struct {
+	Name    string  `json:"name"`
+	Current int64   `json:"current"`
+	Total   int64   `json:"total,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+	Done    bool    `json:"done,omitempty"`
+}
+
+type progressTracker struct {
+	name    string
+	total   int64
+	current atomic.Int64
+	done    atomic.Bool
+}
+
+func (p *progressTracker) Progress() Progress {
+	out := Progress{
+		Name:    p.name,
+		Current: p.current.Load(),
+		Total:   p.total,
+		Done:    p.done.Load(),
+	}
+	if out.Total > 0 {
+		out.Percent = float64(out.Current) * 100 / float64(out.Total)
+	}
+	return out
+}
+
+type recordKey struct{}
+
+func withBuildRecord(ctx context.Context, record *buildRecord) context.Context {
+	return context.WithValue(ctx, recordKey{}, record)
+}
+
+func buildRecordFrom(ctx context.Context) *buildRecord {
+	record, _ := ctx.Value(recordKey{}).(*buildRecord)
+	return record
+}
+
+type startedKey struct{}
+
+// withBuildStarted returns the ctx whose build sends its record to the started once it is recorded.
+func withBuildStarted(ctx context.Context, started chan<- *buildRecord) context.Context {
+	return context.WithValue(ctx, startedKey{}, started)
+}
+
+func notifyBuildStarted(ctx context.Context, record *buildRecord) {
+	if started, ok := ctx.Value(startedKey{}).(chan<- *buildRecord); ok {
+		started <- record
+	}
+}
+
+// trackProgress wraps the reader to report the progress of reading it to the build carried by the ctx,
+// the total is the expected size or -1 if unknown.
+func trackProgress(ctx context.Context, name string, total int64, r io.Reader) io.Reader {
+	record := buildRecordFrom(ctx)
+	if record == nil {
+		return r
+	}
+	p := &progressTracker{
+		name:  name,
+		total: total,
+	}
+	record.addProgress(p)
+	return &progressReader{
+		reader:  r,
+		tracker: p,
+	}
+}
+
+type progressReader struct {
+	reader  io.Reader
+	tracker *progressTracker
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.tracker.current.Add(int64(n))
+	if err == io.EOF {
+		p.tracker.done.Store(true)
+	}
+	return n, err
+}
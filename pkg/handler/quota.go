@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/wzshiming/jitdi/pkg/metadata"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// errQuotaExceeded is the error of the builds of the rules whose other tags use their quotas.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// ruleTags returns the tags of the metadata index built by the rule, without the tag of the ref.
+func (h *Handler) ruleTags(name, skip string) ([]metadata.Tag, error) {
+	all, err := h.image.index.List()
+	if err != nil {
+		return nil, err
+	}
+	var tags []metadata.Tag
+	for _, tag := range all {
+		if tag.Rule == name && tag.Image+":"+tag.Tag != skip {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// checkQuota fails with errQuotaExceeded if the other tags of the rule already use its quota,
+// the tag of the ref is not counted so that the tags within the quota can be built again.
+func (h *Handler) checkQuota(rule *pattern.Rule, ref string) error {
+	quota := rule.Quota()
+	if quota <= 0 {
+		return nil
+	}
+	tags, err := h.ruleTags(rule.Name(), ref)
+	if err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+	size := h.tagsSize(tags)
+	if size < quota {
+		return nil
+	}
+	return fmt.Errorf("%w: the %d other tags of rule %s use %d bytes of its quota of %d bytes, delete some of them or raise the quota",
+		errQuotaExceeded, len(tags), rule.Name(), size, quota)
+}
@@ -0,0 +1,287 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// upstreamCheckTTL is how long the reachability of the upstream registries is cached for the verbose readiness.
+	upstreamCheckTTL = 30 * time.Second
+
+	// upstreamCheckTimeout is how long an upstream registry is waited for.
+	upstreamCheckTimeout = 5 * time.Second
+)
+
+// Ready is the readiness of the instance with the details of its checks, the upstream registries are only reported.
+type Ready struct {
+	Ready     bool            `json:"ready"`
+	Checks    []ReadyCheck    `json:"checks"`
+	Builds    BuildQueue      `json:"builds"`
+	Disk      *DiskSpace      `json:"disk,omitempty"`
+	Upstreams []UpstreamCheck `json:"upstreams,omitempty"`
+	Circuits  []CircuitState  `json:"circuits,omitempty"`
+}
+
+// ReadyCheck is a check that the instance must pass to be ready.
+type ReadyCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// BuildQueue is the state of the builds of the instance.
+type BuildQueue struct {
+	// Running is the number of the builds running.
+	Running int `json:"running"`
+	// Concurrency is the maximum number of the mutation sources fetched concurrently per build.
+	Concurrency int `json:"concurrency"`
+	// WorkerSlots and WorkerSlotsUsed are the builds requested by the frontends that can run at the same time and the ones running,
+	// WorkerWaiting are the ones waiting in line, only on the workers limiting them.
+	WorkerSlots     int   `json:"workerSlots,omitempty"`
+	WorkerSlotsUsed int   `json:"workerSlotsUsed,omitempty"`
+	WorkerWaiting   int64 `json:"workerWaiting,omitempty"`
+}
+
+// DiskSpace is the space of the file system of the cache.
+type DiskSpace struct {
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"freeBytes"`
+	TotalBytes uint64 `json:"totalBytes"`
+}
+
+// UpstreamCheck is the reachability of an upstream registry of the base images of the rules.
+type UpstreamCheck struct {
+	Registry  string    `json:"registry"`
+	Reachable bool      `json:"reachable"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Latency   string    `json:"latency,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// informers are the informers that must be synced before the instance is ready.
+type informers struct {
+	mut    sync.Mutex
+	synced map[string]cache.InformerSynced
+}
+
+func (i *informers) add(name string, synced cache.InformerSynced) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	if i.synced == nil {
+		i.synced = map[string]cache.InformerSynced{}
+	}
+	i.synced[name] = synced
+}
+
+func (i *informers) checks() []ReadyCheck {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	checks := make([]ReadyCheck, 0, len(i.synced))
+	for name, synced := range i.synced {
+		check := ReadyCheck{Name: "informer/" + name, OK: synced()}
+		if !check.OK {
+			check.Message = "not synced"
+		}
+		checks = append(checks, check)
+	}
+	sort.Slice(checks, func(a, b int) bool {
+		return checks[a].Name < checks[b].Name
+	})
+	return checks
+}
+
+// upstreamChecks caches the reachability of the upstream registries.
+type upstreamChecks struct {
+	mut    sync.Mutex
+	checks map[string]UpstreamCheck
+}
+
+// ReadyHandler returns the handler of /readyz, which fails until the informers are synced and the tags are warmed or when the cache is out of space,
+// ?verbose returns the details as JSON, which require the admin token like the admin API.
+func (h *Handler) ReadyHandler() http.Handler {
+	return http.HandlerFunc(h.serveReady)
+}
+
+func (h *Handler) serveReady(w http.ResponseWriter, r *http.Request) {
+	_, verbose := r.URL.Query()["verbose"]
+	if verbose && !h.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jitdi-admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ready := h.ready(r.Context(), verbose)
+	status := http.StatusOK
+	if !ready.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	if verbose {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		serveJSON(w, ready)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	for _, check := range ready.Checks {
+		if !check.OK {
+			fmt.Fprintf(w, "[-]%s failed: %s\n", check.Name, check.Message)
+		}
+	}
+	if ready.Ready {
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// ready runs the checks, and reports the upstream registries of the rules too if verbose.
+func (h *Handler) ready(ctx context.Context, verbose bool) Ready {
+	ready := Ready{
+		Ready:  true,
+		Checks: h.informers.checks(),
+		Builds: h.buildQueue(),
+	}
+
+	disk, err := diskSpace(h.image.cache)
+	if err == nil {
+		ready.Disk = disk
+		if h.readyMinFreeBytes > 0 {
+			check := ReadyCheck{Name: "disk", OK: disk.FreeBytes >= uint64(h.readyMinFreeBytes)}
+			if !check.OK {
+				check.Message = fmt.Sprintf("%d bytes free of %d, less than %d", disk.FreeBytes, disk.TotalBytes, h.readyMinFreeBytes)
+			}
+			ready.Checks = append(ready.Checks, check)
+		}
+	} else if h.readyMinFreeBytes > 0 {
+		ready.Checks = append(ready.Checks, ReadyCheck{Name: "disk", OK: false, Message: err.Error()})
+	}
+
+	if h.warmer != nil {
+		ready.Checks = append(ready.Checks, h.warmer.state.check())
+	}
+
+	for _, check := range ready.Checks {
+		if !check.OK {
+			ready.Ready = false
+		}
+	}
+	if verbose {
+		ready.Upstreams = h.checkUpstreams(ctx)
+		if h.breaker != nil {
+			ready.Circuits = h.breaker.states(time.Now())
+		}
+	}
+	return ready
+}
+
+func (h *Handler) buildQueue() BuildQueue {
+	queue := BuildQueue{
+		Concurrency:   h.image.concurrency,
+		WorkerWaiting: h.workerWaiting.Load(),
+	}
+	for _, build := range h.builds.List() {
+		if build.Status == BuildRunning {
+			queue.Running++
+		}
+	}
+	if h.workerSlots != nil {
+		queue.WorkerSlots = cap(h.workerSlots)
+		queue.WorkerSlotsUsed = len(h.workerSlots)
+	}
+	return queue
+}
+
+// upstreamRegistries returns the registries of the base images of the rules, except the ones templated by the parameters,
+// and whether they are reached over plain HTTP.
+func (h *Handler) upstreamRegistries() map[string]bool {
+	registries := map[string]bool{}
+	for _, rule := range h.getRules() {
+		spec := rule.Spec()
+		if spec.BaseImage == "" || strings.Contains(strings.SplitN(spec.BaseImage, "/", 2)[0], "{") {
+			continue
+		}
+		ref, err := name.ParseReference(strings.NewReplacer("{", "", "}", "").Replace(spec.BaseImage))
+		if err != nil {
+			continue
+		}
+		registry := ref.Context().Registry
+		registries[registry.RegistryStr()] = registries[registry.RegistryStr()] || h.image.isInsecure(registry, spec.Insecure)
+	}
+	return registries
+}
+
+// checkUpstreams reports whether the upstream registries answer to /v2/, any answer but the server errors is reachable.
+func (h *Handler) checkUpstreams(ctx context.Context) []UpstreamCheck {
+	registries := h.upstreamRegistries()
+
+	h.upstreamChecks.mut.Lock()
+	defer h.upstreamChecks.mut.Unlock()
+	if h.upstreamChecks.checks == nil {
+		h.upstreamChecks.checks = map[string]UpstreamCheck{}
+	}
+
+	var wg sync.WaitGroup
+	var mut sync.Mutex
+	for registry, insecure := range registries {
+		if check, ok := h.upstreamChecks.checks[registry]; ok && time.Since(check.Time) < upstreamCheckTTL {
+			continue
+		}
+		wg.Add(1)
+		go func(registry string, insecure bool) {
+			defer wg.Done()
+			check := h.checkUpstream(ctx, registry, insecure)
+			mut.Lock()
+			h.upstreamChecks.checks[registry] = check
+			mut.Unlock()
+		}(registry, insecure)
+	}
+	wg.Wait()
+
+	checks := make([]UpstreamCheck, 0, len(registries))
+	for registry := range registries {
+		checks = append(checks, h.upstreamChecks.checks[registry])
+	}
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].Registry < checks[j].Registry
+	})
+	return checks
+}
+
+func (h *Handler) checkUpstream(ctx context.Context, registry string, insecure bool) UpstreamCheck {
+	check := UpstreamCheck{
+		Registry: registry,
+		Time:     time.Now(),
+	}
+	scheme, rt := "https", h.image.transport
+	if insecure {
+		scheme, rt = "http", h.image.insecureTransport
+	}
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+registry+"/v2/", nil)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	client := &http.Client{Transport: rt}
+	resp, err := client.Do(req)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	resp.Body.Close()
+	check.Status = resp.StatusCode
+	check.Reachable = resp.StatusCode < http.StatusInternalServerError
+	check.Latency = time.Since(check.Time).Round(time.Millisecond).String()
+	return check
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+type ruleRemoteKey struct{}
+
+// withRuleRemote returns the context of the build of a rule with the options of go-containerregistry of the rule.
+func withRuleRemote(ctx context.Context, r v1alpha1.Remote) context.Context {
+	return context.WithValue(ctx, ruleRemoteKey{}, r)
+}
+
+// ruleRemoteFrom returns the options of go-containerregistry of the rule of the build, the zero ones outside of the builds.
+func ruleRemoteFrom(ctx context.Context) v1alpha1.Remote {
+	r, _ := ctx.Value(ruleRemoteKey{}).(v1alpha1.Remote)
+	return r
+}
+
+// mergeRemote returns the options of go-containerregistry of the rule, its zero ones are the global ones.
+func mergeRemote(global, rule v1alpha1.Remote) v1alpha1.Remote {
+	if rule.UserAgent != "" {
+		global.UserAgent = rule.UserAgent
+	}
+	if rule.Jobs != 0 {
+		global.Jobs = rule.Jobs
+	}
+	if rule.Platform != "" {
+		global.Platform = rule.Platform
+	}
+	if rule.RetryAttempts != 0 {
+		global.RetryAttempts = rule.RetryAttempts
+	}
+	if rule.HTTPProxy != "" || rule.HTTPSProxy != "" || rule.NoProxy != "" {
+		global.HTTPProxy = rule.HTTPProxy
+		global.HTTPSProxy = rule.HTTPSProxy
+		global.NoProxy = rule.NoProxy
+	}
+	if rule.CAData != "" {
+		global.CAData = rule.CAData
+	}
+	if len(rule.Headers) != 0 {
+		headers := make(map[string]string, len(global.Headers)+len(rule.Headers))
+		for name, value := range global.Headers {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+		for name, value := range rule.Headers {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+		global.Headers = headers
+	}
+	return global
+}
+
+// remoteTuning returns the options of go-containerregistry of the options set, the platform is checked with the rules.
+func remoteTuning(r v1alpha1.Remote) []remote.Option {
+	var opts []remote.Option
+	if r.UserAgent != "" {
+		opts = append(opts, remote.WithUserAgent(r.UserAgent))
+	}
+	if r.Jobs > 0 {
+		opts = append(opts, remote.WithJobs(r.Jobs))
+	}
+	if r.Platform != "" {
+		if p, err := v1.ParsePlatform(r.Platform); err == nil {
+			opts = append(opts, remote.WithPlatform(*p))
+		}
+	}
+	if r.RetryAttempts > 0 {
+		// The backoff of go-containerregistry by default, with the attempts.
+		opts = append(opts, remote.WithRetryBackoff(remote.Backoff{
+			Duration: time.Second,
+			Factor:   3,
+			Jitter:   0.1,
+			Steps:    r.RetryAttempts,
+		}))
+	}
+	return opts
+}
+
+// headerTransport sets the user agent and the headers of the options of the build of the requests on the requests to the upstreams,
+// go-containerregistry has already set its user agent on the ones to the registries.
+type headerTransport struct {
+	global v1alpha1.Remote
+	base   http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := mergeRemote(t.global, ruleRemoteFrom(req.Context()))
+	if r.UserAgent == "" && len(r.Headers) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if r.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", r.UserAgent)
+	}
+	for name, value := range r.Headers {
+		req.Header.Set(name, value)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// ruleTransport sends the requests of the builds of the rules setting proxies or CA certificates
+// with a transport of their own, derived from the base one.
+type ruleTransport struct {
+	base http.RoundTripper
+
+	mut        sync.Mutex
+	transports map[ruleTransportKey]*http.Transport
+}
+
+type ruleTransportKey struct {
+	httpProxy  string
+	httpsProxy string
+	noProxy    string
+	caData     string
+}
+
+func newRuleTransport(base http.RoundTripper) *ruleTransport {
+	return &ruleTransport{
+		base:       base,
+		transports: map[ruleTransportKey]*http.Transport{},
+	}
+}
+
+func (t *ruleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := ruleRemoteFrom(req.Context())
+	key := ruleTransportKey{
+		httpProxy:  r.HTTPProxy,
+		httpsProxy: r.HTTPSProxy,
+		noProxy:    r.NoProxy,
+		caData:     r.CAData,
+	}
+	if key == (ruleTransportKey{}) {
+		return t.base.RoundTrip(req)
+	}
+	tr, err := t.transport(key)
+	if err != nil {
+		return nil, err
+	}
+	return tr.RoundTrip(req)
+}
+
+// transport returns the transport of the options, it is shared by the builds of the rules with the same ones.
+func (t *ruleTransport) transport(key ruleTransportKey) (*http.Transport, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if tr, ok := t.transports[key]; ok {
+		return tr, nil
+	}
+
+	base, ok := t.base.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("the proxies and the CA certificates of the rules need an *http.Transport, got %T", t.base)
+	}
+	tr := base.Clone()
+	if key.httpProxy != "" || key.httpsProxy != "" || key.noProxy != "" {
+		proxy := (&httpproxy.Config{
+			HTTPProxy:  key.httpProxy,
+			HTTPSProxy: key.httpsProxy,
+			NoProxy:    key.noProxy,
+		}).ProxyFunc()
+		tr.Proxy = func(r *http.Request) (*url.URL, error) {
+			return proxy(r.URL)
+		}
+	}
+	if key.caData != "" {
+		var pool *x509.CertPool
+		if tr.TLSClientConfig != nil && tr.TLSClientConfig.RootCAs != nil {
+			pool = tr.TLSClientConfig.RootCAs.Clone()
+		} else if system, err := x509.SystemCertPool(); err == nil {
+			pool = system
+		} else {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(key.caData)) {
+			return nil, fmt.Errorf("caData: no certificates found")
+		}
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}
+	t.transports[key] = tr
+	return tr, nil
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/wzshiming/jitdi/pkg/atomic"
+)
+
+// remoteFileMeta is the validators of a downloaded file, stored next to it.
+type remoteFileMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// fetchRemoteFile downloads the url to the dst, the cached copy is revalidated
+// with If-None-Match and If-Modified-Since, so unchanged files are not downloaded again.
+// The downloaded file is deduplicated with the staged content.
+func fetchRemoteFile(ctx context.Context, client *http.Client, staged *stagedContent, u string, dst string) (os.FileInfo, error) {
+	metaPath := dst + ".meta"
+
+	stat, _ := os.Stat(dst)
+	var meta remoteFileMeta
+	if stat != nil {
+		data, err := os.ReadFile(metaPath)
+		if err == nil {
+			_ = json.Unmarshal(data, &meta)
+		}
+		if meta.URL != u {
+			meta = remoteFileMeta{}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if stat != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if stat != nil {
+			loggerFrom(ctx).Warn("revalidate remote file failed, using the cached copy", "url", u, "err", err)
+			return stat, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if stat != nil {
+			loggerFrom(ctx).Info("remote file not modified", "url", u)
+			return stat, nil
+		}
+		return nil, fmt.Errorf("http.Get(%q): %w", u, fmt.Errorf("unexpected status code %d", resp.StatusCode))
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("http.Get(%q): %w", u, fmt.Errorf("status code %d", resp.StatusCode))
+	}
+
+	hash := sha256.New()
+	err = atomic.WriteFileWithReader(dst, io.TeeReader(trackProgress(ctx, u, resp.ContentLength, resp.Body), hash), 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = staged.store("sha256:"+hex.EncodeToString(hash.Sum(nil)), dst)
+	if err != nil {
+		return nil, fmt.Errorf("store staged content: %w", err)
+	}
+
+	meta = remoteFileMeta{
+		URL:          u,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	err = atomic.WriteFile(metaPath, data, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Stat(dst)
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync/atomic"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+func TestRuleProxy(t *testing.T) {
+	host := newSlowRegistry(t, 0, true)
+	var proxied atomic.Int64
+	proxy := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			proxied.Add(1)
+			r.URL.Host = host
+		},
+	})
+	t.Cleanup(proxy.Close)
+
+	tests := []struct {
+		name        string
+		remote      *v1alpha1.Remote
+		wantErr     bool
+		wantProxied bool
+	}{
+		{
+			name:    "without the proxy of the rule",
+			wantErr: true,
+		},
+		{
+			name:        "proxy of the rule",
+			remote:      &v1alpha1.Remote{HTTPProxy: proxy.URL},
+			wantProxied: true,
+		},
+		{
+			name:    "bypassed by the rule",
+			remote:  &v1alpha1.Remote{HTTPProxy: proxy.URL, NoProxy: "registry.test"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxied.Store(0)
+			// The host of the base image only resolves through the proxy.
+			rules := []*v1alpha1.Image{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "a"},
+					Spec: v1alpha1.ImageSpec{
+						Match:     "a:{tag}",
+						BaseImage: "registry.test/base:latest",
+						Remote:    tt.remote,
+					},
+				},
+			}
+			h, err := NewHandler(t.TempDir(), rules, nil, WithInsecureRegistries("registry.test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = h.Close() })
+
+			err = h.build(context.Background(), "a", "v1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("build error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := proxied.Load() != 0; got != tt.wantProxied {
+				t.Errorf("proxied = %v, want %v", got, tt.wantProxied)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+// maxRenderSourceSize is the size of the source of a Go template read at most.
+const maxRenderSourceSize = 1 << 20
+
+// buildRender returns the layers of the file of the Go template rendered with the parameters and the values,
+// and the description of what it adds, the layers are annotated if the template reads Secrets.
+func (b *imageBuilder) buildRender(ctx context.Context, render *v1alpha1.Render, params map[string]string, layerMediaType types.MediaType, creationTime time.Time, windows bool) ([]mutate.Addendum, string, error) {
+	var mode int64 = 0644
+	if render.Mode != "" {
+		m, err := strconv.ParseUint(render.Mode, 0, 0)
+		if err == nil {
+			mode = int64(m)
+		}
+	}
+
+	builder := NewFileLayerBuilder(b.client, b.cacheTmp, mode, creationTime, layerMediaType, 0, windows)
+	text := render.Template
+	source := "a template"
+	if render.Source != "" {
+		var err error
+		raw, err := b.readSource(ctx, builder, render.Source, maxRenderSourceSize)
+		if err != nil {
+			return nil, "", fmt.Errorf("render %s: %w", render.Destination, err)
+		}
+		text = string(raw)
+		source = render.Source
+	}
+
+	content, secret, err := b.renderGoTemplate(ctx, render.Destination, text, params, render.Values)
+	if err != nil {
+		return nil, "", fmt.Errorf("render %s: %w", render.Destination, err)
+	}
+
+	addendums, err := builder.BuildFile(ctx, bytes.NewReader(content), render.Destination, int64(len(content)))
+	if err != nil {
+		return nil, "", fmt.Errorf("file layer builder: %w", err)
+	}
+	if !secret {
+		return addendums, fmt.Sprintf("render %s from %s", render.Destination, source), nil
+	}
+	for i := range addendums {
+		addendums[i].Annotations = map[string]string{v1alpha1.AnnotationSecret: "true"}
+	}
+	return addendums, fmt.Sprintf("render %s from %s with secrets", render.Destination, source), nil
+}
+
+// readSource reads the small file of the URL, the path or the digest of the uploaded blob of the source.
+func (b *imageBuilder) readSource(ctx context.Context, builder *FileLayerBuilder, source string, maxSize int64) ([]byte, error) {
+	u, err := remoteSource(source)
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		source, _, err = builder.fetchRemote(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+	} else if digestRegexp.MatchString(source) {
+		// The blobs pushed by the upload API are referenced by digest.
+		source = b.UploadedBlobPath(source)
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	raw, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > maxSize {
+		return nil, fmt.Errorf("the file is larger than %d bytes", maxSize)
+	}
+	return raw, nil
+}
+
+// renderGoTemplate executes the Go template with the parameters and the values, which override the parameters,
+// the template can read the keys of the Secrets with {{ secret "<name>" "<key>" }}, which are redacted from the logs of the build.
+func (b *imageBuilder) renderGoTemplate(ctx context.Context, name, text string, params, values map[string]string) ([]byte, bool, error) {
+	data := make(map[string]string, len(params)+len(values))
+	for k, v := range params {
+		data[k] = v
+	}
+	for k, v := range values {
+		data[k] = v
+	}
+
+	var secret bool
+	record := buildRecordFrom(ctx)
+	funcs := template.FuncMap{
+		"secret": func(name, key string) (string, error) {
+			value, err := b.readSecret(name, key)
+			if err != nil {
+				return "", err
+			}
+			secret = true
+			if record != nil {
+				record.redactor.add(value)
+			}
+			return value, nil
+		},
+		"default": func(def, value string) string {
+			if value == "" {
+				return def
+			}
+			return value
+		},
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"quote":      strconv.Quote,
+	}
+
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, false, err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), secret, nil
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/metadata"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// applyRetention deletes the tags of the rules with a retention that are over their max tags or older than their max age,
+// the least recently used first, and drops the previous builds of their other tags over their max revisions.
+// The blobs of the tags deleted are left to the garbage collection, the tags are built again when they are pulled.
+func (h *Handler) applyRetention(ctx context.Context, now time.Time) (int, error) {
+	rules := map[string]*pattern.Rule{}
+	for _, rule := range h.getRules() {
+		maxTags, maxAge, maxRevisions := rule.Retention()
+		if maxTags > 0 || maxAge > 0 || maxRevisions >= 0 {
+			rules[rule.Name()] = rule
+		}
+	}
+	if len(rules) == 0 {
+		return 0, nil
+	}
+
+	all, err := h.image.index.List()
+	if err != nil {
+		return 0, fmt.Errorf("retention: %w", err)
+	}
+	byRule := map[string][]metadata.Tag{}
+	for _, tag := range all {
+		if _, ok := rules[tag.Rule]; ok {
+			byRule[tag.Rule] = append(byRule[tag.Rule], tag)
+		}
+	}
+
+	logger := loggerFrom(ctx)
+	var expired int
+	for name, tags := range byRule {
+		maxTags, maxAge, maxRevisions := rules[name].Retention()
+		// The tags used the most recently first.
+		slices.SortStableFunc(tags, func(a, b metadata.Tag) int {
+			return lastUse(b).Compare(lastUse(a))
+		})
+		for i, tag := range tags {
+			overTags := maxTags > 0 && i >= maxTags
+			overAge := maxAge > 0 && now.Sub(lastUse(tag)) > maxAge
+			if overTags || overAge {
+				_, err := h.image.DeleteManifest(tag.Image, tag.Tag)
+				if err != nil {
+					logger.Error("delete tag out of the retention", "rule", name, "image", tag.Image, "tag", tag.Tag, "err", err)
+					continue
+				}
+				expired++
+				logger.Info("tag deleted out of the retention of the rule", "rule", name, "image", tag.Image, "tag", tag.Tag,
+					"lastUse", lastUse(tag), "overTags", overTags, "overAge", overAge)
+				continue
+			}
+			if maxRevisions >= 0 && len(tag.History) > maxRevisions {
+				tag.History = tag.History[:maxRevisions]
+				if len(tag.History) == 0 {
+					tag.History = nil
+				}
+				err := h.image.index.Put(tag)
+				if err != nil {
+					return expired, fmt.Errorf("retention: %w", err)
+				}
+			}
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// maxRetryBackoff is the longest wait between two attempts, including the ones asked by Retry-After.
+const maxRetryBackoff = 30 * time.Second
+
+// RetryPolicy is the policy of the retries of the requests to the upstreams that failed transiently.
+type RetryPolicy struct {
+	// Attempts is the number of the attempts of a request, one or less disables the retries.
+	Attempts int
+	// Backoff is the wait before the first retry, doubled before every next one.
+	Backoff time.Duration
+	// StatusCodes are the status codes of the responses retried.
+	StatusCodes []int
+}
+
+// DefaultRetryStatusCodes are the status codes retried by default.
+var DefaultRetryStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+func (p RetryPolicy) enabled() bool {
+	return p.Attempts > 1
+}
+
+func (p RetryPolicy) check() error {
+	if p.enabled() && p.Backoff < 0 {
+		return fmt.Errorf("retry backoff %s must not be negative", p.Backoff)
+	}
+	for _, code := range p.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("retry status code %d is invalid", code)
+		}
+	}
+	return nil
+}
+
+// wrap returns the transport retrying the requests with the policy.
+func (p RetryPolicy) wrap(rt http.RoundTripper) http.RoundTripper {
+	if !p.enabled() {
+		return rt
+	}
+	return &retryTransport{policy: p, base: rt}
+}
+
+type retryTransport struct {
+	policy RetryPolicy
+	base   http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only the requests without side effects are replayed.
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.base.RoundTrip(req)
+	}
+
+	backoff := t.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.policy.Attempts {
+			return resp, err
+		}
+
+		wait := backoff
+		switch {
+		case err != nil:
+			if !isTransient(err) {
+				return nil, err
+			}
+		case slices.Contains(t.policy.StatusCodes, resp.StatusCode):
+			if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = after
+			}
+			err = fmt.Errorf("status code %d", resp.StatusCode)
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+		wait = min(wait, maxRetryBackoff)
+
+		loggerFrom(req.Context()).Warn("retrying upstream request", "url", req.URL.String(), "attempt", attempt, "wait", wait, "err", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// parseRetryAfter parses the Retry-After header in seconds or as a date.
+func parseRetryAfter(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(s); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// isTransient reports whether the error of a request may not happen again,
+// the connections reset, refused or timing out, but not the errors of TLS or the open circuits.
+func isTransient(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EPIPE):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/metadata"
+)
+
+// mutationLayers are the layers of the mutations of the previous build of a tag, which the build reuses
+// for the mutations whose fingerprints are unchanged, and the layers of the mutations of the build recorded for the next one.
+type mutationLayers struct {
+	previous map[string]metadata.Mutation
+	// pinned is set if the time of the build is pinned, the time is an input of the mutations then.
+	pinned bool
+
+	mut      sync.Mutex
+	recorded []metadata.Mutation
+	seen     map[string]struct{}
+}
+
+type mutationLayersKey struct{}
+
+// withMutationLayers returns the context of the build reusing the layers of the mutations of the previous build.
+func withMutationLayers(ctx context.Context, previous []metadata.Mutation, pinned bool) context.Context {
+	l := &mutationLayers{
+		previous: make(map[string]metadata.Mutation, len(previous)),
+		pinned:   pinned,
+		seen:     map[string]struct{}{},
+	}
+	for _, m := range previous {
+		l.previous[m.Fingerprint] = m
+	}
+	return context.WithValue(ctx, mutationLayersKey{}, l)
+}
+
+// mutationLayersFrom returns the layers of the mutations of the build, nil if the layers are not reused.
+func mutationLayersFrom(ctx context.Context) *mutationLayers {
+	l, _ := ctx.Value(mutationLayersKey{}).(*mutationLayers)
+	return l
+}
+
+// mutations returns the layers of the mutations recorded by the build.
+func (l *mutationLayers) mutations() []metadata.Mutation {
+	if l == nil {
+		return nil
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.recorded
+}
+
+// fingerprint returns the fingerprint of the inputs of the mutate, false if they cannot be fingerprinted.
+func (l *mutationLayers) fingerprint(base v1.Image, m v1alpha1.Mutate, params map[string]string, layerMediaType types.MediaType, creationTime time.Time, windows bool) (string, bool, error) {
+	if !l.pinned {
+		creationTime = time.Time{}
+	}
+	return mutationFingerprint(base, m, params, layerMediaType, creationTime, windows)
+}
+
+// reuse returns the layers of the mutation of the fingerprint built previously and the description of what it adds,
+// false if the previous build has no such mutation or one of its blobs is missing from the cache.
+func (l *mutationLayers) reuse(b *imageBuilder, fingerprint string) ([]mutate.Addendum, string, bool) {
+	m, ok := l.previous[fingerprint]
+	if !ok {
+		return nil, "", false
+	}
+	addendums := make([]mutate.Addendum, 0, len(m.Layers))
+	for _, layer := range m.Layers {
+		digest, err := v1.NewHash(layer.Digest)
+		if err != nil {
+			return nil, "", false
+		}
+		diffID, err := v1.NewHash(layer.DiffID)
+		if err != nil {
+			return nil, "", false
+		}
+		blobPath := b.BlobsPath(layer.Digest)
+		if _, err := os.Stat(blobPath); err != nil {
+			return nil, "", false
+		}
+		cl, err := partial.CompressedToLayer(&cachedLayer{
+			path:      blobPath,
+			digest:    digest,
+			diffID:    diffID,
+			size:      layer.Size,
+			mediaType: types.MediaType(layer.MediaType),
+		})
+		if err != nil {
+			return nil, "", false
+		}
+		addendums = append(addendums, mutate.Addendum{
+			Layer:       cl,
+			Annotations: layer.Annotations,
+			MediaType:   types.MediaType(layer.MediaType),
+			History: v1.History{
+				Created:   v1.Time{Time: layer.Created},
+				Author:    "jitdi",
+				CreatedBy: layer.CreatedBy,
+				Comment:   layer.Comment,
+			},
+		})
+	}
+	return addendums, m.Description, true
+}
+
+// record records the layers of the mutation of the fingerprint for the next build,
+// the same mutation of several platforms is recorded once.
+func (l *mutationLayers) record(fingerprint, description string, addendums []mutate.Addendum) error {
+	m := metadata.Mutation{
+		Fingerprint: fingerprint,
+		Description: description,
+		Layers:      make([]metadata.Layer, 0, len(addendums)),
+	}
+	for _, add := range addendums {
+		digest, err := add.Layer.Digest()
+		if err != nil {
+			return err
+		}
+		diffID, err := add.Layer.DiffID()
+		if err != nil {
+			return err
+		}
+		size, err := add.Layer.Size()
+		if err != nil {
+			return err
+		}
+		mediaType := add.MediaType
+		if mediaType == "" {
+			mediaType, err = add.Layer.MediaType()
+			if err != nil {
+				return err
+			}
+		}
+		m.Layers = append(m.Layers, metadata.Layer{
+			Digest:      digest.String(),
+			DiffID:      diffID.String(),
+			Size:        size,
+			MediaType:   string(mediaType),
+			Annotations: add.Annotations,
+			Created:     add.History.Created.Time,
+			CreatedBy:   add.History.CreatedBy,
+			Comment:     add.History.Comment,
+		})
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if _, ok := l.seen[fingerprint]; ok {
+		return nil
+	}
+	l.seen[fingerprint] = struct{}{}
+	l.recorded = append(l.recorded, m)
+	return nil
+}
+
+// cachedLayer is a layer of the blobs of the cache whose digests are known, it is not hashed again.
+type cachedLayer struct {
+	path      string
+	digest    v1.Hash
+	diffID    v1.Hash
+	size      int64
+	mediaType types.MediaType
+}
+
+func (c *cachedLayer) Digest() (v1.Hash, error) {
+	return c.digest, nil
+}
+
+func (c *cachedLayer) DiffID() (v1.Hash, error) {
+	return c.diffID, nil
+}
+
+func (c *cachedLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(c.path)
+}
+
+func (c *cachedLayer) Size() (int64, error) {
+	return c.size, nil
+}
+
+func (c *cachedLayer) MediaType() (types.MediaType, error) {
+	return c.mediaType, nil
+}
+
+// fingerprintInputs are the inputs of a mutation that its layers depend on.
+type fingerprintInputs struct {
+	Mutate         v1alpha1.Mutate   `json:"mutate"`
+	Params         map[string]string `json:"params"`
+	LayerMediaType types.MediaType   `json:"layerMediaType"`
+	Windows        bool              `json:"windows"`
+	// Created is the time of the build if it is pinned, the layers of the builds at other times are reused otherwise.
+	Created *time.Time `json:"created,omitempty"`
+	// Base is the digest of the base image for the mutations reading its files.
+	Base string `json:"base,omitempty"`
+	// Sources are the names, the sizes, the modes and the modification times of the files of the local sources.
+	Sources map[string]string `json:"sources,omitempty"`
+}
+
+// mutationFingerprint returns the fingerprint of the inputs of the mutate, false if they cannot be fingerprinted
+// as they may change while the mutate does not, e.g. the remote sources, the Secrets and the models.
+// The creation time is zero unless the time of the build is pinned.
+func mutationFingerprint(base v1.Image, m v1alpha1.Mutate, params map[string]string, layerMediaType types.MediaType, creationTime time.Time, windows bool) (string, bool, error) {
+	inputs := fingerprintInputs{
+		Mutate:         m,
+		Params:         params,
+		LayerMediaType: layerMediaType,
+		Windows:        windows,
+		Sources:        map[string]string{},
+	}
+	if !creationTime.IsZero() {
+		inputs.Created = &creationTime
+	}
+
+	var sources []string
+	readsBase := m.Patch != nil || m.User != nil || m.TrustedCA != nil || m.Locale != nil
+	switch {
+	case m.Ollama != nil, m.HuggingFace != nil:
+		return "", false, nil
+	case m.File != nil:
+		if secretPattern.MatchString(m.File.Template) {
+			return "", false, nil
+		}
+		if m.File.Source != "" {
+			sources = append(sources, m.File.Source)
+		}
+		readsBase = m.File.Replaces != ""
+	case m.Render != nil:
+		// The templates may read Secrets, the ones of the sources are not read to tell.
+		if m.Render.Source != "" || strings.Contains(m.Render.Template, "secret") {
+			return "", false, nil
+		}
+	case m.TrustedCA != nil:
+		sources = append(sources, m.TrustedCA.Sources...)
+	case m.Binary != nil:
+		if m.Binary.Index != "" {
+			// The index is only pinned by its digest.
+			if !strings.Contains(m.Binary.Index, "@") {
+				return "", false, nil
+			}
+			break
+		}
+		source, ok := binarySource(m.Binary.Sources, v1.Platform{OS: params["GOOS"], Architecture: params["GOARCH"], Variant: params["VARIANT"]})
+		if ok {
+			sources = append(sources, source)
+		}
+	}
+
+	for _, source := range sources {
+		if digestRegexp.MatchString(source) {
+			// The uploaded blobs are referenced by their digests.
+			continue
+		}
+		u, err := remoteSource(source)
+		if err != nil || u != nil {
+			return "", false, nil
+		}
+		stat, err := statFingerprint(source)
+		if err != nil {
+			// The build reports the missing sources.
+			return "", false, nil
+		}
+		inputs.Sources[source] = stat
+	}
+
+	if readsBase {
+		digest, err := base.Digest()
+		if err != nil {
+			return "", false, err
+		}
+		inputs.Base = digest.String()
+	}
+
+	raw, err := json.Marshal(inputs)
+	if err != nil {
+		return "", false, err
+	}
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:]), true, nil
+}
+
+// statFingerprint returns the hash of the names, the sizes, the modes and the modification times of the files of the local path.
+func statFingerprint(p string) (string, error) {
+	h := sha256.New()
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		fmt.Fprintf(h, "%s %d %o %d\n", p, info.Size(), info.Mode(), info.ModTime().UnixNano())
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	err = filepath.WalkDir(p, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d %o %d\n", name, info.Size(), info.Mode(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/wzshiming/jitdi/pkg/atomic"
+	"github.com/wzshiming/jitdi/pkg/metadata"
+)
+
+var (
+	errTagUnknown      = errors.New("tag unknown")
+	errRevisionUnknown = errors.New("no previous build of the tag with the digest")
+	errTagBuilding     = errors.New("the tag is being built")
+)
+
+// RollbackResult is the tag rolled back to one of its previous builds.
+type RollbackResult struct {
+	Ref string `json:"ref"`
+	// Digest is the digest that the tag points at now, and Previous the one it pointed at before.
+	Digest   string `json:"digest"`
+	Previous string `json:"previous"`
+}
+
+// adminRollback points the tag of the ref at its previous build, or at the one of the digest,
+// the build rolled back from is kept in the history so that the tag can be rolled forward again.
+func (h *Handler) adminRollback(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly {
+		http.Error(w, "the cache is read-only", http.StatusForbidden)
+		return
+	}
+	ref, ok := adminRef(w, r)
+	if !ok {
+		return
+	}
+	digest := r.URL.Query().Get("digest")
+	if digest != "" && !digestRegexp.MatchString(digest) {
+		http.Error(w, fmt.Sprintf("invalid digest %q", digest), http.StatusBadRequest)
+		return
+	}
+	i := strings.LastIndex(ref, ":")
+	image, tag := ref[:i], ref[i+1:]
+
+	current, previous, err := h.rollback(image, tag, digest)
+	if err != nil {
+		switch {
+		case errors.Is(err, errTagUnknown), errors.Is(err, errRevisionUnknown):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errTagBuilding):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	loggerFrom(r.Context()).Info("tag rolled back", "image", image, "tag", tag, "digest", current, "previous", previous)
+	serveJSON(w, RollbackResult{
+		Ref:      ref,
+		Digest:   current,
+		Previous: previous,
+	})
+}
+
+// rollback rolls the tag back, and returns the digests it points at now and before.
+func (h *Handler) rollback(image, tag, digest string) (current, previous string, err error) {
+	err = h.lockTag(image, tag, func() error {
+		current, previous, err = h.image.rollbackTag(image, tag, digest)
+		return err
+	})
+	return current, previous, err
+}
+
+// lockTag runs the fn while holding the lock of the builds of the tag, so that no build updates the tag at the same time,
+// it fails with errTagBuilding if the tag is being built.
+func (h *Handler) lockTag(image, tag string, fn func() error) error {
+	ref := image + ":" + tag
+	call := &buildCall{done: make(chan struct{})}
+	if _, loaded := h.buildCalls.LoadOrStore(ref, call); loaded {
+		return errTagBuilding
+	}
+	defer func() {
+		h.buildCalls.Delete(ref)
+		close(call.done)
+	}()
+	call.err = fn()
+	return call.err
+}
+
+// rollbackTag writes the manifests of the previous build of the tag, the latest one if the digest is empty,
+// and records it as the current build, which ends the canary of the tag.
+func (b *imageBuilder) rollbackTag(image, tag, digest string) (string, string, error) {
+	record, ok, err := b.index.Get(image, tag)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		return "", "", errTagUnknown
+	}
+	// The stable build of the canary is the one before, even if the tag was rebuilt again during the canary.
+	candidates := record.History
+	if record.Canary != nil {
+		candidates = append([]metadata.Revision{record.Canary.Stable}, candidates...)
+	}
+	var revision *metadata.Revision
+	for i := range candidates {
+		if digest == "" || candidates[i].Digest == digest {
+			revision = &candidates[i]
+			break
+		}
+	}
+	if revision == nil {
+		return "", "", errRevisionUnknown
+	}
+
+	primary, err := os.ReadFile(b.BlobsPath(revision.Digest))
+	if err != nil {
+		return "", "", fmt.Errorf("read manifest %s: %w", revision.Digest, err)
+	}
+	var alternate []byte
+	if revision.AlternateDigest != "" {
+		alternate, err = os.ReadFile(b.BlobsPath(revision.AlternateDigest))
+		if err != nil {
+			return "", "", fmt.Errorf("read manifest %s: %w", revision.AlternateDigest, err)
+		}
+	}
+
+	manifestPath := b.ManifestPath(image, tag)
+	alternatePath := b.AlternateManifestPath(image, tag)
+	if alternate != nil {
+		err = atomic.WriteFile(alternatePath, alternate, 0644)
+		if err != nil {
+			return "", "", fmt.Errorf("write manifest: %w", err)
+		}
+	} else {
+		err = os.Remove(alternatePath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", "", fmt.Errorf("remove manifest: %w", err)
+		}
+	}
+	err = atomic.WriteFile(manifestPath, primary, 0644)
+	if err != nil {
+		return "", "", fmt.Errorf("write manifest: %w", err)
+	}
+	b.memory.remove(manifestPath, alternatePath)
+
+	rolledBack := metadata.Tag{
+		Image:           image,
+		Tag:             tag,
+		Digest:          revision.Digest,
+		MediaType:       revision.MediaType,
+		AlternateDigest: revision.AlternateDigest,
+		Rule:            revision.Rule,
+		RuleHash:        revision.RuleHash,
+		Blobs:           revision.Blobs,
+		BuildTime:       revision.BuildTime,
+		AccessTime:      record.AccessTime,
+	}
+	// The history is not shortened by the rollback, the build rolled back from takes the place of the one rolled back to.
+	rolledBack.History = pushRevision(record, revision.Digest, len(record.History))
+	err = b.index.Put(rolledBack)
+	if err != nil {
+		return "", "", err
+	}
+	return revision.Digest, record.Digest, nil
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/atomic"
+	"github.com/wzshiming/jitdi/pkg/client/clientset/versioned"
+)
+
+var (
+	errRuleNotFound = errors.New("rule not found")
+	errRuleExists   = errors.New("rule already exists")
+	errRuleConflict = errors.New("rule has been modified")
+)
+
+// ruleStore stores the rules managed by the rules API, the resource version of the rules changes on every write,
+// and a write with a resource version fails with errRuleConflict if the rule has been modified since then.
+type ruleStore interface {
+	Get(ctx context.Context, name string) (*v1alpha1.Image, error)
+	// Create fails with errRuleExists if there is already a rule of the same name.
+	Create(ctx context.Context, image *v1alpha1.Image) (*v1alpha1.Image, error)
+	// Update replaces the rule, unconditionally if the image has no resource version.
+	Update(ctx context.Context, image *v1alpha1.Image) (*v1alpha1.Image, error)
+	// Delete removes the rule, unconditionally if the resource version is empty.
+	Delete(ctx context.Context, name, resourceVersion string) error
+}
+
+// crdRuleStore stores the rules as the Images of the cluster.
+type crdRuleStore struct {
+	clientset *versioned.Clientset
+}
+
+func (s *crdRuleStore) Get(ctx context.Context, name string) (*v1alpha1.Image, error) {
+	image, err := s.clientset.ApisV1alpha1().Images().Get(ctx, name, metav1.GetOptions{})
+	return image, crdRuleError(err)
+}
+
+func (s *crdRuleStore) Create(ctx context.Context, image *v1alpha1.Image) (*v1alpha1.Image, error) {
+	image, err := s.clientset.ApisV1alpha1().Images().Create(ctx, image, metav1.CreateOptions{})
+	return image, crdRuleError(err)
+}
+
+func (s *crdRuleStore) Update(ctx context.Context, image *v1alpha1.Image) (*v1alpha1.Image, error) {
+	api := s.clientset.ApisV1alpha1().Images()
+	current, err := api.Get(ctx, image.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, crdRuleError(err)
+	}
+	image = image.DeepCopy()
+	if image.ResourceVersion == "" {
+		image.ResourceVersion = current.ResourceVersion
+	}
+	image.Status = current.Status
+	image, err = api.Update(ctx, image, metav1.UpdateOptions{})
+	return image, crdRuleError(err)
+}
+
+func (s *crdRuleStore) Delete(ctx context.Context, name, resourceVersion string) error {
+	opts := metav1.DeleteOptions{}
+	if resourceVersion != "" {
+		opts.Preconditions = &metav1.Preconditions{ResourceVersion: &resourceVersion}
+	}
+	return crdRuleError(s.clientset.ApisV1alpha1().Images().Delete(ctx, name, opts))
+}
+
+func crdRuleError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case apierrors.IsNotFound(err):
+		return errRuleNotFound
+	case apierrors.IsAlreadyExists(err):
+		return errRuleExists
+	case apierrors.IsConflict(err):
+		return errRuleConflict
+	}
+	return err
+}
+
+// fileRuleStore stores the rules in a JSON file when jitdi runs outside of Kubernetes,
+// the resource versions are a counter persisted with the rules.
+type fileRuleStore struct {
+	path string
+
+	mut     sync.Mutex
+	version int64
+	images  map[string]*v1alpha1.Image
+}
+
+type fileRules struct {
+	Version int64             `json:"version"`
+	Images  []*v1alpha1.Image `json:"images"`
+}
+
+// newFileRuleStore loads the rules stored in the file, there are none if the file does not exist.
+func newFileRuleStore(path string) (*fileRuleStore, error) {
+	s := &fileRuleStore{
+		path:   path,
+		images: map[string]*v1alpha1.Image{},
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	var rules fileRules
+	err = json.Unmarshal(raw, &rules)
+	if err != nil {
+		return nil, err
+	}
+	s.version = rules.Version
+	for _, image := range rules.Images {
+		s.images[image.Name] = image
+	}
+	return s, nil
+}
+
+// List returns the rules sorted by name.
+func (s *fileRuleStore) List() []*v1alpha1.Image {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.list()
+}
+
+func (s *fileRuleStore) list() []*v1alpha1.Image {
+	images := make([]*v1alpha1.Image, 0, len(s.images))
+	for _, image := range s.images {
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Name < images[j].Name
+	})
+	return images
+}
+
+func (s *fileRuleStore) Get(ctx context.Context, name string) (*v1alpha1.Image, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	image, ok := s.images[name]
+	if !ok {
+		return nil, errRuleNotFound
+	}
+	return image.DeepCopy(), nil
+}
+
+func (s *fileRuleStore) Create(ctx context.Context, image *v1alpha1.Image) (*v1alpha1.Image, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.images[image.Name]; ok {
+		return nil, errRuleExists
+	}
+	image = image.DeepCopy()
+	image.CreationTimestamp = metav1.Now()
+	return s.put(image)
+}
+
+func (s *fileRuleStore) Update(ctx context.Context, image *v1alpha1.Image) (*v1alpha1.Image, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	current, ok := s.images[image.Name]
+	if !ok {
+		return nil, errRuleNotFound
+	}
+	if image.ResourceVersion != "" && image.ResourceVersion != current.ResourceVersion {
+		return nil, errRuleConflict
+	}
+	image = image.DeepCopy()
+	image.CreationTimestamp = current.CreationTimestamp
+	return s.put(image)
+}
+
+func (s *fileRuleStore) Delete(ctx context.Context, name, resourceVersion string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	current, ok := s.images[name]
+	if !ok {
+		return errRuleNotFound
+	}
+	if resourceVersion != "" && resourceVersion != current.ResourceVersion {
+		return errRuleConflict
+	}
+	delete(s.images, name)
+	s.version++
+	return s.flush()
+}
+
+// put stores the image with a new resource version.
+func (s *fileRuleStore) put(image *v1alpha1.Image) (*v1alpha1.Image, error) {
+	previous, ok := s.images[image.Name]
+	s.version++
+	image.ResourceVersion = strconv.FormatInt(s.version, 10)
+	s.images[image.Name] = image
+	err := s.flush()
+	if err != nil {
+		if ok {
+			s.images[image.Name] = previous
+		} else {
+			delete(s.images, image.Name)
+		}
+		return nil, err
+	}
+	return image.DeepCopy(), nil
+}
+
+func (s *fileRuleStore) flush() error {
+	raw, err := json.MarshalIndent(fileRules{
+		Version: s.version,
+		Images:  s.list(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomic.WriteFile(s.path, raw, 0644)
+}
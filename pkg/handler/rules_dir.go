@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/logging"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// rulesDirDebounce is how long the changes of the rules directory settle before it is reloaded,
+// so that a file written in several steps is only loaded once.
+const rulesDirDebounce = 200 * time.Millisecond
+
+// rulesDir loads the rules of the YAML and JSON files of a directory, each file is validated independently,
+// so that an invalid file keeps its last valid rules without affecting the others.
+type rulesDir struct {
+	dir    string
+	logger *slog.Logger
+
+	mut   sync.Mutex
+	files map[string]*rulesFile
+}
+
+type rulesFile struct {
+	modTime time.Time
+	size    int64
+	images  []*v1alpha1.Image
+}
+
+func newRulesDir(dir string) (*rulesDir, error) {
+	d := &rulesDir{
+		dir:    dir,
+		logger: slog.Default().With(logging.ComponentKey, "rules"),
+		files:  map[string]*rulesFile{},
+	}
+	_, err := d.reload()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// List returns the rules of all the files, in the order of the names of the files.
+func (d *rulesDir) List() []*v1alpha1.Image {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	names := make([]string, 0, len(d.files))
+	for name := range d.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var images []*v1alpha1.Image
+	for _, name := range names {
+		images = append(images, d.files[name].images...)
+	}
+	return images
+}
+
+// Contains reports whether the image is one of the rules of the files.
+func (d *rulesDir) Contains(image *v1alpha1.Image) bool {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	for _, f := range d.files {
+		for _, i := range f.images {
+			if i == image {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reload loads the files which have been created or changed and forgets the removed ones,
+// and reports whether any rule has changed.
+func (d *rulesDir) reload() (bool, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return false, fmt.Errorf("read rules directory: %w", err)
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	changed := false
+	seen := map[string]struct{}{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !isRulesFile(name) {
+			continue
+		}
+		p := filepath.Join(d.dir, name)
+		// Stat follows the symlinks of the files of the mounted ConfigMaps.
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		previous, ok := d.files[name]
+		if ok && previous.modTime.Equal(info.ModTime()) && previous.size == info.Size() {
+			continue
+		}
+		images, err := loadRulesFile(p)
+		if err != nil {
+			d.logger.Error("invalid rules file, keeping its previous rules", "file", p, "err", err)
+			continue
+		}
+		d.files[name] = &rulesFile{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+			images:  images,
+		}
+		d.logger.Info("rules file loaded", "file", p, "rules", len(images))
+		changed = true
+	}
+	for name := range d.files {
+		if _, ok := seen[name]; !ok {
+			delete(d.files, name)
+			d.logger.Info("rules file removed", "file", filepath.Join(d.dir, name))
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func isRulesFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// loadRulesFile decodes and validates the rules of the file.
+func loadRulesFile(p string) ([]*v1alpha1.Image, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	images, err := LoadConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		if image.Name == "" {
+			return nil, fmt.Errorf("rule without a name")
+		}
+		_, err := pattern.NewRule(image)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", image.Name, err)
+		}
+	}
+	return images, nil
+}
+
+// watch reloads the directory when it changes, and calls the onChange if any rule has changed.
+func (d *rulesDir) watch(ctx context.Context, onChange func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		d.logger.Error("watch rules directory", "err", err)
+		return
+	}
+	defer watcher.Close()
+	err = watcher.Add(d.dir)
+	if err != nil {
+		d.logger.Error("watch rules directory", "dir", d.dir, "err", err)
+		return
+	}
+
+	timer := time.NewTimer(rulesDirDebounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			d.logger.Warn("watch rules directory", "err", err)
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			timer.Reset(rulesDirDebounce)
+		case <-timer.C:
+			changed, err := d.reload()
+			if err != nil {
+				d.logger.Error("reload rules directory", "err", err)
+				continue
+			}
+			if changed {
+				onChange()
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// buildSandbox constrains the mutations of a build, their layers are written to a temporary directory of the build
+// which is removed when the build ends, and the number and the size of the files they add are bounded.
+type buildSandbox struct {
+	dir      string
+	maxFiles int64
+	maxBytes int64
+
+	files atomic.Int64
+	bytes atomic.Int64
+}
+
+type sandboxKey struct{}
+
+// sandbox returns the context of the build with its sandbox, and the function removing the sandbox at the end of the build.
+func (b *imageBuilder) sandbox(ctx context.Context) (context.Context, func(), error) {
+	root := b.buildTmpDir
+	if root == "" {
+		root = path.Join(b.cacheTmp, "builds")
+	}
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, err := os.MkdirTemp(root, "build-")
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &buildSandbox{
+		dir:      dir,
+		maxFiles: b.buildMaxFiles,
+		maxBytes: b.buildMaxBytes,
+	}
+	cleanup := func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			loggerFrom(ctx).Warn("remove build directory", "dir", dir, "err", err)
+		}
+	}
+	return context.WithValue(ctx, sandboxKey{}, s), cleanup, nil
+}
+
+func sandboxFrom(ctx context.Context) *buildSandbox {
+	s, _ := ctx.Value(sandboxKey{}).(*buildSandbox)
+	return s
+}
+
+// layerDir returns the directory that the layers are written to, the dir outside of a build.
+func (s *buildSandbox) layerDir(dir string) string {
+	if s == nil {
+		return dir
+	}
+	return s.dir
+}
+
+// addFile counts the file added to the layers of the build, and fails over the ceilings.
+func (s *buildSandbox) addFile(name string, size int64) error {
+	if s == nil {
+		return nil
+	}
+	if files := s.files.Add(1); s.maxFiles > 0 && files > s.maxFiles {
+		return fmt.Errorf("file %q: the build adds more than %d files", name, s.maxFiles)
+	}
+	if bytes := s.bytes.Add(size); s.maxBytes > 0 && bytes > s.maxBytes {
+		return fmt.Errorf("file %q: the build adds more than %d bytes", name, s.maxBytes)
+	}
+	return nil
+}
+
+// checkEntryName checks that the name of a file added to a layer stays where it is placed, without any ".." segment.
+func checkEntryName(name string) error {
+	if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	for _, segment := range strings.Split(filepath.ToSlash(name), "/") {
+		if segment == ".." {
+			return fmt.Errorf("file name %q must not contain \"..\"", name)
+		}
+	}
+	return nil
+}
+
+// resolveInside resolves the symbolic link found under the root, and fails if it points outside of the root.
+func resolveInside(root, p string) (string, os.FileInfo, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", nil, err
+	}
+	target, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", nil, err
+	}
+	rel, err := filepath.Rel(realRoot, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", nil, fmt.Errorf("symbolic link %q points outside of %q", p, root)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", nil, err
+	}
+	return target, info, nil
+}
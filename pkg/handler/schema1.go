@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+type schema1Compatibility struct {
+	Created         time.Time `json:"created"`
+	Author          string    `json:"author,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+	ThrowAway       bool      `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd,omitempty"`
+	} `json:"container_config,omitempty"`
+}
+
+// convertSchema1 converts the legacy Docker schema1 image to a Docker schema2 image,
+// the layers marked as throwaway are dropped and recorded as empty layers in the history.
+func convertSchema1(img v1.Image) (v1.Image, error) {
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest schema1Manifest
+	err = json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("decode schema1 manifest: %w", err)
+	}
+	if len(manifest.History) == 0 || len(manifest.History) != len(manifest.FSLayers) {
+		return nil, fmt.Errorf("schema1 manifest has %d layers and %d history", len(manifest.FSLayers), len(manifest.History))
+	}
+
+	// The layers are the oldest first, but the history of schema1 is the newest first.
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]v1.History, 0, len(manifest.History))
+	addendums := make([]mutate.Addendum, 0, len(layers))
+	for i, layer := range layers {
+		var compat schema1Compatibility
+		err = json.Unmarshal([]byte(manifest.History[len(manifest.History)-1-i].V1Compatibility), &compat)
+		if err != nil {
+			return nil, fmt.Errorf("decode schema1 history: %w", err)
+		}
+
+		h := v1.History{
+			Created:    v1.Time{Time: compat.Created},
+			Author:     compat.Author,
+			Comment:    compat.Comment,
+			EmptyLayer: compat.ThrowAway,
+		}
+		if len(compat.ContainerConfig.Cmd) != 0 {
+			h.CreatedBy = strings.Join(compat.ContainerConfig.Cmd, " ")
+		}
+		history = append(history, h)
+
+		if compat.ThrowAway {
+			continue
+		}
+		addendums = append(addendums, mutate.Addendum{
+			Layer:     layer,
+			MediaType: types.DockerLayer,
+		})
+	}
+
+	// The config is the newest v1Compatibility without the fields of schema1.
+	config := map[string]json.RawMessage{}
+	err = json.Unmarshal([]byte(manifest.History[0].V1Compatibility), &config)
+	if err != nil {
+		return nil, fmt.Errorf("decode schema1 config: %w", err)
+	}
+	for _, key := range []string{"id", "parent", "parent_id", "layer_id", "Size", "throwaway"} {
+		delete(config, key)
+	}
+	configBlob, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var configFile v1.ConfigFile
+	err = json.Unmarshal(configBlob, &configFile)
+	if err != nil {
+		return nil, fmt.Errorf("decode schema1 config: %w", err)
+	}
+
+	out := mutate.MediaType(empty.Image, types.DockerManifestSchema2)
+	out = mutate.ConfigMediaType(out, types.DockerConfigJSON)
+	out, err = mutate.Append(out, addendums...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The diff ids are computed by appending the layers.
+	appended, err := out.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	configFile.RootFS = appended.RootFS
+	configFile.History = history
+	return mutate.ConfigFile(out, &configFile)
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// secretPattern matches the references to the keys of the Secrets in the templates of the files, e.g. "{secret:registry/token}".
+var secretPattern = regexp.MustCompile(`\{secret:([^/{}]*)/([^/{}]*)\}`)
+
+// renderTemplate replaces the references to the keys of the Secrets in the template with their values,
+// which are redacted from the logs of the build, and reports whether the template references any Secret.
+func (b *imageBuilder) renderTemplate(ctx context.Context, template string) ([]byte, bool, error) {
+	var errs []error
+	var secret bool
+	record := buildRecordFrom(ctx)
+	content := secretPattern.ReplaceAllStringFunc(template, func(ref string) string {
+		m := secretPattern.FindStringSubmatch(ref)
+		value, err := b.readSecret(m[1], m[2])
+		if err != nil {
+			errs = append(errs, err)
+			return ""
+		}
+		secret = true
+		if record != nil {
+			record.redactor.add(value)
+		}
+		return value
+	})
+	if len(errs) != 0 {
+		return nil, false, errors.Join(errs...)
+	}
+	return []byte(content), secret, nil
+}
+
+// readSecret reads the key of the Secret mounted in the secrets directory, at <dir>/<name>/<key>.
+func (b *imageBuilder) readSecret(name, key string) (string, error) {
+	if b.secretsDir == "" {
+		return "", fmt.Errorf("secret %s/%s: no secrets directory", name, key)
+	}
+	for _, part := range []string{name, key} {
+		if part == "" || part == "." || part == ".." || strings.ContainsRune(part, filepath.Separator) {
+			return "", fmt.Errorf("secret %s/%s: invalid reference", name, key)
+		}
+	}
+	raw, err := os.ReadFile(filepath.Join(b.secretsDir, name, key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("secret %s/%s: not found", name, key)
+		}
+		return "", fmt.Errorf("secret %s/%s: %w", name, key, err)
+	}
+	return string(raw), nil
+}
+
+// redactedValue replaces the values of the Secrets in the logs.
+const redactedValue = "[REDACTED]"
+
+// redactor redacts the values of the Secrets that a build has read.
+type redactor struct {
+	mut    sync.RWMutex
+	values []string
+}
+
+func (r *redactor) add(value string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	// The files of the Secrets often end with a newline that the logged values do not have.
+	for _, v := range []string{value, strings.TrimSpace(value)} {
+		if v == "" {
+			continue
+		}
+		known := false
+		for _, existing := range r.values {
+			if existing == v {
+				known = true
+				break
+			}
+		}
+		if !known {
+			r.values = append(r.values, v)
+		}
+	}
+}
+
+func (r *redactor) redact(s string) string {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, redactedValue)
+	}
+	return s
+}
+
+func (r *redactor) empty() bool {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return len(r.values) == 0
+}
+
+// redactHandler is a slog.Handler that redacts the values of the Secrets from the messages and the attributes.
+type redactHandler struct {
+	slog.Handler
+	redactor *redactor
+}
+
+func (h redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	if h.redactor.empty() {
+		return h.Handler.Handle(ctx, record)
+	}
+	redacted := slog.NewRecord(record.Time, record.Level, h.redactor.redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(attr))
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h redactHandler) redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		attrs := value.Group()
+		redacted := make([]any, 0, len(attrs))
+		for _, a := range attrs {
+			redacted = append(redacted, h.redactAttr(a))
+		}
+		return slog.Group(attr.Key, redacted...)
+	}
+	s := value.String()
+	if r := h.redactor.redact(s); r != s {
+		return slog.String(attr.Key, r)
+	}
+	return attr
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return redactHandler{h.Handler.WithAttrs(attrs), h.redactor}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{h.Handler.WithGroup(name), h.redactor}
+}
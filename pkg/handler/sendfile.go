@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// The headers that hand the serving of the files over to the reverse proxy.
+const (
+	sendfileXAccelRedirect = "X-Accel-Redirect"
+	sendfileXSendfile      = "X-Sendfile"
+)
+
+// blobUnknownMessage hints that the blobs of the built images only exist once their manifests are pulled,
+// as pulling a blob never builds an image.
+const blobUnknownMessage = "blob unknown, the blobs of a built image are served once its manifest is pulled"
+
+func checkSendfileHeader(header string) error {
+	switch header {
+	case "", sendfileXAccelRedirect, sendfileXSendfile:
+		return nil
+	}
+	return fmt.Errorf("unknown sendfile header %q, must be %q or %q", header, sendfileXAccelRedirect, sendfileXSendfile)
+}
+
+// serveBlobFile serves the blob from the file, the file is opened once and its headers are set
+// before handing it to ServeContent, which copies the *os.File with sendfile.
+// With a sendfile header the reverse proxy serves the file instead.
+func (h *Handler) serveBlobFile(w http.ResponseWriter, r *http.Request, blobPath string) {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			registryError(w, http.StatusNotFound, errCodeBlobUnknown, blobUnknownMessage)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if stat.IsDir() {
+		registryError(w, http.StatusNotFound, errCodeBlobUnknown, blobUnknownMessage)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", h.image.BlobMediaType(stat.Name()))
+
+	switch h.sendfileHeader {
+	case sendfileXAccelRedirect:
+		rel, err := filepath.Rel(h.image.cache, blobPath)
+		if err == nil {
+			header.Set(sendfileXAccelRedirect, path.Join("/", h.sendfilePrefix, filepath.ToSlash(rel)))
+			return
+		}
+	case sendfileXSendfile:
+		abs, err := filepath.Abs(blobPath)
+		if err == nil {
+			header.Set(sendfileXSendfile, abs)
+			return
+		}
+	}
+
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+}
+
+// headBlob answers the HEAD of the blob from the stat of its file only, without opening it.
+func (h *Handler) headBlob(w http.ResponseWriter, stat fs.FileInfo, err error) {
+	if err != nil || stat.IsDir() {
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		registryError(w, http.StatusNotFound, errCodeBlobUnknown, blobUnknownMessage)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", h.image.BlobMediaType(stat.Name()))
+	header.Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// stagedContent keeps the files staged for the builds once on the disk by their digests,
+// the staged paths are hard links to the content, so that the same large file downloaded for several rules,
+// e.g. from other URLs or revisions of a model, takes the disk once and is not downloaded again when its digest is known.
+// A nil stagedContent does not deduplicate.
+type stagedContent struct {
+	dir string
+}
+
+func newStagedContent(dir string) (*stagedContent, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedContent{dir: dir}, nil
+}
+
+func (s *stagedContent) path(digest string) string {
+	return cachePath(s.dir, digest)
+}
+
+// link links the staged path to the content of the digest, and reports whether the content is known.
+func (s *stagedContent) link(digest, p string) (bool, error) {
+	if s == nil || !digestRegexp.MatchString(digest) {
+		return false, nil
+	}
+	content := s.path(digest)
+	if !fileExists(content) {
+		return false, nil
+	}
+	err := os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return false, err
+	}
+	err = replaceWithLink(content, p)
+	if os.IsNotExist(err) {
+		// The content has just been pruned.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// store adds the staged file of the digest to the content, or replaces it with a hard link to the content of the same digest.
+func (s *stagedContent) store(digest, p string) error {
+	if s == nil {
+		return nil
+	}
+	content := s.path(digest)
+	if !fileExists(content) {
+		err := os.Link(p, content)
+		if err == nil || os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return replaceWithLink(content, p)
+}
+
+// storeFile hashes the staged file and stores it.
+func (s *stagedContent) storeFile(p string) error {
+	if s == nil {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	return s.store("sha256:"+hex.EncodeToString(hash.Sum(nil)), p)
+}
+
+// prune removes the content no staged path links to anymore.
+func (s *stagedContent) prune(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		loggerFrom(ctx).Warn("read staged content", "err", err)
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "sha256:") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if links, ok := hardLinks(info); ok && links == 1 {
+			err = os.Remove(path.Join(s.dir, entry.Name()))
+			if err != nil {
+				loggerFrom(ctx).Warn("remove staged content", "digest", entry.Name(), "err", err)
+			}
+		}
+	}
+}
+
+// replaceWithLink replaces the path with a hard link to the content, atomically.
+func replaceWithLink(content, p string) error {
+	f, err := os.CreateTemp(path.Dir(p), path.Base(p)+".link-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	_ = os.Remove(tmp)
+	err = os.Link(content, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, p)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd)
+
+package handler
+
+import (
+	"io/fs"
+)
+
+// hardLinks is not supported on this platform, the staged content is never pruned.
+func hardLinks(info fs.FileInfo) (uint64, bool) {
+	return 0, false
+}
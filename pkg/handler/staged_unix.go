@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd
+
+package handler
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// hardLinks returns the number of the hard links of the file.
+func hardLinks(info fs.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Nlink), true
+}
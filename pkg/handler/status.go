@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+const (
+	// ConditionBuilt is the condition type reporting the result of the last build of the image.
+	ConditionBuilt = "Built"
+
+	// maxConditionMessage is the max length of the condition message allowed by the CRD.
+	maxConditionMessage = 32768
+
+	// statusLogLines is the number of log lines of failed builds attached to the status.
+	statusLogLines = 20
+)
+
+// updateStatus reports the result of the build and the usage of the tags of the rule on the Image the rule is created from.
+func (h *Handler) updateStatus(ctx context.Context, rule *pattern.Rule, record *buildRecord) {
+	image := rule.Image()
+	if h.clientset == nil || image.UID == "" {
+		return
+	}
+
+	build := record.Build()
+	cond := v1alpha1.Condition{
+		Type:               ConditionBuilt,
+		LastTransitionTime: metav1.NewTime(time.Now()),
+	}
+	if build.Status == BuildFailed {
+		cond.Status = v1alpha1.ConditionFalse
+		cond.Reason = "BuildFailed"
+		cond.Message = fmt.Sprintf("build %s of %s failed: %s\n%s", build.ID, build.Ref, build.Error, strings.Join(record.logs.Tail(statusLogLines), "\n"))
+	} else {
+		cond.Status = v1alpha1.ConditionTrue
+		cond.Reason = "BuildSucceeded"
+		cond.Message = fmt.Sprintf("build %s of %s succeeded", build.ID, build.Ref)
+	}
+	if len(cond.Message) > maxConditionMessage {
+		cond.Message = cond.Message[len(cond.Message)-maxConditionMessage:]
+	}
+
+	var usage *v1alpha1.ImageUsage
+	tags, err := h.ruleTags(rule.Name(), "")
+	if err != nil {
+		loggerFrom(ctx).Error("usage of the rule", "image", image.Name, "err", err)
+	} else {
+		usage = &v1alpha1.ImageUsage{
+			Tags:       len(tags),
+			Bytes:      h.tagsSize(tags),
+			Quota:      rule.Spec().Quota,
+			UpdateTime: metav1.NewTime(time.Now()),
+		}
+	}
+
+	api := h.clientset.ApisV1alpha1().Images()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := api.Get(ctx, image.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		latest.Status.Conditions = setCondition(latest.Status.Conditions, cond)
+		if usage != nil {
+			latest.Status.Usage = usage
+		}
+		_, err = api.UpdateStatus(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("update image status", "image", image.Name, "err", err)
+	}
+}
+
+// setCondition adds or replaces the condition of the same type,
+// the transition time is kept if the status is not changed.
+func setCondition(conditions []v1alpha1.Condition, cond v1alpha1.Condition) []v1alpha1.Condition {
+	for i, c := range conditions {
+		if c.Type != cond.Type {
+			continue
+		}
+		if c.Status == cond.Status {
+			cond.LastTransitionTime = c.LastTransitionTime
+		}
+		conditions[i] = cond
+		return conditions
+	}
+	return append(conditions, cond)
+}
@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/metadata"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// TenantConfig is a tenant of the tenants file, the clients addressing jitdi as one of its hosts
+// are only served by its rules, authenticated with its users and its tags are cached within its quota.
+type TenantConfig struct {
+	Name string `json:"name"`
+	// Hosts are the host names the clients of the tenant address jitdi as, in the Host header or the TLS server name,
+	// the tags of the tenant are cached under the full references of the first one.
+	Hosts []string `json:"hosts"`
+	// Config are the config files, globs or directories of the rules of the tenant, relative to the tenants file.
+	Config []string `json:"config,omitempty"`
+	// Htpasswd is the htpasswd file of the users of the tenant, relative to the tenants file,
+	// the users of --htpasswd authenticate the clients of the tenant if empty.
+	Htpasswd string `json:"htpasswd,omitempty"`
+	// Quota is the size of the blobs of the tags of the tenant, e.g. 50Gi, the least recently pulled tags are evicted over it.
+	Quota string `json:"quota,omitempty"`
+}
+
+type tenant struct {
+	name  string
+	host  string
+	users map[string][]byte
+	quota int64
+
+	// mut serializes the quota enforcements of the tenant.
+	mut     sync.Mutex
+	pulls   atomic.Int64
+	evicted atomic.Int64
+}
+
+type tenants struct {
+	list   []*tenant
+	hosts  map[string]*tenant
+	images map[*v1alpha1.Image]*tenant
+}
+
+// loadTenants loads the tenants of the file and the rules of the tenants,
+// which only match the full references of the first host of their tenant.
+func loadTenants(p string) (*tenants, []*v1alpha1.Image, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var file struct {
+		Tenants []TenantConfig `json:"tenants"`
+	}
+	err = yaml.NewYAMLToJSONDecoder(f).Decode(&file)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, err
+	}
+
+	dir := filepath.Dir(p)
+	resolve := func(name string) string {
+		if filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(dir, name)
+	}
+
+	ts := &tenants{
+		hosts:  map[string]*tenant{},
+		images: map[*v1alpha1.Image]*tenant{},
+	}
+	var images []*v1alpha1.Image
+	names := map[string]struct{}{}
+	for _, conf := range file.Tenants {
+		if conf.Name == "" {
+			return nil, nil, fmt.Errorf("tenant without a name")
+		}
+		if _, ok := names[conf.Name]; ok {
+			return nil, nil, fmt.Errorf("tenant %q: duplicate name", conf.Name)
+		}
+		names[conf.Name] = struct{}{}
+		if len(conf.Hosts) == 0 {
+			return nil, nil, fmt.Errorf("tenant %q: no hosts", conf.Name)
+		}
+
+		t := &tenant{
+			name: conf.Name,
+			host: strings.ToLower(conf.Hosts[0]),
+		}
+		for _, host := range conf.Hosts {
+			host = strings.ToLower(host)
+			if host == "" || strings.ContainsAny(host, "/{}:") {
+				return nil, nil, fmt.Errorf("tenant %q: invalid host %q, it must be a host name without a port", conf.Name, host)
+			}
+			if other, ok := ts.hosts[host]; ok {
+				return nil, nil, fmt.Errorf("tenant %q: host %q is already the host of tenant %q", conf.Name, host, other.name)
+			}
+			ts.hosts[host] = t
+		}
+		if conf.Quota != "" {
+			quota, err := resource.ParseQuantity(conf.Quota)
+			if err != nil {
+				return nil, nil, fmt.Errorf("tenant %q: invalid quota %q: %w", conf.Name, conf.Quota, err)
+			}
+			t.quota = quota.Value()
+		}
+		if conf.Htpasswd != "" {
+			t.users, err = loadHtpasswd(resolve(conf.Htpasswd))
+			if err != nil {
+				return nil, nil, fmt.Errorf("tenant %q: load htpasswd: %w", conf.Name, err)
+			}
+		}
+
+		paths := make([]string, 0, len(conf.Config))
+		for _, c := range conf.Config {
+			paths = append(paths, resolve(c))
+		}
+		loaded, err := LoadConfigFiles(paths)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tenant %q: %w", conf.Name, err)
+		}
+		own := map[string]struct{}{}
+		for _, image := range loaded {
+			own[image.Name] = struct{}{}
+		}
+		for _, image := range loaded {
+			if image.Spec.Host != "" {
+				return nil, nil, fmt.Errorf("tenant %q: rule %q: the rules of a tenant can not set a host", conf.Name, image.Name)
+			}
+			image.Name = conf.Name + "." + image.Name
+			image.Spec.Host = t.host
+			// The rules of the tenant extend its own rules, or else the ones of the config file.
+			for i, name := range image.Spec.Extends {
+				if _, ok := own[name]; ok {
+					image.Spec.Extends[i] = conf.Name + "." + name
+				}
+			}
+			ts.images[image] = t
+			images = append(images, image)
+		}
+		ts.list = append(ts.list, t)
+	}
+	return ts, images, nil
+}
+
+// tenantOf returns the tenant of the host the client addresses jitdi as, or nil if there is none.
+func (h *Handler) tenantOf(r *http.Request) *tenant {
+	if h.tenants == nil {
+		return nil
+	}
+	host := r.Host
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		host = r.TLS.ServerName
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return h.tenants.hosts[strings.ToLower(host)]
+}
+
+// ruleTenant returns the tenant of the rule, or nil if it is not the rule of a tenant.
+func (h *Handler) ruleTenant(rule *pattern.Rule) *tenant {
+	if h.tenants == nil || rule == nil {
+		return nil
+	}
+	return h.tenants.images[rule.Image()]
+}
+
+// usersOf returns the users that the client is authenticated against, the ones of its tenant if it has any.
+func (h *Handler) usersOf(r *http.Request) map[string][]byte {
+	if t := h.tenantOf(r); t != nil && t.users != nil {
+		return t.users
+	}
+	return h.users
+}
+
+// tenantTags returns the tags of the tenant, the least recently pulled first,
+// and the size of their blobs, the blobs shared by several tags counted once.
+func (h *Handler) tenantTags(t *tenant) ([]metadata.Tag, int64, error) {
+	all, err := h.image.index.List()
+	if err != nil {
+		return nil, 0, err
+	}
+	prefix := t.host + "/"
+	var tags []metadata.Tag
+	for _, tag := range all {
+		if strings.HasPrefix(tag.Image, prefix) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return lastUse(tags[i]).Before(lastUse(tags[j]))
+	})
+	return tags, h.tagsSize(tags), nil
+}
+
+func (h *Handler) tagsSize(tags []metadata.Tag) int64 {
+	var size int64
+	seen := map[string]struct{}{}
+	for _, tag := range tags {
+		for _, blob := range tag.Blobs {
+			if _, ok := seen[blob]; ok {
+				continue
+			}
+			seen[blob] = struct{}{}
+			if stat, err := os.Stat(h.image.BlobsPath(blob)); err == nil {
+				size += stat.Size()
+			}
+		}
+	}
+	return size
+}
+
+// enforceQuota evicts the least recently pulled tags of the tenant until its tags fit in its quota,
+// the tag just built is kept. The blobs of the evicted tags are removed by the garbage collection.
+func (h *Handler) enforceQuota(ctx context.Context, t *tenant, keep string) {
+	if t.quota <= 0 {
+		return
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	logger := loggerFrom(ctx)
+	tags, size, err := h.tenantTags(t)
+	if err != nil {
+		logger.Error("list the tags of the tenant", "tenant", t.name, "err", err)
+		return
+	}
+	for i := 0; size > t.quota && i < len(tags); {
+		tag := tags[i]
+		if tag.Image+":"+tag.Tag == keep {
+			i++
+			continue
+		}
+		_, err := h.image.DeleteManifest(tag.Image, tag.Tag)
+		if err != nil {
+			logger.Error("evict tag", "tenant", t.name, "image", tag.Image, "tag", tag.Tag, "err", err)
+			i++
+			continue
+		}
+		t.evicted.Add(1)
+		tags = append(tags[:i], tags[i+1:]...)
+		previous := size
+		size = h.tagsSize(tags)
+		logger.Info("tag evicted over the quota of the tenant", "tenant", t.name, "image", tag.Image, "tag", tag.Tag,
+			"freedBytes", previous-size, "bytes", size, "quota", t.quota)
+	}
+	if size > t.quota {
+		logger.Warn("the tags of the tenant exceed its quota", "tenant", t.name, "bytes", size, "quota", t.quota)
+	}
+}
+
+// lastUse returns when the tag was last pulled, or built if it has never been pulled.
+func lastUse(tag metadata.Tag) time.Time {
+	if tag.AccessTime != nil {
+		return *tag.AccessTime
+	}
+	return tag.BuildTime
+}
@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+// maxCABundleSize is the size of the PEM bundle of a source read at most.
+const maxCABundleSize = 4 << 20
+
+// trustStore is the system trust store of a distribution, the bundles are read by the TLS clients and
+// the anchor is kept when the bundles are generated again, e.g. by update-ca-certificates.
+type trustStore struct {
+	bundles []string
+	anchor  string
+}
+
+var trustStores = []trustStore{
+	// Debian, Ubuntu and Alpine.
+	{bundles: []string{"/etc/ssl/certs/ca-certificates.crt"}, anchor: "/usr/local/share/ca-certificates/jitdi.crt"},
+	// RHEL and Fedora, the bundle of /etc/pki/tls/certs is a link to the extracted one since RHEL 7.
+	{bundles: []string{"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", "/etc/pki/tls/certs/ca-bundle.crt"}, anchor: "/etc/pki/ca-trust/source/anchors/jitdi.pem"},
+	// SUSE.
+	{bundles: []string{"/var/lib/ca-certificates/ca-bundle.pem"}, anchor: "/etc/pki/trust/anchors/jitdi.pem"},
+}
+
+// buildTrustedCA returns the layer of the bundles of the trust stores of the base image with the certificates appended
+// and of their anchors, and the description of what it adds.
+// The base images without a trust store, e.g. scratch, get the bundle of Debian, which the Go and the OpenSSL clients read.
+func (b *imageBuilder) buildTrustedCA(ctx context.Context, ca *v1alpha1.TrustedCA, base v1.Image, layerMediaType types.MediaType, creationTime time.Time, windows bool) ([]mutate.Addendum, string, error) {
+	if windows {
+		return nil, "", fmt.Errorf("trustedCA: the certificates are not added to the windows images")
+	}
+
+	builder := NewFileLayerBuilder(b.client, b.cacheTmp, 0644, creationTime, layerMediaType, 0, windows)
+	var certs [][]byte
+	for _, source := range ca.Sources {
+		raw, err := b.readSource(ctx, builder, source, maxCABundleSize)
+		if err != nil {
+			return nil, "", fmt.Errorf("trustedCA %s: %w", source, err)
+		}
+		ders, err := parseCertificates(raw)
+		if err != nil {
+			return nil, "", fmt.Errorf("trustedCA %s: %w", source, err)
+		}
+		certs = append(certs, ders...)
+	}
+	if ca.Certificates != "" {
+		ders, err := parseCertificates([]byte(ca.Certificates))
+		if err != nil {
+			return nil, "", fmt.Errorf("trustedCA certificates: %w", err)
+		}
+		certs = append(certs, ders...)
+	}
+
+	var anchor []byte
+	for _, der := range certs {
+		anchor = append(anchor, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	var files []*baseFile
+	var bundles []string
+	for _, store := range trustStores {
+		var found bool
+		for _, bundle := range store.bundles {
+			f, err := readOptionalBaseFile(base, bundle)
+			if err != nil {
+				if errors.Is(err, errBaseFileLink) {
+					continue
+				}
+				return nil, "", fmt.Errorf("trustedCA: %w", err)
+			}
+			if f.header == nil {
+				continue
+			}
+			found = true
+			appendCertificates(f, certs)
+			files = append(files, f)
+			bundles = append(bundles, bundle)
+		}
+		if found {
+			files = append(files, &baseFile{name: store.anchor, content: anchor, changed: true})
+		}
+	}
+	if len(bundles) == 0 {
+		f := &baseFile{name: trustStores[0].bundles[0]}
+		appendCertificates(f, certs)
+		files = append(files, f)
+		bundles = append(bundles, f.name)
+	}
+
+	addendums, err := builder.build(ctx, func(tw *tarWriter) error {
+		for _, f := range files {
+			if !f.changed {
+				continue
+			}
+			header := f.header
+			if header == nil {
+				header = &tar.Header{Mode: 0644}
+			}
+			err := tarBaseFile(tw, f.name, header, f.content, creationTime)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, v1.History{
+		Created:   v1.Time{Time: creationTime},
+		Author:    "jitdi",
+		CreatedBy: fmt.Sprintf("ADD CA certificates %s", strings.Join(bundles, " ")),
+		Comment:   fmt.Sprintf("Trust %d CA certificates", len(certs)),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("file layer builder: %w", err)
+	}
+	return addendums, fmt.Sprintf("trust %d CA certificates in %s", len(certs), strings.Join(bundles, ", ")), nil
+}
+
+// parseCertificates returns the DER of the certificates of the PEM bundle, the other blocks, e.g. the private keys, fail.
+func parseCertificates(raw []byte) ([][]byte, error) {
+	var ders [][]byte
+	for {
+		var block *pem.Block
+		block, raw = pem.Decode(raw)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("the PEM block %q is not a certificate", block.Type)
+		}
+		_, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ders = append(ders, block.Bytes)
+	}
+	if len(ders) == 0 {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return ders, nil
+}
+
+// appendCertificates appends the certificates that the bundle does not have yet.
+func appendCertificates(f *baseFile, certs [][]byte) {
+	existing := map[string]struct{}{}
+	rest := f.content
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		existing[string(block.Bytes)] = struct{}{}
+	}
+	var buf bytes.Buffer
+	for _, der := range certs {
+		if _, ok := existing[string(der)]; ok {
+			continue
+		}
+		existing[string(der)] = struct{}{}
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	if buf.Len() != 0 {
+		f.append(buf.Bytes())
+	}
+}
@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	uiPath      = "/admin/ui/"
+	uiLoginPath = "/admin/ui/login"
+	// uiTokenCookie is the cookie the UI keeps the admin token in, so that the browser sends it to the admin API.
+	uiTokenCookie = "jitdi-admin-token"
+)
+
+var (
+	//go:embed ui/index.html
+	uiIndex []byte
+	//go:embed ui/login.html
+	uiLoginPage string
+)
+
+// serveUI serves the page of the web UI, which only calls the admin API.
+func (h *Handler) serveUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != uiPath {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	_, _ = w.Write(uiIndex)
+}
+
+// uiLogin keeps the admin token of the login form in a cookie.
+func (h *Handler) uiLogin(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		serveUILogin(w, true)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     uiTokenCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int((12 * time.Hour).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, uiPath, http.StatusSeeOther)
+}
+
+func serveUILogin(w http.ResponseWriter, failed bool) {
+	message := ""
+	if failed {
+		message = `<p class="error">Invalid token</p>`
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write([]byte(strings.Replace(uiLoginPage, "{{message}}", message, 1)))
+}
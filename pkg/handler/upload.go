@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	uploadIDRegexp = regexp.MustCompile(`^[0-9a-f]{16}$`)
+	digestRegexp   = regexp.MustCompile(`^(sha256:[0-9a-f]{64}|sha512:[0-9a-f]{128})$`)
+)
+
+// digestHasher returns the hash of the algorithm of the digest matching digestRegexp.
+func digestHasher(digest string) hash.Hash {
+	if strings.HasPrefix(digest, "sha512:") {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// uploads serves the blob upload endpoints of the distribution spec,
+// the uploaded blobs are kept out of the garbage collection so that they can be referenced by the mutates.
+func (h *Handler) uploads(w http.ResponseWriter, r *http.Request, image, id string) {
+	if !h.enableUpload {
+		registryError(w, http.StatusMethodNotAllowed, errCodeUnsupported, "uploading is disabled")
+		return
+	}
+	if !h.authorizeUploaded(w, r) {
+		return
+	}
+
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.startUpload(w, r, image)
+		return
+	}
+
+	if !uploadIDRegexp.MatchString(id) {
+		registryError(w, http.StatusNotFound, errCodeBlobUploadUnknown, "blob upload unknown")
+		return
+	}
+	uploadPath := h.image.UploadPath(id)
+	stat, err := os.Stat(uploadPath)
+	if err != nil {
+		registryError(w, http.StatusNotFound, errCodeBlobUploadUnknown, "blob upload unknown")
+		return
+	}
+
+	switch r.Method {
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case http.MethodGet:
+		uploadAccepted(w, image, id, stat.Size(), http.StatusNoContent)
+	case http.MethodPatch:
+		size, err := appendUpload(r, uploadPath, stat.Size())
+		if err != nil {
+			registryError(w, http.StatusRequestedRangeNotSatisfiable, errCodeBlobUploadInvalid, err.Error())
+			return
+		}
+		uploadAccepted(w, image, id, size, http.StatusAccepted)
+	case http.MethodPut:
+		_, err := appendUpload(r, uploadPath, stat.Size())
+		if err != nil {
+			registryError(w, http.StatusRequestedRangeNotSatisfiable, errCodeBlobUploadInvalid, err.Error())
+			return
+		}
+		h.finishUpload(w, r, image, uploadPath)
+	case http.MethodDelete:
+		_ = os.Remove(uploadPath)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *Handler) startUpload(w http.ResponseWriter, r *http.Request, image string) {
+	query := r.URL.Query()
+	if mount := query.Get("mount"); mount != "" {
+		if digestRegexp.MatchString(mount) {
+			if _, err := os.Stat(h.image.UploadedBlobPath(mount)); err == nil {
+				blobCreated(w, image, mount)
+				return
+			}
+		}
+	}
+
+	id := newBuildID()
+	uploadPath := h.image.UploadPath(id)
+	err := os.WriteFile(uploadPath, nil, 0644)
+	if err != nil {
+		loggerFrom(r.Context()).Error("create upload", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Monolithic upload
+	if query.Get("digest") != "" {
+		_, err := appendUpload(r, uploadPath, 0)
+		if err != nil {
+			_ = os.Remove(uploadPath)
+			registryError(w, http.StatusBadRequest, errCodeBlobUploadInvalid, err.Error())
+			return
+		}
+		h.finishUpload(w, r, image, uploadPath)
+		return
+	}
+
+	uploadAccepted(w, image, id, 0, http.StatusAccepted)
+}
+
+// finishUpload verifies the digest of the upload and moves it into the uploaded blobs.
+func (h *Handler) finishUpload(w http.ResponseWriter, r *http.Request, image, uploadPath string) {
+	digest := r.URL.Query().Get("digest")
+	if !digestRegexp.MatchString(digest) {
+		registryError(w, http.StatusBadRequest, errCodeDigestInvalid, fmt.Sprintf("invalid digest %q", digest))
+		return
+	}
+
+	f, err := os.Open(uploadPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := digestHasher(digest)
+	_, err = io.Copy(sum, f)
+	f.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	algorithm, _, _ := strings.Cut(digest, ":")
+	if got := algorithm + ":" + hex.EncodeToString(sum.Sum(nil)); got != digest {
+		_ = os.Remove(uploadPath)
+		registryError(w, http.StatusBadRequest, errCodeDigestInvalid, fmt.Sprintf("digest mismatch %q != %q", got, digest))
+		return
+	}
+
+	err = os.Rename(uploadPath, h.image.UploadedBlobPath(digest))
+	if err != nil {
+		loggerFrom(r.Context()).Error("finish upload", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	loggerFrom(r.Context()).Info("blob uploaded", "image", image, "digest", digest)
+	blobCreated(w, image, digest)
+}
+
+// appendUpload appends the body of the request to the upload, and returns the size of the upload.
+func appendUpload(r *http.Request, uploadPath string, size int64) (int64, error) {
+	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+		start, _, ok := strings.Cut(strings.TrimPrefix(contentRange, "bytes="), "-")
+		offset, err := strconv.ParseInt(start, 10, 64)
+		if !ok || err != nil || offset != size {
+			return size, fmt.Errorf("range %q does not start at %d", contentRange, size)
+		}
+	}
+
+	f, err := os.OpenFile(uploadPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return size, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, r.Body)
+	return size + n, err
+}
+
+func uploadAccepted(w http.ResponseWriter, image, id string, size int64, status int) {
+	w.Header().Set("Location", path.Join("/v2", image, "blobs/uploads", id))
+	w.Header().Set("Docker-Upload-UUID", id)
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+func blobCreated(w http.ResponseWriter, image, digest string) {
+	w.Header().Set("Location", path.Join("/v2", image, "blobs", digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/wzshiming/jitdi/pkg/atomic"
+)
+
+// upstreamBlob is the upstream repository of a layer of a base image that is not stored,
+// the clients pulling it are redirected to the upstream registry, or it is stored when they can not be.
+type upstreamBlob struct {
+	Repository string `json:"repository"`
+	Insecure   bool   `json:"insecure,omitempty"`
+}
+
+// UpstreamPath is the path of the upstream repository recorded for the blob.
+func (b *imageBuilder) UpstreamPath(digest string) string {
+	return cachePath(b.cacheUpstreams, digest)
+}
+
+// isUpstream reports whether the blob is left in its upstream repository.
+func (b *imageBuilder) isUpstream(digest string) bool {
+	return fileExists(b.UpstreamPath(digest))
+}
+
+// recordUpstreamLayers records the upstream repository of the layers of the base image that are not in the blobs yet,
+// and returns them so that they are not saved. Nothing is recorded unless redirectUpstream is set.
+func (b *imageBuilder) recordUpstreamLayers(img v1.Image, ref name.Reference, insecure bool) (map[v1.Hash]struct{}, error) {
+	if !b.redirectUpstream {
+		return nil, nil
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	repo := ref.Context()
+	raw, err := json.Marshal(upstreamBlob{
+		Repository: repo.Name(),
+		Insecure:   b.isInsecure(repo.Registry, insecure),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	upstream := map[v1.Hash]struct{}{}
+	for _, layer := range manifest.Layers {
+		digest := layer.Digest.String()
+		if !layer.MediaType.IsDistributable() || fileExists(b.BlobsPath(digest)) {
+			continue
+		}
+		err = atomic.WriteFile(b.UpstreamPath(digest), raw, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("write upstream of %s: %w", digest, err)
+		}
+		upstream[layer.Digest] = struct{}{}
+	}
+	return upstream, nil
+}
+
+// upstreamRepository returns the upstream repository of the blob and the transport authenticated to it with the credentials of jitdi,
+// it reports false if the blob is not left in an upstream repository.
+func (b *imageBuilder) upstreamRepository(ctx context.Context, digest string) (name.Repository, http.RoundTripper, bool, error) {
+	raw, err := os.ReadFile(b.UpstreamPath(digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return name.Repository{}, nil, false, nil
+		}
+		return name.Repository{}, nil, true, err
+	}
+	var upstream upstreamBlob
+	err = json.Unmarshal(raw, &upstream)
+	if err != nil {
+		return name.Repository{}, nil, true, fmt.Errorf("read upstream of %s: %w", digest, err)
+	}
+
+	var opts []name.Option
+	rt := b.transport
+	if upstream.Insecure {
+		opts = append(opts, name.Insecure)
+		rt = b.insecureTransport
+	}
+	repo, err := name.NewRepository(upstream.Repository, opts...)
+	if err != nil {
+		return name.Repository{}, nil, true, err
+	}
+	auth, err := b.keychain.Resolve(repo)
+	if err != nil {
+		return name.Repository{}, nil, true, fmt.Errorf("resolve credentials of %s: %w", repo, err)
+	}
+	rt, err = transport.NewWithContext(ctx, repo.Registry, auth, rt, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return name.Repository{}, nil, true, fmt.Errorf("authenticate to %s: %w", repo, err)
+	}
+	return repo, rt, true, nil
+}
+
+// resolveUpstreamBlob returns where the upstream registry redirects the blob to, which is usually a short-lived URL of its storage,
+// or nil if the upstream registry serves the blob itself.
+func resolveUpstreamBlob(ctx context.Context, repo name.Repository, rt http.RoundTripper, digest string) (*url.URL, error) {
+	u := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", repo.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: rt,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Location()
+	case http.StatusOK:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// canRedirect reports whether the clients can be redirected to the location of the blob of the upstream repository,
+// the hosts of the redirect hosts if they are set, or else the hosts other than the upstream registry,
+// whose blobs need the credentials of jitdi.
+func (b *imageBuilder) canRedirect(repo name.Repository, location *url.URL) bool {
+	host := strings.ToLower(location.Hostname())
+	if len(b.redirectHosts) != 0 {
+		for _, pattern := range b.redirectHosts {
+			if ok, _ := path.Match(pattern, host); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return !strings.EqualFold(location.Host, repo.RegistryStr())
+}
+
+// saveUpstreamBlob saves the blob of the upstream repository to the blobs, so that it is served locally from then on.
+func (b *imageBuilder) saveUpstreamBlob(ctx context.Context, repo name.Repository, rt http.RoundTripper, digest string) error {
+	layer, err := remote.Layer(repo.Digest(digest), append(b.remoteOptions(ctx, rt), remote.WithContext(ctx))...)
+	if err != nil {
+		return err
+	}
+	err = saveLayer(ctx, layer, b.cacheBlobs, b.faults)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(b.UpstreamPath(digest))
+	return nil
+}
+
+// serveUpstreamBlob redirects the client to the blob left in its upstream repository if it can be,
+// or else saves the blob and serves it locally. It reports false if the blob is not upstream.
+func (h *Handler) serveUpstreamBlob(w http.ResponseWriter, r *http.Request, digest string) bool {
+	ctx := r.Context()
+	repo, rt, ok, err := h.image.upstreamRepository(ctx, digest)
+	if !ok {
+		return false
+	}
+	logger := loggerFrom(ctx)
+	if err == nil {
+		var location *url.URL
+		location, err = resolveUpstreamBlob(ctx, repo, rt, digest)
+		if err == nil {
+			if location != nil && h.image.canRedirect(repo, location) {
+				http.Redirect(w, r, location.String(), http.StatusTemporaryRedirect)
+				return true
+			}
+			logger.Info("serve upstream blob locally", "digest", digest, "repository", repo.Name())
+			err = h.image.saveUpstreamBlob(ctx, repo, rt, digest)
+		}
+	}
+	if err != nil {
+		logger.Error("fetch upstream blob", "digest", digest, "err", err)
+		registryError(w, http.StatusBadGateway, errCodeUnknown, fmt.Sprintf("fetch upstream blob %s: %s", digest, err))
+		return true
+	}
+	h.serveBlobFile(w, r, h.image.BlobsPath(digest))
+	return true
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/pattern"
+)
+
+// upstreamPrefixRulePrefix prefixes the names of the rules of the upstream prefixes.
+const upstreamPrefixRulePrefix = "upstream:"
+
+// upstreamPrefixRules returns the rules serving the images of the registries under their path prefixes without any mutation,
+// e.g. docker.io/library/nginx:latest is library/nginx:latest of the registry of the prefix docker.io.
+// They are sorted with the other rules, so that the rules matching the images of a prefix more specifically
+// apply their mutations to them.
+func upstreamPrefixRules(prefixes map[string]string) ([]*pattern.Rule, error) {
+	names := make([]string, 0, len(prefixes))
+	for prefix := range prefixes {
+		names = append(names, prefix)
+	}
+	sort.Strings(names)
+
+	images := make([]*v1alpha1.Image, 0, len(prefixes))
+	for _, prefix := range names {
+		registry := prefixes[prefix]
+		if registry == "" {
+			registry = prefix
+		}
+		prefix = strings.ToLower(prefix)
+		// Like in the references of docker, the first component of the path is a host only if it has a dot,
+		// so that the prefixes do not shadow the repositories of the other rules, and it can not have a port.
+		if !strings.Contains(prefix, ".") || strings.Contains(prefix, ":") {
+			return nil, fmt.Errorf("upstream prefix %q must be a host with a dot and without a port", prefix)
+		}
+		if _, err := name.NewRegistry(prefix, name.StrictValidation); err != nil {
+			return nil, fmt.Errorf("upstream prefix %q: %w", prefix, err)
+		}
+		if _, err := name.NewRegistry(registry, name.StrictValidation); err != nil {
+			return nil, fmt.Errorf("upstream prefix %q: registry %q: %w", prefix, registry, err)
+		}
+		images = append(images, &v1alpha1.Image{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: upstreamPrefixRulePrefix + prefix,
+			},
+			Spec: v1alpha1.ImageSpec{
+				Match:     prefix + "/{path}:{tag}",
+				BaseImage: registry + "/{path}:{tag}",
+			},
+		})
+	}
+	var errs []error
+	rules := pattern.NewRules(images, nil, nil, func(image *v1alpha1.Image, err error) {
+		errs = append(errs, fmt.Errorf("upstream prefix %q: %w", strings.TrimPrefix(image.Name, upstreamPrefixRulePrefix), err))
+	})
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+	return rules, nil
+}
+
+// isUpstreamPrefixRule reports whether the rule is one of the upstream prefixes.
+func (h *Handler) isUpstreamPrefixRule(rule *pattern.Rule) bool {
+	for _, r := range h.prefixRules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageTTL is how long the usage of the cache is reused, so that scraping the metrics does not walk the cache every time.
+const usageTTL = time.Minute
+
+// blobAgeBuckets are the upper bounds in seconds of the buckets of the ages of the blobs.
+var blobAgeBuckets = []float64{
+	time.Hour.Seconds(),
+	(24 * time.Hour).Seconds(),
+	(7 * 24 * time.Hour).Seconds(),
+	(30 * 24 * time.Hour).Seconds(),
+}
+
+// Usage is the disk usage of the cache.
+type Usage struct {
+	Time       time.Time `json:"time"`
+	TotalBytes int64     `json:"totalBytes"`
+	Blobs      int       `json:"blobs"`
+	BlobBytes  int64     `json:"blobBytes"`
+	// BlobAges counts the blobs by the age since they were written, the buckets are cumulative.
+	BlobAges     []BlobAgeBucket   `json:"blobAges"`
+	BlobAgeSum   float64           `json:"blobAgeSum"`
+	Repositories []RepositoryUsage `json:"repositories"`
+}
+
+// BlobAgeBucket is the number of blobs not older than the upper bound in seconds, +Inf for all the blobs.
+type BlobAgeBucket struct {
+	LE    string `json:"le"`
+	Blobs int    `json:"blobs"`
+}
+
+// RepositoryUsage is the size of the blobs referenced by the tags of a repository, the shared blobs are counted in each repository.
+type RepositoryUsage struct {
+	Repository string `json:"repository"`
+	Tags       int    `json:"tags"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// Usage walks the cache and returns its disk usage, the repositories are sorted by size.
+func (b *imageBuilder) Usage() (*Usage, error) {
+	now := time.Now()
+	usage := &Usage{
+		Time:         now,
+		Repositories: []RepositoryUsage{},
+	}
+
+	err := filepath.WalkDir(b.cache, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		usage.TotalBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk cache: %w", err)
+	}
+
+	sizes := map[string]int64{}
+	ages := make([]int, len(blobAgeBuckets))
+	entries, err := os.ReadDir(b.cacheBlobs)
+	if err != nil {
+		return nil, fmt.Errorf("read blobs: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !digestRegexp.MatchString(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		sizes[name] = info.Size()
+		usage.Blobs++
+		usage.BlobBytes += info.Size()
+
+		age := now.Sub(info.ModTime()).Seconds()
+		usage.BlobAgeSum += age
+		for i, le := range blobAgeBuckets {
+			if age <= le {
+				ages[i]++
+			}
+		}
+	}
+	for i, le := range blobAgeBuckets {
+		usage.BlobAges = append(usage.BlobAges, BlobAgeBucket{LE: strconv.FormatFloat(le, 'f', -1, 64), Blobs: ages[i]})
+	}
+	usage.BlobAges = append(usage.BlobAges, BlobAgeBucket{LE: "+Inf", Blobs: usage.Blobs})
+
+	indexed, err := b.index.List()
+	if err != nil {
+		return nil, fmt.Errorf("list tags: %w", err)
+	}
+	repositories := map[string]map[string]struct{}{}
+	tags := map[string]int{}
+	for _, tag := range indexed {
+		marked, ok := repositories[tag.Image]
+		if !ok {
+			marked = map[string]struct{}{}
+			repositories[tag.Image] = marked
+		}
+		tags[tag.Image]++
+		for _, blob := range tag.Blobs {
+			marked[blob] = struct{}{}
+		}
+	}
+	for repository, marked := range repositories {
+		var bytes int64
+		for digest := range marked {
+			bytes += sizes[digest]
+		}
+		usage.Repositories = append(usage.Repositories, RepositoryUsage{
+			Repository: repository,
+			Tags:       tags[repository],
+			Bytes:      bytes,
+		})
+	}
+	sort.Slice(usage.Repositories, func(i, j int) bool {
+		if usage.Repositories[i].Bytes != usage.Repositories[j].Bytes {
+			return usage.Repositories[i].Bytes > usage.Repositories[j].Bytes
+		}
+		return usage.Repositories[i].Repository < usage.Repositories[j].Repository
+	})
+	return usage, nil
+}
+
+// usageCache reuses the usage of the cache for the usageTTL.
+type usageCache struct {
+	mut   sync.Mutex
+	usage *Usage
+}
+
+func (c *usageCache) get(b *imageBuilder) (*Usage, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.usage != nil && time.Since(c.usage.Time) < usageTTL {
+		return c.usage, nil
+	}
+	usage, err := b.Usage()
+	if err != nil {
+		return nil, err
+	}
+	c.usage = usage
+	return usage, nil
+}
+
+// MetricsHandler returns the handler of the metrics of the cache and of the builds in the Prometheus text format,
+// it is protected by the admin token if there is one, and open to the scrapers otherwise.
+func (h *Handler) MetricsHandler() http.Handler {
+	if h.adminToken == "" {
+		return http.HandlerFunc(h.serveMetrics)
+	}
+	return h.adminAuth(http.HandlerFunc(h.serveMetrics))
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	usage, err := h.usage.get(h.image)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintf(w, "# HELP jitdi_cache_bytes Total size of the files in the cache.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_cache_bytes gauge\n")
+	fmt.Fprintf(w, "jitdi_cache_bytes %d\n", usage.TotalBytes)
+	fmt.Fprintf(w, "# HELP jitdi_cache_blobs Number of the blobs in the cache.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_cache_blobs gauge\n")
+	fmt.Fprintf(w, "jitdi_cache_blobs %d\n", usage.Blobs)
+	fmt.Fprintf(w, "# HELP jitdi_cache_blob_bytes Total size of the blobs in the cache.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_cache_blob_bytes gauge\n")
+	fmt.Fprintf(w, "jitdi_cache_blob_bytes %d\n", usage.BlobBytes)
+	fmt.Fprintf(w, "# HELP jitdi_cache_blob_age_seconds Age of the blobs in the cache since they were written.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_cache_blob_age_seconds histogram\n")
+	for _, bucket := range usage.BlobAges {
+		fmt.Fprintf(w, "jitdi_cache_blob_age_seconds_bucket{le=%q} %d\n", bucket.LE, bucket.Blobs)
+	}
+	fmt.Fprintf(w, "jitdi_cache_blob_age_seconds_sum %s\n", strconv.FormatFloat(usage.BlobAgeSum, 'f', -1, 64))
+	fmt.Fprintf(w, "jitdi_cache_blob_age_seconds_count %d\n", usage.Blobs)
+	fmt.Fprintf(w, "# HELP jitdi_cache_repository_bytes Size of the blobs referenced by the tags of the repository.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_cache_repository_bytes gauge\n")
+	for _, repository := range usage.Repositories {
+		fmt.Fprintf(w, "jitdi_cache_repository_bytes{repository=\"%s\"} %d\n", labelReplacer.Replace(repository.Repository), repository.Bytes)
+	}
+	fmt.Fprintf(w, "# HELP jitdi_builds_total Number of the builds run by the instance.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_builds_total counter\n")
+	fmt.Fprintf(w, "jitdi_builds_total %d\n", h.buildsRun.Load())
+	fmt.Fprintf(w, "# HELP jitdi_builds_coalesced_total Number of the builds waited for instead of being run, of the instance or of another instance sharing the cache.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_builds_coalesced_total counter\n")
+	fmt.Fprintf(w, "jitdi_builds_coalesced_total{scope=\"instance\"} %d\n", h.buildsCoalescedLocal.Load())
+	fmt.Fprintf(w, "jitdi_builds_coalesced_total{scope=\"cluster\"} %d\n", h.buildsCoalescedCluster.Load())
+	fmt.Fprintf(w, "# HELP jitdi_peer_notices_total Number of the builds announced by the peers.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_peer_notices_total counter\n")
+	fmt.Fprintf(w, "jitdi_peer_notices_total %d\n", h.peerNotices.Load())
+	if h.tenants != nil {
+		h.serveTenantMetrics(w)
+	}
+}
+
+func (h *Handler) serveTenantMetrics(w io.Writer) {
+	type tenantUsage struct {
+		tags  int
+		bytes int64
+	}
+	usages := make([]tenantUsage, len(h.tenants.list))
+	for i, t := range h.tenants.list {
+		tags, bytes, err := h.tenantTags(t)
+		if err != nil {
+			slog.Error("list the tags of the tenant", "tenant", t.name, "err", err)
+			continue
+		}
+		usages[i] = tenantUsage{tags: len(tags), bytes: bytes}
+	}
+
+	fmt.Fprintf(w, "# HELP jitdi_tenant_cache_bytes Size of the blobs referenced by the tags of the tenant.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_tenant_cache_bytes gauge\n")
+	for i, t := range h.tenants.list {
+		fmt.Fprintf(w, "jitdi_tenant_cache_bytes{tenant=\"%s\"} %d\n", labelReplacer.Replace(t.name), usages[i].bytes)
+	}
+	fmt.Fprintf(w, "# HELP jitdi_tenant_quota_bytes Quota of the tenant, 0 if it has none.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_tenant_quota_bytes gauge\n")
+	for _, t := range h.tenants.list {
+		fmt.Fprintf(w, "jitdi_tenant_quota_bytes{tenant=\"%s\"} %d\n", labelReplacer.Replace(t.name), t.quota)
+	}
+	fmt.Fprintf(w, "# HELP jitdi_tenant_tags Number of the tags of the tenant in the cache.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_tenant_tags gauge\n")
+	for i, t := range h.tenants.list {
+		fmt.Fprintf(w, "jitdi_tenant_tags{tenant=\"%s\"} %d\n", labelReplacer.Replace(t.name), usages[i].tags)
+	}
+	fmt.Fprintf(w, "# HELP jitdi_tenant_pulls_total Number of the manifests served to the clients of the tenant.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_tenant_pulls_total counter\n")
+	for _, t := range h.tenants.list {
+		fmt.Fprintf(w, "jitdi_tenant_pulls_total{tenant=\"%s\"} %d\n", labelReplacer.Replace(t.name), t.pulls.Load())
+	}
+	fmt.Fprintf(w, "# HELP jitdi_tenant_evicted_tags_total Number of the tags of the tenant evicted over its quota.\n")
+	fmt.Fprintf(w, "# TYPE jitdi_tenant_evicted_tags_total counter\n")
+	for _, t := range h.tenants.list {
+		fmt.Fprintf(w, "jitdi_tenant_evicted_tags_total{tenant=\"%s\"} %d\n", labelReplacer.Replace(t.name), t.evicted.Load())
+	}
+}
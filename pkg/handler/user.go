@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+// buildUser returns the layer of the /etc/passwd, /etc/group and /etc/shadow files of the base image with the user
+// appended and of the home directory of the user, and the description of what it adds.
+// The user and the group that the base image has with the same ids are kept, the ones with other ids fail the build.
+func (b *imageBuilder) buildUser(ctx context.Context, user *v1alpha1.User, base v1.Image, layerMediaType types.MediaType, creationTime time.Time, windows bool) ([]mutate.Addendum, string, error) {
+	if windows {
+		return nil, "", fmt.Errorf("user %s: the users are not added to the windows images", user.Name)
+	}
+	group := user.Group
+	if group == "" {
+		group = user.Name
+	}
+	gidNum := user.UID
+	if user.GID != nil {
+		gidNum = *user.GID
+	}
+	uid := strconv.FormatInt(user.UID, 10)
+	gid := strconv.FormatInt(gidNum, 10)
+	home := user.Home
+	if home == "" {
+		home = path.Join("/home", user.Name)
+	}
+	shell := user.Shell
+	if shell == "" {
+		shell = "/sbin/nologin"
+	}
+	for _, field := range []string{user.Name, group, home, shell} {
+		if field == "" || strings.ContainsAny(field, ":\n") {
+			return nil, "", fmt.Errorf("user %s: invalid field %q", user.Name, field)
+		}
+	}
+
+	passwd, err := readOptionalBaseFile(base, "/etc/passwd")
+	if err != nil {
+		return nil, "", fmt.Errorf("user %s: %w", user.Name, err)
+	}
+	groups, err := readOptionalBaseFile(base, "/etc/group")
+	if err != nil {
+		return nil, "", fmt.Errorf("user %s: %w", user.Name, err)
+	}
+	shadow, err := readOptionalBaseFile(base, "/etc/shadow")
+	if err != nil {
+		return nil, "", fmt.Errorf("user %s: %w", user.Name, err)
+	}
+
+	exists, err := findEntry(passwd, user.Name, uid, "user", "uid")
+	if err != nil {
+		return nil, "", fmt.Errorf("user %s: %w", user.Name, err)
+	}
+	if !exists {
+		passwd.append([]byte(strings.Join([]string{user.Name, "x", uid, gid, user.Name, home, shell}, ":") + "\n"))
+		// The password is locked, the base images without the shadow file have none.
+		if shadow.header != nil {
+			shadowExists, err := findEntry(shadow, user.Name, "", "user", "")
+			if err != nil {
+				return nil, "", fmt.Errorf("user %s: %w", user.Name, err)
+			}
+			if !shadowExists {
+				shadow.append([]byte(user.Name + ":!:::::::\n"))
+			}
+		}
+	}
+
+	// The group of the base image with the gid is the primary group whatever its name.
+	groupExists, err := findEntry(groups, group, gid, "group", "")
+	if err != nil {
+		return nil, "", fmt.Errorf("user %s: %w", user.Name, err)
+	}
+	if !groupExists && !hasID(groups, gid) {
+		groups.append([]byte(strings.Join([]string{group, "x", gid, ""}, ":") + "\n"))
+	}
+
+	builder := NewFileLayerBuilder(b.client, b.cacheTmp, 0644, creationTime, layerMediaType, 0, windows)
+	addendums, err := builder.build(ctx, func(tw *tarWriter) error {
+		for _, f := range []*baseFile{passwd, groups, shadow} {
+			if !f.changed {
+				continue
+			}
+			header := f.header
+			if header == nil {
+				header = &tar.Header{Mode: 0644}
+			}
+			err := tarBaseFile(tw, f.name, header, f.content, creationTime)
+			if err != nil {
+				return err
+			}
+		}
+		if home == "/" || home == "/nonexistent" {
+			return nil
+		}
+		err := sandboxFrom(ctx).addFile(home, 0)
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:     strings.TrimSuffix(home, "/") + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			Uid:      int(user.UID),
+			Gid:      int(gidNum),
+			ModTime:  creationTime,
+		})
+		if err != nil {
+			return fmt.Errorf("tar.Writer.WriteHeader(%q): %w", home, err)
+		}
+		tw.entries++
+		return nil
+	}, v1.History{
+		Created:   v1.Time{Time: creationTime},
+		Author:    "jitdi",
+		CreatedBy: fmt.Sprintf("USERADD %s %s:%s", user.Name, uid, gid),
+		Comment:   fmt.Sprintf("Add the user %s", user.Name),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("file layer builder: %w", err)
+	}
+	return addendums, fmt.Sprintf("user %s %s:%s", user.Name, uid, gid), nil
+}
+
+// findEntry reports whether the file has the entry of the name with the id, the id of the third field is not checked if empty,
+// and fails if the name has another id or, if the idKind is not empty, the id has another name.
+func findEntry(f *baseFile, name, id, nameKind, idKind string) (bool, error) {
+	for _, line := range strings.Split(string(f.content), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 && id != "" {
+			continue
+		}
+		switch {
+		case fields[0] == name:
+			if id != "" && fields[2] != id {
+				return false, fmt.Errorf("%s: the %s %s has the id %s", f.name, nameKind, name, fields[2])
+			}
+			return true, nil
+		case idKind != "" && fields[2] == id:
+			return false, fmt.Errorf("%s: the %s %s is used by %s", f.name, idKind, id, fields[0])
+		}
+	}
+	return false, nil
+}
+
+// hasID reports whether the file has an entry with the id in the third field.
+func hasID(f *baseFile, id string) bool {
+	for _, line := range strings.Split(string(f.content), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) >= 3 && fields[2] == id {
+			return true
+		}
+	}
+	return false
+}
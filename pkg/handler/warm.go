@@ -0,0 +1,341 @@
+package handler
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/wzshiming/jitdi/pkg/atomic"
+	"github.com/wzshiming/jitdi/pkg/logging"
+	"github.com/wzshiming/jitdi/pkg/metadata"
+)
+
+// warmState is the progress of the startup warm, the instance is not ready until it is done.
+type warmState struct {
+	mut    sync.Mutex
+	done   bool
+	warmed int
+	total  int
+}
+
+func (s *warmState) check() ReadyCheck {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	check := ReadyCheck{Name: "warm", OK: s.done}
+	if !check.OK {
+		check.Message = fmt.Sprintf("%d of %d tags warmed", s.warmed, s.total)
+	}
+	return check
+}
+
+// warmer loads the hottest tags on start, so that a new instance does not send all the first pulls of its clients
+// to the disk of the cache or to the upstream registries at once.
+type warmer struct {
+	logger *slog.Logger
+	state  *warmState
+
+	top    int
+	peer   string
+	token  string
+	client *http.Client
+}
+
+func newWarmer(top int, peer, token string, transport http.RoundTripper) (*warmer, error) {
+	if top <= 0 {
+		return nil, nil
+	}
+	if peer != "" {
+		u, err := url.Parse(peer)
+		if err != nil {
+			return nil, fmt.Errorf("warm peer %q: %w", peer, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("warm peer %q: must be a http or https url", peer)
+		}
+	}
+	return &warmer{
+		logger: slog.Default().With(logging.ComponentKey, "warm"),
+		state:  &warmState{},
+		top:    top,
+		peer:   strings.TrimSuffix(peer, "/"),
+		token:  token,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+// runWarm copies the hottest tags of the peer into the cache if there is a peer,
+// and loads the hottest tags of the cache.
+func (h *Handler) runWarm(ctx context.Context) {
+	w := h.warmer
+	start := time.Now()
+	defer func() {
+		w.state.mut.Lock()
+		w.state.done = true
+		w.state.mut.Unlock()
+	}()
+
+	var tags []metadata.Tag
+	var err error
+	if w.peer != "" {
+		tags, err = w.peerTags(ctx)
+	} else {
+		tags, err = h.image.index.List()
+	}
+	if err != nil {
+		w.logger.Error("list the tags to warm", "peer", w.peer, "err", err)
+		return
+	}
+	tags = hottestTags(tags, w.top)
+	w.state.mut.Lock()
+	w.state.total = len(tags)
+	w.state.mut.Unlock()
+
+	for _, tag := range tags {
+		if w.peer != "" {
+			err = h.warmFromPeer(ctx, tag)
+			if err != nil {
+				w.logger.Error("copy the tag from the peer", "image", tag.Image, "tag", tag.Tag, "err", err)
+				continue
+			}
+		}
+		h.image.warmTag(tag.Image, tag.Tag)
+		w.state.mut.Lock()
+		w.state.warmed++
+		w.state.mut.Unlock()
+	}
+	w.logger.Info("warm done", "peer", w.peer, "tags", len(tags), "duration", time.Since(start))
+}
+
+// hottestTags returns the top tags accessed the most recently, then the ones built the most recently.
+func hottestTags(tags []metadata.Tag, top int) []metadata.Tag {
+	lastUsed := func(tag metadata.Tag) time.Time {
+		if tag.AccessTime != nil && tag.AccessTime.After(tag.BuildTime) {
+			return *tag.AccessTime
+		}
+		return tag.BuildTime
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return lastUsed(tags[i]).After(lastUsed(tags[j]))
+	})
+	if len(tags) > top {
+		tags = tags[:top]
+	}
+	return tags
+}
+
+// warmTag loads the manifests and the blobs small enough for the memory cache of the tag,
+// and reads the other blobs so that the page cache of the node holds them.
+func (b *imageBuilder) warmTag(image, tag string) {
+	_, err := b.readManifest(b.ManifestPath(image, tag))
+	if err != nil {
+		return
+	}
+	record, ok, err := b.index.Get(image, tag)
+	if err != nil || !ok {
+		return
+	}
+	for _, blob := range record.Blobs {
+		blobPath := b.BlobsPath(blob)
+		if _, ok := b.readSmallBlob(blobPath); ok {
+			continue
+		}
+		f, err := os.Open(blobPath)
+		if err != nil {
+			continue
+		}
+		_, _ = io.Copy(io.Discard, f)
+		f.Close()
+	}
+}
+
+// peerTags lists the tags built by the peer.
+func (w *warmer) peerTags(ctx context.Context) ([]metadata.Tag, error) {
+	resp, err := w.get(ctx, "/admin/tags")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var infos []TagInfo
+	err = json.NewDecoder(resp.Body).Decode(&infos)
+	if err != nil {
+		return nil, fmt.Errorf("decode the tags of the peer: %w", err)
+	}
+	tags := make([]metadata.Tag, 0, len(infos))
+	for _, info := range infos {
+		tags = append(tags, info.Tag)
+	}
+	return tags, nil
+}
+
+func (w *warmer) get(ctx context.Context, uri string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.peer+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("peer %s: status code %d: %s", w.peer, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// warmFromPeer copies the tag from the OCI image layout exported by the peer into the cache,
+// unless the cache has the same build of the tag.
+func (h *Handler) warmFromPeer(ctx context.Context, tag metadata.Tag) error {
+	if current, ok, err := h.image.index.Get(tag.Image, tag.Tag); err == nil && ok && current.Digest == tag.Digest &&
+		fileExists(h.image.ManifestPath(tag.Image, tag.Tag)) {
+		return nil
+	}
+	return h.lockTag(tag.Image, tag.Tag, func() error {
+		resp, err := h.warmer.get(ctx, "/admin/export?ref="+url.QueryEscape(tag.Image+":"+tag.Tag))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		err = h.image.importLayout(tag.Image, tag.Tag, resp.Body)
+		if err != nil {
+			return err
+		}
+		return h.image.indexTag(tag.Image, tag.Tag, h.matchRule(tag.Image, tag.Tag), nil)
+	})
+}
+
+// importLayout writes the blobs of the tarball of an OCI image layout of a single image or index into the cache,
+// and then the root manifest as the tag.
+func (b *imageBuilder) importLayout(image, tag string, r io.Reader) error {
+	var root *v1.Descriptor
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("read layout: %w", err)
+		}
+		switch {
+		case hdr.Name == "index.json":
+			var index v1.IndexManifest
+			err = json.NewDecoder(tr).Decode(&index)
+			if err != nil {
+				return fmt.Errorf("decode layout index: %w", err)
+			}
+			if len(index.Manifests) != 1 {
+				return fmt.Errorf("layout index has %d manifests, want 1", len(index.Manifests))
+			}
+			root = &index.Manifests[0]
+		case strings.HasPrefix(hdr.Name, "blobs/sha256/"):
+			digest := "sha256:" + path.Base(hdr.Name)
+			if !digestRegexp.MatchString(digest) {
+				return fmt.Errorf("invalid blob %q in layout", hdr.Name)
+			}
+			if fileExists(b.BlobsPath(digest)) {
+				continue
+			}
+			err = writeVerifiedBlob(b.BlobsPath(digest), digest, tr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if root == nil {
+		return fmt.Errorf("no index in layout")
+	}
+
+	raw, err := os.ReadFile(b.BlobsPath(root.Digest.String()))
+	if err != nil {
+		return fmt.Errorf("read manifest %s: %w", root.Digest, err)
+	}
+	err = b.saveMediaTypes(raw)
+	if err != nil {
+		return err
+	}
+	manifestPath := b.ManifestPath(image, tag)
+	err = atomic.WriteFile(manifestPath, raw, 0644)
+	if err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	b.memory.remove(manifestPath)
+	return nil
+}
+
+// saveMediaTypes records the media types of the blobs referenced by the manifest or index, and by the manifests of the index.
+func (b *imageBuilder) saveMediaTypes(raw []byte) error {
+	var manifest struct {
+		Config    *v1.Descriptor  `json:"config,omitempty"`
+		Layers    []v1.Descriptor `json:"layers,omitempty"`
+		Manifests []v1.Descriptor `json:"manifests,omitempty"`
+	}
+	err := json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return err
+	}
+	descs := manifest.Layers
+	if manifest.Config != nil {
+		descs = append(descs, *manifest.Config)
+	}
+	for _, desc := range append(descs, manifest.Manifests...) {
+		err = saveMediaType(b.cacheMediaTypes, desc.Digest, desc.MediaType)
+		if err != nil {
+			return err
+		}
+	}
+	for _, desc := range manifest.Manifests {
+		child, err := os.ReadFile(b.BlobsPath(desc.Digest.String()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		err = b.saveMediaTypes(child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeVerifiedBlob writes the blob read from r, which must have the digest.
+func writeVerifiedBlob(blobPath, digest string, r io.Reader) error {
+	f, err := atomic.OpenFileWithWriter(blobPath, 0644)
+	if err != nil {
+		return fmt.Errorf("create blob %s: %w", digest, err)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), r)
+	if err != nil {
+		_ = f.Abort()
+		return fmt.Errorf("write blob %s: %w", digest, err)
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+		_ = f.Abort()
+		return fmt.Errorf("blob %s: digest mismatch, got %s", digest, got)
+	}
+	return f.Close()
+}
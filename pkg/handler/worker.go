@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/wzshiming/jitdi/pkg/buildapi"
+)
+
+// buildWorker sends the builds of a frontend to the workers behind the target,
+// which write the built images to the cache shared with the frontend.
+type buildWorker struct {
+	conn   *grpc.ClientConn
+	client buildapi.WorkerClient
+	target string
+	token  string
+}
+
+// newBuildWorker connects to the gRPC Worker service of the workers behind the target,
+// over TLS if withTLS, the connection is established on the first build.
+// The builds are balanced over the addresses the target resolves to.
+func newBuildWorker(target, token string, withTLS bool) (*buildWorker, error) {
+	if target == "" {
+		return nil, nil
+	}
+	creds := insecure.NewCredentials()
+	if withTLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.Dial(target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"round_robin":{}}]}`),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &buildWorker{
+		conn:   conn,
+		client: buildapi.NewWorkerClient(conn),
+		target: target,
+		token:  token,
+	}, nil
+}
+
+// build waits for a worker to build the tag.
+func (w *buildWorker) build(ctx context.Context, image, tag string) (*buildapi.WorkerBuildResponse, error) {
+	if w.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+w.token)
+	}
+	result, err := w.client.Build(ctx, &buildapi.WorkerBuildRequest{
+		Image: image,
+		Tag:   tag,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("worker %s: %w", w.target, err)
+	}
+	return result, nil
+}
+
+func (w *buildWorker) Close() error {
+	return w.conn.Close()
+}
+
+// workerServer builds the tags requested by the frontends, it is served by the gRPC server of the handler.
+type workerServer struct {
+	buildapi.UnimplementedWorkerServer
+	h *Handler
+}
+
+func (s *workerServer) Build(ctx context.Context, req *buildapi.WorkerBuildRequest) (*buildapi.WorkerBuildResponse, error) {
+	h := s.h
+	if h.readOnly {
+		return nil, grpcError(ErrReadOnly)
+	}
+	if req.Image == "" || req.Tag == "" {
+		return nil, status.Error(codes.InvalidArgument, "image and tag are required")
+	}
+
+	// The builds over the limit wait in line, until the frontend gives up.
+	if h.workerSlots != nil {
+		h.workerWaiting.Add(1)
+		select {
+		case h.workerSlots <- struct{}{}:
+			h.workerWaiting.Add(-1)
+			defer func() { <-h.workerSlots }()
+		case <-ctx.Done():
+			h.workerWaiting.Add(-1)
+			return nil, grpcError(ctx.Err())
+		}
+	}
+
+	err := h.build(ctx, req.Image, req.Tag)
+	if err != nil {
+		loggerFrom(ctx).Error("image.Build", "err", err)
+		return nil, grpcError(err)
+	}
+
+	result := &buildapi.WorkerBuildResponse{
+		Ref: req.Image + ":" + req.Tag,
+	}
+	entry, err := h.image.readManifest(h.image.ManifestPath(req.Image, req.Tag))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, grpcError(err)
+		}
+	} else {
+		result.Digest = entry.digest
+	}
+	return result, nil
+}
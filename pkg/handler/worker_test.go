@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// newTestWorker serves the gRPC server of a worker building into the cache and returns its address.
+func newTestWorker(t *testing.T, cache, host string) (*Handler, string) {
+	t.Helper()
+	h, err := NewHandler(cache, testBuildRules(host), nil, WithAdminToken("secret"), WithInsecureRegistries(host), WithWorkerConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := h.GRPCServer()
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return h, listener.Addr().String()
+}
+
+func TestBuildWorker(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{
+			name:  "built by the worker",
+			token: "secret",
+		},
+		{
+			name:    "wrong token",
+			token:   "wrong",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newSlowRegistry(t, 0, true)
+			cache := t.TempDir()
+			worker, target := newTestWorker(t, cache, host)
+			frontend, err := NewHandler(cache, testBuildRules(host), nil, WithBuildWorker(target, tt.token))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = frontend.Close() })
+
+			err = frontend.build(context.Background(), "a", "v1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("build error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if frontend.buildsRun.Load() != 0 {
+				t.Errorf("builds run by the frontend = %d, want 0", frontend.buildsRun.Load())
+			}
+			var wantRun int64
+			if !tt.wantErr {
+				wantRun = 1
+			}
+			if worker.buildsRun.Load() != wantRun {
+				t.Errorf("builds run by the worker = %d, want %d", worker.buildsRun.Load(), wantRun)
+			}
+			if tt.wantErr {
+				return
+			}
+			_, err = frontend.image.readManifest(frontend.image.ManifestPath("a", "v1"))
+			if err != nil {
+				t.Errorf("manifest built by the worker is not in the shared cache: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// ComponentKey is the attribute that the component of a logger is set with, e.g. logger.With(logging.ComponentKey, "rules").
+const ComponentKey = "component"
+
+// Options holds the options for the logger.
+type Options struct {
+	// Level is the minimum level logged, one of debug, info, warn or error, defaults to info.
+	Level string
+	// Format is the format of the logs, text or json, defaults to text.
+	Format string
+	// ComponentLevels overrides the level of the components, in the form of <component>=<level>.
+	ComponentLevels []string
+}
+
+// New returns a logger writing to the w configured with the options.
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if opts.Level != "" {
+		err := level.UnmarshalText([]byte(opts.Level))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %w", opts.Level, err)
+		}
+	}
+
+	minLevel := level
+	levels := make(map[string]slog.Level, len(opts.ComponentLevels))
+	for _, c := range opts.ComponentLevels {
+		component, l, ok := strings.Cut(c, "=")
+		if !ok || component == "" {
+			return nil, fmt.Errorf("invalid component level %q, must be <component>=<level>", c)
+		}
+		var cl slog.Level
+		err := cl.UnmarshalText([]byte(l))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level of component %q: %w", component, err)
+		}
+		levels[component] = cl
+		if cl < minLevel {
+			minLevel = cl
+		}
+	}
+
+	handlerOptions := &slog.HandlerOptions{
+		Level: minLevel,
+	}
+	var handler slog.Handler
+	switch opts.Format {
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be text or json", opts.Format)
+	case "", "text":
+		handler = slog.NewTextHandler(w, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	}
+
+	return slog.New(&componentHandler{
+		Handler: handler,
+		level:   level,
+		levels:  levels,
+	}), nil
+}
+
+// componentHandler is a slog.Handler that filters the records with the level of the component of the logger.
+type componentHandler struct {
+	slog.Handler
+	level  slog.Level
+	levels map[string]slog.Level
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.Handler.Enabled(ctx, level)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.Handler = h.Handler.WithAttrs(attrs)
+	for _, attr := range attrs {
+		if attr.Key != ComponentKey {
+			continue
+		}
+		if level, ok := h.levels[attr.Value.String()]; ok {
+			n.level = level
+		}
+	}
+	return &n
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	n := *h
+	n.Handler = h.Handler.WithGroup(name)
+	return &n
+}
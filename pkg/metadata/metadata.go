@@ -0,0 +1,346 @@
+// Package metadata indexes the tags built in the cache,
+// so that listing, garbage collection and invalidation do not have to read every manifest.
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wzshiming/jitdi/pkg/atomic"
+)
+
+// Tag is the metadata of a built tag.
+type Tag struct {
+	Image     string `json:"image"`
+	Tag       string `json:"tag"`
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType,omitempty"`
+	// AlternateDigest is the digest of the docker manifest of the tag when the output media type is "both".
+	AlternateDigest string `json:"alternateDigest,omitempty"`
+	// Rule is the name of the rule that built the tag and RuleHash the hash of its spec at the time of the build.
+	Rule     string `json:"rule,omitempty"`
+	RuleHash string `json:"ruleHash,omitempty"`
+	// Blobs are the digests of the blobs referenced by the tag, including the manifests.
+	Blobs      []string   `json:"blobs,omitempty"`
+	BuildTime  time.Time  `json:"buildTime"`
+	AccessTime *time.Time `json:"accessTime,omitempty"`
+	// History are the previous builds of the tag, the latest first, which the tag can be rolled back to.
+	History []Revision `json:"history,omitempty"`
+	// Canary is set while the build of the tag is only served to some of the clients.
+	Canary *Canary `json:"canary,omitempty"`
+	// Mutations are the layers of the mutations of the build by the fingerprints of their inputs,
+	// which the next build of the tag reuses for the mutations whose inputs are unchanged.
+	Mutations []Mutation `json:"mutations,omitempty"`
+}
+
+// Mutation is the layers added by a mutation of a build.
+type Mutation struct {
+	// Fingerprint is the hash of the inputs of the mutation, the mutate, the parameters and the files it reads.
+	Fingerprint string `json:"fingerprint"`
+	// Description is what the mutation adds, as in the history of the image.
+	Description string  `json:"description,omitempty"`
+	Layers      []Layer `json:"layers,omitempty"`
+}
+
+// Layer is a layer added by a mutation.
+type Layer struct {
+	Digest      string            `json:"digest"`
+	DiffID      string            `json:"diffID"`
+	Size        int64             `json:"size"`
+	MediaType   string            `json:"mediaType,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Created, CreatedBy and Comment are the history entry of the layer.
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// Canary is the soak of a rebuilt tag.
+type Canary struct {
+	// Stable is the build served to the clients out of the canary.
+	Stable Revision `json:"stable"`
+	// Until is when the build is promoted and served to all the clients.
+	Until time.Time `json:"until"`
+}
+
+// Revision is a build of a tag.
+type Revision struct {
+	Digest          string    `json:"digest"`
+	MediaType       string    `json:"mediaType,omitempty"`
+	AlternateDigest string    `json:"alternateDigest,omitempty"`
+	Rule            string    `json:"rule,omitempty"`
+	RuleHash        string    `json:"ruleHash,omitempty"`
+	Blobs           []string  `json:"blobs,omitempty"`
+	BuildTime       time.Time `json:"buildTime"`
+}
+
+// Revision returns the current build of the tag.
+func (t Tag) Revision() Revision {
+	return Revision{
+		Digest:          t.Digest,
+		MediaType:       t.MediaType,
+		AlternateDigest: t.AlternateDigest,
+		Rule:            t.Rule,
+		RuleHash:        t.RuleHash,
+		Blobs:           t.Blobs,
+		BuildTime:       t.BuildTime,
+	}
+}
+
+// Index records the metadata of the tags, the implementations must be safe for concurrent use.
+type Index interface {
+	// Put records the tag, replacing the previous record of the same image and tag.
+	Put(tag Tag) error
+	// Get returns the record of the tag.
+	Get(image, tag string) (Tag, bool, error)
+	// Delete removes the record of the tag.
+	Delete(image, tag string) error
+	// List returns the records of all the tags sorted by image and tag.
+	List() ([]Tag, error)
+	// Touch sets the access time of the tag, it may be persisted lazily.
+	Touch(image, tag string, t time.Time) error
+	// Close persists the pending changes.
+	Close() error
+}
+
+const (
+	// touchFlushInterval is how often the access times alone are persisted by the FileIndex.
+	touchFlushInterval = time.Minute
+
+	// reloadInterval is how often the FileIndex checks whether the file was written by another instance sharing it.
+	reloadInterval = time.Second
+
+	// lockStale is how long the lock file of the FileIndex is kept before the instance holding it is considered gone.
+	lockStale = 10 * time.Second
+
+	// lockPoll is how often the lock file of the FileIndex is tried while another instance holds it.
+	lockPoll = 10 * time.Millisecond
+)
+
+// FileIndex is an Index kept in memory and persisted to a JSON file, which can be shared by several instances:
+// the changes are merged into the records of the file under a lock file, and the file is read again when another instance writes it.
+type FileIndex struct {
+	path string
+
+	mut       sync.Mutex
+	tags      map[string]Tag
+	touches   map[string]time.Time
+	loaded    os.FileInfo
+	lastCheck time.Time
+	lastFlush time.Time
+}
+
+// NewFileIndex loads the index persisted to the file, it is empty if the file does not exist.
+func NewFileIndex(path string) (*FileIndex, error) {
+	idx := &FileIndex{
+		path:      path,
+		tags:      map[string]Tag{},
+		touches:   map[string]time.Time{},
+		lastFlush: time.Now(),
+	}
+	err := idx.load()
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func key(image, tag string) string {
+	return image + ":" + tag
+}
+
+// load reads the records of the file, with the access times not persisted yet on top of them.
+func (i *FileIndex) load() error {
+	i.lastCheck = time.Now()
+	stat, err := os.Stat(i.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	raw, err := os.ReadFile(i.path)
+	if err != nil {
+		return err
+	}
+	var tags []Tag
+	err = json.Unmarshal(raw, &tags)
+	if err != nil {
+		return err
+	}
+	i.tags = make(map[string]Tag, len(tags))
+	for _, tag := range tags {
+		i.tags[key(tag.Image, tag.Tag)] = tag
+	}
+	for k, t := range i.touches {
+		i.touch(k, t)
+	}
+	i.loaded = stat
+	return nil
+}
+
+// reload reads the file again if another instance wrote it since it was read.
+func (i *FileIndex) reload() error {
+	if time.Since(i.lastCheck) < reloadInterval {
+		return nil
+	}
+	i.lastCheck = time.Now()
+	stat, err := os.Stat(i.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if i.loaded != nil && stat.ModTime().Equal(i.loaded.ModTime()) && stat.Size() == i.loaded.Size() {
+		return nil
+	}
+	return i.load()
+}
+
+func (i *FileIndex) Put(tag Tag) error {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.update(func() {
+		i.tags[key(tag.Image, tag.Tag)] = tag
+	})
+}
+
+func (i *FileIndex) Get(image, tag string) (Tag, bool, error) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	err := i.reload()
+	if err != nil {
+		return Tag{}, false, err
+	}
+	t, ok := i.tags[key(image, tag)]
+	return t, ok, nil
+}
+
+func (i *FileIndex) Delete(image, tag string) error {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.update(func() {
+		delete(i.tags, key(image, tag))
+	})
+}
+
+func (i *FileIndex) List() ([]Tag, error) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	err := i.reload()
+	if err != nil {
+		return nil, err
+	}
+	return i.list(), nil
+}
+
+func (i *FileIndex) list() []Tag {
+	tags := make([]Tag, 0, len(i.tags))
+	for _, tag := range i.tags {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(a, b int) bool {
+		if tags[a].Image != tags[b].Image {
+			return tags[a].Image < tags[b].Image
+		}
+		return tags[a].Tag < tags[b].Tag
+	})
+	return tags
+}
+
+func (i *FileIndex) Touch(image, tag string, t time.Time) error {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	k := key(image, tag)
+	if _, ok := i.tags[k]; !ok {
+		return nil
+	}
+	i.touches[k] = t
+	i.touch(k, t)
+	if time.Since(i.lastFlush) < touchFlushInterval {
+		return nil
+	}
+	return i.update(func() {})
+}
+
+// touch sets the access time of the record, unless it was accessed later, e.g. through another instance.
+func (i *FileIndex) touch(k string, t time.Time) {
+	record, ok := i.tags[k]
+	if !ok || record.AccessTime != nil && !record.AccessTime.Before(t) {
+		return
+	}
+	record.AccessTime = &t
+	i.tags[k] = record
+}
+
+func (i *FileIndex) Close() error {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	if len(i.touches) == 0 {
+		return nil
+	}
+	return i.update(func() {})
+}
+
+// update applies the change and the access times not persisted yet to the records of the file,
+// and writes them back under the lock file so that the changes of the other instances are not lost.
+func (i *FileIndex) update(change func()) error {
+	unlock, err := i.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = i.load()
+	if err != nil {
+		return err
+	}
+	change()
+	raw, err := json.Marshal(i.list())
+	if err != nil {
+		return err
+	}
+	err = atomic.WriteFile(i.path, raw, 0644)
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Stat(i.path); err == nil {
+		i.loaded = stat
+	}
+	clear(i.touches)
+	i.lastFlush = time.Now()
+	return nil
+}
+
+// lock creates the lock file of the index, waiting for the other instances holding it,
+// and returns the function removing it.
+func (i *FileIndex) lock() (func(), error) {
+	p := i.path + ".lock"
+	for {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			err = f.Close()
+			if err != nil {
+				_ = os.Remove(p)
+				return nil, err
+			}
+			return func() {
+				_ = os.Remove(p)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("lock metadata index: %w", err)
+		}
+		if stat, err := os.Stat(p); err == nil && time.Since(stat.ModTime()) > lockStale {
+			// The instance holding the lock was killed while writing the file, which is written atomically.
+			_ = os.Remove(p)
+			continue
+		}
+		time.Sleep(lockPoll)
+	}
+}
@@ -0,0 +1,68 @@
+package metadata
+
+import (
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileIndexShared(t *testing.T) {
+	p := path.Join(t.TempDir(), "index.json")
+	a, err := NewFileIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewFileIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for n, idx := range []*FileIndex{a, b} {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(image string, i int) {
+				defer wg.Done()
+				err := idx.Put(Tag{Image: image, Tag: string(rune('a' + i))})
+				if err != nil {
+					t.Error(err)
+				}
+			}(string(rune('x'+n)), i)
+		}
+	}
+	wg.Wait()
+
+	err = a.Delete("y", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := time.Now().Truncate(time.Second)
+	err = b.Touch("x", "b", access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewFileIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 19 {
+		t.Fatalf("got %d tags, want 19", len(tags))
+	}
+	if _, ok, _ := c.Get("y", "a"); ok {
+		t.Errorf("y:a is not deleted")
+	}
+	tag, ok, _ := c.Get("x", "b")
+	if !ok || tag.AccessTime == nil || !tag.AccessTime.Equal(access) {
+		t.Errorf("x:b access time = %v, want %v", tag.AccessTime, access)
+	}
+}
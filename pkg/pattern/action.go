@@ -1,7 +1,9 @@
 package pattern
 
 import (
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/v1"
 
@@ -17,17 +19,129 @@ func (r *Action) GetBaseImage() string {
 	return replaceWithParams(r.rule.baseImage, r.params)
 }
 
+// Params returns the parameters of the match.
+func (r *Action) Params() map[string]string {
+	return r.params
+}
+
+func (r *Action) Rule() *Rule {
+	return r.rule
+}
+
+func (r *Action) IsInsecure() bool {
+	return r.rule.insecure
+}
+
+func (r *Action) OutputMediaType() string {
+	return r.rule.outputMediaType
+}
+
+// DigestAlgorithm returns the algorithm of the digests of the manifests of the tag, sha256 or sha512.
+func (r *Action) DigestAlgorithm() string {
+	return r.rule.DigestAlgorithm()
+}
+
+// IsReproducible reports whether the layers are built with pinned timestamps.
+func (r *Action) IsReproducible() bool {
+	return r.rule.reproducible
+}
+
+// DropLayers returns the indexes or the digests of the layers of the base image removed before the mutations.
+func (r *Action) DropLayers() []string {
+	return r.rule.dropLayers
+}
+
+// EncryptionRecipients returns the public keys of the recipients of the layers added by the mutations,
+// which are not encrypted if empty.
+func (r *Action) EncryptionRecipients() []string {
+	return r.rule.recipients
+}
+
+// Created returns the created timestamp of the built images, the buildTime if the rule sets the time of the build,
+// false if the one of the base image is kept.
+func (r *Action) Created(buildTime time.Time) (time.Time, bool) {
+	switch r.rule.created {
+	case "", v1alpha1.CreatedUpstream:
+		return time.Time{}, false
+	case v1alpha1.CreatedBuild:
+		return buildTime, true
+	}
+	return r.rule.createdTime, true
+}
+
+// GetAnnotations returns the annotations of the built manifests,
+// the ones of the rule with the parameters replaced and the ones identifying the Image of the rule.
+func (r *Action) GetAnnotations() map[string]string {
+	annotations := make(map[string]string, len(r.rule.annotations)+3)
+	for k, v := range r.rule.annotations {
+		annotations[k] = replaceWithParams(v, r.params)
+	}
+
+	image := r.rule.image
+	if image.Name != "" {
+		annotations[v1alpha1.AnnotationImage] = image.Name
+	}
+	if image.Namespace != "" {
+		annotations[v1alpha1.AnnotationNamespace] = image.Namespace
+	}
+	if image.Generation != 0 {
+		annotations[v1alpha1.AnnotationGeneration] = strconv.FormatInt(image.Generation, 10)
+	}
+	return annotations
+}
+
+// MatchPlatform reports whether the image of the platform should be built by the rule.
+func (r *Action) MatchPlatform(p *v1.Platform) bool {
+	if len(r.rule.platforms) == 0 {
+		return true
+	}
+	if p == nil {
+		p = &v1.Platform{OS: "linux", Architecture: "amd64"}
+	}
+	for _, want := range r.rule.platforms {
+		if matchPlatform(want, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPlatform(want v1alpha1.Platform, p *v1.Platform) bool {
+	if want.OS != "" && want.OS != p.OS {
+		return false
+	}
+	if want.Architecture != "" && want.Architecture != p.Architecture {
+		return false
+	}
+	if want.Variant != "" && want.Variant != p.Variant {
+		return false
+	}
+	if want.OSVersion != "" && want.OSVersion != p.OSVersion && !strings.HasPrefix(p.OSVersion, want.OSVersion+".") {
+		return false
+	}
+	return true
+}
+
 func (r *Action) GetMutates(p *v1.Platform) []v1alpha1.Mutate {
-	mutates := r.rule.mutates
-	params := r.params
+	return replaceMutateWithParams(r.rule.mutates, r.GetParams(p))
+}
+
+// GetParams returns the parameters of match and of the platform, that the parameters of the mutates are replaced with.
+func (r *Action) GetParams(p *v1.Platform) map[string]string {
+	params := make(map[string]string, len(r.params)+4)
+	for k, v := range r.params {
+		params[k] = v
+	}
 	if p == nil {
 		params["GOOS"] = "linux"
 		params["GOARCH"] = "amd64"
 	} else {
 		params["GOOS"] = p.OS
 		params["GOARCH"] = p.Architecture
+		params["OSVERSION"] = p.OSVersion
+		params["VARIANT"] = p.Variant
 	}
-	return replaceMutateWithParams(mutates, r.params)
+	return params
 }
 
 func replaceWithParams(s string, params map[string]string) string {
@@ -37,6 +151,28 @@ func replaceWithParams(s string, params map[string]string) string {
 	return s
 }
 
+func replaceSliceWithParams(s []string, params map[string]string) []string {
+	if s == nil {
+		return nil
+	}
+	out := make([]string, 0, len(s))
+	for _, v := range s {
+		out = append(out, replaceWithParams(v, params))
+	}
+	return out
+}
+
+func replaceExtractWithParams(e *v1alpha1.Extract, params map[string]string) *v1alpha1.Extract {
+	if e == nil {
+		return nil
+	}
+	return &v1alpha1.Extract{
+		StripComponents: e.StripComponents,
+		Include:         replaceSliceWithParams(e.Include, params),
+		Exclude:         replaceSliceWithParams(e.Exclude, params),
+	}
+}
+
 func replaceMutateWithParams(m []v1alpha1.Mutate, params map[string]string) []v1alpha1.Mutate {
 	ms := make([]v1alpha1.Mutate, 0, len(m))
 	for _, v := range m {
@@ -44,9 +180,15 @@ func replaceMutateWithParams(m []v1alpha1.Mutate, params map[string]string) []v1
 			ms = append(ms, v1alpha1.Mutate{
 				File: &v1alpha1.File{
 					Source:      replaceWithParams(v.File.Source, params),
+					Template:    replaceWithParams(v.File.Template, params),
 					Destination: replaceWithParams(v.File.Destination, params),
 					Mode:        v.File.Mode,
+					ChunkSize:   v.File.ChunkSize,
+					Extract:     replaceExtractWithParams(v.File.Extract, params),
+					Replaces:    v.File.Replaces,
 				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
 			})
 		} else if v.Ollama != nil {
 			ms = append(ms, v1alpha1.Mutate{
@@ -55,6 +197,131 @@ func replaceMutateWithParams(m []v1alpha1.Mutate, params map[string]string) []v1
 					WorkDir:   replaceWithParams(v.Ollama.WorkDir, params),
 					ModelName: replaceWithParams(v.Ollama.ModelName, params),
 				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
+			})
+		} else if v.Render != nil {
+			var values map[string]string
+			if v.Render.Values != nil {
+				values = make(map[string]string, len(v.Render.Values))
+				for k, value := range v.Render.Values {
+					values[k] = replaceWithParams(value, params)
+				}
+			}
+			// The template is rendered with the parameters instead.
+			ms = append(ms, v1alpha1.Mutate{
+				Render: &v1alpha1.Render{
+					Template:    v.Render.Template,
+					Source:      replaceWithParams(v.Render.Source, params),
+					Values:      values,
+					Destination: replaceWithParams(v.Render.Destination, params),
+					Mode:        v.Render.Mode,
+				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
+			})
+		} else if v.Patch != nil {
+			var set map[string]string
+			if v.Patch.Set != nil {
+				set = make(map[string]string, len(v.Patch.Set))
+				for k, value := range v.Patch.Set {
+					set[replaceWithParams(k, params)] = replaceWithParams(value, params)
+				}
+			}
+			ms = append(ms, v1alpha1.Mutate{
+				Patch: &v1alpha1.Patch{
+					Path:       replaceWithParams(v.Patch.Path, params),
+					Format:     v.Patch.Format,
+					MergePatch: replaceWithParams(v.Patch.MergePatch, params),
+					Set:        set,
+				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
+			})
+		} else if v.Config != nil {
+			var healthcheck *v1alpha1.Healthcheck
+			if hc := v.Config.Healthcheck; hc != nil {
+				healthcheck = &v1alpha1.Healthcheck{
+					Test:        replaceSliceWithParams(hc.Test, params),
+					Interval:    hc.Interval,
+					Timeout:     hc.Timeout,
+					StartPeriod: hc.StartPeriod,
+					Retries:     hc.Retries,
+				}
+			}
+			ms = append(ms, v1alpha1.Mutate{
+				Config: &v1alpha1.Config{
+					Healthcheck:  healthcheck,
+					StopSignal:   v.Config.StopSignal,
+					ExposedPorts: replaceSliceWithParams(v.Config.ExposedPorts, params),
+					Volumes:      replaceSliceWithParams(v.Config.Volumes, params),
+				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
+			})
+		} else if v.User != nil {
+			ms = append(ms, v1alpha1.Mutate{
+				User: &v1alpha1.User{
+					Name:  replaceWithParams(v.User.Name, params),
+					UID:   v.User.UID,
+					Group: replaceWithParams(v.User.Group, params),
+					GID:   v.User.GID,
+					Home:  replaceWithParams(v.User.Home, params),
+					Shell: v.User.Shell,
+				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
+			})
+		} else if v.TrustedCA != nil {
+			ms = append(ms, v1alpha1.Mutate{
+				TrustedCA: &v1alpha1.TrustedCA{
+					Sources:      replaceSliceWithParams(v.TrustedCA.Sources, params),
+					Certificates: v.TrustedCA.Certificates,
+				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
+			})
+		} else if v.Binary != nil {
+			var sources map[string]string
+			if v.Binary.Sources != nil {
+				sources = make(map[string]string, len(v.Binary.Sources))
+				for platform, source := range v.Binary.Sources {
+					sources[platform] = replaceWithParams(source, params)
+				}
+			}
+			ms = append(ms, v1alpha1.Mutate{
+				Binary: &v1alpha1.Binary{
+					Sources:     sources,
+					Index:       replaceWithParams(v.Binary.Index, params),
+					Destination: replaceWithParams(v.Binary.Destination, params),
+					Mode:        v.Binary.Mode,
+					Optional:    v.Binary.Optional,
+				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
+			})
+		} else if v.Locale != nil {
+			ms = append(ms, v1alpha1.Mutate{
+				Locale: &v1alpha1.Locale{
+					Timezone: replaceWithParams(v.Locale.Timezone, params),
+					Lang:     replaceWithParams(v.Locale.Lang, params),
+				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
+			})
+		} else if v.HuggingFace != nil {
+			ms = append(ms, v1alpha1.Mutate{
+				HuggingFace: &v1alpha1.HuggingFace{
+					Repo:      replaceWithParams(v.HuggingFace.Repo, params),
+					Revision:  replaceWithParams(v.HuggingFace.Revision, params),
+					Token:     v.HuggingFace.Token,
+					Include:   replaceSliceWithParams(v.HuggingFace.Include, params),
+					Exclude:   replaceSliceWithParams(v.HuggingFace.Exclude, params),
+					ChunkSize: v.HuggingFace.ChunkSize,
+					WorkDir:   replaceWithParams(v.HuggingFace.WorkDir, params),
+				},
+				CachePriority: v.CachePriority,
+				LayerOrder:    v.LayerOrder,
 			})
 		}
 	}
@@ -0,0 +1,208 @@
+package pattern
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+)
+
+// IsTemplate reports whether the image is a template, which matches nothing and only serves as a base of the rules extending it.
+func IsTemplate(image *v1alpha1.Image) bool {
+	return image.Spec.Match == "" && image.Spec.Rewrite == nil
+}
+
+// NewRules creates the rules of the images that are not templates, with their specs composed onto the ones of the rules they extend
+// and of the ClusterImageTemplates they reference. The rules extended are looked up by name in the images and then in the bases,
+// the images that fail are passed to the onError and skipped.
+func NewRules(images, bases []*v1alpha1.Image, templates []*v1alpha1.ClusterImageTemplate, onError func(image *v1alpha1.Image, err error)) []*Rule {
+	byName := map[string]*v1alpha1.Image{}
+	for _, list := range [][]*v1alpha1.Image{images, bases} {
+		for _, image := range list {
+			// The first of the rules of the same name is extended.
+			if _, ok := byName[image.Name]; !ok {
+				byName[image.Name] = image
+			}
+		}
+	}
+
+	c := composer{
+		byName:    byName,
+		templates: map[string]*v1alpha1.ClusterImageTemplate{},
+		composed:  map[string]*v1alpha1.ImageSpec{},
+	}
+	for _, t := range templates {
+		c.templates[t.Name] = t
+	}
+	rules := make([]*Rule, 0, len(images))
+	for _, image := range images {
+		if IsTemplate(image) {
+			continue
+		}
+		spec, err := c.compose(image, nil)
+		if err == nil {
+			var rule *Rule
+			rule, err = newRule(image, spec)
+			if err == nil {
+				rules = append(rules, rule)
+				continue
+			}
+		}
+		onError(image, err)
+	}
+	return rules
+}
+
+type composer struct {
+	byName    map[string]*v1alpha1.Image
+	templates map[string]*v1alpha1.ClusterImageTemplate
+	composed  map[string]*v1alpha1.ImageSpec
+}
+
+// compose returns the spec of the image composed onto the ones of the rules it extends and of the templates it references,
+// the path is the rules extending it.
+func (c *composer) compose(image *v1alpha1.Image, path []string) (*v1alpha1.ImageSpec, error) {
+	if len(image.Spec.Extends) == 0 && len(image.Spec.Templates) == 0 {
+		return &image.Spec, nil
+	}
+	if spec, ok := c.composed[image.Name]; ok && c.byName[image.Name] == image {
+		return spec, nil
+	}
+	for _, name := range path {
+		if name == image.Name {
+			return nil, fmt.Errorf("extends cycle %s", strings.Join(append(path, image.Name), " -> "))
+		}
+	}
+	path = append(path, image.Name)
+
+	var spec v1alpha1.ImageSpec
+	for _, name := range image.Spec.Extends {
+		base, ok := c.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("extends %q: no such rule", name)
+		}
+		baseSpec, err := c.compose(base, path)
+		if err != nil {
+			return nil, err
+		}
+		overlaySpec(&spec, baseSpec)
+	}
+	for _, ref := range image.Spec.Templates {
+		t, ok := c.templates[ref.Name]
+		if !ok {
+			return nil, fmt.Errorf("template %q: no such ClusterImageTemplate", ref.Name)
+		}
+		templateSpec, err := expandTemplate(t, ref)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", ref.Name, err)
+		}
+		overlaySpec(&spec, templateSpec)
+	}
+	own := image.Spec.DeepCopy()
+	overlaySpec(&spec, own)
+	// The rule keeps its own matching and restrictions.
+	spec.Match, spec.Host, spec.ExcludeTags, spec.TagSemver, spec.Rewrite = own.Match, own.Host, own.ExcludeTags, own.TagSemver, own.Rewrite
+	spec.AllowedClients, spec.AllowedNamespaces = own.AllowedClients, own.AllowedNamespaces
+	spec.Reproducible, spec.Created = own.Reproducible, own.Created
+	spec.Extends, spec.Templates = own.Extends, own.Templates
+
+	if c.byName[image.Name] == image {
+		c.composed[image.Name] = &spec
+	}
+	return &spec, nil
+}
+
+// expandTemplate returns the mutations and the annotations of the template with the values of the parameters of the reference,
+// the other "{name}" are left to the parameters of match.
+func expandTemplate(t *v1alpha1.ClusterImageTemplate, ref v1alpha1.TemplateRef) (*v1alpha1.ImageSpec, error) {
+	declared := map[string]struct{}{}
+	var pairs, jsonPairs []string
+	for _, param := range t.Spec.Parameters {
+		declared[param.Name] = struct{}{}
+		value, ok := ref.Parameters[param.Name]
+		if !ok {
+			if param.Required {
+				return nil, fmt.Errorf("parameter %q is required", param.Name)
+			}
+			value = param.Default
+		}
+		escaped, _ := json.Marshal(value)
+		pairs = append(pairs, "{"+param.Name+"}", value)
+		jsonPairs = append(jsonPairs, "{"+param.Name+"}", string(escaped[1:len(escaped)-1]))
+	}
+	for name := range ref.Parameters {
+		if _, ok := declared[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+
+	spec := &v1alpha1.ImageSpec{}
+	if len(t.Spec.Mutates) != 0 {
+		raw, err := json.Marshal(t.Spec.Mutates)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(strings.NewReplacer(jsonPairs...).Replace(string(raw))), &spec.Mutates)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(t.Spec.Annotations) != 0 {
+		replacer := strings.NewReplacer(pairs...)
+		spec.Annotations = make(map[string]string, len(t.Spec.Annotations))
+		for k, v := range t.Spec.Annotations {
+			spec.Annotations[k] = replacer.Replace(v)
+		}
+	}
+	return spec, nil
+}
+
+// overlaySpec overlays the spec onto the dst, the fields it sets replace the ones of the dst
+// except the annotations that are merged and the mutations that are appended.
+func overlaySpec(dst, spec *v1alpha1.ImageSpec) {
+	if spec.BaseImage != "" {
+		dst.BaseImage = spec.BaseImage
+	}
+	if len(spec.DropLayers) != 0 {
+		dst.DropLayers = spec.DropLayers
+	}
+	if spec.Insecure {
+		dst.Insecure = true
+	}
+	if len(spec.Platforms) != 0 {
+		dst.Platforms = spec.Platforms
+	}
+	if spec.OutputMediaType != "" {
+		dst.OutputMediaType = spec.OutputMediaType
+	}
+	if spec.DigestAlgorithm != "" {
+		dst.DigestAlgorithm = spec.DigestAlgorithm
+	}
+	if spec.Encryption != nil {
+		dst.Encryption = spec.Encryption
+	}
+	if spec.CacheControl != nil {
+		dst.CacheControl = spec.CacheControl
+	}
+	if spec.Retention != nil {
+		dst.Retention = spec.Retention
+	}
+	if spec.Quota != "" {
+		dst.Quota = spec.Quota
+	}
+	if spec.Remote != nil {
+		dst.Remote = spec.Remote
+	}
+	if len(spec.Annotations) != 0 {
+		annotations := make(map[string]string, len(dst.Annotations)+len(spec.Annotations))
+		for k, v := range dst.Annotations {
+			annotations[k] = v
+		}
+		for k, v := range spec.Annotations {
+			annotations[k] = v
+		}
+		dst.Annotations = annotations
+	}
+	dst.Mutates = append(dst.Mutates[:len(dst.Mutates):len(dst.Mutates)], spec.Mutates...)
+}
@@ -6,7 +6,7 @@ import (
 )
 
 type segment struct {
-	s string // literal or parameter name
+	s string // literal or parameter name, empty for the anonymous '*'
 
 	wildcard bool
 }
@@ -28,6 +28,21 @@ func parsePattern(s string) (p *pattern, err error) {
 	return &pattern{segs}, nil
 }
 
+// String returns the pattern in the form it is parsed from.
+func (p *pattern) String() string {
+	var b strings.Builder
+	for _, seg := range p.segments {
+		if seg.wildcard && seg.s == "" {
+			b.WriteString("*")
+		} else if seg.wildcard {
+			b.WriteString("{" + seg.s + "}")
+		} else {
+			b.WriteString(seg.s)
+		}
+	}
+	return b.String()
+}
+
 func (p *pattern) Match(s string) (map[string]string, bool) {
 	return matchSegments(p.segments, s)
 }
@@ -36,9 +51,9 @@ func parseSegments(s string) ([]segment, error) {
 	var segs []segment
 	off := 0
 	for off < len(s) {
-		// Find the next '{'.
+		// Find the next '{' or '*'.
 		start := off
-		for off < len(s) && s[off] != '{' {
+		for off < len(s) && s[off] != '{' && s[off] != '*' {
 			off++
 		}
 		if off > start {
@@ -47,6 +62,12 @@ func parseSegments(s string) ([]segment, error) {
 		if off == len(s) {
 			break
 		}
+		// A '*' matches like a parameter without a name.
+		if s[off] == '*' {
+			segs = append(segs, segment{wildcard: true})
+			off++
+			continue
+		}
 		// Find the next '}'.
 		start = off
 		for off < len(s) && s[off] != '}' {
@@ -77,7 +98,9 @@ func matchSegments(segs []segment, s string) (map[string]string, bool) {
 			continue
 		}
 		if i == len(segs)-1 {
-			params[seg.s] = s[off:]
+			if seg.s != "" {
+				params[seg.s] = s[off:]
+			}
 			return params, true
 		}
 		end := off
@@ -85,7 +108,9 @@ func matchSegments(segs []segment, s string) (map[string]string, bool) {
 		for end < len(s) && !strings.HasPrefix(s[end:], nextSeg.s) {
 			end++
 		}
-		params[seg.s] = s[off:end]
+		if seg.s != "" {
+			params[seg.s] = s[off:end]
+		}
 		off = end
 	}
 	return params, off == len(s)
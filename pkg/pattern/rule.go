@@ -1,32 +1,526 @@
 package pattern
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/net/http/httpguts"
+	"k8s.io/apimachinery/pkg/api/resource"
+
 	"github.com/wzshiming/jitdi/pkg/apis/v1alpha1"
+	"github.com/wzshiming/jitdi/pkg/atomic"
 )
 
+// fileDigestRegexp matches the digests of the files replaced in the base images.
+var fileDigestRegexp = regexp.MustCompile(`^(sha256:[0-9a-f]{64}|sha512:[0-9a-f]{128})$`)
+
+// userNameRegexp matches the names of the users and the groups that useradd accepts.
+var userNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,31}$`)
+
+// TimezoneRegexp matches the IANA names of the timezones, e.g. "Asia/Shanghai" or "Etc/GMT+8".
+var TimezoneRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+-]*(/[A-Za-z0-9_+-]+)*$`)
+
+// LangRegexp matches the names of the locales, e.g. "en_US.UTF-8" or "de_DE@euro".
+var LangRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.@-]*$`)
+
+// HuggingFaceRepoRegexp matches the repositories of the hub as owner/name, e.g. "meta-llama/Llama-2-7b-hf",
+// neither part is "." or ".." as they are joined to the paths of the cache.
+var HuggingFaceRepoRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*/[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// paramRegexp matches the params of the fields of the mutates, e.g. "{model}".
+var paramRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
 type Rule struct {
+	image     *v1alpha1.Image
+	spec      *v1alpha1.ImageSpec
 	match     *pattern
+	hostMatch *pattern
+	excludes  []string
+	semver    semverRange
 	baseImage string
 	mutates   []v1alpha1.Mutate
+	insecure  bool
+
+	outputMediaType string
+	digestAlgorithm string
+	platforms       []v1alpha1.Platform
+	annotations     map[string]string
+	reproducible    bool
+	created         string
+	createdTime     time.Time
+	recipients      []string
+	cacheControl    *v1alpha1.CacheControl
+	dropLayers      []string
+	retention       *v1alpha1.Retention
+	retentionMaxAge time.Duration
+	quota           int64
+	remote          v1alpha1.Remote
+
+	allowedUsers      []string
+	allowedNetworks   []*net.IPNet
+	allowedNamespaces []string
+}
+
+// NewRule creates the rule of the image on its own, without the rules it extends.
+func NewRule(image *v1alpha1.Image) (*Rule, error) {
+	return newRule(image, &image.Spec)
 }
 
-func NewRule(conf *v1alpha1.ImageSpec) (*Rule, error) {
-	pat, err := parsePattern(conf.Match)
+func newRule(image *v1alpha1.Image, conf *v1alpha1.ImageSpec) (*Rule, error) {
+	match, baseImage := conf.Match, conf.BaseImage
+	if conf.Rewrite != nil {
+		if match != "" || baseImage != "" {
+			return nil, fmt.Errorf("rewrite can not be used with match or baseImage")
+		}
+		match, baseImage = rewriteToPattern(conf.Rewrite)
+	}
+
+	pat, err := parsePattern(match)
 	if err != nil {
 		return nil, err
 	}
+	host := strings.ToLower(conf.Host)
+	var hostPat *pattern
+	if host != "" {
+		hostPat, pat, err = withHost(pat, host)
+		if err != nil {
+			return nil, fmt.Errorf("host: %w", err)
+		}
+	}
+
+	for _, exclude := range conf.ExcludeTags {
+		_, err := path.Match(strings.TrimPrefix(exclude, "!"), "")
+		if err != nil {
+			return nil, fmt.Errorf("excludeTags %q: %w", exclude, err)
+		}
+	}
+
+	var semver semverRange
+	if conf.TagSemver != "" {
+		semver, err = parseSemverRange(conf.TagSemver)
+		if err != nil {
+			return nil, fmt.Errorf("tagSemver: %w", err)
+		}
+	}
+
+	var createdTime time.Time
+	switch conf.Created {
+	case "", v1alpha1.CreatedUpstream, v1alpha1.CreatedBuild:
+	default:
+		createdTime, err = time.Parse(time.RFC3339, conf.Created)
+		if err != nil {
+			return nil, fmt.Errorf("created must be %q, %q or a RFC 3339 time: %w", v1alpha1.CreatedUpstream, v1alpha1.CreatedBuild, err)
+		}
+	}
+
+	switch conf.DigestAlgorithm {
+	case "", "sha256", "sha512":
+	default:
+		return nil, fmt.Errorf("digestAlgorithm must be sha256 or sha512, not %q", conf.DigestAlgorithm)
+	}
+
+	for _, layer := range conf.DropLayers {
+		if i, err := strconv.Atoi(layer); err == nil && i >= 0 {
+			continue
+		}
+		if !fileDigestRegexp.MatchString(layer) {
+			return nil, fmt.Errorf("dropLayers: %q is neither an index nor a digest of a layer", layer)
+		}
+	}
+
+	var retentionMaxAge time.Duration
+	if r := conf.Retention; r != nil {
+		if r.MaxTags < 0 {
+			return nil, fmt.Errorf("retention: maxTags must not be negative")
+		}
+		if r.MaxRevisions != nil && *r.MaxRevisions < 0 {
+			return nil, fmt.Errorf("retention: maxRevisions must not be negative")
+		}
+		if r.MaxAge != "" {
+			retentionMaxAge, err = time.ParseDuration(r.MaxAge)
+			if err != nil {
+				return nil, fmt.Errorf("retention: maxAge: %w", err)
+			}
+			if retentionMaxAge <= 0 {
+				return nil, fmt.Errorf("retention: maxAge must be positive")
+			}
+		}
+	}
+
+	var quota int64
+	if conf.Quota != "" {
+		q, err := resource.ParseQuantity(conf.Quota)
+		if err != nil {
+			return nil, fmt.Errorf("quota %q: %w", conf.Quota, err)
+		}
+		quota = q.Value()
+		if quota <= 0 {
+			return nil, fmt.Errorf("quota %q must be positive", conf.Quota)
+		}
+	}
+
+	var remote v1alpha1.Remote
+	if conf.Remote != nil {
+		err = ValidateRemote(*conf.Remote)
+		if err != nil {
+			return nil, fmt.Errorf("remote: %w", err)
+		}
+		remote = *conf.Remote
+	}
+
+	var users, trustedCAs, locales int
+	for i, m := range conf.Mutates {
+		switch m.CachePriority {
+		case "", v1alpha1.CachePriorityPin, v1alpha1.CachePriorityEvictFirst:
+		default:
+			return nil, fmt.Errorf("mutates %d: cachePriority must be %q or %q", i, v1alpha1.CachePriorityPin, v1alpha1.CachePriorityEvictFirst)
+		}
+		if m.Render != nil {
+			if (m.Render.Template == "") == (m.Render.Source == "") {
+				return nil, fmt.Errorf("mutates %d: render needs either a template or a source", i)
+			}
+			if strings.HasSuffix(m.Render.Destination, "/") {
+				return nil, fmt.Errorf("mutates %d: the destination of a render must be a file", i)
+			}
+		}
+		if m.Patch != nil {
+			if m.Patch.Path == "" || strings.HasSuffix(m.Patch.Path, "/") {
+				return nil, fmt.Errorf("mutates %d: the path of a patch must be a file", i)
+			}
+			if m.Patch.MergePatch == "" && len(m.Patch.Set) == 0 {
+				return nil, fmt.Errorf("mutates %d: patch needs a mergePatch or a set", i)
+			}
+			switch m.Patch.Format {
+			case v1alpha1.PatchFormatJSON, v1alpha1.PatchFormatYAML:
+			case "":
+				switch path.Ext(m.Patch.Path) {
+				case ".json", ".yaml", ".yml":
+				default:
+					return nil, fmt.Errorf("mutates %d: the format of the patch of %q is unknown", i, m.Patch.Path)
+				}
+			default:
+				return nil, fmt.Errorf("mutates %d: format must be %q or %q", i, v1alpha1.PatchFormatJSON, v1alpha1.PatchFormatYAML)
+			}
+		}
+		if m.Config != nil {
+			err = validateConfig(m.Config)
+			if err != nil {
+				return nil, fmt.Errorf("mutates %d: %w", i, err)
+			}
+		}
+		if m.User != nil {
+			// The mutations read the files of the base image, not the ones of each other.
+			users++
+			if users > 1 {
+				return nil, fmt.Errorf("mutates %d: only one user mutate is allowed", i)
+			}
+			err = validateUser(m.User)
+			if err != nil {
+				return nil, fmt.Errorf("mutates %d: %w", i, err)
+			}
+		}
+		if m.TrustedCA != nil {
+			// Like the users, the bundles of the base image are appended once.
+			trustedCAs++
+			if trustedCAs > 1 {
+				return nil, fmt.Errorf("mutates %d: only one trustedCA mutate is allowed", i)
+			}
+			if len(m.TrustedCA.Sources) == 0 && m.TrustedCA.Certificates == "" {
+				return nil, fmt.Errorf("mutates %d: trustedCA needs sources or certificates", i)
+			}
+		}
+		if m.Locale != nil {
+			// Like the users, the files of the base image are written once.
+			locales++
+			if locales > 1 {
+				return nil, fmt.Errorf("mutates %d: only one locale mutate is allowed", i)
+			}
+			err = validateLocale(m.Locale)
+			if err != nil {
+				return nil, fmt.Errorf("mutates %d: %w", i, err)
+			}
+		}
+		if m.HuggingFace != nil {
+			// The params are checked again once replaced by the builds, a single one may stand for the whole repo.
+			repo := paramRegexp.ReplaceAllString(m.HuggingFace.Repo, "x")
+			if repo != "x" && !HuggingFaceRepoRegexp.MatchString(repo) {
+				return nil, fmt.Errorf("mutates %d: invalid huggingFace repo %q, must be owner/name", i, m.HuggingFace.Repo)
+			}
+		}
+		if m.Binary != nil {
+			err = validateBinary(m.Binary)
+			if err != nil {
+				return nil, fmt.Errorf("mutates %d: %w", i, err)
+			}
+		}
+		if m.File != nil && m.File.Replaces != "" {
+			if !fileDigestRegexp.MatchString(m.File.Replaces) {
+				return nil, fmt.Errorf("mutates %d: replaces must be a sha256 or sha512 digest", i)
+			}
+			if m.File.Extract != nil || strings.HasSuffix(m.File.Destination, "/") {
+				return nil, fmt.Errorf("mutates %d: the destination of replaces must be a file", i)
+			}
+		}
+		if m.File != nil && m.File.Extract != nil {
+			if m.File.Source == "" {
+				return nil, fmt.Errorf("mutates %d: extract needs a source", i)
+			}
+			if m.File.Extract.StripComponents < 0 {
+				return nil, fmt.Errorf("mutates %d: stripComponents must not be negative", i)
+			}
+		}
+	}
+
+	var recipients []string
+	if conf.Encryption != nil {
+		if len(conf.Encryption.Recipients) == 0 {
+			return nil, fmt.Errorf("encryption without recipients")
+		}
+		recipients = conf.Encryption.Recipients
+	}
+
+	var allowedUsers []string
+	var allowedNetworks []*net.IPNet
+	for _, client := range conf.AllowedClients {
+		if _, network, err := net.ParseCIDR(client); err == nil {
+			allowedNetworks = append(allowedNetworks, network)
+		} else if ip := net.ParseIP(client); ip != nil {
+			allowedNetworks = append(allowedNetworks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			allowedUsers = append(allowedUsers, client)
+		}
+	}
 	return &Rule{
+		image:     image,
+		spec:      conf,
 		match:     pat,
-		baseImage: conf.BaseImage,
+		hostMatch: hostPat,
+		excludes:  conf.ExcludeTags,
+		semver:    semver,
+		baseImage: baseImage,
 		mutates:   conf.Mutates,
+		insecure:  conf.Insecure,
+
+		outputMediaType: conf.OutputMediaType,
+		digestAlgorithm: conf.DigestAlgorithm,
+		platforms:       conf.Platforms,
+		annotations:     conf.Annotations,
+		reproducible:    conf.Reproducible,
+		created:         conf.Created,
+		createdTime:     createdTime,
+		recipients:      recipients,
+		cacheControl:    conf.CacheControl,
+		dropLayers:      conf.DropLayers,
+		retention:       conf.Retention,
+		retentionMaxAge: retentionMaxAge,
+		quota:           quota,
+		remote:          remote,
+
+		allowedUsers:      allowedUsers,
+		allowedNetworks:   allowedNetworks,
+		allowedNamespaces: conf.AllowedNamespaces,
 	}, nil
 }
 
+// validateConfig checks the config mutate, the ports using the parameters of match are checked once they are replaced.
+func validateConfig(c *v1alpha1.Config) error {
+	if hc := c.Healthcheck; hc != nil {
+		if len(hc.Test) == 0 {
+			return fmt.Errorf("healthcheck needs a test")
+		}
+		switch hc.Test[0] {
+		case "NONE", "CMD", "CMD-SHELL":
+		default:
+			return fmt.Errorf("the test of the healthcheck must start with %q, %q or %q", "NONE", "CMD", "CMD-SHELL")
+		}
+		for _, d := range []string{hc.Interval, hc.Timeout, hc.StartPeriod} {
+			if d == "" {
+				continue
+			}
+			if _, err := time.ParseDuration(d); err != nil {
+				return fmt.Errorf("healthcheck: %w", err)
+			}
+		}
+		if hc.Retries < 0 {
+			return fmt.Errorf("the retries of the healthcheck must not be negative")
+		}
+	}
+	for _, port := range c.ExposedPorts {
+		if strings.Contains(port, "{") {
+			continue
+		}
+		if _, _, err := ParsePort(port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateUser checks the user mutate, the names using the parameters of match are checked once they are replaced.
+func validateUser(u *v1alpha1.User) error {
+	for _, name := range []string{u.Name, u.Group} {
+		if name == "" || strings.Contains(name, "{") {
+			continue
+		}
+		if !userNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid user or group name %q", name)
+		}
+	}
+	if u.Name == "" {
+		return fmt.Errorf("user needs a name")
+	}
+	if u.UID < 0 || u.GID != nil && *u.GID < 0 {
+		return fmt.Errorf("the uid and the gid of the user must not be negative")
+	}
+	for _, field := range []string{u.Home, u.Shell} {
+		if strings.ContainsAny(field, ":\n") {
+			return fmt.Errorf("the home and the shell of the user must not contain \":\" or a newline")
+		}
+	}
+	return nil
+}
+
+// validateLocale checks the locale mutate, the names using the parameters of match are checked once they are replaced.
+func validateLocale(l *v1alpha1.Locale) error {
+	if l.Timezone == "" && l.Lang == "" {
+		return fmt.Errorf("locale needs a timezone or a lang")
+	}
+	if l.Timezone != "" && !strings.Contains(l.Timezone, "{") && !TimezoneRegexp.MatchString(l.Timezone) {
+		return fmt.Errorf("invalid timezone %q", l.Timezone)
+	}
+	if l.Lang != "" && !strings.Contains(l.Lang, "{") && !LangRegexp.MatchString(l.Lang) {
+		return fmt.Errorf("invalid lang %q", l.Lang)
+	}
+	return nil
+}
+
+// validateBinary checks the binary mutate and the platforms of its sources.
+func validateBinary(b *v1alpha1.Binary) error {
+	if (len(b.Sources) == 0) == (b.Index == "") {
+		return fmt.Errorf("binary needs either sources or an index")
+	}
+	if b.Destination == "" || strings.HasSuffix(b.Destination, "/") {
+		return fmt.Errorf("the destination of a binary must be a file")
+	}
+	for platform := range b.Sources {
+		parts := strings.Split(platform, "/")
+		if len(parts) > 3 || slices.Contains(parts, "") {
+			return fmt.Errorf("invalid platform %q of the binary, must be \"<arch>\", \"<os>/<arch>\" or \"<os>/<arch>/<variant>\"", platform)
+		}
+	}
+	return nil
+}
+
+// ParsePort parses the exposed port, e.g. "8080" or "53/udp", the protocol defaults to tcp.
+func ParsePort(port string) (int, string, error) {
+	number, protocol, _ := strings.Cut(port, "/")
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	switch protocol {
+	case "tcp", "udp", "sctp":
+	default:
+		return 0, "", fmt.Errorf("port %q: the protocol must be tcp, udp or sctp", port)
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > 65535 {
+		return 0, "", fmt.Errorf("port %q: invalid number", port)
+	}
+	return n, protocol, nil
+}
+
+// rewriteToPattern converts the prefix rewriting to the match and the base image patterns.
+func rewriteToPattern(r *v1alpha1.Rewrite) (match, baseImage string) {
+	from := strings.TrimSuffix(r.From, "*")
+	to := strings.TrimSuffix(r.To, "*")
+	return from + "{path}:{tag}", to + "{path}:{tag}"
+}
+
+// withHost returns the pattern of the host, and the pattern prefixed by it to match the full references.
+func withHost(p *pattern, host string) (*pattern, *pattern, error) {
+	if strings.Contains(host, "/") {
+		return nil, nil, fmt.Errorf("%q must not contain '/'", host)
+	}
+	hostSegs, err := parseSegments(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	segs, _ := parseSegments(host + "/")
+	for _, seg := range p.segments {
+		last := &segs[len(segs)-1]
+		if !seg.wildcard && !last.wildcard {
+			last.s += seg.s
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	return &pattern{hostSegs}, &pattern{segs}, nil
+}
+
+// Name returns the name of the image that the rule is created from.
+func (r *Rule) Name() string {
+	return r.image.Name
+}
+
+// Hash returns the hash of the spec of the rule, which changes when the rule or the rules it extends are updated.
+func (r *Rule) Hash() string {
+	raw, _ := json.Marshal(r.spec)
+	return "sha256:" + atomic.SumSha256(raw)
+}
+
+// Spec returns the spec of the rule, composed onto the ones of the rules it extends.
+func (r *Rule) Spec() *v1alpha1.ImageSpec {
+	return r.spec
+}
+
+// Image returns the image that the rule is created from.
+func (r *Rule) Image() *v1alpha1.Image {
+	return r.image
+}
+
+// HasHost reports whether the rule only matches the full references of the clients of some hosts.
+func (r *Rule) HasHost() bool {
+	return r.hostMatch != nil
+}
+
+// Pattern returns the pattern that the rule matches the images with, prefixed by the host if any.
+func (r *Rule) Pattern() string {
+	return r.match.String()
+}
+
 func (r *Rule) Match(image string) (*Action, bool) {
+	if r.hostMatch != nil {
+		// The parameters of the host can not span the path.
+		host, _, ok := strings.Cut(image, "/")
+		if !ok {
+			return nil, false
+		}
+		if _, ok := r.hostMatch.Match(host); !ok {
+			return nil, false
+		}
+	}
 	params, ok := r.match.Match(image)
 	if !ok {
 		return nil, false
 	}
+	tag := tagOf(image)
+	if r.excluded(tag) {
+		return nil, false
+	}
+	if r.semver != nil && !r.semver.containsTag(tag) {
+		return nil, false
+	}
 
 	return &Action{
 		params: params,
@@ -34,6 +528,168 @@ func (r *Rule) Match(image string) (*Action, bool) {
 	}, true
 }
 
+// tagOf returns the tag of the reference.
+func tagOf(ref string) string {
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[i+1:]
+	}
+	return ref
+}
+
+// excluded reports whether the tag is excluded by the globs of excludeTags,
+// the last glob matching the tag wins and the ones prefixed with "!" include it again.
+func (r *Rule) excluded(tag string) bool {
+	if len(r.excludes) == 0 {
+		return false
+	}
+	excluded := false
+	for _, exclude := range r.excludes {
+		glob, include := strings.CutPrefix(exclude, "!")
+		if ok, _ := path.Match(glob, tag); ok {
+			excluded = !include
+		}
+	}
+	return excluded
+}
+
+// CacheControl returns the Cache-Control of the manifests of the rule pulled by tag or by digest,
+// empty if the rule does not set it.
+func (r *Rule) CacheControl(byDigest bool) string {
+	if r.cacheControl == nil {
+		return ""
+	}
+	if byDigest {
+		return r.cacheControl.Digest
+	}
+	return r.cacheControl.Tag
+}
+
+// Retention returns how many tags of the rule are kept and how many previous builds of each, and how long a tag is kept
+// after it is last used, zero for the unlimited ones. The revisions are negative if the rule does not set them.
+func (r *Rule) Retention() (maxTags int, maxAge time.Duration, maxRevisions int) {
+	if r.retention == nil {
+		return 0, 0, -1
+	}
+	maxRevisions = -1
+	if r.retention.MaxRevisions != nil {
+		maxRevisions = *r.retention.MaxRevisions
+	}
+	return r.retention.MaxTags, r.retentionMaxAge, maxRevisions
+}
+
+// DigestAlgorithm returns the algorithm of the digests of the manifests of the tags served by tag, sha256 or sha512.
+func (r *Rule) DigestAlgorithm() string {
+	if r.digestAlgorithm == "" {
+		return "sha256"
+	}
+	return r.digestAlgorithm
+}
+
+// Quota returns the size in bytes of the blobs of the tags that the rule builds at most, zero if unlimited.
+func (r *Rule) Quota() int64 {
+	return r.quota
+}
+
+// Remote returns the options of go-containerregistry of the rule, the zero ones are the defaults.
+func (r *Rule) Remote() v1alpha1.Remote {
+	return r.remote
+}
+
+// ValidateRemote checks the options of go-containerregistry and the headers of the requests to the upstreams.
+func ValidateRemote(r v1alpha1.Remote) error {
+	if r.Jobs < 0 {
+		return fmt.Errorf("jobs must not be negative")
+	}
+	if r.RetryAttempts < 0 {
+		return fmt.Errorf("retryAttempts must not be negative")
+	}
+	if r.Platform != "" {
+		p, err := v1.ParsePlatform(r.Platform)
+		if err != nil {
+			return fmt.Errorf("platform %q: %w", r.Platform, err)
+		}
+		if p.OS == "" || p.Architecture == "" {
+			return fmt.Errorf("platform %q must be os/arch[/variant]", r.Platform)
+		}
+	}
+	if !httpguts.ValidHeaderFieldValue(r.UserAgent) {
+		return fmt.Errorf("userAgent %q is not a valid header value", r.UserAgent)
+	}
+	for name, value := range r.Headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("headers: %q is not a valid header name", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("headers: the value of %q is not a valid header value", name)
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Host":
+			return fmt.Errorf("headers: %q cannot be set, the credentials of the upstreams are read from --docker-config", name)
+		}
+	}
+	for _, p := range []struct{ field, proxy string }{{"httpProxy", r.HTTPProxy}, {"httpsProxy", r.HTTPSProxy}} {
+		field, proxy := p.field, p.proxy
+		if proxy == "" {
+			continue
+		}
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("%s %q: the scheme must be http, https or socks5", field, u.Redacted())
+		}
+		if u.Host == "" {
+			return fmt.Errorf("%s %q: the host is missing", field, u.Redacted())
+		}
+	}
+	if r.CAData != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(r.CAData)) {
+		return fmt.Errorf("caData: no certificates found")
+	}
+	return nil
+}
+
+// IsRestricted reports whether the image is only served to some clients.
+func (r *Rule) IsRestricted() bool {
+	return len(r.allowedUsers) != 0 || len(r.allowedNetworks) != 0 || len(r.allowedNamespaces) != 0
+}
+
+// Allow reports whether the image is served to the client of the user name and the source address,
+// the user name is empty for the anonymous clients.
+func (r *Rule) Allow(user string, ip net.IP) bool {
+	if !r.IsRestricted() {
+		return true
+	}
+	if ip != nil {
+		for _, network := range r.allowedNetworks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	if user == "" {
+		return false
+	}
+	for _, u := range r.allowedUsers {
+		if u == user {
+			return true
+		}
+	}
+	if namespace, _, ok := strings.Cut(user, "/"); ok {
+		for _, ns := range r.allowedNamespaces {
+			if ns == namespace {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (r *Rule) LessThan(o *Rule) bool {
+	if r.HasHost() != o.HasHost() {
+		return r.HasHost()
+	}
 	return patternLess(r.match, o.match)
 }
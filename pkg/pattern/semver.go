@@ -0,0 +1,291 @@
+package pattern
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semverVersion is a semantic version.
+type semverVersion struct {
+	major, minor, patch int
+	pre                 []string
+}
+
+// parseSemverTag parses the tag as a version, e.g. "1.2.3", "v1.2" or "1.2.3-rc.1", the missing patch of "1.2" is 0,
+// it reports false for the tags that are not versions, e.g. "latest".
+func parseSemverTag(tag string) (semverVersion, bool) {
+	v, n, ok := parseSemver(tag)
+	if !ok {
+		return semverVersion{}, false
+	}
+	// The tags have no wildcards.
+	release, _, _ := strings.Cut(strings.TrimPrefix(tag, "v"), "-")
+	if n == 0 || n != strings.Count(release, ".")+1 {
+		return semverVersion{}, false
+	}
+	return v, true
+}
+
+// parseSemver parses the version and returns the number of its numeric parts,
+// which is 0 to 3 since the missing or "x" and "*" parts of a range are wildcards.
+func parseSemver(s string) (semverVersion, int, bool) {
+	s = strings.TrimPrefix(s, "v")
+	s, pre, hasPre := strings.Cut(s, "-")
+	var v semverVersion
+	if hasPre {
+		if pre == "" {
+			return v, 0, false
+		}
+		v.pre = strings.Split(pre, ".")
+		for _, id := range v.pre {
+			if id == "" {
+				return v, 0, false
+			}
+		}
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, false
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	n := 0
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			// A wildcard can only be followed by wildcards.
+			for _, rest := range parts[i+1:] {
+				if rest != "x" && rest != "X" && rest != "*" {
+					return v, 0, false
+				}
+			}
+			break
+		}
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 || part[0] == '+' || (len(part) > 1 && part[0] == '0') {
+			return v, 0, false
+		}
+		*nums[i] = num
+		n++
+	}
+	if hasPre && n != 3 {
+		return v, 0, false
+	}
+	return v, n, true
+}
+
+func (v semverVersion) compare(o semverVersion) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d != 0 {
+			if d < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+	// A pre-release is lower than its release.
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := comparePreID(v.pre[i], o.pre[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.pre) < len(o.pre):
+		return -1
+	case len(v.pre) > len(o.pre):
+		return 1
+	}
+	return 0
+}
+
+// comparePreID compares the identifiers of the pre-releases, the numeric ones numerically and lower than the others.
+func comparePreID(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// sameRelease reports whether the versions are of the same major, minor and patch.
+func (v semverVersion) sameRelease(o semverVersion) bool {
+	return v.major == o.major && v.minor == o.minor && v.patch == o.patch
+}
+
+type semverComparator struct {
+	op      string
+	version semverVersion
+}
+
+func (c semverComparator) contains(v semverVersion) bool {
+	cmp := v.compare(c.version)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "!=":
+		return cmp != 0
+	}
+	return cmp == 0
+}
+
+// semverRange is the alternatives separated by "||" of the comparators separated by spaces that a version must all satisfy.
+type semverRange [][]semverComparator
+
+// parseSemverRange parses the range, e.g. ">=1.2.0 <2.0.0", "^1.2", "~1.2.3 || 2.x" or "!=1.4.0".
+func parseSemverRange(s string) (semverRange, error) {
+	var r semverRange
+	for _, alt := range strings.Split(s, "||") {
+		fields := strings.Fields(alt)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%q has an empty alternative", s)
+		}
+		var set []semverComparator
+		for _, field := range fields {
+			cs, err := parseSemverComparator(field)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, cs...)
+		}
+		r = append(r, set)
+	}
+	return r, nil
+}
+
+// parseSemverComparator parses the comparator into the ones of its bounds, the missing parts of its version widen it,
+// e.g. "1.2" is ">=1.2.0 <1.3.0-0", "^1.2.3" is ">=1.2.3 <2.0.0-0" and "~1.2.3" is ">=1.2.3 <1.3.0-0".
+func parseSemverComparator(s string) ([]semverComparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", "!=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			break
+		}
+	}
+	v, n, ok := parseSemver(s[len(op):])
+	if !ok {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+
+	// next returns the lowest version above the ones of the first parts of v,
+	// the "-0" pre-release keeps the pre-releases of that version out.
+	next := func(parts int) semverVersion {
+		u := semverVersion{major: v.major, minor: v.minor, patch: v.patch, pre: []string{"0"}}
+		switch parts {
+		case 1:
+			u.major, u.minor, u.patch = v.major+1, 0, 0
+		case 2:
+			u.minor, u.patch = v.minor+1, 0
+		default:
+			u.patch = v.patch + 1
+		}
+		return u
+	}
+	lower := semverComparator{">=", v}
+	if n == 0 {
+		if op == "" || op == "=" || op == ">=" || op == "<=" || op == "^" || op == "~" {
+			return []semverComparator{{">=", semverVersion{}}}, nil
+		}
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return []semverComparator{{"=", v}}, nil
+		}
+		return []semverComparator{lower, {"<", next(n)}}, nil
+	case "!=":
+		if n != 3 {
+			return nil, fmt.Errorf("%q needs a full version", s)
+		}
+		return []semverComparator{{"!=", v}}, nil
+	case ">", "<=":
+		if n == 3 {
+			return []semverComparator{{op, v}}, nil
+		}
+		if op == ">" {
+			u := next(n)
+			u.pre = nil
+			return []semverComparator{{">=", u}}, nil
+		}
+		return []semverComparator{{"<", next(n)}}, nil
+	case ">=", "<":
+		return []semverComparator{{op, v}}, nil
+	case "~":
+		if n == 1 {
+			return []semverComparator{lower, {"<", next(1)}}, nil
+		}
+		return []semverComparator{lower, {"<", next(2)}}, nil
+	}
+
+	// "^" allows the changes that do not modify the first non-zero part.
+	parts := 1
+	switch {
+	case v.major != 0 || n == 1:
+	case v.minor != 0 || n == 2:
+		parts = 2
+	default:
+		parts = 3
+	}
+	return []semverComparator{lower, {"<", next(parts)}}, nil
+}
+
+// containsTag reports whether the tag is a version within the range. Like npm, a pre-release is only within it
+// when one of the comparators of the same alternative has a pre-release of the same release.
+func (r semverRange) containsTag(tag string) bool {
+	v, ok := parseSemverTag(tag)
+	if !ok {
+		return false
+	}
+	for _, set := range r {
+		if v.within(set) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v semverVersion) within(set []semverComparator) bool {
+	for _, c := range set {
+		if !c.contains(v) {
+			return false
+		}
+	}
+	if len(v.pre) == 0 {
+		return true
+	}
+	for _, c := range set {
+		// The "-0" upper bounds of the partial versions are not pre-releases that the users wrote.
+		if len(c.version.pre) != 0 && c.version.sameRelease(v) && !(c.op == "<" && len(c.version.pre) == 1 && c.version.pre[0] == "0") {
+			return true
+		}
+	}
+	return false
+}
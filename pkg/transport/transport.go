@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Options holds the options for the transport used to reach upstreams.
+type Options struct {
+	// HTTPProxy is the proxy for http requests, defaults to the HTTP_PROXY environment variable.
+	HTTPProxy string
+	// HTTPSProxy is the proxy for https requests, defaults to the HTTPS_PROXY environment variable.
+	HTTPSProxy string
+	// NoProxy is the comma-separated list of hosts that bypass the proxy, defaults to the NO_PROXY environment variable.
+	NoProxy string
+	// CAFiles are PEM bundles trusted in addition to the system pool.
+	CAFiles []string
+	// Insecure skips the TLS verification.
+	Insecure bool
+}
+
+// New returns a transport configured with the options.
+func New(opts Options) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	proxy := httpproxy.FromEnvironment()
+	if opts.HTTPProxy != "" {
+		proxy.HTTPProxy = opts.HTTPProxy
+	}
+	if opts.HTTPSProxy != "" {
+		proxy.HTTPSProxy = opts.HTTPSProxy
+	}
+	if opts.NoProxy != "" {
+		proxy.NoProxy = opts.NoProxy
+	}
+	proxyFunc := proxy.ProxyFunc()
+	t.Proxy = func(r *http.Request) (*url.URL, error) {
+		return proxyFunc(r.URL)
+	}
+
+	if len(opts.CAFiles) != 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range opts.CAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("read ca file %q: %w", file, err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in ca file %q", file)
+			}
+		}
+		t.TLSClientConfig = &tls.Config{
+			RootCAs: pool,
+		}
+	}
+
+	if opts.Insecure {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return t, nil
+}
@@ -0,0 +1,21 @@
+package version
+
+import (
+	"runtime/debug"
+)
+
+// Version is the version of jitdi, it can be set at build time with
+// -ldflags "-X github.com/wzshiming/jitdi/pkg/version.Version=v0.0.1"
+var Version = ""
+
+// Get returns the version of jitdi, which is read from the build info if it is not set at build time.
+func Get() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}